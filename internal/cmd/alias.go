@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/spf13/cobra"
+)
+
+var aliasCmd = &cobra.Command{
+	Use:   "alias <alias> <environment>",
+	Short: "Add an alternate name for an environment",
+	Long: `Add an alternate name for an environment.
+
+After renaming an environment, an alias keeps old invocations working.
+Aliases are accepted anywhere an environment name is expected
+(promote, demote, lock, unlock, rebuild, status --env).
+
+Example:
+  hitch alias qa test    # 'hitch promote feature/x to qa' now targets test`,
+	Args: cobra.ExactArgs(2),
+	RunE: runAlias,
+}
+
+func init() {
+	rootCmd.AddCommand(aliasCmd)
+}
+
+func runAlias(cmd *cobra.Command, args []string) error {
+	alias := args[0]
+	envName := args[1]
+
+	// 1. Open Git repository
+	repo, err := openRepo()
+	if err != nil {
+		errorMsg("Not a Git repository")
+		return err
+	}
+
+	// 2. Get current branch to return to
+	currentBranch, err := repo.CurrentBranch()
+	if err != nil {
+		errorMsg("Failed to get current branch")
+		return err
+	}
+	defer restoreBranch(repo, currentBranch)
+
+	// 3. Read metadata
+	reader := metadata.NewReader(repo.Repository)
+	if !reader.Exists() {
+		errorMsg("Hitch is not initialized in this repository")
+		fmt.Println("\nRun 'hitch init' to initialize Hitch.")
+		return fmt.Errorf("hitch not initialized")
+	}
+
+	meta, err := reader.Read()
+	if err != nil {
+		errorMsg("Failed to read metadata")
+		return err
+	}
+
+	if err := checkMetadataNotBehind(repo); err != nil {
+		return err
+	}
+
+	if err := checkNotFrozen(meta); err != nil {
+		return err
+	}
+
+	// 4. Get user info
+	userEmail, err := repo.UserEmail()
+	if err != nil {
+		userEmailMissing()
+		return err
+	}
+	userName, _ := repo.UserName()
+
+	// 5. Add alias
+	if err := meta.SetAlias(alias, envName); err != nil {
+		errorMsg(fmt.Sprintf("Failed to add alias: %v", err))
+		return err
+	}
+
+	// 6. Write metadata
+	meta.UpdateMeta(userEmail, fmt.Sprintf("hitch alias %s %s", alias, envName))
+
+	writer := metadata.NewWriter(repo.Repository)
+	if err := writer.Write(meta, fmt.Sprintf("Alias %s to %s", alias, envName), userName, userEmail); err != nil {
+		errorMsg("Failed to write metadata")
+		return err
+	}
+
+	success(fmt.Sprintf("%s is now an alias for %s", alias, envName))
+	return nil
+}
@@ -1,21 +1,22 @@
 package cmd
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
 	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/logging"
 	"github.com/DoomedRamen/hitch/internal/metadata"
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
 )
 
 var (
-	cleanupDryRun bool
-	cleanupForce  bool
+	cleanupDryRun  bool
+	cleanupForce   bool
+	cleanupExplain string
 )
 
 var cleanupCmd = &cobra.Command{
@@ -28,22 +29,32 @@ A branch is safe to delete if:
 - It has passed the retention period (configured days after merge)
 - It is not currently in any environment
 
+Branches released with --no-delete are never cleaned up.
+
+Inactive branches (unmerged, no recent commits) are only listed, unless
+config.inactive_branch_action is "archive" (tag archive/<branch>-<date>,
+then delete) or "delete". Branches in an environment are always kept.
+
+Use --explain <branch> to see why a branch is or isn't eligible.
+
 Example:
   hitch cleanup           # Interactive cleanup
   hitch cleanup --dry-run # Show what would be deleted
-  hitch cleanup --force   # Delete without confirmation`,
+  hitch cleanup --force   # Delete without confirmation
+  hitch cleanup --explain feature/old`,
 	RunE: runCleanup,
 }
 
 func init() {
 	cleanupCmd.Flags().BoolVar(&cleanupDryRun, "dry-run", false, "Show what would be deleted without actually deleting")
 	cleanupCmd.Flags().BoolVarP(&cleanupForce, "force", "f", false, "Delete without confirmation")
+	cleanupCmd.Flags().StringVar(&cleanupExplain, "explain", "", "Explain why a branch is or isn't eligible for cleanup, without deleting anything")
 	rootCmd.AddCommand(cleanupCmd)
 }
 
 func runCleanup(cmd *cobra.Command, args []string) error {
 	// 1. Open Git repository
-	repo, err := hitchgit.OpenRepo(".")
+	repo, err := openRepo()
 	if err != nil {
 		errorMsg("Not a Git repository")
 		return err
@@ -55,9 +66,7 @@ func runCleanup(cmd *cobra.Command, args []string) error {
 		errorMsg("Failed to get current branch")
 		return err
 	}
-	defer func() {
-		_ = repo.Checkout(currentBranch)
-	}()
+	defer restoreBranch(repo, currentBranch)
 
 	// 3. Read metadata
 	reader := metadata.NewReader(repo.Repository)
@@ -73,43 +82,27 @@ func runCleanup(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	// 4. Find stale branches
-	safeToDelete := []string{}
-	inactive := []string{}
-
-	for branchName, info := range meta.Branches {
-		// Safe to delete if merged + past retention period + not in any env
-		if info.MergedToMainAt != nil {
-			daysSinceMerge := int(time.Since(*info.MergedToMainAt).Hours() / 24)
-			if daysSinceMerge > meta.Config.RetentionDaysAfterMerge {
-				// Check not in any environment
-				inEnv := false
-				for _, env := range meta.Environments {
-					for _, f := range env.Features {
-						if f == branchName {
-							inEnv = true
-							break
-						}
-					}
-					if inEnv {
-						break
-					}
-				}
-				if !inEnv {
-					safeToDelete = append(safeToDelete, branchName)
-				}
-			}
+	if cleanupExplain != "" {
+		explainCleanup(meta.ExplainCleanup(cleanupExplain))
+		return nil
+	}
+
+	if !cleanupDryRun {
+		if err := checkMetadataNotBehind(repo); err != nil {
+			return err
 		}
 
-		// Warn about inactive branches (but don't delete)
-		if info.MergedToMainAt == nil && !info.LastCommitAt.IsZero() {
-			daysSinceCommit := int(time.Since(info.LastCommitAt).Hours() / 24)
-			if daysSinceCommit > meta.Config.StaleDaysNoActivity {
-				inactive = append(inactive, branchName)
-			}
+		if err := checkNotFrozen(meta); err != nil {
+			return err
 		}
 	}
 
+	// 4. Find stale branches
+	safeToDelete, inactive := splitStaleBranches(meta)
+	inactive = stillInactive(repo, meta, inactive)
+	action := meta.Config.InactiveBranchAction
+	abandoned := abandonedBranches(inactive, action)
+
 	// 5. Display results
 	if len(safeToDelete) == 0 && len(inactive) == 0 {
 		success("No stale branches found")
@@ -118,46 +111,50 @@ func runCleanup(cmd *cobra.Command, args []string) error {
 
 	if len(safeToDelete) > 0 {
 		color.New(color.Bold).Println("Branches safe to delete (merged to main):")
-		for _, branch := range safeToDelete {
-			info := meta.Branches[branch]
-			daysSinceMerge := int(time.Since(*info.MergedToMainAt).Hours() / 24)
-			fmt.Printf("  ✓ %s (merged %d days ago)\n", branch, daysSinceMerge)
+		for _, stale := range safeToDelete {
+			fmt.Printf("  ✓ %s (merged %d days ago)\n", stale.Branch, stale.DaysSinceMerge)
 		}
 		fmt.Println()
 	}
 
 	if len(inactive) > 0 {
 		color.New(color.Bold).Println("Inactive branches (no recent commits):")
-		for _, branch := range inactive {
-			info := meta.Branches[branch]
-			daysSinceCommit := int(time.Since(info.LastCommitAt).Hours() / 24)
-			fmt.Printf("  ? %s (last commit %d days ago)\n", branch, daysSinceCommit)
+		for _, stale := range inactive {
+			kept := ""
+			if stale.InEnvironment && len(abandoned) > 0 {
+				kept = ", kept while in an environment"
+			}
+			fmt.Printf("  ? %s (last commit %d days ago%s)\n", stale.Branch, stale.DaysSinceCommit, kept)
 		}
 		fmt.Println()
-		warning("Inactive branches are NOT automatically deleted. Review and delete manually if needed.")
+		switch {
+		case len(abandoned) > 0 && action == "archive":
+			info("Inactive branches will be tagged archive/<branch>-<date>, then deleted (config.inactive_branch_action)")
+		case len(abandoned) > 0:
+			warning("Inactive branches will be deleted without an archive tag (config.inactive_branch_action)")
+		default:
+			warning("Inactive branches are NOT automatically deleted. Review and delete manually if needed.")
+		}
 		fmt.Println()
 	}
 
-	if len(safeToDelete) == 0 {
+	if len(safeToDelete) == 0 && len(abandoned) == 0 {
 		return nil
 	}
 
 	// 6. Dry run mode
 	if cleanupDryRun {
-		info(fmt.Sprintf("Dry run: would delete %d branches", len(safeToDelete)))
+		info(fmt.Sprintf("Dry run: would delete %d branches", len(safeToDelete)+len(abandoned)))
 		return nil
 	}
 
 	// 7. Confirm deletion
 	if !cleanupForce {
-		fmt.Printf("Delete %d branches? [y/N]: ", len(safeToDelete))
-		reader := bufio.NewReader(os.Stdin)
-		response, err := reader.ReadString('\n')
+		ok, err := confirm(fmt.Sprintf("Delete %d branches?", len(safeToDelete)+len(abandoned)))
 		if err != nil {
 			return err
 		}
-		response = strings.TrimSpace(strings.ToLower(response))
-		if response != "y" && response != "yes" {
+		if !ok {
 			info("Cleanup cancelled")
 			return nil
 		}
@@ -177,18 +174,40 @@ func runCleanup(cmd *cobra.Command, args []string) error {
 
 	// 9. Delete branches
 	deletedCount := 0
-	for _, branch := range safeToDelete {
-		// Delete local branch
-		if err := repo.DeleteBranch(branch, true); err != nil {
-			warning(fmt.Sprintf("Failed to delete local branch %s: %v", branch, err))
-			continue
+	failedCount := 0
+	archive := action == "archive"
+	for _, stale := range append(safeToDelete, abandoned...) {
+		branch := stale.Branch
+
+		// Tag an inactive branch first, so deleting it loses nothing
+		if archive && stale.Reason == metadata.StaleInactive {
+			tag, err := archiveBranch(repo, branch)
+			if err != nil {
+				warning(fmt.Sprintf("Failed to archive %s, keeping it: %v", branch, err))
+				failedCount++
+				continue
+			}
+			success(fmt.Sprintf("Archived %s as %s", branch, tag))
+		}
+
+		// Delete remote branch first: if that fails, the local branch and
+		// metadata entry stay so the next cleanup tries again
+		if !skipRemote(repo, "remote delete of "+branch, fmt.Sprintf("git push origin --delete %s", branch)) {
+			if err := repo.DeleteRemoteBranch("origin", branch); errors.Is(err, hitchgit.ErrRemoteBranchNotFound) {
+				// This is OK if the branch was never pushed
+				logging.Debugf("%s is not on origin", branch)
+			} else if err != nil {
+				warning(fmt.Sprintf("Failed to delete %s on origin, keeping it: %v", branch, err))
+				failedCount++
+				continue
+			}
 		}
 
-		// Delete remote branch (if exists)
-		if err := repo.DeleteRemoteBranch("origin", branch); err != nil {
-			// This is OK if remote doesn't exist or branch wasn't pushed
-			if verbose {
-				warning(fmt.Sprintf("Could not delete remote branch %s (may not exist): %v", branch, err))
+		// Delete local branch
+		if repo.BranchExists(branch) {
+			if err := repo.DeleteBranch(branch, true); err != nil {
+				warning(fmt.Sprintf("Failed to delete local branch %s: %v", branch, err))
+				continue
 			}
 		}
 
@@ -202,7 +221,7 @@ func runCleanup(cmd *cobra.Command, args []string) error {
 	if deletedCount > 0 {
 		meta.UpdateMeta(userEmail, "hitch cleanup")
 		writer := metadata.NewWriter(repo.Repository)
-		if err := writer.Write(meta, userName, userEmail, fmt.Sprintf("Clean up %d stale branches", deletedCount)); err != nil {
+		if err := writer.Write(meta, fmt.Sprintf("Clean up %d stale branches", deletedCount), userName, userEmail); err != nil {
 			errorMsg("Failed to update metadata")
 			return err
 		}
@@ -210,5 +229,142 @@ func runCleanup(cmd *cobra.Command, args []string) error {
 
 	success(fmt.Sprintf("Deleted %d branches", deletedCount))
 
+	if failedCount > 0 {
+		fmt.Println()
+		warning(fmt.Sprintf("%d branch(es) could not be archived or deleted on origin and are still tracked", failedCount))
+		fmt.Println("Fix the problem, then run 'hitch cleanup' again.")
+		return fmt.Errorf("failed to clean up %d branch(es)", failedCount)
+	}
+
 	return nil
 }
+
+// explainCleanup prints the checks behind cleanup's decision about a
+// branch and the verdict
+func explainCleanup(e metadata.CleanupExplanation) {
+	pass := func(format string, args ...any) {
+		fmt.Printf("  %s %s\n", color.GreenString("✓"), fmt.Sprintf(format, args...))
+	}
+	fail := func(format string, args ...any) {
+		fmt.Printf("  %s %s\n", color.RedString("✗"), fmt.Sprintf(format, args...))
+	}
+
+	color.New(color.Bold).Printf("Cleanup decision for %s:\n", e.Branch)
+
+	switch {
+	case !e.Tracked:
+		fail("Tracked by Hitch: no (never promoted or released)")
+	case e.MergedAt == nil:
+		pass("Tracked by Hitch")
+		fail("Merged to main: no")
+	case e.EligibleAt == nil:
+		pass("Tracked by Hitch")
+		pass("Merged to main %s (%s)", e.MergedAt.Format("2006-01-02"), formatTimeAgo(*e.MergedAt))
+		fail("Cleanup date: none (released with --no-delete)")
+	default:
+		pass("Tracked by Hitch")
+		pass("Merged to main %s (%s)", e.MergedAt.Format("2006-01-02"), formatTimeAgo(*e.MergedAt))
+		if e.PastRetention {
+			pass("Past retention: eligible since %s (%d days after merge)", e.EligibleAt.Format("2006-01-02"), e.RetentionDays)
+		} else {
+			fail("Past retention: eligible on %s (%d days after merge)", e.EligibleAt.Format("2006-01-02"), e.RetentionDays)
+		}
+		if len(e.Environments) == 0 {
+			pass("Not in any environment")
+		} else {
+			fail("In environments: %s", strings.Join(e.Environments, ", "))
+		}
+	}
+
+	fmt.Println()
+	if e.SafeToDelete() {
+		success(fmt.Sprintf("%s is eligible: 'hitch cleanup' will delete it", e.Branch))
+	} else {
+		info(fmt.Sprintf("%s is not eligible: %s", e.Branch, e.Blocker))
+	}
+}
+
+// splitStaleBranches separates stale branches into those cleanup may delete
+// and inactive ones that are only reported
+func splitStaleBranches(meta *metadata.Metadata) (safeToDelete, inactive []metadata.StaleBranch) {
+	for _, stale := range meta.StaleBranchDetails() {
+		switch {
+		case stale.SafeToDelete():
+			safeToDelete = append(safeToDelete, stale)
+		case stale.Reason == metadata.StaleInactive:
+			inactive = append(inactive, stale)
+		}
+	}
+	return safeToDelete, inactive
+}
+
+// stillInactive drops the inactive branches whose tip, locally or on origin,
+// was committed within config.stale_days_no_activity. Metadata's
+// last_commit_at isn't kept up to date, so git has the final say before
+// cleanup archives or deletes unmerged work.
+func stillInactive(repo *hitchgit.Repo, meta *metadata.Metadata, inactive []metadata.StaleBranch) []metadata.StaleBranch {
+	var kept []metadata.StaleBranch
+	for _, stale := range inactive {
+		var last time.Time
+		for _, ref := range []string{stale.Branch, "origin/" + stale.Branch} {
+			if when, err := repo.CommitTime(ref); err == nil && when.After(last) {
+				last = when
+			}
+		}
+		if !last.IsZero() {
+			days := int(time.Since(last).Hours() / 24)
+			if days <= meta.Config.StaleDaysNoActivity {
+				logging.Debugf("%s has a commit from %d days ago, so it isn't inactive", stale.Branch, days)
+				continue
+			}
+			stale.DaysSinceCommit = days
+		}
+		kept = append(kept, stale)
+	}
+	return kept
+}
+
+// abandonedBranches returns the inactive branches config.inactive_branch_action
+// tells cleanup to remove. Branches still in an environment are never removed.
+func abandonedBranches(inactive []metadata.StaleBranch, action string) []metadata.StaleBranch {
+	if action != "archive" && action != "delete" {
+		return nil
+	}
+
+	var abandoned []metadata.StaleBranch
+	for _, stale := range inactive {
+		if !stale.InEnvironment {
+			abandoned = append(abandoned, stale)
+		}
+	}
+	return abandoned
+}
+
+// archiveBranch tags branch's tip as archive/<branch>-<date> and pushes the
+// tag, so the branch can be restored after cleanup deletes it. A branch that
+// only exists on origin is tagged at origin's tip. Archiving twice on the
+// same day reuses the tag.
+func archiveBranch(repo *hitchgit.Repo, branch string) (string, error) {
+	tip, err := repo.ResolveCommit(branch)
+	if err != nil {
+		if tip, err = repo.ResolveCommit("origin/" + branch); err != nil {
+			return "", fmt.Errorf("%s not found locally or on origin", branch)
+		}
+	}
+
+	tag := fmt.Sprintf("archive/%s-%s", branch, time.Now().Format("2006-01-02"))
+	if existing, err := repo.ResolveCommit("refs/tags/" + tag); err != nil {
+		if err := repo.CreateTag(tag, tip); err != nil {
+			return "", err
+		}
+	} else if existing != tip {
+		return "", fmt.Errorf("tag %s already exists at a different commit", tag)
+	}
+
+	if !skipRemote(repo, "push of tag "+tag, fmt.Sprintf("git push origin refs/tags/%s", tag)) {
+		if err := repo.PushTag("origin", tag); err != nil {
+			return "", err
+		}
+	}
+	return tag, nil
+}
@@ -0,0 +1,4919 @@
+//go:build dockertest
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DoomedRamen/hitch/internal/forge"
+	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/logging"
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/DoomedRamen/hitch/internal/notify"
+	"github.com/DoomedRamen/hitch/internal/testutil"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// newHitchRepo creates a test repository with Hitch initialized (dev, qa)
+// and makes it the working directory for the duration of the test
+func newHitchRepo(t *testing.T) *testutil.TestRepo {
+	t.Helper()
+
+	tr := testutil.NewTestRepo(t)
+	t.Chdir(tr.Path)
+	resetFlags(rootCmd)
+
+	meta := metadata.NewMetadata([]string{"dev", "qa"}, "main", "test@example.com")
+	if err := tr.InitMetadata(meta); err != nil {
+		t.Fatalf("Failed to initialize metadata: %v", err)
+	}
+
+	return tr
+}
+
+// runHitch executes the root command with args, resetting every flag to its
+// default first so values don't leak between tests
+func runHitch(t *testing.T, args ...string) error {
+	t.Helper()
+
+	resetFlags(rootCmd)
+	rootCmd.SetArgs(args)
+	t.Cleanup(func() { rootCmd.SetArgs(nil) })
+
+	return Execute()
+}
+
+func resetFlags(c *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		_ = f.Value.Set(f.DefValue)
+		f.Changed = false
+	}
+	c.Flags().VisitAll(reset)
+	c.PersistentFlags().VisitAll(reset)
+
+	for _, sub := range c.Commands() {
+		resetFlags(sub)
+	}
+}
+
+// captureStdout runs fn and returns everything it wrote to os.Stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	return captureFile(t, &os.Stdout, fn)
+}
+
+// captureStderr runs fn and returns everything it wrote to os.Stderr
+func captureStderr(t *testing.T, fn func()) string {
+	t.Helper()
+	return captureFile(t, &os.Stderr, fn)
+}
+
+// captureFile temporarily replaces *target with a pipe while fn runs and
+// returns everything written to it
+func captureFile(t *testing.T, target **os.File, fn func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+
+	saved := *target
+	*target = w
+	defer func() { *target = saved }()
+
+	done := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		_, _ = io.Copy(&buf, r)
+		done <- buf.String()
+	}()
+
+	fn()
+	w.Close()
+	return <-done
+}
+
+// gitOutput runs a git command in dir and returns its trimmed output
+func gitOutput(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// readMetadata reads hitch.json from the test repository
+func readMetadata(t *testing.T, tr *testutil.TestRepo) *metadata.Metadata {
+	t.Helper()
+
+	meta, err := metadata.NewReader(tr.Repo.Repository).Read()
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	return meta
+}
+
+func TestReleaseRollsBackWhenPushFails(t *testing.T) {
+	tr := newHitchRepo(t)
+
+	if err := tr.CreateBranch("feature/x", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	if err := runHitch(t, "promote", "feature/x", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	// An unreachable origin makes the merge succeed locally but the push fail
+	gitOutput(t, tr.Path, "remote", "add", "origin", tr.Path+"-missing-remote")
+
+	mainBefore := gitOutput(t, tr.Path, "rev-parse", "main")
+
+	if err := runHitch(t, "release", "feature/x"); err == nil {
+		t.Fatal("Expected release to fail when push fails")
+	}
+
+	if mainAfter := gitOutput(t, tr.Path, "rev-parse", "main"); mainAfter != mainBefore {
+		t.Errorf("Expected main to be rolled back to %s, got %s", mainBefore, mainAfter)
+	}
+
+	meta := readMetadata(t, tr)
+	info := meta.Branches["feature/x"]
+	if info.MergedToMainAt != nil {
+		t.Error("Metadata should not record a merge when the push failed")
+	}
+	if len(info.PromotedTo) != 1 || info.PromotedTo[0] != "dev" {
+		t.Errorf("Expected feature/x to remain in dev, got %v", info.PromotedTo)
+	}
+
+	if branch, _ := tr.GetCurrentBranch(); branch != "main" {
+		t.Errorf("Expected to be returned to main, got %s", branch)
+	}
+}
+
+func TestOfflineModeCompletesLocally(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/offline", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+
+	// No remote is configured, so any attempted push would fail
+	if err := runHitch(t, "promote", "feature/offline", "to", "dev"); err != nil {
+		t.Fatalf("Offline promote failed: %v", err)
+	}
+
+	featureTip := gitOutput(t, tr.Path, "rev-parse", "feature/offline")
+	gitOutput(t, tr.Path, "merge-base", "--is-ancestor", featureTip, "dev")
+
+	if err := runHitch(t, "release", "feature/offline"); err != nil {
+		t.Fatalf("Offline release failed: %v", err)
+	}
+
+	gitOutput(t, tr.Path, "merge-base", "--is-ancestor", featureTip, "main")
+
+	meta := readMetadata(t, tr)
+	if meta.Branches["feature/offline"].MergedToMainAt == nil {
+		t.Error("Expected release to be recorded in local metadata")
+	}
+}
+
+func TestNoPushFlagSkipsRemote(t *testing.T) {
+	tr := newHitchRepo(t)
+
+	if err := tr.CreateBranch("feature/flag", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	if err := runHitch(t, "promote", "feature/flag", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	if err := runHitch(t, "release", "feature/flag", "--no-push"); err != nil {
+		t.Fatalf("release --no-push failed: %v", err)
+	}
+
+	if meta := readMetadata(t, tr); meta.Branches["feature/flag"].MergedToMainAt == nil {
+		t.Error("Expected release to be recorded in local metadata")
+	}
+}
+
+func TestRemotelessRepoSkipsRemoteOperations(t *testing.T) {
+	tr := newHitchRepo(t)
+
+	if err := tr.CreateBranch("feature/local", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+
+	var err error
+	var stdout string
+	stderr := captureStderr(t, func() {
+		stdout = captureStdout(t, func() {
+			if err = runHitch(t, "promote", "feature/local", "to", "dev"); err != nil {
+				return
+			}
+			err = runHitch(t, "release", "feature/local")
+		})
+	})
+	if err != nil {
+		t.Fatalf("promote/release failed: %v\n%s", err, stderr)
+	}
+
+	if strings.Contains(stderr, "⚠") || strings.Contains(stderr, "Failed") {
+		t.Errorf("Expected no warnings without a remote, got:\n%s", stderr)
+	}
+	for _, skipped := range []string{"push of dev", "pull of main", "push of main"} {
+		if !strings.Contains(stdout, "Skipped "+skipped+" (no origin remote configured)") {
+			t.Errorf("Expected %q to be skipped, got:\n%s", skipped, stdout)
+		}
+	}
+
+	if meta := readMetadata(t, tr); meta.Branches["feature/local"].MergedToMainAt == nil {
+		t.Error("Expected release to be recorded in local metadata")
+	}
+}
+
+func TestDemoteAllEmptiesEnvironment(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	features := []string{"feature/one", "feature/two"}
+	for _, name := range features {
+		if err := tr.CreateBranch(name, true); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		if err := runHitch(t, "promote", name, "to", "dev"); err != nil {
+			t.Fatalf("promote %s failed: %v", name, err)
+		}
+	}
+
+	if err := runHitch(t, "demote", "--all", "from", "dev", "--force"); err != nil {
+		t.Fatalf("demote --all failed: %v", err)
+	}
+
+	meta := readMetadata(t, tr)
+	if got := meta.Environments["dev"].Features; len(got) != 0 {
+		t.Errorf("Expected dev to have no features, got %v", got)
+	}
+	for _, name := range features {
+		info := meta.Branches[name]
+		if len(info.PromotedTo) != 0 {
+			t.Errorf("Expected %s to be in no environments, got %v", name, info.PromotedTo)
+		}
+		if len(info.PromotedHistory) == 0 || info.PromotedHistory[len(info.PromotedHistory)-1].DemotedAt == nil {
+			t.Errorf("Expected %s's demotion to be recorded, got %+v", name, info.PromotedHistory)
+		}
+	}
+
+	if devTree, mainTree := gitOutput(t, tr.Path, "rev-parse", "dev^{tree}"), gitOutput(t, tr.Path, "rev-parse", "main^{tree}"); devTree != mainTree {
+		t.Error("Expected dev to be rebuilt to match main")
+	}
+}
+
+func TestDemoteAllRequiresConfirmation(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/kept", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	if err := runHitch(t, "promote", "feature/kept", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	answer := filepath.Join(t.TempDir(), "answer")
+	if err := os.WriteFile(answer, []byte("n\n"), 0644); err != nil {
+		t.Fatalf("Failed to write answer: %v", err)
+	}
+	stdin, err := os.Open(answer)
+	if err != nil {
+		t.Fatalf("Failed to open answer: %v", err)
+	}
+	defer stdin.Close()
+
+	realStdin := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = realStdin }()
+
+	if err := runHitch(t, "demote", "--all", "from", "dev"); err != nil {
+		t.Fatalf("demote --all failed: %v", err)
+	}
+
+	if got := readMetadata(t, tr).Environments["dev"].Features; len(got) != 1 {
+		t.Errorf("Expected declining to leave dev unchanged, got %v", got)
+	}
+}
+
+func TestDoctorFixReconcilesPromotedTo(t *testing.T) {
+	tr := testutil.NewTestRepo(t)
+	t.Chdir(tr.Path)
+	resetFlags(rootCmd)
+
+	meta := metadata.NewMetadata([]string{"dev", "qa"}, "main", "test@example.com")
+	dev := meta.Environments["dev"]
+	dev.Features = []string{"feature/drifted"}
+	meta.Environments["dev"] = dev
+	meta.Branches["feature/drifted"] = metadata.BranchInfo{PromotedTo: []string{"qa"}}
+	if err := tr.InitMetadata(meta); err != nil {
+		t.Fatalf("Failed to initialize metadata: %v", err)
+	}
+
+	if err := runHitch(t, "doctor"); err == nil {
+		t.Fatal("Expected doctor to report the inconsistency")
+	}
+	if got := readMetadata(t, tr).Branches["feature/drifted"].PromotedTo; len(got) != 1 || got[0] != "qa" {
+		t.Fatalf("Expected doctor without --fix to change nothing, got %v", got)
+	}
+
+	if err := runHitch(t, "doctor", "--fix"); err != nil {
+		t.Fatalf("doctor --fix failed: %v", err)
+	}
+	if got := readMetadata(t, tr).Branches["feature/drifted"].PromotedTo; len(got) != 1 || got[0] != "dev" {
+		t.Errorf("Expected promoted_to to be reconciled to [dev], got %v", got)
+	}
+	if branch, _ := tr.GetCurrentBranch(); branch != "main" {
+		t.Errorf("Expected to be returned to main, got %s", branch)
+	}
+
+	if err := runHitch(t, "doctor"); err != nil {
+		t.Errorf("Expected doctor to pass after --fix, got %v", err)
+	}
+}
+
+// addBareRemote creates a bare repository, adds it as origin, and pushes
+// main and hitch-metadata to it. It returns the remote's path.
+func addBareRemote(t *testing.T, tr *testutil.TestRepo) string {
+	t.Helper()
+
+	remote, err := tr.AddRemote()
+	if err != nil {
+		t.Fatalf("Failed to add remote: %v", err)
+	}
+	for _, branch := range []string{"main", metadata.MetadataBranch} {
+		if err := tr.PushBranch(branch); err != nil {
+			t.Fatalf("Failed to push %s: %v", branch, err)
+		}
+	}
+
+	return remote
+}
+
+// commitMetadata adds an empty commit on top of the local hitch-metadata branch
+func commitMetadata(t *testing.T, tr *testutil.TestRepo, message string) {
+	t.Helper()
+
+	parent := gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch)
+	commit := gitOutput(t, tr.Path, "commit-tree", parent+"^{tree}", "-p", parent, "-m", message)
+	gitOutput(t, tr.Path, "update-ref", "refs/heads/"+metadata.MetadataBranch, commit)
+}
+
+func TestCheckMetadataNotBehind(t *testing.T) {
+	tr := newHitchRepo(t)
+	addBareRemote(t, tr)
+
+	// Up to date
+	if err := checkMetadataNotBehind(tr.Repo); err != nil {
+		t.Errorf("Up-to-date metadata should pass, got: %v", err)
+	}
+
+	// Ahead: local has an unpushed commit
+	commitMetadata(t, tr, "Local change")
+	if err := checkMetadataNotBehind(tr.Repo); err != nil {
+		t.Errorf("Metadata ahead of origin should pass, got: %v", err)
+	}
+
+	// Behind: origin has a commit the local branch doesn't
+	gitOutput(t, tr.Path, "push", "origin", metadata.MetadataBranch)
+	gitOutput(t, tr.Path, "update-ref", "refs/heads/"+metadata.MetadataBranch, metadata.MetadataBranch+"~1")
+
+	err := checkMetadataNotBehind(tr.Repo)
+	var staleErr *metadata.StaleMetadataError
+	if !errors.As(err, &staleErr) {
+		t.Fatalf("Expected StaleMetadataError when behind, got: %v", err)
+	}
+	if staleErr.Behind != 1 {
+		t.Errorf("Expected 1 commit behind, got %d", staleErr.Behind)
+	}
+
+	if err := tr.CreateBranch("feature/x", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	if err := runHitch(t, "promote", "feature/x", "to", "dev", "--no-rebuild"); err == nil {
+		t.Error("Expected promote to refuse writing on stale metadata")
+	}
+
+	// --allow-stale-metadata overrides the check
+	allowStaleMetadata = true
+	if err := checkMetadataNotBehind(tr.Repo); err != nil {
+		t.Errorf("Expected --allow-stale-metadata to skip the check, got: %v", err)
+	}
+	allowStaleMetadata = false
+}
+
+func TestSyncFastForwardsMetadata(t *testing.T) {
+	tr := newHitchRepo(t)
+	addBareRemote(t, tr)
+
+	commitMetadata(t, tr, "Remote change")
+	gitOutput(t, tr.Path, "push", "origin", metadata.MetadataBranch)
+	remoteTip := gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch)
+	gitOutput(t, tr.Path, "update-ref", "refs/heads/"+metadata.MetadataBranch, metadata.MetadataBranch+"~1")
+
+	if err := runHitch(t, "sync"); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	if tip := gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch); tip != remoteTip {
+		t.Errorf("Expected hitch-metadata fast-forwarded to %s, got %s", remoteTip, tip)
+	}
+
+	if err := checkMetadataNotBehind(tr.Repo); err != nil {
+		t.Errorf("Expected metadata to be current after sync, got: %v", err)
+	}
+
+	// Running again is a no-op
+	if err := runHitch(t, "sync"); err != nil {
+		t.Errorf("Second sync failed: %v", err)
+	}
+}
+
+func TestSyncPushRejectedByConcurrentMetadataPush(t *testing.T) {
+	tr := newHitchRepo(t)
+	remote := addBareRemote(t, tr)
+
+	// Read origin's metadata, then commit locally on top of it
+	gitOutput(t, tr.Path, "fetch", "origin")
+	lease := tr.Repo.RemoteTrackingSHA("origin", metadata.MetadataBranch)
+	commitMetadata(t, tr, "Local change")
+
+	// Meanwhile, another user pushes their own metadata change
+	other := t.TempDir()
+	gitOutput(t, other, "clone", "--branch", metadata.MetadataBranch, remote, ".")
+	gitOutput(t, other, "-c", "user.email=other@example.com", "-c", "user.name=Other", "commit", "--allow-empty", "-m", "Concurrent change")
+	gitOutput(t, other, "push", "origin", metadata.MetadataBranch)
+	otherTip := gitOutput(t, other, "rev-parse", "HEAD")
+
+	err := pushMetadata(tr.Repo, lease)
+	var leaseErr *hitchgit.LeaseRejectedError
+	if !errors.As(err, &leaseErr) {
+		t.Fatalf("Expected LeaseRejectedError, got %v", err)
+	}
+	if tip := gitOutput(t, remote, "rev-parse", metadata.MetadataBranch); tip != otherTip {
+		t.Errorf("Expected the concurrent metadata push to survive, remote is at %s", tip)
+	}
+
+	// Once caught up, sync publishes local commits
+	gitOutput(t, tr.Path, "update-ref", "refs/heads/"+metadata.MetadataBranch, metadata.MetadataBranch+"~1")
+	if err := runHitch(t, "sync"); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	commitMetadata(t, tr, "Local change after sync")
+	if err := runHitch(t, "sync"); err != nil {
+		t.Fatalf("sync push failed: %v", err)
+	}
+	if remoteTip, localTip := gitOutput(t, remote, "rev-parse", metadata.MetadataBranch), gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch); remoteTip != localTip {
+		t.Errorf("Expected sync to push local metadata, remote %s local %s", remoteTip, localTip)
+	}
+}
+
+func TestVerboseLogsGitCommands(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	var buf bytes.Buffer
+	logging.SetOutput(&buf)
+	t.Cleanup(func() {
+		logging.SetOutput(os.Stderr)
+		logging.SetLevel(logging.LevelWarn)
+	})
+
+	if err := tr.CreateBranch("feature/verbose", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	if err := runHitch(t, "promote", "feature/verbose", "to", "dev", "--verbose"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	logs := buf.String()
+	for _, want := range []string{"[debug] git merge", "rebuild dev took", "wrote hitch.json"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("Expected verbose log to contain %q, got:\n%s", want, logs)
+		}
+	}
+}
+
+func TestRepoFlagRunsOutsideRepository(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/elsewhere", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	t.Chdir(t.TempDir())
+
+	if err := runHitch(t, "-C", tr.Path, "promote", "feature/elsewhere", "to", "dev"); err != nil {
+		t.Fatalf("promote -C failed: %v", err)
+	}
+	featureTip := gitOutput(t, tr.Path, "rev-parse", "feature/elsewhere")
+	gitOutput(t, tr.Path, "merge-base", "--is-ancestor", featureTip, "dev")
+
+	// HITCH_REPO works the same way when no flag is given
+	t.Setenv("HITCH_REPO", tr.Path)
+	if err := runHitch(t, "demote", "feature/elsewhere", "from", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("demote with HITCH_REPO failed: %v", err)
+	}
+	if readMetadata(t, tr).IsInAnyEnvironment("feature/elsewhere") {
+		t.Error("Expected feature/elsewhere to be demoted from dev")
+	}
+}
+
+func TestPromoteCreateMakesBranch(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := runHitch(t, "promote", "feature/new", "to", "dev", "--create", "--no-rebuild"); err != nil {
+		t.Fatalf("promote --create failed: %v", err)
+	}
+
+	if !tr.BranchExists("feature/new") {
+		t.Fatal("Expected --create to create feature/new")
+	}
+	if got, want := gitOutput(t, tr.Path, "rev-parse", "feature/new"), gitOutput(t, tr.Path, "rev-parse", "main"); got != want {
+		t.Errorf("Expected feature/new to start at main (%s), got %s", want, got)
+	}
+
+	meta := readMetadata(t, tr)
+	if !meta.IsInAnyEnvironment("feature/new") {
+		t.Error("Expected feature/new to be promoted to dev")
+	}
+}
+
+func TestPromoteCreateFromRef(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/parent", true); err != nil {
+		t.Fatalf("Failed to create parent branch: %v", err)
+	}
+
+	if err := runHitch(t, "promote", "feature/child", "to", "dev", "--create", "--from", "feature/parent", "--no-rebuild"); err != nil {
+		t.Fatalf("promote --create --from failed: %v", err)
+	}
+
+	if got, want := gitOutput(t, tr.Path, "rev-parse", "feature/child"), gitOutput(t, tr.Path, "rev-parse", "feature/parent"); got != want {
+		t.Errorf("Expected feature/child to start at feature/parent (%s), got %s", want, got)
+	}
+}
+
+func TestPromoteCreateRefusesExistingBranch(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/exists", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+
+	if err := runHitch(t, "promote", "feature/exists", "to", "dev", "--create"); err == nil {
+		t.Fatal("Expected promote --create to fail for an existing branch")
+	}
+
+	if readMetadata(t, tr).IsInAnyEnvironment("feature/exists") {
+		t.Error("Expected feature/exists not to be promoted")
+	}
+}
+
+func TestLocksJSON(t *testing.T) {
+	tr := testutil.NewTestRepo(t)
+	t.Chdir(tr.Path)
+
+	meta := metadata.NewMetadata([]string{"qa", "dev", "prod"}, "main", "test@example.com")
+	lockedAt := time.Date(2025, 10, 17, 14, 30, 0, 0, time.FixedZone("EST", -5*3600))
+	if err := meta.LockEnvironment("dev", "alice@example.com", "deploy"); err != nil {
+		t.Fatalf("Failed to lock dev: %v", err)
+	}
+	dev := meta.Environments["dev"]
+	dev.LockedAt = lockedAt
+	meta.Environments["dev"] = dev
+	if err := meta.LockEnvironment("qa", "bob@example.com", "testing"); err != nil {
+		t.Fatalf("Failed to lock qa: %v", err)
+	}
+	if err := tr.InitMetadata(meta); err != nil {
+		t.Fatalf("Failed to initialize metadata: %v", err)
+	}
+
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	t.Cleanup(func() { rootCmd.SetOut(nil) })
+
+	if err := runHitch(t, "locks", "--json"); err != nil {
+		t.Fatalf("locks --json failed: %v", err)
+	}
+
+	var states []map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &states); err != nil {
+		t.Fatalf("Invalid JSON output: %v\n%s", err, out.String())
+	}
+
+	if len(states) != 3 {
+		t.Fatalf("Expected 3 environments, got %d", len(states))
+	}
+
+	for i, want := range []string{"dev", "prod", "qa"} {
+		if states[i]["environment"] != want {
+			t.Errorf("Expected environment %d to be %s, got %v", i, want, states[i]["environment"])
+		}
+		for _, field := range []string{"locked", "locked_by", "locked_at", "stale", "timeout_minutes"} {
+			if _, ok := states[i][field]; !ok {
+				t.Errorf("Expected %s to have field %s", want, field)
+			}
+		}
+	}
+
+	dev0 := states[0]
+	if dev0["locked"] != true || dev0["locked_by"] != "alice@example.com" {
+		t.Errorf("Unexpected dev lock: %v", dev0)
+	}
+	if dev0["locked_at"] != "2025-10-17T19:30:00Z" {
+		t.Errorf("Expected RFC3339 UTC locked_at, got %v", dev0["locked_at"])
+	}
+	if dev0["stale"] != true {
+		t.Error("Expected old dev lock to be stale")
+	}
+	if dev0["timeout_minutes"] != float64(15) {
+		t.Errorf("Expected timeout_minutes 15, got %v", dev0["timeout_minutes"])
+	}
+
+	if states[1]["locked"] != false || states[1]["locked_by"] != nil || states[1]["locked_at"] != nil {
+		t.Errorf("Expected prod to be unlocked with null lock fields, got %v", states[1])
+	}
+
+	if states[2]["locked"] != true || states[2]["stale"] != false {
+		t.Errorf("Expected fresh qa lock not to be stale, got %v", states[2])
+	}
+}
+
+func TestRestoreBranchRecoversFromConflictedMerge(t *testing.T) {
+	tr := newHitchRepo(t)
+
+	gitOutput(t, tr.Path, "checkout", "-b", "feature/a")
+	if err := tr.CommitFile("shared.txt", "from a\n", "a"); err != nil {
+		t.Fatalf("Failed to commit on feature/a: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "-b", "feature/b", "main")
+	if err := tr.CommitFile("shared.txt", "from b\n", "b"); err != nil {
+		t.Fatalf("Failed to commit on feature/b: %v", err)
+	}
+
+	// Leave feature/b mid-merge with conflicts, as a failed rebuild would
+	if err := tr.Repo.Merge("feature/a", ""); err == nil {
+		t.Fatal("Expected merge to conflict")
+	}
+
+	restoreBranch(tr.Repo, "main")
+
+	if branch, _ := tr.GetCurrentBranch(); branch != "main" {
+		t.Errorf("Expected to be back on main, got %s", branch)
+	}
+	if status := gitOutput(t, tr.Path, "status", "--porcelain"); status != "" {
+		t.Errorf("Expected a clean worktree, got:\n%s", status)
+	}
+	if err := exec.Command("git", "-C", tr.Path, "rev-parse", "-q", "--verify", "MERGE_HEAD").Run(); err == nil {
+		t.Error("Expected the in-progress merge to be aborted")
+	}
+}
+
+func TestRestoreBranchKeepsChangesOnUserBranch(t *testing.T) {
+	tr := newHitchRepo(t)
+
+	gitOutput(t, tr.Path, "checkout", "-b", "feature/mine")
+	path := filepath.Join(tr.Path, "README.md")
+	if err := os.WriteFile(path, []byte("my work\n"), 0644); err != nil {
+		t.Fatalf("Failed to edit README.md: %v", err)
+	}
+
+	// The checkout back to main fails, and feature/mine isn't Hitch's to reset
+	restoreBranch(tr.Repo, "main")
+
+	if branch, _ := tr.GetCurrentBranch(); branch != "feature/mine" {
+		t.Errorf("Expected to stay on feature/mine, got %s", branch)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "my work\n" {
+		t.Errorf("Expected the uncommitted change to be kept, got %q", content)
+	}
+}
+
+func TestDirtyWorktreeSurvivesMetadataWrites(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	path := filepath.Join(tr.Path, "README.md")
+	if err := os.WriteFile(path, []byte("staged\n"), 0644); err != nil {
+		t.Fatalf("Failed to edit README.md: %v", err)
+	}
+	gitOutput(t, tr.Path, "add", "README.md")
+	if err := os.WriteFile(path, []byte("unstaged\n"), 0644); err != nil {
+		t.Fatalf("Failed to edit README.md: %v", err)
+	}
+	status := gitOutput(t, tr.Path, "status", "--porcelain")
+
+	// Metadata-only commands work around the changes
+	if err := runHitch(t, "lock", "dev"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if err := runHitch(t, "unlock", "dev"); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+
+	// Rebuilding in place needs other checkouts, so it's refused up front
+	if err := runHitch(t, "rebuild", "dev"); err == nil {
+		t.Error("Expected rebuild to refuse uncommitted changes")
+	}
+	if tr.Repo.BranchExists("dev") {
+		t.Error("Expected the refused rebuild not to create dev")
+	}
+
+	if branch, _ := tr.GetCurrentBranch(); branch != "main" {
+		t.Errorf("Expected to stay on main, got %s", branch)
+	}
+	if after := gitOutput(t, tr.Path, "status", "--porcelain"); after != status {
+		t.Errorf("Expected the changes to be untouched, was %q, now %q", status, after)
+	}
+	if staged := gitOutput(t, tr.Path, "show", ":README.md"); staged != "staged" {
+		t.Errorf("Expected the staged change to be kept, got %q", staged)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "unstaged\n" {
+		t.Errorf("Expected the unstaged change to be kept, got %q", content)
+	}
+}
+
+func TestCommandsAcceptEnvironmentAlias(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := runHitch(t, "alias", "development", "dev"); err != nil {
+		t.Fatalf("alias failed: %v", err)
+	}
+
+	if err := tr.CreateBranch("feature/aliased", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	if err := runHitch(t, "promote", "feature/aliased", "to", "development", "--no-rebuild"); err != nil {
+		t.Fatalf("promote via alias failed: %v", err)
+	}
+
+	meta := readMetadata(t, tr)
+	if features := meta.Environments["dev"].Features; len(features) != 1 || features[0] != "feature/aliased" {
+		t.Errorf("Expected feature/aliased in dev, got %v", features)
+	}
+	if _, exists := meta.Environments["development"]; exists {
+		t.Error("Alias must not create a new environment")
+	}
+
+	if err := runHitch(t, "lock", "development"); err != nil {
+		t.Fatalf("lock via alias failed: %v", err)
+	}
+	if !readMetadata(t, tr).IsEnvironmentLocked("dev") {
+		t.Error("Expected lock via alias to lock dev")
+	}
+
+	if err := runHitch(t, "promote", "feature/aliased", "to", "nope"); err == nil {
+		t.Error("Expected unknown environment to fail")
+	}
+}
+
+func TestReleaseDryRunChangesNothing(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/preview", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	if err := runHitch(t, "promote", "feature/preview", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	mainBefore := gitOutput(t, tr.Path, "rev-parse", "main")
+	metaBefore := gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch)
+
+	if err := runHitch(t, "release", "feature/preview", "--dry-run"); err != nil {
+		t.Fatalf("release --dry-run failed: %v", err)
+	}
+
+	if got := gitOutput(t, tr.Path, "rev-parse", "main"); got != mainBefore {
+		t.Errorf("Expected main unchanged at %s, got %s", mainBefore, got)
+	}
+	if got := gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch); got != metaBefore {
+		t.Errorf("Expected metadata unchanged at %s, got %s", metaBefore, got)
+	}
+	if meta := readMetadata(t, tr); meta.Branches["feature/preview"].MergedToMainAt != nil {
+		t.Error("Expected dry run not to mark the branch as merged")
+	}
+}
+
+func TestReleaseDryRunReportsConflict(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	gitOutput(t, tr.Path, "checkout", "-b", "feature/clash")
+	if err := tr.CommitFile("README.md", "feature change\n", "Change README on feature"); err != nil {
+		t.Fatalf("Failed to commit on feature: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := tr.CommitFile("README.md", "main change\n", "Change README on main"); err != nil {
+		t.Fatalf("Failed to commit on main: %v", err)
+	}
+
+	if err := runHitch(t, "promote", "feature/clash", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	mainBefore := gitOutput(t, tr.Path, "rev-parse", "main")
+
+	if err := runHitch(t, "release", "feature/clash", "--dry-run"); err == nil {
+		t.Fatal("Expected release --dry-run to report the conflict")
+	}
+
+	if got := gitOutput(t, tr.Path, "rev-parse", "main"); got != mainBefore {
+		t.Errorf("Expected main unchanged at %s, got %s", mainBefore, got)
+	}
+	if status := gitOutput(t, tr.Path, "status", "--porcelain"); status != "" {
+		t.Errorf("Expected a clean worktree, got:\n%s", status)
+	}
+}
+
+func TestJSONModeEmitsTypedErrorEnvelope(t *testing.T) {
+	tr := testutil.NewTestRepo(t)
+	t.Chdir(tr.Path)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	meta := metadata.NewMetadata([]string{"dev", "qa"}, "main", "test@example.com")
+	if err := meta.LockEnvironment("dev", "alice@example.com", "deploying"); err != nil {
+		t.Fatalf("Failed to lock dev: %v", err)
+	}
+	if err := tr.InitMetadata(meta); err != nil {
+		t.Fatalf("Failed to initialize metadata: %v", err)
+	}
+
+	for _, args := range [][]string{
+		{"lock", "dev", "--json"},
+		{"rebuild", "dev", "--json"},
+	} {
+		var out bytes.Buffer
+		rootCmd.SetOut(&out)
+
+		if err := runHitch(t, args...); err == nil {
+			t.Fatalf("Expected %v to fail on a locked environment", args)
+		}
+		rootCmd.SetOut(nil)
+
+		var envelope struct {
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(out.Bytes(), &envelope); err != nil {
+			t.Fatalf("%v: expected only a JSON envelope on stdout: %v\n%s", args, err, out.String())
+		}
+		if envelope.Error.Type != "EnvironmentLockedError" {
+			t.Errorf("%v: expected type EnvironmentLockedError, got %q", args, envelope.Error.Type)
+		}
+		if !strings.Contains(envelope.Error.Message, "alice@example.com") {
+			t.Errorf("%v: expected message to name the lock holder, got %q", args, envelope.Error.Message)
+		}
+	}
+}
+
+func TestRebuildPlanApply(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, branch := range []string{"feature/a", "feature/b"} {
+		if err := tr.CreateBranch(branch, true); err != nil {
+			t.Fatalf("Failed to create %s: %v", branch, err)
+		}
+		if err := runHitch(t, "promote", branch, "to", "dev", "--no-rebuild"); err != nil {
+			t.Fatalf("promote %s failed: %v", branch, err)
+		}
+	}
+
+	planFile := filepath.Join(t.TempDir(), "dev.plan.json")
+	if err := runHitch(t, "rebuild", "dev", "--plan", planFile); err != nil {
+		t.Fatalf("rebuild --plan failed: %v", err)
+	}
+	if tr.BranchExists("dev") {
+		t.Fatal("Expected --plan not to create the dev branch")
+	}
+
+	data, err := os.ReadFile(planFile)
+	if err != nil {
+		t.Fatalf("Failed to read plan: %v", err)
+	}
+	var plan rebuildPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		t.Fatalf("Failed to parse plan: %v", err)
+	}
+	if len(plan.Features) != 2 || plan.Features[0].Branch != "feature/a" || plan.Features[1].Branch != "feature/b" {
+		t.Fatalf("Expected feature/a then feature/b in the plan, got %+v", plan.Features)
+	}
+	if plan.MetadataCommit != gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch) {
+		t.Errorf("Expected plan to record the metadata commit, got %s", plan.MetadataCommit)
+	}
+
+	// A feature moving after the plan was made invalidates it
+	gitOutput(t, tr.Path, "checkout", "feature/b")
+	if err := tr.CommitFile("late.txt", "late\n", "Late change"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	if err := runHitch(t, "rebuild", "dev", "--apply", planFile); err == nil {
+		t.Fatal("Expected --apply to reject a plan whose feature moved")
+	}
+	if tr.BranchExists("dev") {
+		t.Error("Expected a rejected plan not to rebuild dev")
+	}
+
+	// A fresh plan applies and merges exactly the planned commits
+	if err := runHitch(t, "rebuild", "dev", "--plan", planFile); err != nil {
+		t.Fatalf("rebuild --plan failed: %v", err)
+	}
+	if err := runHitch(t, "rebuild", "dev", "--apply", planFile); err != nil {
+		t.Fatalf("rebuild --apply failed: %v", err)
+	}
+	for _, branch := range []string{"feature/a", "feature/b"} {
+		gitOutput(t, tr.Path, "merge-base", "--is-ancestor", branch, "dev")
+	}
+
+	// Applying the same plan again is refused: the rebuild changed the metadata
+	if err := runHitch(t, "rebuild", "dev", "--apply", planFile); err == nil {
+		t.Error("Expected --apply to reject a plan made before the metadata changed")
+	}
+}
+
+func TestPromoteStackMergesInOrder(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	// feature/ui builds on feature/api
+	if err := tr.CreateBranch("feature/api", true); err != nil {
+		t.Fatalf("Failed to create feature/api: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "-b", "feature/ui", "feature/api")
+	if err := tr.CommitFile("ui.txt", "ui\n", "Add UI"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	if err := runHitch(t, "stack", "cart", "feature/api", "feature/ui"); err != nil {
+		t.Fatalf("stack failed: %v", err)
+	}
+	if err := runHitch(t, "promote-stack", "cart", "to", "dev"); err != nil {
+		t.Fatalf("promote-stack failed: %v", err)
+	}
+
+	meta := readMetadata(t, tr)
+	if got := meta.Environments["dev"].Features; len(got) != 2 || got[0] != "feature/api" || got[1] != "feature/ui" {
+		t.Errorf("Expected dev features [feature/api feature/ui], got %v", got)
+	}
+	for _, branch := range []string{"feature/api", "feature/ui"} {
+		gitOutput(t, tr.Path, "merge-base", "--is-ancestor", branch, "dev")
+	}
+
+	// Demoting the bottom of the stack warns about what depends on it
+	stderr := captureStderr(t, func() {
+		if err := runHitch(t, "demote", "feature/api", "from", "dev", "--no-rebuild"); err != nil {
+			t.Errorf("demote failed: %v", err)
+		}
+	})
+	if !strings.Contains(stderr, "feature/ui depends on feature/api in stack cart") {
+		t.Errorf("Expected a stack dependency warning, got:\n%s", stderr)
+	}
+}
+
+func TestPostRebuildHook(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	record := filepath.Join(t.TempDir(), "hook.log")
+	meta := readMetadata(t, tr)
+	meta.Config.PostRebuildHook = `echo "$HITCH_ENVIRONMENT $HITCH_COMMIT $1 $2" >> ` + record
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Configure hook", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	if err := tr.CreateBranch("feature/hooked", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	if err := runHitch(t, "promote", "feature/hooked", "to", "dev"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	devTip := gitOutput(t, tr.Path, "rev-parse", "dev")
+	data, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatalf("Expected the hook to run: %v", err)
+	}
+	if got, want := strings.TrimSpace(string(data)), strings.Join([]string{"dev", devTip, "dev", devTip}, " "); got != want {
+		t.Errorf("Expected hook to see %q, got %q", want, got)
+	}
+
+	// A rebuild that fails on a conflict doesn't run the hook
+	for _, name := range []string{"feature/left", "feature/right"} {
+		gitOutput(t, tr.Path, "checkout", "-b", name, "main")
+		if err := tr.CommitFile("shared.txt", name+"\n", "Edit shared.txt on "+name); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+		gitOutput(t, tr.Path, "checkout", "main")
+		if err := runHitch(t, "promote", name, "to", "qa", "--no-rebuild"); err != nil {
+			t.Fatalf("promote %s failed: %v", name, err)
+		}
+	}
+	if err := runHitch(t, "rebuild", "qa"); err == nil {
+		t.Fatal("Expected rebuild of conflicting features to fail")
+	}
+	if err := runHitch(t, "rebuild", "qa", "--abort"); err != nil {
+		t.Fatalf("rebuild --abort failed: %v", err)
+	}
+	if data, _ := os.ReadFile(record); strings.Count(string(data), "\n") != 1 {
+		t.Errorf("Expected the hook not to run after a failed rebuild, got:\n%s", data)
+	}
+
+	// With --strict a failing hook fails the rebuild
+	meta = readMetadata(t, tr)
+	meta.Config.PostRebuildHook = "exit 3"
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Break hook", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "rebuild", "dev"); err != nil {
+		t.Errorf("Expected a failing hook only to warn, got %v", err)
+	}
+	if err := runHitch(t, "rebuild", "dev", "--strict"); err == nil {
+		t.Error("Expected --strict to fail when the hook fails")
+	}
+}
+
+func TestRebuildConflictPromptSkipsAndContinues(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, name := range []string{"feature/left", "feature/right", "feature/after"} {
+		gitOutput(t, tr.Path, "checkout", "-b", name, "main")
+		file := "shared.txt"
+		if name == "feature/after" {
+			file = "after.txt"
+		}
+		if err := tr.CommitFile(file, name+"\n", "Edit "+file+" on "+name); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+		gitOutput(t, tr.Path, "checkout", "main")
+		if err := runHitch(t, "promote", name, "to", "dev", "--no-rebuild"); err != nil {
+			t.Fatalf("promote %s failed: %v", name, err)
+		}
+	}
+
+	// Script the prompt: skip the conflicting feature
+	answer := filepath.Join(t.TempDir(), "answer")
+	if err := os.WriteFile(answer, []byte("s\n"), 0644); err != nil {
+		t.Fatalf("Failed to write answer: %v", err)
+	}
+	stdin, err := os.Open(answer)
+	if err != nil {
+		t.Fatalf("Failed to open answer: %v", err)
+	}
+	defer stdin.Close()
+
+	realStdin, realIsTerminal := os.Stdin, stdinIsTerminal
+	os.Stdin, stdinIsTerminal = stdin, func() bool { return true }
+	defer func() { os.Stdin, stdinIsTerminal = realStdin, realIsTerminal }()
+
+	if err := runHitch(t, "rebuild", "dev"); err != nil {
+		t.Fatalf("rebuild with skip failed: %v", err)
+	}
+
+	for _, merged := range []string{"feature/left", "feature/after"} {
+		gitOutput(t, tr.Path, "merge-base", "--is-ancestor", merged, "dev")
+	}
+	if err := exec.Command("git", "-C", tr.Path, "merge-base", "--is-ancestor", "feature/right", "dev").Run(); err == nil {
+		t.Error("Expected the skipped feature/right not to be merged into dev")
+	}
+
+	dev := readMetadata(t, tr).Environments["dev"]
+	if len(dev.Skipped) != 1 || dev.Skipped[0] != "feature/right" {
+		t.Errorf("Expected the skip of feature/right to be recorded, got %v", dev.Skipped)
+	}
+	if len(dev.Features) != 3 {
+		t.Errorf("Expected skipping to leave the feature list alone, got %v", dev.Features)
+	}
+
+	// Without a terminal the rebuild aborts as before
+	stdinIsTerminal = func() bool { return false }
+	if err := runHitch(t, "rebuild", "dev"); err == nil {
+		t.Error("Expected a non-interactive rebuild to abort on the conflict")
+	}
+}
+
+func TestRebuildConflictShellMustMergeFeature(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, name := range []string{"feature/left", "feature/right"} {
+		gitOutput(t, tr.Path, "checkout", "-b", name, "main")
+		if err := tr.CommitFile("shared.txt", name+"\n", "Edit shared.txt on "+name); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+		gitOutput(t, tr.Path, "checkout", "main")
+		if err := runHitch(t, "promote", name, "to", "dev", "--no-rebuild"); err != nil {
+			t.Fatalf("promote %s failed: %v", name, err)
+		}
+	}
+
+	dir := t.TempDir()
+	realIsTerminal := stdinIsTerminal
+	stdinIsTerminal = func() bool { return true }
+	defer func() { stdinIsTerminal = realIsTerminal }()
+
+	// rebuildWith runs a rebuild whose shell is script, answering the
+	// prompts with answers
+	rebuildWith := func(script string, answers string) error {
+		shell := filepath.Join(dir, "shell")
+		if err := os.WriteFile(shell, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatalf("Failed to write shell: %v", err)
+		}
+		t.Setenv("SHELL", shell)
+
+		answer := filepath.Join(dir, "answer")
+		if err := os.WriteFile(answer, []byte(answers), 0644); err != nil {
+			t.Fatalf("Failed to write answer: %v", err)
+		}
+		stdin, err := os.Open(answer)
+		if err != nil {
+			t.Fatalf("Failed to open answer: %v", err)
+		}
+		defer stdin.Close()
+
+		realStdin := os.Stdin
+		os.Stdin = stdin
+		defer func() { os.Stdin = realStdin }()
+		return runHitch(t, "rebuild", "dev")
+	}
+
+	// Aborting the merge in the shell doesn't count as resolving it, so the
+	// prompt comes back and the feature is skipped
+	if err := rebuildWith("git merge --abort", "h\ns\n"); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if err := exec.Command("git", "-C", tr.Path, "merge-base", "--is-ancestor", "feature/right", "dev").Run(); err == nil {
+		t.Error("Expected feature/right not to be merged into dev")
+	}
+	if skipped := readMetadata(t, tr).Environments["dev"].Skipped; !slices.Equal(skipped, []string{"feature/right"}) {
+		t.Errorf("Expected feature/right to be skipped, got %v", skipped)
+	}
+
+	// Committing the merge in the shell resolves it
+	if err := rebuildWith("git checkout --theirs shared.txt && git add shared.txt && git commit -q --no-edit", "h\n"); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	gitOutput(t, tr.Path, "merge-base", "--is-ancestor", "feature/right", "dev")
+}
+
+func TestPinnedFeatureRebuildsFromPinnedCommit(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/pinned", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	pinned := gitOutput(t, tr.Path, "rev-parse", "feature/pinned")
+
+	if err := runHitch(t, "promote", "feature/pinned@"+pinned[:7], "to", "dev"); err != nil {
+		t.Fatalf("pinned promote failed: %v", err)
+	}
+
+	if got := readMetadata(t, tr).Environments["dev"].Pins["feature/pinned"]; got != pinned {
+		t.Errorf("Expected pin %s to be stored, got %q", pinned, got)
+	}
+
+	// New work lands on the branch after the pin
+	gitOutput(t, tr.Path, "checkout", "feature/pinned")
+	if err := tr.CommitFile("later.txt", "later\n", "Later work"); err != nil {
+		t.Fatalf("Failed to commit later work: %v", err)
+	}
+	later := gitOutput(t, tr.Path, "rev-parse", "HEAD")
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	if err := runHitch(t, "rebuild", "dev"); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+
+	gitOutput(t, tr.Path, "merge-base", "--is-ancestor", pinned, "dev")
+	if err := exec.Command("git", "-C", tr.Path, "merge-base", "--is-ancestor", later, "dev").Run(); err == nil {
+		t.Error("Expected dev not to contain commits after the pin")
+	}
+
+	// Promoting without @sha unpins and tracks the tip again
+	if err := runHitch(t, "promote", "feature/pinned", "to", "dev"); err != nil {
+		t.Fatalf("unpin promote failed: %v", err)
+	}
+	if pins := readMetadata(t, tr).Environments["dev"].Pins; len(pins) != 0 {
+		t.Errorf("Expected pin to be removed, got %v", pins)
+	}
+	gitOutput(t, tr.Path, "merge-base", "--is-ancestor", later, "dev")
+}
+
+func TestPinMustBeOnBranch(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/a", true); err != nil {
+		t.Fatalf("Failed to create feature/a: %v", err)
+	}
+	if err := tr.CreateBranch("feature/b", true); err != nil {
+		t.Fatalf("Failed to create feature/b: %v", err)
+	}
+	other := gitOutput(t, tr.Path, "rev-parse", "feature/b")
+
+	if err := runHitch(t, "promote", "feature/a@"+other, "to", "dev"); err == nil {
+		t.Error("Expected pin to a commit from another branch to fail")
+	}
+	if err := runHitch(t, "promote", "feature/a@", "to", "dev"); err == nil {
+		t.Error("Expected empty pin to fail")
+	}
+	if readMetadata(t, tr).IsInAnyEnvironment("feature/a") {
+		t.Error("Expected feature/a not to be promoted")
+	}
+}
+
+func TestStatusFlagsMissingBranches(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, name := range []string{"feature/kept", "feature/gone"} {
+		if err := tr.CreateBranch(name, true); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		if err := runHitch(t, "promote", name, "to", "dev", "--no-rebuild"); err != nil {
+			t.Fatalf("promote %s failed: %v", name, err)
+		}
+	}
+	gitOutput(t, tr.Path, "branch", "-D", "feature/gone")
+
+	var err error
+	out := captureStdout(t, func() { err = runHitch(t, "status") })
+	if err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+
+	if !strings.Contains(out, "feature/gone (branch missing)") {
+		t.Errorf("Expected feature/gone to be flagged as missing, got:\n%s", out)
+	}
+	if strings.Contains(out, "feature/kept (branch missing)") {
+		t.Errorf("Expected feature/kept not to be flagged, got:\n%s", out)
+	}
+
+	out = captureStdout(t, func() { err = runHitch(t, "status", "--no-git-check") })
+	if err != nil {
+		t.Fatalf("status --no-git-check failed: %v", err)
+	}
+	if strings.Contains(out, "branch missing") {
+		t.Errorf("Expected --no-git-check to skip the branch check, got:\n%s", out)
+	}
+}
+
+func TestStatusJSONDerivedFieldsMatchHumanOutput(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, name := range []string{"feature/built", "feature/queued"} {
+		if err := tr.CreateBranch(name, true); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	// dev is rebuilt, then moved by hand; qa has a feature waiting for a rebuild
+	if err := runHitch(t, "promote", "feature/built", "to", "dev"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "dev")
+	if err := tr.CommitFile("hotfix.txt", "hotfix\n", "Commit straight to dev"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "promote", "feature/queued", "to", "qa", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	// feature/built was released long enough ago to be cleaned up
+	meta := readMetadata(t, tr)
+	past := time.Now().Add(-48 * time.Hour)
+	built := meta.Branches["feature/built"]
+	built.MergedToMainAt, built.EligibleForCleanupAt = &past, &past
+	meta.Branches["feature/built"] = built
+	if err := meta.LockEnvironment("qa", "alice@example.com", ""); err != nil {
+		t.Fatalf("Failed to lock qa: %v", err)
+	}
+	qa := meta.Environments["qa"]
+	qa.LockedAt = time.Now().Add(-time.Hour)
+	meta.Environments["qa"] = qa
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Fixture", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	if err := runHitch(t, "status", "--json"); err != nil {
+		t.Fatalf("status --json failed: %v", err)
+	}
+	rootCmd.SetOut(nil)
+
+	var view statusView
+	if err := json.Unmarshal(out.Bytes(), &view); err != nil {
+		t.Fatalf("Failed to parse status JSON: %v\n%s", err, out.String())
+	}
+	envs := map[string]environmentStatus{}
+	for _, env := range view.Environments {
+		envs[env.Name] = env
+	}
+
+	if dev := envs["dev"]; !dev.Drifted || dev.PendingRebuild || dev.StaleLock {
+		t.Errorf("Expected dev drifted only, got %+v", dev)
+	}
+	if qa := envs["qa"]; qa.Drifted || !qa.PendingRebuild || !qa.StaleLock {
+		t.Errorf("Expected qa pending rebuild with a stale lock, got %+v", qa)
+	}
+	for _, branch := range view.Branches {
+		if want := branch.Name == "feature/built"; branch.EligibleForCleanup != want {
+			t.Errorf("Expected %s eligible_for_cleanup=%t, got %t", branch.Name, want, branch.EligibleForCleanup)
+		}
+	}
+
+	human := captureStdout(t, func() {
+		if err := runHitch(t, "status"); err != nil {
+			t.Errorf("status failed: %v", err)
+		}
+	})
+	devSection, qaSection, _ := strings.Cut(human, "Environment: qa")
+	if !strings.Contains(devSection, "Drifted:") || strings.Contains(devSection, "Pending rebuild") {
+		t.Errorf("Expected human output to show dev drifted only, got:\n%s", devSection)
+	}
+	if !strings.Contains(qaSection, "Pending rebuild") || !strings.Contains(qaSection, "(STALE)") || strings.Contains(qaSection, "Drifted:") {
+		t.Errorf("Expected human output to show qa pending with a stale lock, got:\n%s", qaSection)
+	}
+}
+
+func TestStatusOrderIsDeterministic(t *testing.T) {
+	resetFlags(rootCmd)
+
+	meta := metadata.NewMetadata([]string{"qa", "dev", "staging", "alpha"}, "main", "test@example.com")
+	features := []string{"feature/zeta", "feature/alpha", "feature/mid"}
+	for _, f := range features {
+		if err := meta.AddBranchToEnvironment("dev", f, "test@example.com"); err != nil {
+			t.Fatalf("Failed to add %s: %v", f, err)
+		}
+	}
+
+	first := captureStdout(t, func() { _ = displayHumanStatus(meta, nil, "", 0) })
+	for i := 0; i < 10; i++ {
+		if out := captureStdout(t, func() { _ = displayHumanStatus(meta, nil, "", 0) }); out != first {
+			t.Fatalf("Status output changed between runs:\n%s\nvs\n%s", first, out)
+		}
+	}
+
+	assertInOrder := func(items ...string) {
+		t.Helper()
+		last := -1
+		for _, item := range items {
+			idx := strings.Index(first, item)
+			if idx <= last {
+				t.Fatalf("Expected %q in order, got:\n%s", items, first)
+			}
+			last = idx
+		}
+	}
+	assertInOrder("Environment: alpha", "Environment: dev", "Environment: qa", "Environment: staging")
+	assertInOrder("feature/alpha", "feature/mid", "feature/zeta")
+
+	// Display sorting must not reorder the stored features; rebuilds merge in that order
+	if got := meta.Environments["dev"].Features; strings.Join(got, ",") != strings.Join(features, ",") {
+		t.Errorf("Expected stored features %v to be untouched, got %v", features, got)
+	}
+}
+
+func TestInitRepairCreatesLocalMetadataFromOrigin(t *testing.T) {
+	tr := newHitchRepo(t)
+	addBareRemote(t, tr)
+
+	remoteTip := gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch)
+
+	// Simulate a fresh clone: metadata exists on origin only
+	gitOutput(t, tr.Path, "branch", "-D", metadata.MetadataBranch)
+
+	if err := runHitch(t, "init", "--repair"); err != nil {
+		t.Fatalf("init --repair failed: %v", err)
+	}
+
+	if got := gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch); got != remoteTip {
+		t.Errorf("Expected local metadata at origin's %s, got %s", remoteTip, got)
+	}
+	if meta := readMetadata(t, tr); len(meta.Environments) != 2 {
+		t.Errorf("Expected existing environments to be kept, got %v", meta.Environments)
+	}
+
+	// Running it again is a no-op
+	if err := runHitch(t, "init", "--repair"); err != nil {
+		t.Fatalf("second init --repair failed: %v", err)
+	}
+	if got := gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch); got != remoteTip {
+		t.Errorf("Expected repeat repair to leave metadata at %s, got %s", remoteTip, got)
+	}
+}
+
+func TestInitRepairRestoresCorruptedMetadataFromExport(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	export := filepath.Join(t.TempDir(), "hitch-export.json")
+	data, err := exec.Command("git", "-C", tr.Path, "show", metadata.MetadataBranch+":"+metadata.MetadataFile).Output()
+	if err != nil {
+		t.Fatalf("Failed to export metadata: %v", err)
+	}
+	if err := os.WriteFile(export, data, 0644); err != nil {
+		t.Fatalf("Failed to write export: %v", err)
+	}
+
+	// Corrupt hitch.json with a new commit on the metadata branch
+	gitOutput(t, tr.Path, "checkout", metadata.MetadataBranch)
+	if err := tr.CommitFile(metadata.MetadataFile, "{not json", "Corrupt metadata"); err != nil {
+		t.Fatalf("Failed to corrupt metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	corrupted := gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch)
+
+	if err := runHitch(t, "init", "--repair"); err == nil {
+		t.Fatal("Expected repair without an export to fail on corrupted metadata")
+	}
+
+	if err := runHitch(t, "init", "--repair", "--from-export", export); err != nil {
+		t.Fatalf("init --repair --from-export failed: %v", err)
+	}
+
+	if meta := readMetadata(t, tr); len(meta.Environments) != 2 {
+		t.Errorf("Expected restored environments, got %v", meta.Environments)
+	}
+	if parent := gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch+"~1"); parent != corrupted {
+		t.Errorf("Expected repair to build on existing history (%s), got parent %s", corrupted, parent)
+	}
+	if branch, _ := tr.GetCurrentBranch(); branch != "main" {
+		t.Errorf("Expected to be back on main, got %s", branch)
+	}
+}
+
+func TestMutatingCommandsRefuseDuringMerge(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/blocked", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+
+	gitOutput(t, tr.Path, "checkout", "-b", "feature/wip")
+	if err := tr.CommitFile("README.md", "wip change\n", "Change README on wip"); err != nil {
+		t.Fatalf("Failed to commit on wip: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := tr.CommitFile("README.md", "main change\n", "Change README on main"); err != nil {
+		t.Fatalf("Failed to commit on main: %v", err)
+	}
+	if err := tr.Repo.Merge("feature/wip", ""); err == nil {
+		t.Fatal("Expected merge to conflict")
+	}
+
+	metaBefore := gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch)
+
+	for _, args := range [][]string{
+		{"promote", "feature/blocked", "to", "dev"},
+		{"demote", "feature/blocked", "from", "dev"},
+		{"rebuild", "dev"},
+		{"release", "feature/blocked"},
+	} {
+		err := runHitch(t, args...)
+		var inProgress *hitchgit.InProgressOperationError
+		if !errors.As(err, &inProgress) || inProgress.Operation != "merge" {
+			t.Errorf("%v: expected InProgressOperationError for merge, got %v", args, err)
+		}
+	}
+
+	if got := gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch); got != metaBefore {
+		t.Error("Expected metadata to be untouched while a merge is in progress")
+	}
+	if _, ok := tr.Repo.InProgressOperation(); !ok {
+		t.Error("Expected the user's merge to be left in progress")
+	}
+}
+
+func TestReleaseRetainDaysOverride(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("hotfix/keep", true); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	if err := runHitch(t, "promote", "hotfix/keep", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	before := time.Now()
+	if err := runHitch(t, "release", "hotfix/keep", "--retain-days", "30"); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+
+	info := readMetadata(t, tr).Branches["hotfix/keep"]
+	if info.RetentionDays == nil || *info.RetentionDays != 30 {
+		t.Fatalf("Expected retention override of 30 days, got %v", info.RetentionDays)
+	}
+	if info.EligibleForCleanupAt == nil {
+		t.Fatal("Expected a cleanup date")
+	}
+
+	want := before.Add(30 * 24 * time.Hour)
+	if diff := info.EligibleForCleanupAt.Sub(want); diff < 0 || diff > time.Minute {
+		t.Errorf("Expected cleanup around %v, got %v", want, *info.EligibleForCleanupAt)
+	}
+
+	if err := runHitch(t, "release", "hotfix/keep", "--retain-days", "-2"); err == nil {
+		t.Error("Expected negative --retain-days to be rejected")
+	}
+}
+
+func TestReleaseChangelogEntry(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CommitFile("RELEASES.md", "- 2025-01-01: feature/old (released by someone@example.com)\n", "Add release log"); err != nil {
+		t.Fatalf("Failed to add release log: %v", err)
+	}
+	if err := tr.CreateBranch("feature/noted", true); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	if err := runHitch(t, "promote", "feature/noted", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	if err := runHitch(t, "release", "feature/noted", "--changelog", "RELEASES.md"); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+
+	content := gitOutput(t, tr.Path, "show", "main:RELEASES.md")
+	lines := strings.Split(content, "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected the new entry above the old one, got:\n%s", content)
+	}
+	if !strings.Contains(lines[0], "feature/noted") || !strings.Contains(lines[0], "test@example.com") {
+		t.Errorf("Expected entry for feature/noted by test@example.com, got %q", lines[0])
+	}
+	if !strings.Contains(lines[1], "feature/old") {
+		t.Errorf("Expected the old entry to be kept, got %q", lines[1])
+	}
+
+	// The entry is part of the merge commit itself
+	parents := strings.Fields(gitOutput(t, tr.Path, "rev-list", "--parents", "-n", "1", "main"))
+	if len(parents) != 3 {
+		t.Errorf("Expected main to be a merge commit, got %v", parents)
+	}
+	if changed := gitOutput(t, tr.Path, "diff", "--name-only", "main^1", "main"); !strings.Contains(changed, "RELEASES.md") {
+		t.Errorf("Expected the merge commit to include RELEASES.md, got %q", changed)
+	}
+
+	if err := runHitch(t, "release", "feature/noted", "--changelog", "../outside.md"); err == nil {
+		t.Error("Expected a changelog path outside the repository to be rejected")
+	}
+}
+
+func TestFreezeBlocksPromoteButNotStatus(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/frozen", true); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+
+	if err := runHitch(t, "freeze"); err == nil {
+		t.Error("Expected freeze without --reason to fail")
+	}
+	if err := runHitch(t, "freeze", "--reason", "CI migration"); err != nil {
+		t.Fatalf("freeze failed: %v", err)
+	}
+
+	err := runHitch(t, "promote", "feature/frozen", "to", "dev")
+	var frozen *metadata.FrozenError
+	if !errors.As(err, &frozen) || frozen.Reason != "CI migration" {
+		t.Fatalf("Expected FrozenError for promote, got %v", err)
+	}
+	if features := readMetadata(t, tr).Environments["dev"].Features; len(features) != 0 {
+		t.Errorf("Expected dev to be unchanged while frozen, got %v", features)
+	}
+
+	out := captureStdout(t, func() {
+		if err := runHitch(t, "status"); err != nil {
+			t.Errorf("status failed while frozen: %v", err)
+		}
+	})
+	if !strings.Contains(out, "Maintenance mode: CI migration") {
+		t.Errorf("Expected status to show maintenance mode, got:\n%s", out)
+	}
+
+	// Only the freezer can unfreeze without --force
+	gitOutput(t, tr.Path, "config", "user.email", "other@example.com")
+	if err := runHitch(t, "unfreeze"); err == nil {
+		t.Error("Expected unfreeze by another user to fail")
+	}
+	if err := runHitch(t, "unfreeze", "--force"); err != nil {
+		t.Fatalf("unfreeze --force failed: %v", err)
+	}
+
+	if err := runHitch(t, "promote", "feature/frozen", "to", "dev"); err != nil {
+		t.Fatalf("promote after unfreeze failed: %v", err)
+	}
+}
+
+func TestLockContextRoundTripsAndAppearsInLockError(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	const jobURL = "https://ci.example.com/jobs/42"
+	if err := runHitch(t, "lock", "qa", "--reason", "Deploying", "--context", jobURL); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+
+	qa := readMetadata(t, tr).Environments["qa"]
+	if qa.LockedContext != jobURL {
+		t.Errorf("Expected lock context %q, got %q", jobURL, qa.LockedContext)
+	}
+	host, _ := os.Hostname()
+	if qa.LockedHost != host {
+		t.Errorf("Expected lock host %q, got %q", host, qa.LockedHost)
+	}
+
+	gitOutput(t, tr.Path, "config", "user.email", "other@example.com")
+	err := runHitch(t, "rebuild", "qa")
+	var locked *metadata.EnvironmentLockedError
+	if !errors.As(err, &locked) {
+		t.Fatalf("Expected EnvironmentLockedError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), jobURL) || !strings.Contains(err.Error(), host) {
+		t.Errorf("Expected lock error to name the host and context, got %q", err.Error())
+	}
+
+	// Unlocking clears the context
+	if err := runHitch(t, "unlock", "qa", "--force"); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	if qa := readMetadata(t, tr).Environments["qa"]; qa.LockedContext != "" || qa.LockedHost != "" {
+		t.Errorf("Expected unlock to clear host and context, got %q / %q", qa.LockedHost, qa.LockedContext)
+	}
+}
+
+func TestRebuildFeaturesFromFile(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, name := range []string{"feature/old", "feature/first", "feature/second", "fix/#123"} {
+		if err := tr.CreateBranch(name, true); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+	if err := runHitch(t, "promote", "feature/old", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "dev.features")
+	content := "# dev environment\nfeature/second\n\nfeature/first  # depends on nothing\nfix/#123 #issue\n"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write feature file: %v", err)
+	}
+
+	if err := runHitch(t, "rebuild", "dev", "--features-from", file); err != nil {
+		t.Fatalf("rebuild --features-from failed: %v", err)
+	}
+
+	meta := readMetadata(t, tr)
+	if got := meta.Environments["dev"].Features; strings.Join(got, ",") != "feature/second,feature/first,fix/#123" {
+		t.Errorf("Expected features from the file in order, got %v", got)
+	}
+	if promoted := meta.Branches["feature/old"].PromotedTo; len(promoted) != 0 {
+		t.Errorf("Expected feature/old to be demoted from dev, got promoted_to %v", promoted)
+	}
+	for _, name := range []string{"feature/first", "feature/second", "fix/#123"} {
+		if merged, err := tr.Repo.IsAncestor(name, "dev"); err != nil || !merged {
+			t.Errorf("Expected %s to be merged into dev", name)
+		}
+	}
+
+	if err := os.WriteFile(file, []byte("feature/first\nfeature/missing\n"), 0644); err != nil {
+		t.Fatalf("Failed to write feature file: %v", err)
+	}
+	err := runHitch(t, "rebuild", "dev", "--features-from", file)
+	var notFound *metadata.BranchNotFoundError
+	if !errors.As(err, &notFound) {
+		t.Errorf("Expected BranchNotFoundError for a missing branch, got %v", err)
+	}
+
+	// A rebuild that stops on a conflict leaves the recorded list alone
+	for _, name := range []string{"feature/left", "feature/right"} {
+		gitOutput(t, tr.Path, "checkout", "-b", name, "main")
+		if err := tr.CommitFile("shared.txt", name+"\n", "Edit shared.txt on "+name); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := os.WriteFile(file, []byte("feature/left\nfeature/right\n"), 0644); err != nil {
+		t.Fatalf("Failed to write feature file: %v", err)
+	}
+	if err := runHitch(t, "rebuild", "dev", "--features-from", file); err == nil {
+		t.Fatal("Expected the rebuild to stop on a conflict")
+	}
+	if got := readMetadata(t, tr).Environments["dev"].Features; strings.Join(got, ",") != "feature/second,feature/first,fix/#123" {
+		t.Errorf("Expected a failed rebuild to keep the old feature list, got %v", got)
+	}
+
+	// Continuing the stopped rebuild records the file's list
+	gitOutput(t, tr.Path, "checkout", "feature/right")
+	gitOutput(t, tr.Path, "merge", "-X", "ours", "--no-edit", "feature/left")
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "rebuild", "dev", "--continue"); err != nil {
+		t.Fatalf("rebuild --continue failed: %v", err)
+	}
+	if got := readMetadata(t, tr).Environments["dev"].Features; strings.Join(got, ",") != "feature/left,feature/right" {
+		t.Errorf("Expected --continue to record the feature file's list, got %v", got)
+	}
+}
+
+func TestCurrentFeatureBranchDetection(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/here", true); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+
+	// On main, there is no branch to default to
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "promote", "to", "dev"); err == nil {
+		t.Error("Expected promote without a branch to fail on main")
+	}
+
+	// On a feature branch, promote defaults to it
+	gitOutput(t, tr.Path, "checkout", "feature/here")
+	if err := runHitch(t, "promote", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote to dev failed: %v", err)
+	}
+	if err := runHitch(t, "promote", "to", "qa", "--no-rebuild"); err != nil {
+		t.Fatalf("promote to qa failed: %v", err)
+	}
+	if envs := readMetadata(t, tr).EnvironmentsContaining("feature/here"); strings.Join(envs, ",") != "dev,qa" {
+		t.Fatalf("Expected feature/here in dev and qa, got %v", envs)
+	}
+
+	out := captureStdout(t, func() {
+		if err := runHitch(t, "status"); err != nil {
+			t.Errorf("status failed: %v", err)
+		}
+	})
+	if !strings.Contains(out, "You are on feature/here, which is in: dev, qa") {
+		t.Errorf("Expected status to note the current branch's environments, got:\n%s", out)
+	}
+}
+
+func TestRebuildCloneLeavesSourceUntouched(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/isolated", true); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	if err := runHitch(t, "promote", "feature/isolated", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "feature/isolated")
+
+	// Every branch but the rebuilt one and metadata
+	branches := func() string {
+		var kept []string
+		for _, line := range strings.Split(gitOutput(t, tr.Path, "for-each-ref", "--format=%(refname:short) %(objectname)", "refs/heads/"), "\n") {
+			if !strings.HasPrefix(line, "dev ") && !strings.HasPrefix(line, metadata.MetadataBranch+" ") {
+				kept = append(kept, line)
+			}
+		}
+		return strings.Join(kept, "\n")
+	}
+	headBefore := gitOutput(t, tr.Path, "symbolic-ref", "HEAD")
+	branchesBefore := branches()
+
+	if err := runHitch(t, "rebuild", "dev", "--clone"); err != nil {
+		t.Fatalf("rebuild --clone failed: %v", err)
+	}
+
+	if head := gitOutput(t, tr.Path, "symbolic-ref", "HEAD"); head != headBefore {
+		t.Errorf("Expected HEAD to stay %s, got %s", headBefore, head)
+	}
+	if temp := gitOutput(t, tr.Path, "branch", "--list", "dev-hitch-temp"); temp != "" {
+		t.Errorf("Expected no temp branch in the source repository, got %q", temp)
+	}
+	if after := branches(); after != branchesBefore {
+		t.Errorf("Expected branches other than dev unchanged, was:\n%s\nnow:\n%s", branchesBefore, after)
+	}
+
+	// The rebuilt branch was copied back and recorded
+	if merged, err := tr.Repo.IsAncestor("feature/isolated", "dev"); err != nil || !merged {
+		t.Errorf("Expected feature/isolated to be merged into dev")
+	}
+	dev := strings.TrimSpace(gitOutput(t, tr.Path, "rev-parse", "dev"))
+	if recorded := readMetadata(t, tr).Environments["dev"].LastRebuildCommit; recorded != dev {
+		t.Errorf("Expected last rebuild commit %s, got %s", dev, recorded)
+	}
+}
+
+func TestRebuildCloneUpdatesCheckedOutBranch(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	gitOutput(t, tr.Path, "checkout", "-b", "feature/onto-dev", "main")
+	if err := tr.CommitFile("onto-dev.txt", "onto dev\n", "Add onto-dev.txt"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "rebuild", "dev"); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if err := runHitch(t, "promote", "feature/onto-dev", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "dev")
+	before := readMetadata(t, tr).Environments["dev"].LastRebuildCommit
+
+	// Uncommitted changes on the checked-out branch are refused up front
+	if err := os.WriteFile(filepath.Join(tr.Path, "README.md"), []byte("local edit\n"), 0644); err != nil {
+		t.Fatalf("Failed to edit README.md: %v", err)
+	}
+	if err := runHitch(t, "rebuild", "dev", "--clone"); err == nil {
+		t.Fatal("Expected rebuild --clone to refuse uncommitted changes on dev")
+	}
+	if recorded := readMetadata(t, tr).Environments["dev"].LastRebuildCommit; recorded != before {
+		t.Errorf("Expected the refused rebuild not to be recorded, got %s", recorded)
+	}
+	if data, _ := os.ReadFile(filepath.Join(tr.Path, "README.md")); string(data) != "local edit\n" {
+		t.Errorf("Expected the local edit to be kept, got %q", data)
+	}
+	gitOutput(t, tr.Path, "checkout", "--", "README.md")
+
+	// With a clean checkout, the branch and its worktree both move
+	if err := runHitch(t, "rebuild", "dev", "--clone"); err != nil {
+		t.Fatalf("rebuild --clone failed: %v", err)
+	}
+	if head := gitOutput(t, tr.Path, "symbolic-ref", "--short", "HEAD"); head != "dev" {
+		t.Errorf("Expected to stay on dev, got %s", head)
+	}
+	gitOutput(t, tr.Path, "merge-base", "--is-ancestor", "feature/onto-dev", "dev")
+	if _, err := os.Stat(filepath.Join(tr.Path, "onto-dev.txt")); err != nil {
+		t.Errorf("Expected the worktree to have onto-dev.txt: %v", err)
+	}
+	if status := gitOutput(t, tr.Path, "status", "--porcelain"); status != "" {
+		t.Errorf("Expected a clean worktree, got:\n%s", status)
+	}
+}
+
+func TestReleaseToEnvironmentBase(t *testing.T) {
+	tr := testutil.NewTestRepo(t)
+	t.Chdir(tr.Path)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	gitOutput(t, tr.Path, "branch", "backend-main", "main")
+
+	// As set up by: hitch init --environments dev,backend-dev --env-base backend-dev=backend-main
+	envList := []string{"dev", "backend-dev"}
+	envBases, err := parseEnvironmentBases("backend-dev=backend-main", envList)
+	if err != nil {
+		t.Fatalf("Failed to parse --env-base: %v", err)
+	}
+	if _, err := parseEnvironmentBases("qa=backend-main", envList); err == nil {
+		t.Error("Expected --env-base for an unknown environment to be rejected")
+	}
+	meta := metadata.NewMetadata(envList, "main", "test@example.com")
+	for env, base := range envBases {
+		if err := meta.SetEnvironmentBase(env, base); err != nil {
+			t.Fatalf("Failed to set base: %v", err)
+		}
+	}
+	if err := tr.InitMetadata(meta); err != nil {
+		t.Fatalf("Failed to initialize metadata: %v", err)
+	}
+
+	for _, name := range []string{"feature/frontend", "feature/backend", "feature/both"} {
+		if err := tr.CreateBranch(name, true); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+	promotions := [][]string{
+		{"feature/frontend", "dev"},
+		{"feature/backend", "backend-dev"},
+		{"feature/both", "dev"},
+		{"feature/both", "backend-dev"},
+	}
+	for _, p := range promotions {
+		if err := runHitch(t, "promote", p[0], "to", p[1], "--no-rebuild"); err != nil {
+			t.Fatalf("promote %s to %s failed: %v", p[0], p[1], err)
+		}
+	}
+
+	// Each feature is released to its environment's base
+	mainBefore := strings.TrimSpace(gitOutput(t, tr.Path, "rev-parse", "main"))
+	if err := runHitch(t, "release", "feature/backend"); err != nil {
+		t.Fatalf("release feature/backend failed: %v", err)
+	}
+	if merged, err := tr.Repo.IsAncestor("feature/backend", "backend-main"); err != nil || !merged {
+		t.Error("Expected feature/backend to be released to backend-main")
+	}
+	if main := strings.TrimSpace(gitOutput(t, tr.Path, "rev-parse", "main")); main != mainBefore {
+		t.Error("Expected main to be untouched by a backend release")
+	}
+
+	if err := runHitch(t, "release", "feature/frontend"); err != nil {
+		t.Fatalf("release feature/frontend failed: %v", err)
+	}
+	if merged, err := tr.Repo.IsAncestor("feature/frontend", "main"); err != nil || !merged {
+		t.Error("Expected feature/frontend to be released to main")
+	}
+
+	meta = readMetadata(t, tr)
+	if into := meta.Branches["feature/backend"].MergedInto; into != "backend-main" {
+		t.Errorf("Expected feature/backend merged into backend-main, got %q", into)
+	}
+	if into := meta.Branches["feature/frontend"].MergedInto; into != "main" {
+		t.Errorf("Expected feature/frontend merged into main, got %q", into)
+	}
+
+	// A feature in environments with different bases needs --base
+	if err := runHitch(t, "release", "feature/both"); err == nil {
+		t.Error("Expected release to refuse an ambiguous base")
+	}
+	if err := runHitch(t, "release", "feature/both", "--base", "backend-main"); err != nil {
+		t.Fatalf("release --base failed: %v", err)
+	}
+	if merged, err := tr.Repo.IsAncestor("feature/both", "backend-main"); err != nil || !merged {
+		t.Error("Expected feature/both to be released to backend-main")
+	}
+}
+
+func TestRebuildContinueDoesNotRemergeFeatures(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, name := range []string{"feature/first", "feature/left", "feature/right"} {
+		file := "shared.txt"
+		if name == "feature/first" {
+			file = "first.txt"
+		}
+		gitOutput(t, tr.Path, "checkout", "-b", name, "main")
+		if err := tr.CommitFile(file, name+"\n", "Edit "+file+" on "+name); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+		gitOutput(t, tr.Path, "checkout", "main")
+		if err := runHitch(t, "promote", name, "to", "dev", "--no-rebuild"); err != nil {
+			t.Fatalf("promote %s failed: %v", name, err)
+		}
+	}
+
+	// feature/right conflicts with feature/left: the rebuild stops and keeps
+	// what it merged so far
+	if err := runHitch(t, "rebuild", "dev"); err == nil {
+		t.Fatal("Expected the rebuild to stop on the conflict")
+	}
+	stateFile := filepath.Join(tr.Path, ".git", "hitch-rebuild-state.json")
+	if _, err := os.Stat(stateFile); err != nil {
+		t.Fatalf("Expected the rebuild state to be saved: %v", err)
+	}
+	gitOutput(t, tr.Path, "rev-parse", "--verify", "dev-hitch-temp")
+
+	if err := runHitch(t, "rebuild", "dev"); err == nil {
+		t.Error("Expected a new rebuild to be refused while one is stopped")
+	}
+
+	// Resolve the conflict on the feature, then continue
+	gitOutput(t, tr.Path, "checkout", "feature/right")
+	gitOutput(t, tr.Path, "merge", "-X", "ours", "--no-edit", "feature/left")
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	if err := runHitch(t, "rebuild", "dev", "--continue"); err != nil {
+		t.Fatalf("rebuild --continue failed: %v", err)
+	}
+
+	for _, feature := range []string{"feature/first", "feature/left", "feature/right"} {
+		gitOutput(t, tr.Path, "merge-base", "--is-ancestor", feature, "dev")
+	}
+	merges := gitOutput(t, tr.Path, "log", "--merges", "--format=%s", "dev")
+	for _, feature := range []string{"feature/first", "feature/left"} {
+		if n := strings.Count(merges, "'"+feature+"' into dev-hitch-temp"); n != 1 {
+			t.Errorf("Expected %s to be merged once, got %d merges:\n%s", feature, n, merges)
+		}
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Error("Expected the rebuild state to be cleared after --continue")
+	}
+	if err := exec.Command("git", "-C", tr.Path, "rev-parse", "--verify", "dev-hitch-temp").Run(); err == nil {
+		t.Error("Expected the temp branch to be gone after --continue")
+	}
+
+	// --abort throws a stopped rebuild away and leaves dev alone
+	gitOutput(t, tr.Path, "checkout", "-b", "feature/clash", "main")
+	if err := tr.CommitFile("first.txt", "clash\n", "Clash with feature/first"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "promote", "feature/clash", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote feature/clash failed: %v", err)
+	}
+	devTip := gitOutput(t, tr.Path, "rev-parse", "dev")
+	if err := runHitch(t, "rebuild", "dev"); err == nil {
+		t.Fatal("Expected the rebuild to stop on the conflict")
+	}
+	if err := runHitch(t, "rebuild", "dev", "--abort"); err != nil {
+		t.Fatalf("rebuild --abort failed: %v", err)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Error("Expected the rebuild state to be cleared after --abort")
+	}
+	if err := exec.Command("git", "-C", tr.Path, "rev-parse", "--verify", "dev-hitch-temp").Run(); err == nil {
+		t.Error("Expected --abort to delete the temp branch")
+	}
+	if got := gitOutput(t, tr.Path, "rev-parse", "dev"); got != devTip {
+		t.Errorf("Expected --abort to leave dev at %s, got %s", devTip, got)
+	}
+}
+
+func TestRebuildContinueRefusesMovedBranches(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, name := range []string{"feature/left", "feature/right"} {
+		gitOutput(t, tr.Path, "checkout", "-b", name, "main")
+		if err := tr.CommitFile("shared.txt", name+"\n", "Edit shared.txt on "+name); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+		gitOutput(t, tr.Path, "checkout", "main")
+		if err := runHitch(t, "promote", name, "to", "dev", "--no-rebuild"); err != nil {
+			t.Fatalf("promote %s failed: %v", name, err)
+		}
+	}
+	if err := runHitch(t, "rebuild", "dev"); err == nil {
+		t.Fatal("Expected the rebuild to stop on the conflict")
+	}
+	gitOutput(t, tr.Path, "checkout", "feature/right")
+	gitOutput(t, tr.Path, "merge", "-X", "ours", "--no-edit", "feature/left")
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	// feature/left is on the temp branch at its old commit
+	left := gitOutput(t, tr.Path, "rev-parse", "feature/left")
+	gitOutput(t, tr.Path, "checkout", "feature/left")
+	if err := tr.CommitFile("left.txt", "more\n", "More work on feature/left"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "rebuild", "dev", "--continue"); err == nil || !strings.Contains(err.Error(), "out of date") {
+		t.Errorf("Expected --continue to refuse a merged feature that moved, got %v", err)
+	}
+	gitOutput(t, tr.Path, "branch", "-f", "feature/left", left)
+
+	// The temp branch was started from the old main
+	base := gitOutput(t, tr.Path, "rev-parse", "main")
+	if err := tr.CommitFile("base.txt", "new\n", "New work on main"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if err := runHitch(t, "rebuild", "dev", "--continue"); err == nil || !strings.Contains(err.Error(), "out of date") {
+		t.Errorf("Expected --continue to refuse a base that moved, got %v", err)
+	}
+	gitOutput(t, tr.Path, "reset", "--hard", base)
+
+	// With both back where they were, it continues
+	if err := runHitch(t, "rebuild", "dev", "--continue"); err != nil {
+		t.Fatalf("rebuild --continue failed: %v", err)
+	}
+	gitOutput(t, tr.Path, "merge-base", "--is-ancestor", "feature/right", "dev")
+}
+
+func TestAuthorOverrideAttributesCommits(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/ci", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	// The environment variables stand in for the flags in CI
+	t.Setenv("HITCH_AUTHOR_NAME", "Dev Eloper")
+	t.Setenv("HITCH_AUTHOR_EMAIL", "dev@example.com")
+	if err := runHitch(t, "promote", "feature/ci", "to", "dev"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	if got := gitOutput(t, tr.Path, "log", "-1", "--format=%an <%ae>", "hitch-metadata"); got != "Dev Eloper <dev@example.com>" {
+		t.Errorf("Expected the metadata commit to be authored by the override, got %q", got)
+	}
+	if got := gitOutput(t, tr.Path, "log", "-1", "--format=%an <%ae>", "dev"); got != "Dev Eloper <dev@example.com>" {
+		t.Errorf("Expected the merge commit to be authored by the override, got %q", got)
+	}
+	if got := gitOutput(t, tr.Path, "log", "-1", "--format=%ce", "dev"); got != "test@example.com" {
+		t.Errorf("Expected the committer to stay the git user, got %q", got)
+	}
+	if dev := readMetadata(t, tr).Environments["dev"]; len(dev.Features) != 1 {
+		t.Fatalf("Expected feature/ci in dev, got %v", dev.Features)
+	}
+
+	// Flags win over the environment
+	if err := runHitch(t, "lock", "qa", "--author-name", "Flag User", "--author-email", "flag@example.com"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if got := readMetadata(t, tr).Environments["qa"].LockedBy; got != "flag@example.com" {
+		t.Errorf("Expected qa to be locked by the flag identity, got %q", got)
+	}
+	if got := gitOutput(t, tr.Path, "log", "-1", "--format=%an", "hitch-metadata"); got != "Flag User" {
+		t.Errorf("Expected the lock commit to be authored by Flag User, got %q", got)
+	}
+}
+
+func TestShallowCloneWarns(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	warned := func(args ...string) bool {
+		stderr := captureStderr(t, func() { _ = runHitch(t, args...) })
+		return strings.Contains(stderr, "shallow clone")
+	}
+
+	if warned("rebuild", "dev") {
+		t.Error("Expected no shallow clone warning in a full repository")
+	}
+
+	// Cut history at the root commit, as a --depth clone would
+	root := gitOutput(t, tr.Path, "rev-list", "--max-parents=0", "main")
+	if err := os.WriteFile(filepath.Join(tr.Path, ".git", "shallow"), []byte(root+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to mark the repository shallow: %v", err)
+	}
+
+	if !warned("rebuild", "dev") {
+		t.Error("Expected rebuild to warn about the shallow clone")
+	}
+	if !warned("doctor") {
+		t.Error("Expected doctor to report the shallow clone")
+	}
+}
+
+func TestBulkLockIsAllOrNothing(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	meta := readMetadata(t, tr)
+	if err := meta.LockEnvironment("qa", "other@example.com", "Deploying"); err != nil {
+		t.Fatalf("Failed to lock qa: %v", err)
+	}
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Lock qa", "Other", "other@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	before := gitOutput(t, tr.Path, "rev-parse", "hitch-metadata")
+
+	// qa is locked by someone else, so dev is released again
+	if err := runHitch(t, "lock", "dev", "qa", "--reason", "Maintenance"); err == nil {
+		t.Fatal("Expected locking dev and qa to fail")
+	}
+	if readMetadata(t, tr).Environments["dev"].Locked {
+		t.Error("Expected dev to be rolled back when qa couldn't be locked")
+	}
+	if after := gitOutput(t, tr.Path, "rev-parse", "hitch-metadata"); after != before {
+		t.Error("Expected a failed bulk lock not to write metadata")
+	}
+
+	// Unlocking is all-or-nothing too
+	if err := runHitch(t, "lock", "dev"); err != nil {
+		t.Fatalf("lock dev failed: %v", err)
+	}
+	if err := runHitch(t, "unlock", "dev", "qa"); err == nil {
+		t.Fatal("Expected unlocking qa, locked by someone else, to fail")
+	}
+	if !readMetadata(t, tr).Environments["dev"].Locked {
+		t.Error("Expected dev to stay locked when qa couldn't be unlocked")
+	}
+	if err := runHitch(t, "unlock", "dev", "qa", "--force"); err != nil {
+		t.Fatalf("unlock --force failed: %v", err)
+	}
+
+	// Both lock in a single metadata commit
+	before = gitOutput(t, tr.Path, "rev-parse", "hitch-metadata")
+	if err := runHitch(t, "lock", "dev", "qa", "--reason", "Maintenance"); err != nil {
+		t.Fatalf("lock dev qa failed: %v", err)
+	}
+	for _, name := range []string{"dev", "qa"} {
+		if env := readMetadata(t, tr).Environments[name]; !env.Locked || env.LockedReason != "Maintenance" {
+			t.Errorf("Expected %s to be locked for maintenance, got %+v", name, env)
+		}
+	}
+	if parent := gitOutput(t, tr.Path, "rev-parse", "hitch-metadata~1"); parent != before {
+		t.Error("Expected both locks in a single metadata commit")
+	}
+}
+
+func TestRebuildIfOutdated(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/nightly", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "promote", "feature/nightly", "to", "dev"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	// Nothing changed: no rebuild and no metadata commit
+	devTip := gitOutput(t, tr.Path, "rev-parse", "dev")
+	metaTip := gitOutput(t, tr.Path, "rev-parse", "hitch-metadata")
+	var err error
+	output := captureStdout(t, func() { err = runHitch(t, "rebuild", "dev", "--if-outdated") })
+	if err != nil {
+		t.Fatalf("rebuild --if-outdated failed: %v", err)
+	}
+	if !strings.Contains(output, "dev is up to date") {
+		t.Errorf("Expected an up-to-date message, got:\n%s", output)
+	}
+	if got := gitOutput(t, tr.Path, "rev-parse", "dev"); got != devTip {
+		t.Error("Expected an up-to-date dev not to be rebuilt")
+	}
+	if got := gitOutput(t, tr.Path, "rev-parse", "hitch-metadata"); got != metaTip {
+		t.Error("Expected an up-to-date rebuild not to write metadata")
+	}
+
+	// A new commit on the feature makes dev outdated
+	gitOutput(t, tr.Path, "checkout", "feature/nightly")
+	if err := tr.CommitFile("nightly.txt", "more\n", "More work"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	output = captureStdout(t, func() { err = runHitch(t, "rebuild", "dev", "--if-outdated") })
+	if err != nil {
+		t.Fatalf("rebuild --if-outdated failed: %v", err)
+	}
+	if !strings.Contains(output, "feature/nightly has commits dev doesn't") {
+		t.Errorf("Expected the outdated feature to be reported, got:\n%s", output)
+	}
+	gitOutput(t, tr.Path, "merge-base", "--is-ancestor", "feature/nightly", "dev")
+}
+
+func TestStatusSectionFlags(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/sections", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "promote", "feature/sections", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	output := captureStdout(t, func() { _ = runHitch(t, "status", "--environments-only") })
+	// The branch table lists each branch with its environments
+	if !strings.Contains(output, "Environment: dev") || strings.Contains(output, "feature/sections  dev") {
+		t.Errorf("Expected only environments, got:\n%s", output)
+	}
+
+	output = captureStdout(t, func() { _ = runHitch(t, "status", "--branches-only") })
+	if !strings.Contains(output, "feature/sections  dev") || strings.Contains(output, "Environment:") {
+		t.Errorf("Expected only the branch table, got:\n%s", output)
+	}
+
+	jsonKeys := func(args ...string) []string {
+		var out bytes.Buffer
+		rootCmd.SetOut(&out)
+		defer rootCmd.SetOut(nil)
+		if err := runHitch(t, append([]string{"status", "--json"}, args...)...); err != nil {
+			t.Fatalf("status --json %v failed: %v", args, err)
+		}
+		var view map[string]json.RawMessage
+		if err := json.Unmarshal(out.Bytes(), &view); err != nil {
+			t.Fatalf("Failed to parse status JSON: %v\n%s", err, out.String())
+		}
+		keys := make([]string, 0, len(view))
+		for key := range view {
+			keys = append(keys, key)
+		}
+		return keys
+	}
+	if keys := jsonKeys("--environments-only"); len(keys) != 1 || keys[0] != "environments" {
+		t.Errorf("Expected only environments in JSON, got %v", keys)
+	}
+	if keys := jsonKeys("--branches-only"); len(keys) != 1 || keys[0] != "branches" {
+		t.Errorf("Expected only branches in JSON, got %v", keys)
+	}
+
+	if err := runHitch(t, "status", "--environments-only", "--branches-only"); err == nil {
+		t.Error("Expected --environments-only and --branches-only together to fail")
+	}
+}
+
+func TestRebuildShowsProgress(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	features := []string{"feature/one", "feature/two", "feature/three"}
+	for _, name := range features {
+		if err := tr.CreateBranch(name, true); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		gitOutput(t, tr.Path, "checkout", "main")
+		if err := runHitch(t, "promote", name, "to", "dev", "--no-rebuild"); err != nil {
+			t.Fatalf("promote %s failed: %v", name, err)
+		}
+	}
+
+	output := captureStdout(t, func() {
+		if err := runHitch(t, "rebuild", "dev"); err != nil {
+			t.Errorf("rebuild failed: %v", err)
+		}
+	})
+	for i, name := range features {
+		if want := fmt.Sprintf("[%d/3] Merging %s...", i+1, name); !strings.Contains(output, want) {
+			t.Errorf("Expected %q in output:\n%s", want, output)
+		}
+	}
+	if !strings.Contains(output, "Took ") {
+		t.Errorf("Expected an elapsed time summary, got:\n%s", output)
+	}
+
+	// --json keeps progress out of its human output
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	defer rootCmd.SetOut(nil)
+	stderr := captureStderr(t, func() {
+		if err := runHitch(t, "rebuild", "dev", "--json"); err != nil {
+			t.Errorf("rebuild --json failed: %v", err)
+		}
+	})
+	if strings.Contains(stderr, "Merging feature/one...") {
+		t.Errorf("Expected no progress counters with --json, got:\n%s", stderr)
+	}
+}
+
+func TestReleaseClosesGitLabMergeRequest(t *testing.T) {
+	var requests []string
+	var comment string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.EscapedPath())
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(`[{"iid": 42, "web_url": "` + "http://" + r.Host + `/group/app/-/merge_requests/42"}]`))
+		case http.MethodPost:
+			r.ParseForm()
+			comment = r.PostForm.Get("body")
+			w.Write([]byte(`{}`))
+		case http.MethodPut:
+			r.ParseForm()
+			if r.PostForm.Get("state_event") != "close" {
+				t.Errorf("Expected state_event=close, got %q", r.PostForm.Get("state_event"))
+			}
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	tr := testutil.NewTestRepo(t)
+	t.Chdir(tr.Path)
+	t.Setenv("GITLAB_TOKEN", "secret")
+
+	meta := metadata.NewMetadata([]string{"dev", "qa"}, "main", "test@example.com")
+	meta.Config.GitLab = &metadata.GitLabConfig{ProjectID: "group/app", BaseURL: server.URL}
+	if err := tr.InitMetadata(meta); err != nil {
+		t.Fatalf("Failed to initialize metadata: %v", err)
+	}
+
+	if err := tr.CreateBranch("feature/mr", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "promote", "feature/mr", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	// No origin remote, so only the GitLab API is contacted
+	if err := runHitch(t, "release", "feature/mr"); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+
+	want := []string{
+		"GET /api/v4/projects/group%2Fapp/merge_requests",
+		"POST /api/v4/projects/group%2Fapp/merge_requests/42/notes",
+		"PUT /api/v4/projects/group%2Fapp/merge_requests/42",
+	}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected requests:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(requests, "\n"))
+	}
+	if !strings.Contains(comment, "Released to `main`") {
+		t.Errorf("Expected a release comment, got %q", comment)
+	}
+
+	// A missing token only warns; the release itself still succeeds
+	t.Setenv("GITLAB_TOKEN", "")
+	requests = nil
+	if err := tr.CreateBranch("feature/no-token", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "promote", "feature/no-token", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	if err := runHitch(t, "release", "feature/no-token"); err != nil {
+		t.Errorf("Expected release without a token to succeed, got %v", err)
+	}
+	if len(requests) != 0 {
+		t.Errorf("Expected no GitLab requests without a token, got %v", requests)
+	}
+}
+
+// fakeForge records the pull request calls release makes
+type fakeForge struct {
+	calls     []string
+	onClose   func()
+	noPRs     bool
+	closeFail error
+}
+
+func (f *fakeForge) Name() string { return "fake pull request" }
+
+func (f *fakeForge) CommentOnPR(branch string, body string) error {
+	f.calls = append(f.calls, "comment "+branch)
+	if f.noPRs {
+		return forge.ErrNoPullRequest
+	}
+	return nil
+}
+
+func (f *fakeForge) ClosePR(branch string) error {
+	f.calls = append(f.calls, "close "+branch)
+	if f.onClose != nil {
+		f.onClose()
+	}
+	return f.closeFail
+}
+
+func (f *fakeForge) CheckAccess() error { return nil }
+
+func TestReleaseUsesForge(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "")
+
+	fake := &fakeForge{}
+	original := newForge
+	newForge = func(metadata.Config) (forge.Forge, error) { return fake, nil }
+	defer func() { newForge = original }()
+
+	if err := tr.CreateBranch("feature/pr", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "promote", "feature/pr", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	// A dry run must not touch the pull request
+	if err := runHitch(t, "release", "feature/pr", "--dry-run"); err != nil {
+		t.Fatalf("release --dry-run failed: %v", err)
+	}
+	if len(fake.calls) != 0 {
+		t.Fatalf("Expected no forge calls on a dry run, got %v", fake.calls)
+	}
+
+	// The pull request is closed only once the release is in metadata
+	fake.onClose = func() {
+		meta := readMetadata(t, tr)
+		if meta.Branches["feature/pr"].MergedToMainAt == nil {
+			t.Error("Expected the release to be recorded before the pull request is closed")
+		}
+	}
+	if err := runHitch(t, "release", "feature/pr"); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	if got := strings.Join(fake.calls, ", "); got != "comment feature/pr, close feature/pr" {
+		t.Errorf("Expected a comment then a close, got %q", got)
+	}
+
+	// Failing to close only warns
+	fake.calls = nil
+	fake.onClose = nil
+	fake.closeFail = fmt.Errorf("boom")
+	if err := tr.CreateBranch("feature/pr-fail", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "promote", "feature/pr-fail", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	if err := runHitch(t, "release", "feature/pr-fail"); err != nil {
+		t.Errorf("Expected a forge failure not to fail the release, got %v", err)
+	}
+	if len(fake.calls) != 2 {
+		t.Errorf("Expected a comment and a close attempt, got %v", fake.calls)
+	}
+}
+
+func TestInitEmptyRepository(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "--initial-branch=main"},
+		{"config", "user.name", "Test User"},
+		{"config", "user.email", "test@example.com"},
+	} {
+		gitOutput(t, dir, args...)
+	}
+	t.Chdir(dir)
+
+	output := captureStdout(t, func() {
+		err := runHitch(t, "init")
+		if err == nil || !strings.Contains(err.Error(), "no commits") {
+			t.Errorf("Expected a no-commits error, got %v", err)
+		}
+	})
+	if !strings.Contains(output, "Commit something first, then run hitch init") {
+		t.Errorf("Expected a hint to commit first, got:\n%s", output)
+	}
+	if out := gitOutput(t, dir, "branch", "--list", metadata.MetadataBranch); out != "" {
+		t.Errorf("Expected no hitch-metadata branch, got %q", out)
+	}
+
+	// Once there is a commit, init leaves the working tree and branch alone
+	gitOutput(t, dir, "commit", "--allow-empty", "-m", "Initial commit")
+	if err := runHitch(t, "init"); err != nil {
+		t.Fatalf("init failed after committing: %v", err)
+	}
+	if branch := gitOutput(t, dir, "rev-parse", "--abbrev-ref", "HEAD"); branch != "main" {
+		t.Errorf("Expected to stay on main, got %s", branch)
+	}
+	if status := gitOutput(t, dir, "status", "--porcelain"); status != "" {
+		t.Errorf("Expected a clean working tree, got:\n%s", status)
+	}
+	if files := gitOutput(t, dir, "ls-tree", "--name-only", metadata.MetadataBranch); files != metadata.MetadataFile {
+		t.Errorf("Expected hitch-metadata to hold only %s, got %q", metadata.MetadataFile, files)
+	}
+	if parents := gitOutput(t, dir, "rev-list", "--parents", "-n", "1", metadata.MetadataBranch); strings.Contains(parents, " ") {
+		t.Errorf("Expected hitch-metadata to be an orphan, got %q", parents)
+	}
+}
+
+func TestStatusCompact(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, feature := range []string{"feature/one", "feature/two"} {
+		if err := tr.CreateBranch(feature, true); err != nil {
+			t.Fatalf("Failed to create %s: %v", feature, err)
+		}
+		gitOutput(t, tr.Path, "checkout", "main")
+		if err := runHitch(t, "promote", feature, "to", "dev", "--no-rebuild"); err != nil {
+			t.Fatalf("promote %s failed: %v", feature, err)
+		}
+	}
+
+	output := captureStdout(t, func() {
+		if err := runHitch(t, "status", "--compact"); err != nil {
+			t.Fatalf("status --compact failed: %v", err)
+		}
+	})
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected one line per environment, got:\n%s", output)
+	}
+	if !strings.HasPrefix(lines[0], "dev  [unlocked]  2 features  never built") || !strings.Contains(lines[0], "pending rebuild") {
+		t.Errorf("Unexpected dev line: %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "qa   [unlocked]  0 features") {
+		t.Errorf("Unexpected qa line: %q", lines[1])
+	}
+	if strings.Contains(output, "feature/one") {
+		t.Errorf("Expected compact output to hide features, got:\n%s", output)
+	}
+
+	output = captureStdout(t, func() {
+		if err := runHitch(t, "status", "--compact", "--env", "qa"); err != nil {
+			t.Fatalf("status --compact --env qa failed: %v", err)
+		}
+	})
+	if lines := strings.Split(strings.TrimRight(output, "\n"), "\n"); len(lines) != 1 || !strings.HasPrefix(lines[0], "qa  ") {
+		t.Errorf("Expected only the qa line, got:\n%s", output)
+	}
+
+	if err := runHitch(t, "status", "--compact", "--branches-only"); err == nil {
+		t.Error("Expected --compact --branches-only to be rejected")
+	}
+}
+
+func TestPromoteRespectsOthersLock(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	meta := readMetadata(t, tr)
+	if err := meta.LockEnvironment("dev", "alice@example.com", "deploying"); err != nil {
+		t.Fatalf("Failed to lock dev: %v", err)
+	}
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Lock dev", "Alice", "alice@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	if err := tr.CreateBranch("feature/locked", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	devBefore := gitOutput(t, tr.Path, "for-each-ref", "refs/heads/dev")
+
+	var lockedErr *metadata.EnvironmentLockedError
+	if err := runHitch(t, "promote", "feature/locked", "to", "dev"); !errors.As(err, &lockedErr) {
+		t.Fatalf("Expected an EnvironmentLockedError, got %v", err)
+	}
+	if devAfter := gitOutput(t, tr.Path, "for-each-ref", "refs/heads/dev"); devAfter != devBefore {
+		t.Error("Expected dev not to be rebuilt while alice holds the lock")
+	}
+	if dev := readMetadata(t, tr).Environments["dev"]; !dev.Locked || dev.LockedBy != "alice@example.com" {
+		t.Errorf("Expected alice to keep the lock, got locked=%v by %q", dev.Locked, dev.LockedBy)
+	}
+
+	// A stale lock isn't taken over silently either; that needs rebuild --force
+	meta = readMetadata(t, tr)
+	dev := meta.Environments["dev"]
+	dev.LockedAt = time.Now().Add(-2 * time.Hour)
+	meta.Environments["dev"] = dev
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Age lock", "Alice", "alice@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	if err := runHitch(t, "rebuild", "dev"); !errors.As(err, &lockedErr) {
+		t.Fatalf("Expected rebuild to refuse a stale lock without --force, got %v", err)
+	}
+	if err := runHitch(t, "demote", "feature/locked", "from", "dev"); !errors.As(err, &lockedErr) {
+		t.Fatalf("Expected demote's rebuild to refuse a stale lock, got %v", err)
+	}
+	if devAfter := gitOutput(t, tr.Path, "for-each-ref", "refs/heads/dev"); devAfter != devBefore {
+		t.Error("Expected dev not to be rebuilt over a stale lock")
+	}
+}
+
+func TestReleaseDeleteBranch(t *testing.T) {
+	tr := newHitchRepo(t)
+	remote := addBareRemote(t, tr)
+
+	if err := tr.CreateBranch("feature/short-lived", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "push", "origin", "feature/short-lived")
+
+	// Release from the feature branch itself, which can't be returned to
+	t.Setenv("HITCH_OFFLINE", "1")
+	if err := runHitch(t, "promote", "feature/short-lived", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "feature/short-lived")
+	gitOutput(t, tr.Path, "push", "origin", metadata.MetadataBranch)
+	t.Setenv("HITCH_OFFLINE", "")
+
+	if err := runHitch(t, "release", "feature/short-lived", "--delete-branch"); err != nil {
+		t.Fatalf("release --delete-branch failed: %v", err)
+	}
+
+	if out := gitOutput(t, tr.Path, "branch", "--list", "feature/short-lived"); out != "" {
+		t.Errorf("Expected the local branch to be deleted, got %q", out)
+	}
+	if out := gitOutput(t, remote, "branch", "--list", "feature/short-lived"); out != "" {
+		t.Errorf("Expected the remote branch to be deleted, got %q", out)
+	}
+	if _, tracked := readMetadata(t, tr).Branches["feature/short-lived"]; tracked {
+		t.Error("Expected the branch to be removed from metadata")
+	}
+	if branch := gitOutput(t, tr.Path, "rev-parse", "--abbrev-ref", "HEAD"); branch != "main" {
+		t.Errorf("Expected to end up on main, got %s", branch)
+	}
+
+	// Environment and base branches are never deleted
+	if err := runHitch(t, "release", "main", "--delete-branch"); err == nil || !strings.Contains(err.Error(), "protected") {
+		t.Errorf("Expected --delete-branch to refuse the base branch, got %v", err)
+	}
+	if err := runHitch(t, "release", "feature/short-lived", "--delete-branch", "--no-delete"); err == nil {
+		t.Error("Expected --delete-branch --no-delete to be rejected")
+	}
+}
+
+func TestSetupSetsMissingEmail(t *testing.T) {
+	tr := newHitchRepo(t)
+	gitOutput(t, tr.Path, "config", "--unset", "user.email")
+
+	realStdin, realIsTerminal := os.Stdin, stdinIsTerminal
+	defer func() { os.Stdin, stdinIsTerminal = realStdin, realIsTerminal }()
+
+	stdinIsTerminal = func() bool { return false }
+	output := captureStdout(t, func() {
+		if err := runHitch(t, "setup"); err == nil {
+			t.Error("Expected setup without --email to fail when not interactive")
+		}
+	})
+	if !strings.Contains(output, "hitch setup --email") {
+		t.Errorf("Expected a hint to run hitch setup --email, got:\n%s", output)
+	}
+
+	if err := runHitch(t, "setup", "--email", "not-an-email"); err == nil {
+		t.Error("Expected an invalid email to be rejected")
+	}
+	if err := runHitch(t, "setup", "--email", "dev@example.com"); err != nil {
+		t.Fatalf("setup --email failed: %v", err)
+	}
+	if email := gitOutput(t, tr.Path, "config", "user.email"); email != "dev@example.com" {
+		t.Errorf("Expected user.email dev@example.com, got %q", email)
+	}
+
+	// Interactively, setup asks for the missing email and a name
+	gitOutput(t, tr.Path, "config", "--unset", "user.email")
+	answers := filepath.Join(t.TempDir(), "answers")
+	if err := os.WriteFile(answers, []byte("Asked@Example.com\nAsked Person\n"), 0644); err != nil {
+		t.Fatalf("Failed to write answers: %v", err)
+	}
+	stdin, err := os.Open(answers)
+	if err != nil {
+		t.Fatalf("Failed to open answers: %v", err)
+	}
+	defer stdin.Close()
+	os.Stdin, stdinIsTerminal = stdin, func() bool { return true }
+
+	if err := runHitch(t, "setup"); err != nil {
+		t.Fatalf("interactive setup failed: %v", err)
+	}
+	if email := gitOutput(t, tr.Path, "config", "user.email"); email != "Asked@Example.com" {
+		t.Errorf("Expected user.email Asked@Example.com, got %q", email)
+	}
+	if name := gitOutput(t, tr.Path, "config", "user.name"); name != "Asked Person" {
+		t.Errorf("Expected user.name Asked Person, got %q", name)
+	}
+}
+
+func TestRebuildSkipsNoOpMerges(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	// feature/released is already merged into main; feature/picked's change
+	// was cherry-picked onto main, so merging it changes nothing either
+	if err := tr.CreateBranch("feature/released", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	gitOutput(t, tr.Path, "merge", "--no-ff", "-m", "Merge feature/released", "feature/released")
+
+	if err := tr.CreateBranch("feature/picked", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	gitOutput(t, tr.Path, "cherry-pick", "-x", "feature/picked")
+
+	if err := tr.CreateBranch("feature/new", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	for _, feature := range []string{"feature/released", "feature/picked", "feature/new"} {
+		if err := runHitch(t, "promote", feature, "to", "dev", "--no-rebuild"); err != nil {
+			t.Fatalf("promote %s failed: %v", feature, err)
+		}
+	}
+
+	output := captureStdout(t, func() {
+		if err := runHitch(t, "rebuild", "dev"); err != nil {
+			t.Fatalf("rebuild failed: %v", err)
+		}
+	})
+
+	for _, feature := range []string{"feature/released", "feature/picked"} {
+		if !strings.Contains(output, feature+" already included (no changes)") {
+			t.Errorf("Expected %s to be reported as a no-op, got:\n%s", feature, output)
+		}
+	}
+
+	// Only feature/new got a merge commit on top of main
+	merges := gitOutput(t, tr.Path, "log", "--merges", "--format=%s", "main..dev")
+	if merges != "Merge branch 'feature/new' into dev-hitch-temp" {
+		t.Errorf("Expected a single merge commit for feature/new, got:\n%s", merges)
+	}
+
+	// Without a merge commit, feature/picked still counts as merged
+	output = captureStdout(t, func() {
+		if err := runHitch(t, "rebuild", "dev", "--if-outdated"); err != nil {
+			t.Fatalf("rebuild --if-outdated failed: %v", err)
+		}
+	})
+	if !strings.Contains(output, "dev is up to date") {
+		t.Errorf("Expected dev to be up to date, got:\n%s", output)
+	}
+
+	// Until it moves
+	gitOutput(t, tr.Path, "checkout", "feature/picked")
+	if err := tr.CommitFile("picked-more.txt", "more\n", "More on feature/picked"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	output = captureStdout(t, func() {
+		if err := runHitch(t, "rebuild", "dev", "--if-outdated"); err != nil {
+			t.Fatalf("rebuild --if-outdated failed: %v", err)
+		}
+	})
+	if !strings.Contains(output, "feature/picked has commits dev doesn't") {
+		t.Errorf("Expected feature/picked to make dev outdated, got:\n%s", output)
+	}
+	gitOutput(t, tr.Path, "merge-base", "--is-ancestor", "feature/picked", "dev")
+}
+
+func TestBareRepository(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/server", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "promote", "feature/server", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	bare := filepath.Join(t.TempDir(), "app.git")
+	gitOutput(t, tr.Path, "clone", "--quiet", "--bare", tr.Path, bare)
+	gitOutput(t, bare, "config", "user.name", "Server")
+	gitOutput(t, bare, "config", "user.email", "server@example.com")
+
+	output := captureStdout(t, func() {
+		if err := runHitch(t, "-C", bare, "status", "--compact"); err != nil {
+			t.Fatalf("status in a bare repository failed: %v", err)
+		}
+	})
+	if !strings.Contains(output, "dev  [unlocked]  1 feature") {
+		t.Errorf("Expected status to read the bare repository's metadata, got:\n%s", output)
+	}
+
+	// Rebuilds merge in a clone and write metadata without a working tree
+	if err := runHitch(t, "-C", bare, "rebuild", "dev"); err != nil {
+		t.Fatalf("rebuild in a bare repository failed: %v", err)
+	}
+	gitOutput(t, bare, "merge-base", "--is-ancestor", "feature/server", "dev")
+
+	repo, err := hitchgit.OpenRepo(bare)
+	if err != nil {
+		t.Fatalf("Failed to open bare repository: %v", err)
+	}
+	meta, err := metadata.NewReader(repo.Repository).Read()
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	dev := meta.Environments["dev"]
+	if dev.Locked || dev.LastRebuildCommit != gitOutput(t, bare, "rev-parse", "dev") {
+		t.Errorf("Expected an unlocked dev recording the rebuild, got locked=%v commit=%q", dev.Locked, dev.LastRebuildCommit)
+	}
+
+	if err := runHitch(t, "-C", bare, "release", "feature/server"); err == nil {
+		t.Error("Expected release to refuse a bare repository")
+	}
+}
+
+func TestPromoteDryRunJSON(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	gitOutput(t, tr.Path, "checkout", "-b", "feature/clean")
+	if err := tr.CommitFile("clean.txt", "clean\n", "Add clean file"); err != nil {
+		t.Fatalf("Failed to commit on feature: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	gitOutput(t, tr.Path, "checkout", "-b", "feature/clash")
+	if err := tr.CommitFile("README.md", "feature change\n", "Change README on feature"); err != nil {
+		t.Fatalf("Failed to commit on feature: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := tr.CommitFile("README.md", "main change\n", "Change README on main"); err != nil {
+		t.Fatalf("Failed to commit on main: %v", err)
+	}
+
+	metaBefore := gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch)
+
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	t.Cleanup(func() { rootCmd.SetOut(nil) })
+
+	check := func(branch string) (map[string]interface{}, error) {
+		out.Reset()
+		err := runHitch(t, "promote", branch, "to", "dev", "--dry-run", "--json")
+		var result map[string]interface{}
+		if jsonErr := json.Unmarshal(out.Bytes(), &result); jsonErr != nil {
+			t.Fatalf("Expected a single JSON object for %s: %v\n%s", branch, jsonErr, out.String())
+		}
+		return result, err
+	}
+
+	result, err := check("feature/clean")
+	if err != nil {
+		t.Fatalf("Expected a mergeable branch to succeed: %v", err)
+	}
+	if result["branch"] != "feature/clean" || result["environment"] != "dev" || result["mergeable"] != true {
+		t.Errorf("Unexpected result for a mergeable branch: %v", result)
+	}
+	if conflicts, ok := result["conflicts"].([]interface{}); !ok || len(conflicts) != 0 {
+		t.Errorf("Expected an empty conflicts list, got %v", result["conflicts"])
+	}
+
+	result, err = check("feature/clash")
+	if err == nil {
+		t.Error("Expected a conflicting branch to fail")
+	}
+	if result["mergeable"] != false {
+		t.Errorf("Expected mergeable false, got %v", result)
+	}
+	if conflicts, ok := result["conflicts"].([]interface{}); !ok || len(conflicts) != 1 || conflicts[0] != "README.md" {
+		t.Errorf("Expected README.md to conflict, got %v", result["conflicts"])
+	}
+
+	if got := gitOutput(t, tr.Path, "rev-parse", metadata.MetadataBranch); got != metaBefore {
+		t.Errorf("Expected metadata unchanged at %s, got %s", metaBefore, got)
+	}
+	if status := gitOutput(t, tr.Path, "status", "--porcelain"); status != "" {
+		t.Errorf("Expected a clean worktree, got:\n%s", status)
+	}
+}
+
+func TestPromoteRequiresUpToDate(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	meta := readMetadata(t, tr)
+	meta.Config.RequireUpToDate = true
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Require up to date", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+
+	if err := tr.CreateBranch("feature/stale", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := tr.CommitFile("main.txt", "moved on\n", "Move main ahead"); err != nil {
+		t.Fatalf("Failed to commit on main: %v", err)
+	}
+
+	if err := runHitch(t, "promote", "feature/stale", "to", "dev", "--no-rebuild"); err == nil {
+		t.Fatal("Expected promote to refuse a feature behind main")
+	}
+	if slices.Contains(readMetadata(t, tr).Environments["dev"].Features, "feature/stale") {
+		t.Fatal("Expected the refused feature not to be added to dev")
+	}
+
+	if err := runHitch(t, "promote", "feature/stale", "to", "dev", "--no-rebuild", "--force"); err != nil {
+		t.Fatalf("promote --force failed: %v", err)
+	}
+	if !slices.Contains(readMetadata(t, tr).Environments["dev"].Features, "feature/stale") {
+		t.Error("Expected --force to add the feature to dev")
+	}
+
+	// Once rebased, no override is needed
+	gitOutput(t, tr.Path, "checkout", "-b", "feature/fresh")
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "promote", "feature/fresh", "to", "dev", "--no-rebuild"); err != nil {
+		t.Errorf("Expected an up-to-date feature to be promoted: %v", err)
+	}
+}
+
+func TestMergedFeatureStillInEnvironmentIsFlagged(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/done", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	if err := tr.CommitFile("done.txt", "done\n", "Finish feature"); err != nil {
+		t.Fatalf("Failed to commit on feature: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "promote", "feature/done", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	if err := runHitch(t, "release", "feature/done"); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+
+	// Re-added by hand after the release
+	if err := runHitch(t, "promote", "feature/done", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("re-promote failed: %v", err)
+	}
+	if readMetadata(t, tr).Branches["feature/done"].MergedToMainAt == nil {
+		t.Fatal("Expected the branch to stay marked as merged")
+	}
+
+	output := captureStdout(t, func() {
+		if err := runHitch(t, "status"); err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+	})
+	if !strings.Contains(output, "feature/done (already merged to main)") {
+		t.Errorf("Expected status to flag the merged feature, got:\n%s", output)
+	}
+
+	var hint string
+	warnings := captureStderr(t, func() {
+		hint = captureStdout(t, func() {
+			if err := runHitch(t, "doctor"); err == nil {
+				t.Error("Expected doctor to report the merged feature")
+			}
+		})
+	})
+	if !strings.Contains(warnings, "feature/done is already merged to main but is still in dev") {
+		t.Errorf("Expected doctor to flag the merged feature, got:\n%s", warnings)
+	}
+	if !strings.Contains(hint, "hitch demote feature/done from dev") {
+		t.Errorf("Expected doctor to suggest demoting it, got:\n%s", hint)
+	}
+}
+
+func TestWebhooksScopedToEnvironment(t *testing.T) {
+	tr := newHitchRepo(t)
+
+	var hits []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.URL.Path)
+	}))
+	defer server.Close()
+
+	meta := readMetadata(t, tr)
+	meta.Config.NotificationWebhooks = []metadata.Webhook{
+		{URL: server.URL + "/qa", Events: []string{"rebuild"}, Environments: []string{"qa"}},
+		{URL: server.URL + "/dev", Events: []string{"rebuild"}, Environments: []string{"dev"}},
+	}
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Configure webhooks", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+
+	if err := runHitch(t, "rebuild", "dev"); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if !slices.Equal(hits, []string{"/dev"}) {
+		t.Errorf("Expected only the dev webhook to fire for a dev rebuild, got %v", hits)
+	}
+
+	// Offline, nothing is sent
+	hits = nil
+	t.Setenv("HITCH_OFFLINE", "1")
+	if err := runHitch(t, "rebuild", "dev"); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if len(hits) != 0 {
+		t.Errorf("Expected no webhooks offline, got %v", hits)
+	}
+}
+
+func TestLockAndUnlockSendWebhooks(t *testing.T) {
+	tr := newHitchRepo(t)
+
+	var events []notify.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event notify.Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("Failed to decode webhook body: %v", err)
+		}
+		events = append(events, event)
+	}))
+	defer server.Close()
+
+	meta := readMetadata(t, tr)
+	meta.Config.NotificationWebhooks = []metadata.Webhook{
+		{URL: server.URL, Events: []string{"lock", "unlock"}},
+	}
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Configure webhooks", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+
+	if err := runHitch(t, "lock", "dev", "--reason", "Testing"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if err := runHitch(t, "unlock", "dev"); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("Expected a lock and an unlock event, got %+v", events)
+	}
+	if events[0].Event != notify.EventLock || events[0].Environment != "dev" || !strings.Contains(events[0].Message, "Testing") {
+		t.Errorf("Unexpected lock event: %+v", events[0])
+	}
+	if events[1].Event != notify.EventUnlock || events[1].Environment != "dev" {
+		t.Errorf("Unexpected unlock event: %+v", events[1])
+	}
+}
+
+func TestCleanupKeepsBranchWhenRemoteDeleteFails(t *testing.T) {
+	tr := newHitchRepo(t)
+	remote := addBareRemote(t, tr)
+
+	retryDelays := hitchgit.RemoteRetryDelays
+	hitchgit.RemoteRetryDelays = []time.Duration{time.Millisecond}
+	t.Cleanup(func() { hitchgit.RemoteRetryDelays = retryDelays })
+
+	// feature/pushed is on origin; feature/local never was
+	for _, branch := range []string{"feature/pushed", "feature/local"} {
+		gitOutput(t, tr.Path, "branch", branch)
+	}
+	gitOutput(t, tr.Path, "push", "origin", "feature/pushed")
+
+	meta := readMetadata(t, tr)
+	past := time.Now().Add(-48 * time.Hour)
+	for _, branch := range []string{"feature/pushed", "feature/local"} {
+		meta.Branches[branch] = metadata.BranchInfo{PromotedTo: []string{}, MergedToMainAt: &past, EligibleForCleanupAt: &past}
+	}
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Fixture", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	gitOutput(t, tr.Path, "push", "origin", metadata.MetadataBranch)
+
+	// An unreachable origin keeps both branches and their metadata
+	gitOutput(t, tr.Path, "remote", "set-url", "origin", filepath.Join(t.TempDir(), "gone.git"))
+	if err := runHitch(t, "cleanup", "--force"); err == nil {
+		t.Fatal("Expected cleanup to fail when origin is unreachable")
+	}
+	meta = readMetadata(t, tr)
+	for _, branch := range []string{"feature/pushed", "feature/local"} {
+		if _, tracked := meta.Branches[branch]; !tracked {
+			t.Errorf("Expected %s to stay tracked", branch)
+		}
+		if !tr.Repo.BranchExists(branch) {
+			t.Errorf("Expected local %s to be kept", branch)
+		}
+	}
+
+	// Reachable again: the pushed branch is deleted on origin, and the one
+	// that was never pushed is deleted without complaint
+	gitOutput(t, tr.Path, "remote", "set-url", "origin", remote)
+	if err := runHitch(t, "cleanup", "--force"); err != nil {
+		t.Fatalf("cleanup failed: %v", err)
+	}
+	if meta := readMetadata(t, tr); len(meta.Branches) != 0 {
+		t.Errorf("Expected both branches to be untracked, got %v", meta.Branches)
+	}
+	if refs := gitOutput(t, remote, "for-each-ref", "refs/heads/feature"); refs != "" {
+		t.Errorf("Expected no feature branches on origin, got:\n%s", refs)
+	}
+	if tr.Repo.BranchExists("feature/local") {
+		t.Error("Expected the local branch to be deleted")
+	}
+}
+
+func TestGraph(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, branch := range []string{"feature/shared", "feature/dev-only"} {
+		gitOutput(t, tr.Path, "branch", branch)
+	}
+	for _, args := range [][]string{
+		{"promote", "feature/shared", "to", "dev", "--no-rebuild"},
+		{"promote", "feature/shared", "to", "qa", "--no-rebuild"},
+		{"promote", "feature/dev-only", "to", "dev", "--no-rebuild"},
+	} {
+		if err := runHitch(t, args...); err != nil {
+			t.Fatalf("%v failed: %v", args, err)
+		}
+	}
+
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	t.Cleanup(func() { rootCmd.SetOut(nil) })
+
+	if err := runHitch(t, "graph"); err != nil {
+		t.Fatalf("graph failed: %v", err)
+	}
+	for _, want := range []string{
+		`"env:dev" [label="dev", shape=box];`,
+		`"env:qa" [label="qa", shape=box];`,
+		`"feature:feature/shared" [label="feature/shared", shape=ellipse, style=filled, fillcolor=lightyellow];`,
+		`"feature:feature/dev-only" [label="feature/dev-only", shape=ellipse];`,
+		`"base:main" -> "env:dev" [style=dashed];`,
+		`"feature:feature/shared" -> "env:dev";`,
+		`"feature:feature/shared" -> "env:qa";`,
+		`"feature:feature/dev-only" -> "env:dev";`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected DOT output to contain %s, got:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), `"feature:feature/dev-only" -> "env:qa"`) {
+		t.Errorf("Expected no edge from feature/dev-only to qa, got:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := runHitch(t, "graph", "--format", "mermaid"); err != nil {
+		t.Fatalf("graph --format mermaid failed: %v", err)
+	}
+	// Features sort as feature/dev-only (f0), feature/shared (f1)
+	for _, want := range []string{
+		"graph LR",
+		`e0["dev"]`,
+		`e1["qa"]`,
+		`f1(["feature/shared"])`,
+		"b0 -.-> e0",
+		"f0 --> e0",
+		"f1 --> e0",
+		"f1 --> e1",
+		"class f1 shared",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected Mermaid output to contain %s, got:\n%s", want, out.String())
+		}
+	}
+
+	if err := runHitch(t, "graph", "--format", "png"); err == nil {
+		t.Error("Expected an unknown format to fail")
+	}
+}
+
+func TestRebuildMergesSharedFeaturesFirst(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, feature := range []string{"only-dev", "x", "y"} {
+		gitOutput(t, tr.Path, "checkout", "-b", "feature/"+feature, "main")
+		if err := tr.CommitFile(feature+".txt", feature+"\n", "Add "+feature); err != nil {
+			t.Fatalf("Failed to commit on feature/%s: %v", feature, err)
+		}
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	// Promoted in different orders to each environment
+	for _, args := range [][]string{
+		{"promote", "feature/only-dev", "to", "dev", "--no-rebuild"},
+		{"promote", "feature/x", "to", "dev", "--no-rebuild"},
+		{"promote", "feature/y", "to", "dev", "--no-rebuild"},
+		{"promote", "feature/y", "to", "qa", "--no-rebuild"},
+		{"promote", "feature/x", "to", "qa", "--no-rebuild"},
+	} {
+		if err := runHitch(t, args...); err != nil {
+			t.Fatalf("%v failed: %v", args, err)
+		}
+	}
+
+	for _, env := range []string{"dev", "qa"} {
+		if err := runHitch(t, "rebuild", env); err != nil {
+			t.Fatalf("rebuild %s failed: %v", env, err)
+		}
+	}
+
+	// dev merges x and y before only-dev, so the commit before its last
+	// merge holds exactly what qa does
+	if dev, qa := gitOutput(t, tr.Path, "rev-parse", "dev~1^{tree}"), gitOutput(t, tr.Path, "rev-parse", "qa^{tree}"); dev != qa {
+		t.Errorf("Expected dev's shared features to produce qa's tree %s, got %s", qa, dev)
+	}
+	for env, want := range map[string]string{"dev": "feature/only-dev", "qa": "feature/y"} {
+		if got := gitOutput(t, tr.Path, "rev-parse", env+"^2"); got != gitOutput(t, tr.Path, "rev-parse", want) {
+			t.Errorf("Expected %s to merge %s last", env, want)
+		}
+	}
+
+	// The stored feature lists keep their promotion order
+	if got := readMetadata(t, tr).Environments["qa"].Features; !slices.Equal(got, []string{"feature/y", "feature/x"}) {
+		t.Errorf("Expected qa's features unchanged, got %v", got)
+	}
+}
+
+func TestJSONOutputFile(t *testing.T) {
+	newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "artifacts", "stage-1", "status.json")
+
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	t.Cleanup(func() {
+		rootCmd.SetOut(nil)
+		resetFlags(rootCmd)
+	})
+
+	stdout := captureStdout(t, func() {
+		if err := runHitch(t, "status", "--json", "--output", path); err != nil {
+			t.Fatalf("status --json --output failed: %v", err)
+		}
+	})
+	if out.Len() != 0 || stdout != "" {
+		t.Errorf("Expected nothing on stdout, got %q / %q", out.String(), stdout)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected the output file to be created: %v", err)
+	}
+	var status map[string]interface{}
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatalf("Invalid JSON in output file: %v\n%s", err, data)
+	}
+	if _, ok := status["environments"]; !ok {
+		t.Errorf("Expected environments in the status JSON, got %v", status)
+	}
+
+	// Failures write their error envelope to the file too
+	errPath := filepath.Join(dir, "error.json")
+	if err := runHitch(t, "rebuild", "staging", "--json", "--output", errPath); err == nil {
+		t.Fatal("Expected rebuild of an unknown environment to fail")
+	}
+	if data, err := os.ReadFile(errPath); err != nil || !strings.Contains(string(data), `"error"`) {
+		t.Errorf("Expected an error envelope in the output file, got %q (%v)", data, err)
+	}
+
+	if err := runHitch(t, "status", "--output", path); err == nil {
+		t.Error("Expected --output without --json to fail")
+	}
+}
+
+func TestDemoteFromEveryEnvironment(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, feature := range []string{"gone", "stays"} {
+		gitOutput(t, tr.Path, "checkout", "-b", "feature/"+feature, "main")
+		if err := tr.CommitFile(feature+".txt", feature+"\n", "Add "+feature); err != nil {
+			t.Fatalf("Failed to commit on feature/%s: %v", feature, err)
+		}
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	for _, args := range [][]string{
+		{"promote", "feature/gone", "to", "dev"},
+		{"promote", "feature/gone", "to", "qa"},
+		{"promote", "feature/stays", "to", "dev"},
+	} {
+		if err := runHitch(t, args...); err != nil {
+			t.Fatalf("%v failed: %v", args, err)
+		}
+	}
+
+	if err := runHitch(t, "demote", "feature/gone", "--force"); err != nil {
+		t.Fatalf("demote without an environment failed: %v", err)
+	}
+
+	meta := readMetadata(t, tr)
+	for _, env := range []string{"dev", "qa"} {
+		if slices.Contains(meta.Environments[env].Features, "feature/gone") {
+			t.Errorf("Expected feature/gone to be removed from %s", env)
+		}
+		if err := exec.Command("git", "-C", tr.Path, "merge-base", "--is-ancestor", "feature/gone", env).Run(); err == nil {
+			t.Errorf("Expected %s to be rebuilt without feature/gone", env)
+		}
+	}
+	if got := meta.Branches["feature/gone"].PromotedTo; len(got) != 0 {
+		t.Errorf("Expected feature/gone to be promoted nowhere, got %v", got)
+	}
+	if !slices.Contains(meta.Environments["dev"].Features, "feature/stays") {
+		t.Error("Expected feature/stays to stay in dev")
+	}
+	gitOutput(t, tr.Path, "merge-base", "--is-ancestor", "feature/stays", "dev")
+
+	if err := runHitch(t, "demote", "feature/gone", "to", "dev"); err == nil {
+		t.Error("Expected a malformed demote to fail")
+	}
+}
+
+func TestRebuildResult(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for feature, content := range map[string]string{"a": "a\n", "b": "b\n", "c": "c\n"} {
+		gitOutput(t, tr.Path, "checkout", "-b", "feature/"+feature, "main")
+		if err := tr.CommitFile("shared.txt", content, "Change shared.txt on "+feature); err != nil {
+			t.Fatalf("Failed to commit on feature/%s: %v", feature, err)
+		}
+	}
+	gitOutput(t, tr.Path, "checkout", "-b", "feature/clean", "main")
+	if err := tr.CommitFile("clean.txt", "clean\n", "Add clean.txt"); err != nil {
+		t.Fatalf("Failed to commit on feature/clean: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	meta := readMetadata(t, tr)
+	env := meta.Environments["dev"]
+	env.Features = []string{"feature/clean", "feature/a"}
+
+	result, err := performRebuild(tr.Repo, "dev", env, meta, "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("Clean rebuild failed: %v", err)
+	}
+	if !slices.Equal(result.Merged, env.Features) || len(result.Skipped) != 0 || result.Conflict != "" {
+		t.Errorf("Expected both features merged and none skipped, got %+v", result)
+	}
+	if want := gitOutput(t, tr.Path, "rev-parse", "dev"); result.Commit != want {
+		t.Errorf("Expected result commit %s, got %s", want, result.Commit)
+	}
+	if result.Duration <= 0 {
+		t.Errorf("Expected a duration, got %s", result.Duration)
+	}
+
+	// feature/b conflicts with feature/a, so c is never reached
+	env.Features = []string{"feature/clean", "feature/a", "feature/b", "feature/c"}
+	result, err = performRebuild(tr.Repo, "dev", env, meta, "test@example.com", nil)
+	if err == nil {
+		t.Fatal("Expected the conflicting rebuild to fail")
+	}
+	if result == nil {
+		t.Fatal("Expected a result for a conflicting rebuild")
+	}
+	if result.Conflict != "feature/b" || !slices.Equal(result.Merged, []string{"feature/clean", "feature/a"}) || result.Commit != "" {
+		t.Errorf("Expected a stop on feature/b after two merges and no commit, got %+v", result)
+	}
+	if status := gitOutput(t, tr.Path, "status", "--porcelain"); status != "" {
+		t.Errorf("Expected the conflicted merge to be aborted, got status:\n%s", status)
+	}
+
+	// --json prints the result, even for a conflict, without an error envelope
+	meta.Environments["dev"] = env
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Add features", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	t.Cleanup(func() { rootCmd.SetOut(nil) })
+
+	if err := runHitch(t, "rebuild", "dev", "--json"); err == nil {
+		t.Fatal("Expected rebuild --json to fail on the conflict")
+	}
+	var got map[string]any
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("Expected a JSON result, got %q: %v", out.String(), err)
+	}
+	if got["conflict"] != "feature/b" || got["environment"] != "dev" || got["error"] != nil {
+		t.Errorf("Expected the conflict result for dev, got %v", got)
+	}
+	if _, ok := got["duration_ms"]; !ok {
+		t.Errorf("Expected duration_ms in %v", got)
+	}
+}
+
+func TestStatusAge(t *testing.T) {
+	tr := newHitchRepo(t)
+
+	meta := readMetadata(t, tr)
+	env := meta.Environments["dev"]
+	env.Features = []string{"feature/old", "feature/new"}
+	meta.Environments["dev"] = env
+	for feature, promoted := range map[string]time.Time{
+		"feature/old": time.Now().Add(-30 * 24 * time.Hour),
+		"feature/new": time.Now().Add(-2 * time.Hour),
+	} {
+		meta.Branches[feature] = metadata.BranchInfo{
+			PromotedTo:      []string{"dev"},
+			PromotedHistory: []metadata.PromotionEvent{{Environment: "dev", PromotedAt: promoted}},
+		}
+	}
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Add features", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+
+	out := captureStdout(t, func() {
+		if err := runHitch(t, "status", "--age", "14d", "--no-git-check"); err != nil {
+			t.Errorf("status --age failed: %v", err)
+		}
+	})
+	for _, line := range strings.Split(out, "\n") {
+		flagged := strings.Contains(line, "older than 14d")
+		if strings.Contains(line, "feature/old") && !flagged {
+			t.Errorf("Expected feature/old to be flagged, got %q", line)
+		}
+		if strings.Contains(line, "feature/new") && flagged {
+			t.Errorf("Expected feature/new not to be flagged, got %q", line)
+		}
+	}
+
+	var buf bytes.Buffer
+	rootCmd.SetOut(&buf)
+	t.Cleanup(func() { rootCmd.SetOut(nil) })
+	if err := runHitch(t, "status", "--json", "--age", "14d", "--env", "dev", "--no-git-check"); err != nil {
+		t.Fatalf("status --json --age failed: %v", err)
+	}
+	var view struct {
+		Environments []struct {
+			FeatureAges []struct {
+				Name string `json:"name"`
+				Age  int64  `json:"age"`
+				Old  bool   `json:"old"`
+			} `json:"feature_ages"`
+		} `json:"environments"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &view); err != nil {
+		t.Fatalf("Failed to parse status JSON: %v", err)
+	}
+	if len(view.Environments) != 1 || len(view.Environments[0].FeatureAges) != 2 {
+		t.Fatalf("Expected ages for dev's two features, got %+v", view)
+	}
+	for _, age := range view.Environments[0].FeatureAges {
+		if age.Old != (age.Name == "feature/old") || age.Age <= 0 {
+			t.Errorf("Unexpected age for %s: %+v", age.Name, age)
+		}
+	}
+
+	if err := runHitch(t, "status", "--age", "soon"); err == nil {
+		t.Error("Expected an invalid --age to be rejected")
+	}
+}
+
+func TestCompactHistoryCommand(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/busy", true); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	for range 3 {
+		for _, args := range [][]string{
+			{"promote", "feature/busy", "to", "dev", "--no-rebuild"},
+			{"demote", "feature/busy", "from", "dev", "--no-rebuild"},
+		} {
+			if err := runHitch(t, args...); err != nil {
+				t.Fatalf("%v failed: %v", args, err)
+			}
+		}
+	}
+	if err := runHitch(t, "promote", "feature/busy", "to", "qa", "--no-rebuild"); err != nil {
+		t.Fatalf("promote to qa failed: %v", err)
+	}
+
+	if err := runHitch(t, "compact-history", "--keep", "1", "--dry-run"); err != nil {
+		t.Fatalf("compact-history --dry-run failed: %v", err)
+	}
+	if got := readMetadata(t, tr).Branches["feature/busy"].PromotedHistory; len(got) != 4 {
+		t.Fatalf("Expected --dry-run to leave 4 events, got %d", len(got))
+	}
+
+	if err := runHitch(t, "compact-history", "--keep", "1"); err != nil {
+		t.Fatalf("compact-history failed: %v", err)
+	}
+	// dev was never rebuilt, so none of its demotions are needed
+	history := readMetadata(t, tr).Branches["feature/busy"].PromotedHistory
+	if len(history) != 1 || history[0].Environment != "qa" || history[0].DemotedAt != nil {
+		t.Errorf("Expected only the active qa promotion kept, got %+v", history)
+	}
+	if branch := gitOutput(t, tr.Path, "branch", "--show-current"); branch != "main" {
+		t.Errorf("Expected to be back on main, got %s", branch)
+	}
+}
+
+func TestRebuildKeepTemp(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, feature := range []string{"a", "b"} {
+		gitOutput(t, tr.Path, "checkout", "-b", "feature/"+feature, "main")
+		if err := tr.CommitFile("shared.txt", feature+"\n", "Change shared.txt on "+feature); err != nil {
+			t.Fatalf("Failed to commit on feature/%s: %v", feature, err)
+		}
+		gitOutput(t, tr.Path, "checkout", "main")
+		if err := runHitch(t, "promote", "feature/"+feature, "to", "dev", "--no-rebuild"); err != nil {
+			t.Fatalf("promote feature/%s failed: %v", feature, err)
+		}
+	}
+	gitOutput(t, tr.Path, "checkout", "-b", "work", "main")
+
+	// A clone rebuild normally takes its temp branch with it
+	if err := runHitch(t, "rebuild", "dev", "--clone"); err == nil {
+		t.Fatal("Expected the rebuild to conflict")
+	}
+	if tr.Repo.BranchExists("dev-hitch-temp") {
+		t.Fatal("Expected no temp branch without --keep-temp")
+	}
+
+	if err := runHitch(t, "rebuild", "dev", "--clone", "--keep-temp"); err == nil {
+		t.Fatal("Expected the rebuild to conflict")
+	}
+	if !tr.Repo.BranchExists("dev-hitch-temp") {
+		t.Fatal("Expected --keep-temp to keep dev-hitch-temp")
+	}
+	if merged, err := tr.Repo.IsAncestor("feature/a", "dev-hitch-temp"); err != nil || !merged {
+		t.Errorf("Expected the kept temp branch to hold feature/a, got %v (%v)", merged, err)
+	}
+	if branch := gitOutput(t, tr.Path, "branch", "--show-current"); branch != "work" {
+		t.Errorf("Expected to stay on work, got %s", branch)
+	}
+
+	if err := runHitch(t, "rebuild", "dev", "--keep-temp", "--dry-run"); err == nil {
+		t.Error("Expected --keep-temp to be rejected with --dry-run")
+	}
+}
+
+func TestPromoteWarnsAboutSameTipFeature(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, branch := range []string{"feature/login", "feature/other"} {
+		if err := tr.CreateBranch(branch, true); err != nil {
+			t.Fatalf("Failed to create %s: %v", branch, err)
+		}
+	}
+	gitOutput(t, tr.Path, "branch", "feature/login-v2", "feature/login")
+
+	if err := runHitch(t, "promote", "feature/login", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote feature/login failed: %v", err)
+	}
+
+	stderr := captureStderr(t, func() {
+		if err := runHitch(t, "promote", "feature/login-v2", "to", "dev", "--no-rebuild"); err != nil {
+			t.Errorf("promote feature/login-v2 failed: %v", err)
+		}
+	})
+	if !strings.Contains(stderr, "feature/login-v2 is at the same commit as feature/login") {
+		t.Errorf("Expected a duplicate warning, got %q", stderr)
+	}
+	if got := readMetadata(t, tr).Environments["dev"].Features; !slices.Contains(got, "feature/login-v2") {
+		t.Errorf("Expected the duplicate to be promoted anyway, got %v", got)
+	}
+
+	stderr = captureStderr(t, func() {
+		if err := runHitch(t, "promote", "feature/other", "to", "dev", "--no-rebuild"); err != nil {
+			t.Errorf("promote feature/other failed: %v", err)
+		}
+	})
+	if strings.Contains(stderr, "same commit") {
+		t.Errorf("Expected no duplicate warning for a different tip, got %q", stderr)
+	}
+}
+
+func TestReleaseDraftAndPublish(t *testing.T) {
+	tr := newHitchRepo(t)
+	if err := tr.CreateBranch("feature/ship", true); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	if err := runHitch(t, "promote", "feature/ship", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	addBareRemote(t, tr)
+	published, _ := tr.RemoteSHA("main")
+
+	if err := runHitch(t, "release", "feature/ship", "--draft", "--delete-branch"); err == nil {
+		t.Error("Expected --draft to refuse --delete-branch")
+	}
+
+	if err := runHitch(t, "release", "feature/ship", "--draft"); err != nil {
+		t.Fatalf("release --draft failed: %v", err)
+	}
+	if got, _ := tr.RemoteSHA("main"); got != published {
+		t.Errorf("Expected the draft to leave origin/main at %s, got %s", published, got)
+	}
+	if merged, _ := tr.Repo.IsAncestor("feature/ship", "main"); !merged {
+		t.Error("Expected the draft to merge feature/ship into local main")
+	}
+	if info := readMetadata(t, tr).Branches["feature/ship"]; info.MergedToMainAt != nil || len(info.PromotedTo) != 1 {
+		t.Errorf("Expected the draft to leave metadata alone, got %+v", info)
+	}
+
+	// Another release can't land on top of the pending draft
+	if err := tr.CreateBranch("feature/next", true); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	if err := runHitch(t, "promote", "feature/next", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	if err := runHitch(t, "release", "feature/next"); err == nil {
+		t.Error("Expected a release to be refused while a draft is pending")
+	}
+
+	if err := runHitch(t, "release", "feature/ship", "--publish"); err != nil {
+		t.Fatalf("release --publish failed: %v", err)
+	}
+	if got, local := gitOutput(t, tr.Path, "--git-dir", tr.RemotePath, "rev-parse", "main"), gitOutput(t, tr.Path, "rev-parse", "main"); got != local {
+		t.Errorf("Expected publish to push main %s, origin has %s", local, got)
+	}
+	info := readMetadata(t, tr).Branches["feature/ship"]
+	if info.MergedToMainAt == nil || len(info.PromotedTo) != 0 {
+		t.Errorf("Expected publish to record the release, got %+v", info)
+	}
+
+	if err := runHitch(t, "release", "feature/next", "--publish"); err == nil {
+		t.Error("Expected --publish without a draft to fail")
+	}
+}
+
+func TestTimings(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+	if err := tr.CreateBranch("feature/timed", true); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+
+	stderr := captureStderr(t, func() {
+		if err := runHitch(t, "promote", "feature/timed", "to", "dev", "--timings"); err != nil {
+			t.Errorf("promote --timings failed: %v", err)
+		}
+	})
+
+	_, table, found := strings.Cut(stderr, "Timings:\n")
+	if !found {
+		t.Fatalf("Expected a timings table on stderr, got %q", stderr)
+	}
+	rows := map[string]bool{}
+	var sum, total time.Duration
+	for _, line := range strings.Split(strings.TrimSpace(table), "\n") {
+		fields := strings.Fields(line)
+		d, err := time.ParseDuration(fields[len(fields)-1])
+		if err != nil {
+			t.Fatalf("Unexpected timings row %q: %v", line, err)
+		}
+		name := strings.Join(fields[:len(fields)-1], " ")
+		rows[name] = true
+		if name == "total" {
+			total = d
+		} else {
+			sum += d
+		}
+	}
+	for _, phase := range []string{"read metadata", "write metadata", "merge feature/timed", "checkout main"} {
+		if !rows[phase] {
+			t.Errorf("Expected a %q phase, got %v", phase, rows)
+		}
+	}
+	// Each row is rounded to 0.1ms
+	if diff := (sum - total).Abs(); total == 0 || diff > time.Duration(len(rows))*timingPrecision {
+		t.Errorf("Expected the phases to add up to the total %s, got %s", total, sum)
+	}
+
+	if out := captureStderr(t, func() { _ = runHitch(t, "status") }); strings.Contains(out, "Timings:") {
+		t.Error("Expected no timings without --timings")
+	}
+}
+
+func TestStatusAt(t *testing.T) {
+	tr := newHitchRepo(t)
+
+	meta := readMetadata(t, tr)
+	if err := meta.AddBranchToEnvironment("dev", "feature/later", "test@example.com"); err != nil {
+		t.Fatalf("Failed to add branch: %v", err)
+	}
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Promote feature/later", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+
+	out := captureStdout(t, func() {
+		if err := runHitch(t, "status", "--at", "hitch-metadata~1"); err != nil {
+			t.Errorf("status --at failed: %v", err)
+		}
+	})
+	if strings.Contains(out, "feature/later") {
+		t.Errorf("Expected the earlier state without feature/later, got:\n%s", out)
+	}
+	if !strings.Contains(out, "Metadata as of hitch-metadata~1") {
+		t.Errorf("Expected a note about the historical state, got:\n%s", out)
+	}
+
+	out = captureStdout(t, func() {
+		if err := runHitch(t, "status"); err != nil {
+			t.Errorf("status failed: %v", err)
+		}
+	})
+	if !strings.Contains(out, "feature/later") {
+		t.Errorf("Expected the current state to list feature/later, got:\n%s", out)
+	}
+}
+
+func TestStatusHintsSyncWhenMetadataOnlyOnRemote(t *testing.T) {
+	tr := newHitchRepo(t)
+	addBareRemote(t, tr)
+
+	// Simulate a fresh clone: metadata exists on origin only
+	gitOutput(t, tr.Path, "branch", "-D", metadata.MetadataBranch)
+
+	out := captureStdout(t, func() {
+		err := runHitch(t, "status")
+		if err == nil || strings.Contains(err.Error(), "not initialized") {
+			t.Errorf("Expected a not-synced error, got %v", err)
+		}
+	})
+	if !strings.Contains(out, "hitch sync") || strings.Contains(out, "hitch init") {
+		t.Errorf("Expected a hint to run hitch sync instead of hitch init, got:\n%s", out)
+	}
+
+	t.Setenv("HITCH_OFFLINE", "")
+	if err := runHitch(t, "sync"); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if err := runHitch(t, "status"); err != nil {
+		t.Errorf("Expected status to work after sync, got %v", err)
+	}
+
+	// Without metadata anywhere, the init hint is still right
+	gitOutput(t, tr.Path, "branch", "-D", metadata.MetadataBranch)
+	gitOutput(t, tr.Path, "update-ref", "-d", "refs/remotes/origin/"+metadata.MetadataBranch)
+	out = captureStdout(t, func() {
+		if err := runHitch(t, "status"); err == nil || !strings.Contains(err.Error(), "not initialized") {
+			t.Errorf("Expected a not-initialized error, got %v", err)
+		}
+	})
+	if !strings.Contains(out, "hitch init") {
+		t.Errorf("Expected a hint to run hitch init, got:\n%s", out)
+	}
+}
+
+func TestCleanupArchivesInactiveBranches(t *testing.T) {
+	tr := newHitchRepo(t)
+	remote := addBareRemote(t, tr)
+
+	longAgo := time.Now().AddDate(0, 0, -90)
+	gitOutput(t, tr.Path, "checkout", "--quiet", "-b", "feature/abandoned")
+	commit := exec.Command("git", "-C", tr.Path, "commit", "--allow-empty", "-m", "Half-finished work")
+	commit.Env = append(os.Environ(), "GIT_COMMITTER_DATE="+longAgo.Format(time.RFC3339))
+	if output, err := commit.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to commit: %v: %s", err, output)
+	}
+	gitOutput(t, tr.Path, "checkout", "--quiet", "main")
+	gitOutput(t, tr.Path, "push", "--quiet", "origin", "feature/abandoned")
+	gitOutput(t, tr.Path, "branch", "feature/in-dev")
+	tip := gitOutput(t, tr.Path, "rev-parse", "feature/abandoned")
+
+	// Metadata says feature/active is inactive, but it has a fresh commit
+	gitOutput(t, tr.Path, "checkout", "--quiet", "-b", "feature/active")
+	gitOutput(t, tr.Path, "commit", "--allow-empty", "-m", "Still working on it")
+	gitOutput(t, tr.Path, "checkout", "--quiet", "main")
+
+	meta := readMetadata(t, tr)
+	meta.Config.InactiveBranchAction = "archive"
+	meta.Branches["feature/abandoned"] = metadata.BranchInfo{PromotedTo: []string{}, LastCommitAt: longAgo}
+	meta.Branches["feature/in-dev"] = metadata.BranchInfo{PromotedTo: []string{"dev"}, LastCommitAt: longAgo}
+	meta.Branches["feature/active"] = metadata.BranchInfo{PromotedTo: []string{}, LastCommitAt: longAgo}
+	env := meta.Environments["dev"]
+	env.Features = []string{"feature/in-dev"}
+	meta.Environments["dev"] = env
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Fixture", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	gitOutput(t, tr.Path, "push", "--quiet", "origin", metadata.MetadataBranch)
+
+	if err := runHitch(t, "cleanup", "--force"); err != nil {
+		t.Fatalf("cleanup failed: %v", err)
+	}
+
+	// The tag holds the deleted branch's tip, locally and on origin
+	tag := "archive/feature/abandoned-" + time.Now().Format("2006-01-02")
+	for _, dir := range []string{tr.Path, remote} {
+		if got := gitOutput(t, dir, "rev-parse", "refs/tags/"+tag); got != tip {
+			t.Errorf("Expected %s in %s at %s, got %q", tag, dir, tip, got)
+		}
+	}
+	if tr.Repo.BranchExists("feature/abandoned") {
+		t.Error("Expected the local branch to be deleted")
+	}
+	if refs := gitOutput(t, remote, "for-each-ref", "refs/heads/feature/abandoned"); refs != "" {
+		t.Errorf("Expected the branch to be deleted on origin, got %s", refs)
+	}
+
+	meta = readMetadata(t, tr)
+	if _, tracked := meta.Branches["feature/abandoned"]; tracked {
+		t.Error("Expected feature/abandoned to be untracked")
+	}
+	if _, tracked := meta.Branches["feature/in-dev"]; !tracked || !tr.Repo.BranchExists("feature/in-dev") {
+		t.Error("Expected an inactive branch still in an environment to be kept")
+	}
+	if _, tracked := meta.Branches["feature/active"]; !tracked || !tr.Repo.BranchExists("feature/active") {
+		t.Error("Expected a branch with a recent commit to be kept")
+	}
+	if out := gitOutput(t, tr.Path, "tag", "--list", "archive/feature/active-*"); out != "" {
+		t.Errorf("Expected a branch with a recent commit not to be archived, got %s", out)
+	}
+}
+
+func TestRebuildIncremental(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, feature := range []string{"a", "b"} {
+		gitOutput(t, tr.Path, "checkout", "-b", "feature/"+feature, "main")
+		if err := tr.CommitFile(feature+".txt", feature+"\n", "Add "+feature+".txt"); err != nil {
+			t.Fatalf("Failed to commit on feature/%s: %v", feature, err)
+		}
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	if err := runHitch(t, "promote", "feature/a", "to", "dev"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	before := gitOutput(t, tr.Path, "rev-parse", "dev")
+
+	meta := readMetadata(t, tr)
+	if err := meta.AddBranchToEnvironment("dev", "feature/b", "test@example.com"); err != nil {
+		t.Fatalf("Failed to add branch: %v", err)
+	}
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Add feature/b", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	out := captureStdout(t, func() {
+		if err := runHitch(t, "rebuild", "dev", "--incremental"); err != nil {
+			t.Errorf("rebuild --incremental failed: %v", err)
+		}
+	})
+	if !strings.Contains(out, "Incrementally rebuilding dev") || strings.Contains(out, "Merged feature/a") {
+		t.Errorf("Expected only feature/b to be merged, got:\n%s", out)
+	}
+	if parent := gitOutput(t, tr.Path, "rev-parse", "dev^1"); parent != before {
+		t.Errorf("Expected feature/b merged onto the old tip %s, got parent %s", before, parent)
+	}
+	incrementalTree := gitOutput(t, tr.Path, "rev-parse", "dev^{tree}")
+	if meta := readMetadata(t, tr); meta.PendingRebuild("dev") || meta.Environments["dev"].LastRebuildCommit != gitOutput(t, tr.Path, "rev-parse", "dev") {
+		t.Error("Expected the incremental rebuild to be recorded like a full one")
+	}
+
+	// A full rebuild produces the same tree
+	if err := runHitch(t, "rebuild", "dev"); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if fullTree := gitOutput(t, tr.Path, "rev-parse", "dev^{tree}"); fullTree != incrementalTree {
+		t.Errorf("Expected the incremental tree %s to match the full rebuild's %s", incrementalTree, fullTree)
+	}
+
+	// A drifted hitched branch falls back to a full rebuild
+	gitOutput(t, tr.Path, "checkout", "dev")
+	if err := tr.CommitFile("stray.txt", "stray\n", "Commit straight to dev"); err != nil {
+		t.Fatalf("Failed to commit on dev: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	out = captureStdout(t, func() {
+		if err := runHitch(t, "rebuild", "dev", "--incremental"); err != nil {
+			t.Errorf("rebuild --incremental failed: %v", err)
+		}
+	})
+	if !strings.Contains(out, "Rebuilding dev from scratch: dev has moved since its last rebuild") {
+		t.Errorf("Expected a fallback to a full rebuild, got:\n%s", out)
+	}
+	if files := gitOutput(t, tr.Path, "ls-tree", "--name-only", "dev"); strings.Contains(files, "stray.txt") {
+		t.Errorf("Expected the full rebuild to drop the stray commit, got:\n%s", files)
+	}
+
+	// So does pinning a feature back to a commit before the one merged
+	pin := gitOutput(t, tr.Path, "rev-parse", "feature/a")
+	gitOutput(t, tr.Path, "checkout", "feature/a")
+	if err := tr.CommitFile("a2.txt", "a2\n", "Add a2.txt"); err != nil {
+		t.Fatalf("Failed to commit on feature/a: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "rebuild", "dev"); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if err := runHitch(t, "promote", "feature/a@"+pin, "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("promote with a pin failed: %v", err)
+	}
+	out = captureStdout(t, func() {
+		if err := runHitch(t, "rebuild", "dev", "--incremental"); err != nil {
+			t.Errorf("rebuild --incremental failed: %v", err)
+		}
+	})
+	if !strings.Contains(out, "Rebuilding dev from scratch: feature/a was moved back or rewritten since the last rebuild") {
+		t.Errorf("Expected a fallback to a full rebuild, got:\n%s", out)
+	}
+	if files := gitOutput(t, tr.Path, "ls-tree", "--name-only", "dev"); strings.Contains(files, "a2.txt") {
+		t.Errorf("Expected the full rebuild to drop the commit after the pin, got:\n%s", files)
+	}
+}
+
+func TestEnvShow(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for feature, commits := range map[string]int{"feature/a": 2, "feature/b": 1} {
+		gitOutput(t, tr.Path, "checkout", "-b", feature, "main")
+		for i := range commits {
+			name := fmt.Sprintf("%s-%d.txt", strings.TrimPrefix(feature, "feature/"), i)
+			if err := tr.CommitFile(name, "content\n", "Add "+name); err != nil {
+				t.Fatalf("Failed to commit on %s: %v", feature, err)
+			}
+		}
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	for _, feature := range []string{"feature/a", "feature/b"} {
+		if err := runHitch(t, "promote", feature, "to", "dev"); err != nil {
+			t.Fatalf("promote %s failed: %v", feature, err)
+		}
+	}
+	if err := tr.CommitFile("main.txt", "main\n", "Move main on"); err != nil {
+		t.Fatalf("Failed to commit on main: %v", err)
+	}
+
+	meta := readMetadata(t, tr)
+	if err := meta.LockEnvironment("dev", "alice@example.com", "deploying"); err != nil {
+		t.Fatalf("Failed to lock dev: %v", err)
+	}
+	dev := meta.Environments["dev"]
+	dev.LockedContext = "https://ci.example.com/jobs/42"
+	meta.Environments["dev"] = dev
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Lock dev", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	var buf bytes.Buffer
+	rootCmd.SetOut(&buf)
+	t.Cleanup(func() { rootCmd.SetOut(nil) })
+	if err := runHitch(t, "env", "show", "dev", "--json"); err != nil {
+		t.Fatalf("env show --json failed: %v", err)
+	}
+	var detail struct {
+		Name     string `json:"name"`
+		Base     string `json:"base"`
+		Features []struct {
+			Name       string     `json:"name"`
+			PromotedAt *time.Time `json:"promoted_at"`
+			Ahead      *int       `json:"ahead"`
+			Behind     *int       `json:"behind"`
+		} `json:"features"`
+		Commit            string `json:"commit"`
+		LastRebuildCommit string `json:"last_rebuild_commit"`
+		Locked            bool   `json:"locked"`
+		LockedBy          string `json:"locked_by"`
+		LockedReason      string `json:"locked_reason"`
+		LockedContext     string `json:"locked_context"`
+		Drifted           bool   `json:"drifted"`
+		PendingRebuild    bool   `json:"pending_rebuild"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &detail); err != nil {
+		t.Fatalf("Invalid JSON output: %v\n%s", err, buf.String())
+	}
+
+	if detail.Name != "dev" || detail.Base != "main" {
+		t.Errorf("Expected dev based on main, got %s based on %s", detail.Name, detail.Base)
+	}
+	if len(detail.Features) != 2 || detail.Features[0].Name != "feature/a" || detail.Features[1].Name != "feature/b" {
+		t.Fatalf("Expected feature/a then feature/b, got %+v", detail.Features)
+	}
+	for i, ahead := range []int{2, 1} {
+		f := detail.Features[i]
+		if f.Ahead == nil || *f.Ahead != ahead || f.Behind == nil || *f.Behind != 1 {
+			t.Errorf("Expected %s %d ahead and 1 behind main, got %v/%v", f.Name, ahead, f.Ahead, f.Behind)
+		}
+		if f.PromotedAt == nil {
+			t.Errorf("Expected a promotion time for %s", f.Name)
+		}
+	}
+	if detail.Commit == "" || detail.Commit != detail.LastRebuildCommit || detail.Drifted || detail.PendingRebuild {
+		t.Errorf("Expected dev at its last rebuild with nothing pending, got %+v", detail)
+	}
+	if !detail.Locked || detail.LockedBy != "alice@example.com" || detail.LockedReason != "deploying" || detail.LockedContext != "https://ci.example.com/jobs/42" {
+		t.Errorf("Expected the lock holder, reason, and context, got %+v", detail)
+	}
+
+	out := captureStdout(t, func() {
+		if err := runHitch(t, "env", "show", "dev"); err != nil {
+			t.Errorf("env show failed: %v", err)
+		}
+	})
+	for _, want := range []string{"1. feature/a, 2 ahead / 1 behind main", "2. feature/b, 1 ahead / 1 behind main", "locked by alice@example.com", "Context: https://ci.example.com/jobs/42", "Pending rebuild: no"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in output, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestAutoRebuildOnPromoteConfig(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, feature := range []string{"feature/a", "feature/b"} {
+		gitOutput(t, tr.Path, "checkout", "-b", feature, "main")
+		if err := tr.CommitFile(strings.TrimPrefix(feature, "feature/")+".txt", "content\n", "Work on "+feature); err != nil {
+			t.Fatalf("Failed to commit on %s: %v", feature, err)
+		}
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	// The default rebuilds
+	if err := runHitch(t, "promote", "feature/a", "to", "dev"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	built := gitOutput(t, tr.Path, "rev-parse", "dev")
+	if meta := readMetadata(t, tr); meta.Environments["dev"].LastRebuildCommit != built {
+		t.Fatal("Expected promote to rebuild dev by default")
+	}
+
+	meta := readMetadata(t, tr)
+	meta.Config.AutoRebuildOnPromote = false
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Turn off auto rebuild", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	// Turned off, promote and demote only update metadata
+	if err := runHitch(t, "promote", "feature/b", "to", "dev"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	if err := runHitch(t, "demote", "feature/a", "from", "dev"); err != nil {
+		t.Fatalf("demote failed: %v", err)
+	}
+	if got := gitOutput(t, tr.Path, "rev-parse", "dev"); got != built {
+		t.Errorf("Expected dev not to be rebuilt, but it moved to %s", got)
+	}
+	meta = readMetadata(t, tr)
+	if !slices.Equal(meta.Environments["dev"].Features, []string{"feature/b"}) || !meta.PendingRebuild("dev") {
+		t.Errorf("Expected the metadata updated with a rebuild pending, got %v", meta.Environments["dev"].Features)
+	}
+
+	// --rebuild overrides the config
+	if err := runHitch(t, "promote", "feature/a", "to", "dev", "--rebuild"); err != nil {
+		t.Fatalf("promote --rebuild failed: %v", err)
+	}
+	if files := gitOutput(t, tr.Path, "ls-tree", "--name-only", "dev"); !strings.Contains(files, "a.txt") || !strings.Contains(files, "b.txt") {
+		t.Errorf("Expected --rebuild to rebuild dev with both features, got:\n%s", files)
+	}
+
+	if err := runHitch(t, "promote", "feature/a", "to", "dev", "--rebuild", "--no-rebuild"); err == nil {
+		t.Error("Expected --rebuild with --no-rebuild to be refused")
+	}
+}
+
+func TestDoctorNotifyTest(t *testing.T) {
+	hooks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer hooks.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	gitlab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message": "401 Unauthorized"}`))
+			return
+		}
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer gitlab.Close()
+
+	tr := testutil.NewTestRepo(t)
+	t.Chdir(tr.Path)
+	t.Setenv("HITCH_OFFLINE", "")
+	t.Setenv("GITLAB_TOKEN", "secret")
+
+	meta := metadata.NewMetadata([]string{"dev", "qa"}, "main", "test@example.com")
+	meta.Config.GitLab = &metadata.GitLabConfig{ProjectID: "group/app", BaseURL: gitlab.URL}
+	meta.Config.NotificationWebhooks = []metadata.Webhook{{URL: hooks.URL + "/chat", Events: []string{"rebuild"}}}
+	if err := tr.InitMetadata(meta); err != nil {
+		t.Fatalf("Failed to initialize metadata: %v", err)
+	}
+
+	var err error
+	out := captureStdout(t, func() { err = runHitch(t, "doctor", "--notify-test") })
+	if err != nil {
+		t.Fatalf("doctor --notify-test failed with healthy integrations: %v\n%s", err, out)
+	}
+	if !strings.Contains(out, "is reachable") || !strings.Contains(out, "accepted the token") || !strings.Contains(out, "2 of 2 healthy") {
+		t.Errorf("Expected a healthy summary, got:\n%s", out)
+	}
+
+	// Without --notify-test, nothing is contacted
+	t.Setenv("GITLAB_TOKEN", "wrong")
+	if err := runHitch(t, "doctor"); err != nil {
+		t.Errorf("Expected plain doctor to skip integration checks, got %v", err)
+	}
+
+	meta.Config.NotificationWebhooks = append(meta.Config.NotificationWebhooks, metadata.Webhook{URL: down.URL, Events: []string{"rebuild"}})
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Add webhook", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	out = captureStdout(t, func() { err = runHitch(t, "doctor", "--notify-test") })
+	if err == nil || !strings.Contains(err.Error(), "2 problem(s)") {
+		t.Errorf("Expected the unreachable webhook and rejected token to be problems, got %v", err)
+	}
+	if !strings.Contains(out, "1 of 3 healthy") {
+		t.Errorf("Expected the summary to count failures, got:\n%s", out)
+	}
+}
+
+func TestRebuildAbortDiscardsWorktreeChanges(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, name := range []string{"feature/left", "feature/right"} {
+		gitOutput(t, tr.Path, "checkout", "-b", name, "main")
+		if err := tr.CommitFile("shared.txt", name+"\n", "Edit shared.txt on "+name); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+		gitOutput(t, tr.Path, "checkout", "main")
+		if err := runHitch(t, "promote", name, "to", "qa", "--no-rebuild"); err != nil {
+			t.Fatalf("promote %s failed: %v", name, err)
+		}
+	}
+	if err := runHitch(t, "rebuild", "qa"); err == nil {
+		t.Fatal("Expected rebuild of conflicting features to fail")
+	}
+
+	// Start resolving by hand on the temp branch, then give up
+	gitOutput(t, tr.Path, "checkout", "qa-hitch-temp")
+	if err := os.WriteFile(filepath.Join(tr.Path, "shared.txt"), []byte("half resolved\n"), 0644); err != nil {
+		t.Fatalf("Failed to edit shared.txt: %v", err)
+	}
+
+	if err := runHitch(t, "rebuild", "qa", "--abort"); err != nil {
+		t.Fatalf("rebuild --abort failed over a dirty temp branch: %v", err)
+	}
+	if branch := gitOutput(t, tr.Path, "rev-parse", "--abbrev-ref", "HEAD"); branch != "main" {
+		t.Errorf("Expected --abort to return to main, got %s", branch)
+	}
+	if status := gitOutput(t, tr.Path, "status", "--porcelain", "--untracked-files=no"); status != "" {
+		t.Errorf("Expected a clean worktree after --abort, got:\n%s", status)
+	}
+	if gitOutput(t, tr.Path, "branch", "--list", "qa-hitch-temp") != "" {
+		t.Error("Expected --abort to delete the temp branch")
+	}
+}
+
+func TestRebuildReportsMissingPinUpFront(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	gitOutput(t, tr.Path, "checkout", "-b", "feature/gone", "main")
+	if err := tr.CommitFile("gone.txt", "gone\n", "Work that gets force-pushed away"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	pinned := gitOutput(t, tr.Path, "rev-parse", "HEAD")
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "promote", "feature/gone@"+pinned, "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("pinned promote failed: %v", err)
+	}
+
+	// Rewrite the branch and let gc collect the pinned commit
+	gitOutput(t, tr.Path, "branch", "--force", "feature/gone", "main")
+	gitOutput(t, tr.Path, "reflog", "expire", "--expire=now", "--all")
+	gitOutput(t, tr.Path, "gc", "--prune=now", "--quiet")
+
+	var err error
+	stderr := captureStderr(t, func() { err = runHitch(t, "rebuild", "dev") })
+	if err == nil {
+		t.Fatal("Expected rebuild to fail on a missing pinned commit")
+	}
+	if want := "Pinned commit " + pinned[:7] + " for feature/gone no longer exists"; !strings.Contains(stderr, want) {
+		t.Errorf("Expected %q, got:\n%s", want, stderr)
+	}
+
+	// Reported before the lock or any merge
+	if readMetadata(t, tr).Environments["dev"].Locked {
+		t.Error("Expected dev not to be locked")
+	}
+	if gitOutput(t, tr.Path, "branch", "--list", "dev", "dev-hitch-temp") != "" {
+		t.Error("Expected no dev or temp branch to be created")
+	}
+
+	// So does the rebuild after a promote
+	if err := tr.CreateBranch("feature/next", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	stderr = captureStderr(t, func() { err = runHitch(t, "promote", "feature/next", "to", "dev") })
+	if err == nil {
+		t.Fatal("Expected the promote's rebuild to fail on a missing pinned commit")
+	}
+	if want := "Pinned commit " + pinned[:7] + " for feature/gone no longer exists"; !strings.Contains(stderr, want) {
+		t.Errorf("Expected %q, got:\n%s", want, stderr)
+	}
+	if readMetadata(t, tr).Environments["dev"].Locked {
+		t.Error("Expected dev not to be locked")
+	}
+	if gitOutput(t, tr.Path, "branch", "--list", "dev", "dev-hitch-temp") != "" {
+		t.Error("Expected no dev or temp branch to be created")
+	}
+}
+
+func TestStatusDistinguishesEmptiedEnvironments(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/brief", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+	if err := runHitch(t, "promote", "feature/brief", "to", "dev"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	if err := runHitch(t, "demote", "feature/brief", "from", "dev"); err != nil {
+		t.Fatalf("demote failed: %v", err)
+	}
+	// Rebuilding qa with nothing in it doesn't make it emptied
+	if err := runHitch(t, "rebuild", "qa"); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+
+	// Trimming feature/brief's history, then cleaning it up, doesn't make
+	// dev look never used
+	if err := runHitch(t, "compact-history", "--keep", "0"); err != nil {
+		t.Fatalf("compact-history failed: %v", err)
+	}
+	meta := readMetadata(t, tr)
+	if history := meta.Branches["feature/brief"].PromotedHistory; len(history) != 0 {
+		t.Fatalf("Expected compact-history to drop feature/brief's history, got %+v", history)
+	}
+	longAgo := time.Now().AddDate(0, 0, -30)
+	info := meta.Branches["feature/brief"]
+	info.MergedToMainAt = &longAgo
+	info.EligibleForCleanupAt = &longAgo
+	meta.Branches["feature/brief"] = info
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Merge feature/brief", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	if err := runHitch(t, "cleanup", "--force"); err != nil {
+		t.Fatalf("cleanup failed: %v", err)
+	}
+	if _, tracked := readMetadata(t, tr).Branches["feature/brief"]; tracked {
+		t.Fatal("Expected cleanup to untrack feature/brief")
+	}
+
+	out := captureStdout(t, func() {
+		if err := runHitch(t, "status"); err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+	})
+	if !strings.Contains(out, "Emptied: dev had features but has none now") {
+		t.Errorf("Expected dev to be reported as emptied, got:\n%s", out)
+	}
+	if strings.Contains(out, "Emptied: qa") || !strings.Contains(out, "Features: (none, never used)") {
+		t.Errorf("Expected qa to be reported as never used, got:\n%s", out)
+	}
+
+	var buf bytes.Buffer
+	rootCmd.SetOut(&buf)
+	t.Cleanup(func() { rootCmd.SetOut(nil) })
+	if err := runHitch(t, "status", "--json"); err != nil {
+		t.Fatalf("status --json failed: %v", err)
+	}
+	var view struct {
+		Environments []struct {
+			Name    string `json:"name"`
+			Emptied bool   `json:"emptied"`
+		} `json:"environments"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &view); err != nil {
+		t.Fatalf("Invalid JSON: %v\n%s", err, buf.String())
+	}
+	for _, env := range view.Environments {
+		if want := env.Name == "dev"; env.Emptied != want {
+			t.Errorf("Expected %s emptied=%v, got %v", env.Name, want, env.Emptied)
+		}
+	}
+}
+
+func TestPromoteMetadataOnly(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	branches := func() string {
+		var refs []string
+		for _, line := range strings.Split(gitOutput(t, tr.Path, "for-each-ref", "--format=%(refname) %(objectname)", "refs/heads"), "\n") {
+			if !strings.HasPrefix(line, "refs/heads/hitch-metadata ") {
+				refs = append(refs, line)
+			}
+		}
+		return strings.Join(refs, "\n")
+	}
+	branchesBefore := branches()
+	metadataBefore := gitOutput(t, tr.Path, "rev-parse", "hitch-metadata")
+
+	// The branch only exists wherever CI builds from
+	pin := strings.Repeat("ab", 20)
+	if err := runHitch(t, "promote", "feature/ci-built@"+pin, "to", "dev", "--metadata-only"); err != nil {
+		t.Fatalf("promote --metadata-only failed: %v", err)
+	}
+
+	meta := readMetadata(t, tr)
+	if !slices.Contains(meta.Environments["dev"].Features, "feature/ci-built") {
+		t.Errorf("Expected feature/ci-built in dev, got %v", meta.Environments["dev"].Features)
+	}
+	if got := meta.Environments["dev"].Pins["feature/ci-built"]; got != pin {
+		t.Errorf("Expected the pin to be recorded as given, got %q", got)
+	}
+	if gitOutput(t, tr.Path, "rev-parse", "hitch-metadata") == metadataBefore {
+		t.Error("Expected a metadata commit")
+	}
+
+	if err := runHitch(t, "demote", "feature/ci-built", "from", "dev", "--metadata-only"); err != nil {
+		t.Fatalf("demote --metadata-only failed: %v", err)
+	}
+	if slices.Contains(readMetadata(t, tr).Environments["dev"].Features, "feature/ci-built") {
+		t.Error("Expected feature/ci-built to be removed from dev")
+	}
+
+	// Only hitch-metadata moved: no hitched, temp, or feature branch
+	if after := branches(); after != branchesBefore {
+		t.Errorf("Expected branches to be untouched, before:\n%s\nafter:\n%s", branchesBefore, after)
+	}
+
+	if err := runHitch(t, "promote", "feature/ci-built@abc1234", "to", "dev", "--metadata-only"); err == nil {
+		t.Error("Expected an abbreviated pin to be refused without a lookup")
+	}
+	if err := runHitch(t, "promote", "feature/ci-built", "to", "dev", "--metadata-only", "--rebuild"); err == nil {
+		t.Error("Expected --metadata-only --rebuild to be rejected")
+	}
+}
+
+func TestCircularBasesDetected(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	meta := readMetadata(t, tr)
+	for env, base := range map[string]string{"dev": "qa", "qa": "dev"} {
+		e := meta.Environments[env]
+		e.Base = base
+		meta.Environments[env] = e
+	}
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Loop bases", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	var err error
+	stderr := captureStderr(t, func() { err = runHitch(t, "doctor") })
+	if err == nil {
+		t.Error("Expected doctor to fail on circular bases")
+	}
+	if !strings.Contains(stderr, "Environment bases form a loop: dev -> qa -> dev") {
+		t.Errorf("Expected the loop to be reported, got:\n%s", stderr)
+	}
+
+	stderr = captureStderr(t, func() { err = runHitch(t, "rebuild", "qa") })
+	if err == nil || !strings.Contains(stderr, "environment bases form a loop") {
+		t.Errorf("Expected rebuild to refuse a circular base, got %v:\n%s", err, stderr)
+	}
+	if readMetadata(t, tr).Environments["qa"].Locked {
+		t.Error("Expected qa not to be locked")
+	}
+}
+
+func TestCompletePinnedFeatures(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/pin-me", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	tip := gitOutput(t, tr.Path, "rev-parse", "--short", "feature/pin-me")
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	complete := func(args ...string) []string {
+		t.Helper()
+		var buf bytes.Buffer
+		rootCmd.SetOut(&buf)
+		defer rootCmd.SetOut(nil)
+		if err := runHitch(t, append([]string{"__complete"}, args...)...); err != nil {
+			t.Fatalf("completion of %v failed: %v", args, err)
+		}
+		// The last line is cobra's directive
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		return lines[:len(lines)-1]
+	}
+
+	if got := complete("promote", "feature/p"); !slices.Equal(got, []string{"feature/pin-me"}) {
+		t.Errorf("Expected the feature branch, got %v", got)
+	}
+	got := complete("promote", "feature/pin-me@")
+	if len(got) == 0 || got[0] != "feature/pin-me@"+tip {
+		t.Fatalf("Expected the branch's commits newest first, got %v", got)
+	}
+	for _, ref := range got {
+		if _, _, err := metadata.ParseFeatureRef(ref); err != nil {
+			t.Errorf("Completed %q doesn't parse: %v", ref, err)
+		}
+	}
+	if got := complete("promote", "feature/pin-me@"+tip, "to", "d"); !slices.Equal(got, []string{"dev"}) {
+		t.Errorf("Expected environments after 'to', got %v", got)
+	}
+
+	if err := runHitch(t, "promote", "feature/pin-me@"+tip, "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("pinned promote failed: %v", err)
+	}
+	if got := complete("demote", ""); !slices.Equal(got, []string{"feature/pin-me"}) {
+		t.Errorf("Expected demote to offer promoted features, got %v", got)
+	}
+
+	// Parsing is shared: malformed pins fail before anything runs
+	if err := runHitch(t, "promote", "feature/pin-me@HEAD~1", "to", "dev"); err == nil || !strings.Contains(err.Error(), "not a commit SHA") {
+		t.Errorf("Expected a malformed pin to be rejected, got %v", err)
+	}
+	if err := runHitch(t, "demote", "feature/pin-me@"+tip, "from", "dev"); err == nil {
+		t.Error("Expected demote to reject a pinned ref")
+	}
+}
+
+func TestDoctorFixRepairsInOneCommit(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	if err := tr.CreateBranch("feature/drifted", false); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	meta := readMetadata(t, tr)
+	meta.Config.ConflictStrategy = "retry"
+	meta.Branches["feature/deleted"] = metadata.BranchInfo{PromotedTo: []string{}}
+	meta.Branches["feature/drifted"] = metadata.BranchInfo{PromotedTo: []string{"qa"}}
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Break metadata", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	// Only origin has the metadata, as on a fresh clone
+	addBareRemote(t, tr)
+	gitOutput(t, tr.Path, "branch", "-D", metadata.MetadataBranch)
+
+	var err error
+	stderr := captureStderr(t, func() { err = runHitch(t, "doctor") })
+	if err == nil || !strings.Contains(stderr, "exists on origin but not locally") {
+		t.Fatalf("Expected doctor to report the missing local branch, got %v:\n%s", err, stderr)
+	}
+
+	stderr = captureStderr(t, func() {
+		if err := runHitch(t, "doctor", "--fix"); err != nil {
+			t.Fatalf("doctor --fix failed: %v", err)
+		}
+	})
+
+	if count := gitOutput(t, tr.Path, "rev-list", "--count", "origin/hitch-metadata..hitch-metadata"); count != "1" {
+		t.Errorf("Expected the repairs in a single commit, got %s", count)
+	}
+	message := gitOutput(t, tr.Path, "log", "-1", "--format=%B", metadata.MetadataBranch)
+	for _, want := range []string{"Repair metadata (3 fixes)", "config.conflict_strategy", "Removed qa from feature/drifted's promoted_to", "Removed feature/deleted"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("Expected the commit message to mention %q, got:\n%s", want, message)
+		}
+	}
+
+	repaired := readMetadata(t, tr)
+	if repaired.Config.ConflictStrategy != "" {
+		t.Errorf("Expected conflict_strategy to be reset, got %q", repaired.Config.ConflictStrategy)
+	}
+	if _, ok := repaired.Branches["feature/deleted"]; ok {
+		t.Error("Expected the deleted branch's entry to be removed")
+	}
+	if branch := gitOutput(t, tr.Path, "rev-parse", "--abbrev-ref", "HEAD"); branch != "main" {
+		t.Errorf("Expected to be returned to main, got %s", branch)
+	}
+
+	if err := runHitch(t, "doctor"); err != nil {
+		t.Errorf("Expected doctor to pass after --fix, got %v\n%s", err, stderr)
+	}
+}
+
+func TestPromoteRefusedDuringFreezeWindow(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	// One window never covers now, the other always does
+	later := weekdayName(time.Now().AddDate(0, 0, 3).Weekday())
+	meta := readMetadata(t, tr)
+	dev := meta.Environments["dev"]
+	dev.FreezeWindows = []metadata.FreezeWindow{{Days: []string{later}}}
+	meta.Environments["dev"] = dev
+	qa := meta.Environments["qa"]
+	qa.FreezeWindows = []metadata.FreezeWindow{{Reason: "release week"}}
+	meta.Environments["qa"] = qa
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Schedule freezes", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+
+	if err := tr.CreateBranch("feature/window", true); err != nil {
+		t.Fatalf("Failed to create feature branch: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	if err := runHitch(t, "promote", "feature/window", "to", "dev", "--no-rebuild"); err != nil {
+		t.Fatalf("Expected promote outside the window to succeed: %v", err)
+	}
+
+	var err error
+	out := captureStdout(t, func() {
+		err = runHitch(t, "promote", "feature/window", "to", "qa", "--no-rebuild")
+	})
+	var freezeErr *metadata.FreezeWindowError
+	if !errors.As(err, &freezeErr) {
+		t.Fatalf("Expected a FreezeWindowError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "qa is in a scheduled freeze until") || !strings.Contains(out, "Reason: release week") {
+		t.Errorf("Expected the freeze and its reason to be reported, got %v and:\n%s", err, out)
+	}
+	if slices.Contains(readMetadata(t, tr).Environments["qa"].Features, "feature/window") {
+		t.Fatal("Expected the frozen environment to be unchanged")
+	}
+
+	if err := runHitch(t, "promote", "feature/window", "to", "qa", "--no-rebuild", "--force"); err != nil {
+		t.Fatalf("promote --force failed: %v", err)
+	}
+	if !slices.Contains(readMetadata(t, tr).Environments["qa"].Features, "feature/window") {
+		t.Error("Expected --force to promote during the freeze")
+	}
+}
+
+func weekdayName(day time.Weekday) string {
+	return strings.ToLower(day.String()[:3])
+}
+
+func TestEnvRollbackRestoresRecordedBuild(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, name := range []string{"feature/good", "feature/bad"} {
+		if err := tr.CreateBranch(name, true); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		if err := tr.CommitFile(strings.TrimPrefix(name, "feature/")+".txt", name+"\n", "Add "+name); err != nil {
+			t.Fatalf("Failed to commit on %s: %v", name, err)
+		}
+		gitOutput(t, tr.Path, "checkout", "main")
+	}
+
+	if err := runHitch(t, "promote", "feature/good", "to", "dev"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	good := gitOutput(t, tr.Path, "rev-parse", "dev")
+	if err := runHitch(t, "promote", "feature/bad", "to", "dev"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	bad := gitOutput(t, tr.Path, "rev-parse", "dev")
+
+	reflog := readMetadata(t, tr).Environments["dev"].Reflog
+	if len(reflog) != 2 || reflog[0].Commit != bad || reflog[1].Commit != good {
+		t.Fatalf("Expected the two builds newest first, got %+v", reflog)
+	}
+	if !slices.Equal(reflog[1].Features, []string{"feature/good"}) {
+		t.Errorf("Expected the first build to record its features, got %v", reflog[1].Features)
+	}
+
+	var buf bytes.Buffer
+	rootCmd.SetOut(&buf)
+	defer rootCmd.SetOut(nil)
+	if err := runHitch(t, "env", "reflog", "dev", "--json"); err != nil {
+		t.Fatalf("env reflog failed: %v", err)
+	}
+	var lines []struct {
+		Commit  string `json:"commit"`
+		Current bool   `json:"current"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &lines); err != nil {
+		t.Fatalf("Failed to parse reflog JSON: %v\n%s", err, buf.String())
+	}
+	if len(lines) != 2 || !lines[0].Current || lines[1].Current {
+		t.Errorf("Expected only the newest build to be current, got %+v", lines)
+	}
+
+	if err := runHitch(t, "env", "rollback", "dev", "0000000"); err == nil {
+		t.Error("Expected rollback to an unrecorded commit to fail")
+	}
+	if err := runHitch(t, "env", "rollback", "dev", good[:7]); err != nil {
+		t.Fatalf("env rollback failed: %v", err)
+	}
+	if got := gitOutput(t, tr.Path, "rev-parse", "dev"); got != good {
+		t.Errorf("Expected dev at %s, got %s", good, got)
+	}
+
+	env := readMetadata(t, tr).Environments["dev"]
+	if env.LastRebuildCommit != good {
+		t.Errorf("Expected the rollback to be recorded as dev's build, got %s", env.LastRebuildCommit)
+	}
+	if len(env.Reflog) != 3 || env.Reflog[0].Action != "rollback" || env.Reflog[0].Commit != good {
+		t.Errorf("Expected the rollback at the top of the reflog, got %+v", env.Reflog)
+	}
+	if !slices.Contains(env.Features, "feature/bad") {
+		t.Error("Expected rollback to leave the feature list alone")
+	}
+}
+
+func TestEnvRollbackPushesWithLease(t *testing.T) {
+	tr := newHitchRepo(t)
+	remote := addBareRemote(t, tr)
+
+	for _, name := range []string{"feature/good", "feature/bad"} {
+		if err := tr.CreateBranch(name, true); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		if err := tr.CommitFile(strings.TrimPrefix(name, "feature/")+".txt", name+"\n", "Add "+name); err != nil {
+			t.Fatalf("Failed to commit on %s: %v", name, err)
+		}
+		gitOutput(t, tr.Path, "checkout", "main")
+	}
+	if err := runHitch(t, "promote", "feature/good", "to", "dev"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	good := gitOutput(t, tr.Path, "rev-parse", "dev")
+	if err := runHitch(t, "promote", "feature/bad", "to", "dev"); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	bad := gitOutput(t, tr.Path, "rev-parse", "dev")
+
+	if err := runHitch(t, "env", "rollback", "dev", good[:7]); err != nil {
+		t.Fatalf("env rollback failed: %v", err)
+	}
+	if got := gitOutput(t, remote, "rev-parse", "dev"); got != good {
+		t.Errorf("Expected the rollback pushed to origin, got %s", got)
+	}
+
+	// Someone else pushes a build; rolling back doesn't overwrite it
+	theirs := gitOutput(t, tr.Path, "rev-parse", "main")
+	gitOutput(t, tr.Path, "push", "--quiet", "--force", "origin", "main:dev")
+	out := captureStderr(t, func() {
+		if err := runHitch(t, "env", "rollback", "dev", bad[:7]); err != nil {
+			t.Fatalf("env rollback failed: %v", err)
+		}
+	})
+	if !strings.Contains(out, "the rollback was not pushed") {
+		t.Errorf("Expected the push to be refused, got:\n%s", out)
+	}
+	if got := gitOutput(t, remote, "rev-parse", "dev"); got != theirs {
+		t.Errorf("Expected origin's dev to stay at %s, got %s", theirs, got)
+	}
+}
+
+func TestForceUnlockRequiresAdmin(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	meta := readMetadata(t, tr)
+	meta.Config.Admins = []string{"Admin@Example.com"}
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Add admins", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	gitOutput(t, tr.Path, "checkout", "main")
+
+	// Locking and unlocking your own lock stay open to everyone
+	if err := runHitch(t, "lock", "qa"); err != nil {
+		t.Fatalf("lock by a non-admin failed: %v", err)
+	}
+
+	gitOutput(t, tr.Path, "config", "user.email", "other@example.com")
+	err := runHitch(t, "unlock", "qa", "--force")
+	var permErr *metadata.PermissionError
+	if !errors.As(err, &permErr) {
+		t.Fatalf("Expected a PermissionError for a non-admin, got %v", err)
+	}
+	if !readMetadata(t, tr).Environments["qa"].Locked {
+		t.Fatal("Expected qa to stay locked")
+	}
+
+	gitOutput(t, tr.Path, "config", "user.email", "admin@example.com")
+	if err := runHitch(t, "unlock", "qa", "--force"); err != nil {
+		t.Fatalf("unlock --force by an admin failed: %v", err)
+	}
+	if readMetadata(t, tr).Environments["qa"].Locked {
+		t.Error("Expected the admin to unlock qa")
+	}
+
+	gitOutput(t, tr.Path, "config", "user.email", "test@example.com")
+	if err := runHitch(t, "lock", "qa"); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if err := runHitch(t, "unlock", "qa"); err != nil {
+		t.Errorf("Expected a non-admin to unlock their own lock: %v", err)
+	}
+}
+
+func TestUnfreezeRequiresAdmin(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	meta := readMetadata(t, tr)
+	meta.Config.Admins = []string{"admin@example.com"}
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Add admins", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+
+	// Anyone may freeze, but the non-admin who did can't unfreeze
+	if err := runHitch(t, "freeze", "--reason", "maintenance"); err != nil {
+		t.Fatalf("freeze by a non-admin failed: %v", err)
+	}
+	err := runHitch(t, "unfreeze")
+	var permErr *metadata.PermissionError
+	if !errors.As(err, &permErr) {
+		t.Fatalf("Expected a PermissionError for a non-admin, got %v", err)
+	}
+	if !readMetadata(t, tr).Frozen {
+		t.Fatal("Expected Hitch to stay frozen")
+	}
+
+	gitOutput(t, tr.Path, "config", "user.email", "admin@example.com")
+	if err := runHitch(t, "unfreeze", "--force"); err != nil {
+		t.Fatalf("unfreeze --force by an admin failed: %v", err)
+	}
+	if readMetadata(t, tr).Frozen {
+		t.Error("Expected the admin to unfreeze Hitch")
+	}
+}
+
+func TestRebuildHonorsMergeDrivers(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	// Built-in union for the changelog, a custom driver keeping our side for
+	// the lockfile, defined in this repository's config only
+	gitOutput(t, tr.Path, "config", "merge.keep-ours.driver", "true")
+	if err := tr.CommitFile(".gitattributes", "CHANGELOG.md merge=union\n*.lock merge=keep-ours\n", "Add merge attributes"); err != nil {
+		t.Fatalf("Failed to commit .gitattributes: %v", err)
+	}
+	if err := tr.CommitFile("CHANGELOG.md", "# Changes\n", "Add changelog"); err != nil {
+		t.Fatalf("Failed to commit changelog: %v", err)
+	}
+	if err := tr.CommitFile("deps.lock", "base\n", "Add lockfile"); err != nil {
+		t.Fatalf("Failed to commit lockfile: %v", err)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		gitOutput(t, tr.Path, "checkout", "-b", "feature/"+name, "main")
+		if err := tr.CommitFile("CHANGELOG.md", "# Changes\n- "+name+"\n", "Log "+name); err != nil {
+			t.Fatalf("Failed to commit on feature/%s: %v", name, err)
+		}
+		if err := tr.CommitFile("deps.lock", name+"\n", "Lock "+name); err != nil {
+			t.Fatalf("Failed to commit on feature/%s: %v", name, err)
+		}
+		gitOutput(t, tr.Path, "checkout", "main")
+		if err := runHitch(t, "promote", "feature/"+name, "to", "dev", "--no-rebuild"); err != nil {
+			t.Fatalf("promote failed: %v", err)
+		}
+	}
+
+	for _, args := range [][]string{{"rebuild", "dev"}, {"rebuild", "dev", "--clone"}} {
+		if err := runHitch(t, args...); err != nil {
+			t.Fatalf("hitch %s failed: %v", strings.Join(args, " "), err)
+		}
+		if got := gitOutput(t, tr.Path, "show", "dev:CHANGELOG.md"); got != "# Changes\n- a\n- b" {
+			t.Errorf("hitch %s: expected both changelog entries, got:\n%s", strings.Join(args, " "), got)
+		}
+		if got := gitOutput(t, tr.Path, "show", "dev:deps.lock"); got != "a" {
+			t.Errorf("hitch %s: expected the custom driver to keep feature/a's lockfile, got %q", strings.Join(args, " "), got)
+		}
+	}
+}
+
+func TestStatusShowsContributors(t *testing.T) {
+	tr := newHitchRepo(t)
+	t.Setenv("HITCH_OFFLINE", "1")
+
+	for _, who := range []string{"alice", "bob"} {
+		gitOutput(t, tr.Path, "config", "user.email", who+"@example.com")
+		gitOutput(t, tr.Path, "checkout", "-b", "feature/"+who, "main")
+		gitOutput(t, tr.Path, "checkout", "main")
+		if err := runHitch(t, "promote", "feature/"+who, "to", "dev", "--no-rebuild"); err != nil {
+			t.Fatalf("promote failed: %v", err)
+		}
+	}
+
+	out := captureStdout(t, func() {
+		if err := runHitch(t, "status"); err != nil {
+			t.Errorf("status failed: %v", err)
+		}
+	})
+	if !strings.Contains(out, "Contributors: alice@example.com, bob@example.com") {
+		t.Errorf("Expected dev's contributors in status, got:\n%s", out)
+	}
+
+	var buf bytes.Buffer
+	rootCmd.SetOut(&buf)
+	defer rootCmd.SetOut(nil)
+	if err := runHitch(t, "status", "--json"); err != nil {
+		t.Fatalf("status --json failed: %v", err)
+	}
+	var view statusView
+	if err := json.Unmarshal(buf.Bytes(), &view); err != nil {
+		t.Fatalf("Failed to parse status JSON: %v\n%s", err, buf.String())
+	}
+	for _, env := range view.Environments {
+		want := []string{}
+		if env.Name == "dev" {
+			want = []string{"alice@example.com", "bob@example.com"}
+		}
+		if !slices.Equal(env.Contributors, want) {
+			t.Errorf("Expected %s contributors %v, got %v", env.Name, want, env.Contributors)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/spf13/cobra"
+)
+
+// defaultHistoryKeep is how many promotion events compact-history keeps per
+// branch unless --keep says otherwise
+const defaultHistoryKeep = 10
+
+var (
+	compactKeep   int
+	compactDryRun bool
+)
+
+var compactHistoryCmd = &cobra.Command{
+	Use:   "compact-history",
+	Short: "Trim old promotion history from metadata",
+	Long: `Trim old promotion history from metadata.
+
+Every promote and demote adds to a branch's promoted_history in hitch.json,
+so on busy repositories it keeps growing. This keeps each branch's most
+recent events (--keep, default 10) and drops the rest.
+
+Promotions still in effect are always kept, and so are demotions from an
+environment that hasn't been rebuilt since, so status and pending-rebuild
+detection are unchanged.
+
+Example:
+  hitch compact-history --keep 5`,
+	Args: cobra.NoArgs,
+	RunE: runCompactHistory,
+}
+
+func init() {
+	compactHistoryCmd.Flags().IntVar(&compactKeep, "keep", defaultHistoryKeep, "Number of most recent events to keep per branch")
+	compactHistoryCmd.Flags().BoolVar(&compactDryRun, "dry-run", false, "Show how many events would be removed without changing metadata")
+	rootCmd.AddCommand(compactHistoryCmd)
+}
+
+func runCompactHistory(cmd *cobra.Command, args []string) error {
+	if compactKeep < 0 {
+		return fmt.Errorf("--keep must not be negative")
+	}
+
+	// 1. Open Git repository
+	repo, err := openRepo()
+	if err != nil {
+		errorMsg("Not a Git repository")
+		return err
+	}
+
+	// 2. Get current branch to return to
+	currentBranch, err := repo.CurrentBranch()
+	if err != nil {
+		errorMsg("Failed to get current branch")
+		return err
+	}
+	defer restoreBranch(repo, currentBranch)
+
+	// 3. Read metadata
+	reader := metadata.NewReader(repo.Repository)
+	if !reader.Exists() {
+		errorMsg("Hitch is not initialized in this repository")
+		fmt.Println("\nRun 'hitch init' to initialize Hitch.")
+		return fmt.Errorf("hitch not initialized")
+	}
+
+	meta, err := reader.Read()
+	if err != nil {
+		errorMsg("Failed to read metadata")
+		return err
+	}
+
+	if !compactDryRun {
+		if err := checkMetadataNotBehind(repo); err != nil {
+			return err
+		}
+
+		if err := checkNotFrozen(meta); err != nil {
+			return err
+		}
+	}
+
+	// 4. Compact
+	removed := meta.CompactHistory(compactKeep)
+	if removed == 0 {
+		success(fmt.Sprintf("Nothing to compact: no branch has more than %d removable events", compactKeep))
+		return nil
+	}
+
+	if compactDryRun {
+		info(fmt.Sprintf("Would remove %d promotion history events, keeping %d per branch", removed, compactKeep))
+		return nil
+	}
+
+	// 5. Write metadata
+	userEmail, err := repo.UserEmail()
+	if err != nil {
+		userEmailMissing()
+		return err
+	}
+	userName, _ := repo.UserName()
+
+	meta.UpdateMeta(userEmail, "hitch compact-history")
+
+	writer := metadata.NewWriter(repo.Repository)
+	if err := writer.Write(meta, fmt.Sprintf("Compact promotion history (keep %d per branch)", compactKeep), userName, userEmail); err != nil {
+		errorMsg("Failed to write metadata")
+		return err
+	}
+
+	success(fmt.Sprintf("Removed %d promotion history events, keeping %d per branch", removed, compactKeep))
+	return nil
+}
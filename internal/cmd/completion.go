@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/spf13/cobra"
+)
+
+// pinCompletionCommits is how many of a branch's recent commits are offered
+// after '@' when completing a pinned feature
+const pinCompletionCommits = 10
+
+func init() {
+	promoteCmd.ValidArgsFunction = completePromoteArgs
+	demoteCmd.ValidArgsFunction = completeDemoteArgs
+}
+
+// completePromoteArgs completes promote [<branch>[@<sha>]] to <environment>
+func completePromoteArgs(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	switch {
+	case len(args) == 0:
+		refs := completeFeatureRefs(toComplete)
+		if !strings.Contains(toComplete, "@") {
+			refs = append(refs, filterPrefix([]string{"to"}, toComplete)...)
+		}
+		return refs, cobra.ShellCompDirectiveNoFileComp
+	case args[len(args)-1] == "to":
+		return filterPrefix(completionEnvironments(), toComplete), cobra.ShellCompDirectiveNoFileComp
+	case len(args) == 1:
+		return filterPrefix([]string{"to"}, toComplete), cobra.ShellCompDirectiveNoFileComp
+	}
+	return nil, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeDemoteArgs completes demote <branch> [from <environment>], offering
+// only features that are in an environment
+func completeDemoteArgs(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	switch len(args) {
+	case 0:
+		meta := completionMetadata()
+		if meta == nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		var features []string
+		for _, name := range slices.Sorted(maps.Keys(meta.Branches)) {
+			if len(meta.Branches[name].PromotedTo) > 0 {
+				features = append(features, name)
+			}
+		}
+		return filterPrefix(features, toComplete), cobra.ShellCompDirectiveNoFileComp
+	case 1:
+		return filterPrefix([]string{"from"}, toComplete), cobra.ShellCompDirectiveNoFileComp
+	case 2:
+		return filterPrefix(completionEnvironments(), toComplete), cobra.ShellCompDirectiveNoFileComp
+	}
+	return nil, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeFeatureRefs completes <branch>[@<sha>]: local branches, or once
+// an '@' is typed, the branch's recent commits. Whatever is offered parses
+// with metadata.ParseFeatureRef.
+func completeFeatureRefs(toComplete string) []string {
+	repo, err := openRepo()
+	if err != nil {
+		return nil
+	}
+
+	branch, _, pinning := strings.Cut(toComplete, "@")
+	if pinning {
+		commits, err := repo.RecentCommits(branch, pinCompletionCommits)
+		if err != nil {
+			return nil
+		}
+		refs := make([]string, 0, len(commits))
+		for _, sha := range commits {
+			refs = append(refs, branch+"@"+sha)
+		}
+		return filterPrefix(refs, toComplete)
+	}
+
+	branches, err := repo.LocalBranches()
+	if err != nil {
+		return nil
+	}
+	var refs []string
+	for _, name := range branches {
+		if name != metadata.MetadataBranch && !strings.HasSuffix(name, "-hitch-temp") {
+			refs = append(refs, name)
+		}
+	}
+	return filterPrefix(refs, toComplete)
+}
+
+// completionEnvironments returns the environment names, and their aliases,
+// for completion
+func completionEnvironments() []string {
+	meta := completionMetadata()
+	if meta == nil {
+		return nil
+	}
+	names := meta.EnvironmentNames()
+	for alias := range meta.Config.Aliases {
+		names = append(names, alias)
+	}
+	return names
+}
+
+// completionMetadata reads metadata for completion, or returns nil; errors
+// are never shown while completing
+func completionMetadata() *metadata.Metadata {
+	repo, err := openRepo()
+	if err != nil {
+		return nil
+	}
+	meta, err := metadata.NewReader(repo.Repository).Read()
+	if err != nil {
+		return nil
+	}
+	return meta
+}
+
+// filterPrefix returns the candidates that start with prefix
+func filterPrefix(candidates []string, prefix string) []string {
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, prefix) {
+			matches = append(matches, c)
+		}
+	}
+	return matches
+}
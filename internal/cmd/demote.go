@@ -2,18 +2,25 @@ package cmd
 
 import (
 	"fmt"
+	"slices"
+	"strings"
 
 	hitchgit "github.com/DoomedRamen/hitch/internal/git"
 	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/DoomedRamen/hitch/internal/notify"
 	"github.com/spf13/cobra"
 )
 
 var (
 	demoteNoRebuild bool
+	demoteRebuild   bool
+	demoteAll       bool
+	demoteForce     bool
+	demoteMetaOnly  bool
 )
 
 var demoteCmd = &cobra.Command{
-	Use:   "demote <branch> from <environment>",
+	Use:   "demote <branch> [from <environment>]",
 	Short: "Remove a feature branch from an environment",
 	Long: `Remove a feature branch from an environment.
 
@@ -23,31 +30,83 @@ This command:
 3. Rebuilds environment without that branch
 4. Force-pushes rebuilt hitched branch
 5. Updates metadata
-6. Releases lock`,
-	Args: cobra.ExactArgs(3), // branch, "from", environment
+6. Releases lock
+
+Without "from <environment>", the branch is removed from every environment
+it was promoted to, and each is rebuilt.
+
+With --all, every feature is removed from the environment and it is rebuilt
+to match its base branch.
+
+Both of these ask for confirmation unless --force is given.
+
+If config.auto_rebuild_on_promote is false, environments aren't rebuilt
+unless --rebuild is given.
+
+With --metadata-only, demote only records the change in hitch.json and
+leaves the rebuild to a separate job, as with promote --metadata-only.
+
+Example:
+  hitch demote feature/login from dev
+  hitch demote feature/login
+  hitch demote --all from dev`,
+	Args: cobra.RangeArgs(1, 3), // [branch], "from", environment
 	RunE: runDemote,
 }
 
 func init() {
 	demoteCmd.Flags().BoolVar(&demoteNoRebuild, "no-rebuild", false, "Remove from metadata but don't rebuild")
+	demoteCmd.Flags().BoolVar(&demoteRebuild, "rebuild", false, "Rebuild even if config.auto_rebuild_on_promote is false")
+	demoteCmd.Flags().BoolVar(&demoteAll, "all", false, "Remove every feature from the environment")
+	demoteCmd.Flags().BoolVar(&demoteMetaOnly, "metadata-only", false, "Only record the demotion in metadata, without rebuilding")
+	demoteCmd.Flags().BoolVarP(&demoteForce, "force", "f", false, "Skip the confirmation prompt of --all or of demoting from every environment, and demote during a scheduled freeze")
 	rootCmd.AddCommand(demoteCmd)
 }
 
 func runDemote(cmd *cobra.Command, args []string) error {
-	if len(args) != 3 || args[1] != "from" {
-		return fmt.Errorf("usage: hitch demote <branch> from <environment>")
+	if demoteRebuild && demoteNoRebuild {
+		return fmt.Errorf("--rebuild cannot be combined with --no-rebuild")
+	}
+	if demoteMetaOnly && demoteRebuild {
+		return fmt.Errorf("--metadata-only cannot be combined with --rebuild")
 	}
 
-	branchName := args[0]
-	envName := args[2]
+	var branchName string
+	if demoteAll {
+		if len(args) != 2 || args[0] != "from" {
+			return fmt.Errorf("usage: hitch demote --all from <environment>")
+		}
+	} else {
+		if (len(args) != 1 && len(args) != 3) || (len(args) == 3 && args[1] != "from") {
+			return fmt.Errorf("usage: hitch demote <branch> [from <environment>]")
+		}
+		branch, pin, err := metadata.ParseFeatureRef(args[0])
+		if err != nil {
+			return err
+		}
+		if pin != "" {
+			return fmt.Errorf("demote removes the whole feature; drop @%s from %s", pin, args[0])
+		}
+		branchName = branch
+	}
+	// Without an environment the branch is demoted from everywhere
+	envName := ""
+	if len(args) > 1 {
+		envName = args[len(args)-1]
+	}
 
 	// 1. Open Git repository
-	repo, err := hitchgit.OpenRepo(".")
+	repo, err := openRepo()
 	if err != nil {
 		errorMsg("Not a Git repository")
 		return err
 	}
 
+	if err := checkNoInProgressOperation(repo); err != nil {
+		return err
+	}
+	warnIfShallow(repo)
+
 	// 2. Remember current branch
 	currentBranch, err := repo.CurrentBranch()
 	if err != nil {
@@ -55,9 +114,7 @@ func runDemote(cmd *cobra.Command, args []string) error {
 		currentBranch = currentCommit
 	}
 
-	defer func() {
-		repo.Checkout(currentBranch)
-	}()
+	defer restoreBranch(repo, currentBranch)
 
 	// 3. Read metadata
 	reader := metadata.NewReader(repo.Repository)
@@ -72,24 +129,51 @@ func runDemote(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	envName = meta.ResolveEnvironment(envName)
+
+	if err := checkMetadataNotBehind(repo); err != nil {
+		return err
+	}
+
+	if err := checkNotFrozen(meta); err != nil {
+		return err
+	}
+
 	// 4. Validate environment exists
-	_, exists := meta.Environments[envName]
-	if !exists {
+	if _, exists := meta.Environments[envName]; !exists && envName != "" {
 		errorMsg(fmt.Sprintf("Environment '%s' not found", envName))
 		return fmt.Errorf("environment not found")
 	}
+	if envName != "" {
+		if err := checkFreezeWindow(meta, envName, demoteForce); err != nil {
+			return err
+		}
+	}
 
 	// 5. Get user info
 	userEmail, err := repo.UserEmail()
 	if err != nil {
-		errorMsg("Git user.email is not configured")
+		userEmailMissing()
 		return err
 	}
 
 	userName, _ := repo.UserName()
 
+	if demoteAll {
+		return demoteAllFeatures(repo, envName, userEmail, userName, meta)
+	}
+	if envName == "" {
+		return demoteEverywhere(repo, branchName, userEmail, userName, meta)
+	}
+
 	fmt.Printf("Demoting %s from %s...\n\n", branchName, envName)
 
+	if dependents := meta.StackDependents(envName, branchName); len(dependents) > 0 {
+		stack, _ := meta.StackOf(branchName)
+		warning(fmt.Sprintf("%s depends on %s in stack %s and stays in %s", strings.Join(dependents, ", "), branchName, stack, envName))
+		fmt.Printf("  The rebuild may fail or %s may break without it\n\n", envName)
+	}
+
 	// 6. Remove from metadata
 	if err := meta.RemoveBranchFromEnvironment(envName, branchName, userEmail); err != nil {
 		errorMsg("Failed to remove branch from environment")
@@ -107,9 +191,21 @@ func runDemote(cmd *cobra.Command, args []string) error {
 	}
 
 	success("Updated metadata")
+	sendNotification(meta, notify.Event{
+		Event:       notify.EventDemote,
+		Environment: envName,
+		Branch:      branchName,
+		User:        userEmail,
+		Message:     fmt.Sprintf("%s demoted %s from %s", userEmail, branchName, envName),
+	})
 
-	// 8. Rebuild environment (unless --no-rebuild)
-	if demoteNoRebuild {
+	// 8. Rebuild environment (unless --metadata-only, --no-rebuild, or
+	// config says not to)
+	if demoteMetaOnly {
+		metadataOnlyNote(envName)
+		return nil
+	}
+	if skipRebuild(meta, demoteNoRebuild, demoteRebuild) {
 		fmt.Println()
 		warning(fmt.Sprintf("Skipped rebuild (use 'hitch rebuild %s' to rebuild)", envName))
 		return nil
@@ -120,3 +216,171 @@ func runDemote(cmd *cobra.Command, args []string) error {
 	// Rebuild
 	return runRebuildInternal(repo, envName, userEmail, userName, meta)
 }
+
+// demoteAllFeatures removes every feature from envName after confirmation,
+// then rebuilds it to match its base
+func demoteAllFeatures(repo *hitchgit.Repo, envName string, userEmail string, userName string, meta *metadata.Metadata) error {
+	features := meta.Environments[envName].Features
+	if len(features) == 0 {
+		info(fmt.Sprintf("%s has no features to demote", envName))
+		return nil
+	}
+
+	fmt.Printf("This will demote %d feature(s) from %s:\n", len(features), envName)
+	for _, feature := range features {
+		fmt.Printf("  - %s\n", feature)
+	}
+	fmt.Println()
+
+	if !demoteForce {
+		ok, err := confirm(fmt.Sprintf("Demote all features from %s?", envName))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			info("Demote cancelled")
+			return nil
+		}
+		fmt.Println()
+	}
+
+	// 6. Remove from metadata
+	removed, err := meta.ClearEnvironment(envName, userEmail)
+	if err != nil {
+		errorMsg("Failed to remove features from environment")
+		return err
+	}
+
+	success(fmt.Sprintf("Removed %d feature(s) from %s feature list", len(removed), envName))
+
+	// 7. Write metadata
+	writer := metadata.NewWriter(repo.Repository)
+	meta.UpdateMeta(userEmail, fmt.Sprintf("hitch demote --all from %s", envName))
+	if err := writer.Write(meta, fmt.Sprintf("Demote all features from %s", envName), userName, userEmail); err != nil {
+		errorMsg("Failed to write metadata")
+		return err
+	}
+
+	success("Updated metadata")
+	for _, feature := range removed {
+		sendNotification(meta, notify.Event{
+			Event:       notify.EventDemote,
+			Environment: envName,
+			Branch:      feature,
+			User:        userEmail,
+			Message:     fmt.Sprintf("%s demoted %s from %s", userEmail, feature, envName),
+		})
+	}
+
+	// 8. Rebuild environment (unless --metadata-only, --no-rebuild, or
+	// config says not to)
+	if demoteMetaOnly {
+		metadataOnlyNote(envName)
+		return nil
+	}
+	if skipRebuild(meta, demoteNoRebuild, demoteRebuild) {
+		fmt.Println()
+		warning(fmt.Sprintf("Skipped rebuild (use 'hitch rebuild %s' to rebuild)", envName))
+		return nil
+	}
+
+	fmt.Println()
+
+	return runRebuildInternal(repo, envName, userEmail, userName, meta)
+}
+
+// demoteEverywhere removes branchName from every environment in its
+// promoted_to after confirmation, then rebuilds each of them
+func demoteEverywhere(repo *hitchgit.Repo, branchName string, userEmail string, userName string, meta *metadata.Metadata) error {
+	var envs []string
+	for _, envName := range meta.Branches[branchName].PromotedTo {
+		if _, exists := meta.Environments[envName]; exists {
+			envs = append(envs, envName)
+		}
+	}
+	slices.Sort(envs)
+	if len(envs) == 0 {
+		info(fmt.Sprintf("%s is not in any environment", branchName))
+		return nil
+	}
+
+	for _, envName := range envs {
+		if err := checkFreezeWindow(meta, envName, demoteForce); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("This will demote %s from %s\n\n", branchName, strings.Join(envs, ", "))
+	for _, envName := range envs {
+		if dependents := meta.StackDependents(envName, branchName); len(dependents) > 0 {
+			stack, _ := meta.StackOf(branchName)
+			warning(fmt.Sprintf("%s depends on %s in stack %s and stays in %s", strings.Join(dependents, ", "), branchName, stack, envName))
+		}
+	}
+
+	if !demoteForce {
+		ok, err := confirm(fmt.Sprintf("Demote %s from %d environment(s)?", branchName, len(envs)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			info("Demote cancelled")
+			return nil
+		}
+		fmt.Println()
+	}
+
+	// 6. Remove from metadata
+	for _, envName := range envs {
+		if err := meta.RemoveBranchFromEnvironment(envName, branchName, userEmail); err != nil {
+			errorMsg(fmt.Sprintf("Failed to remove branch from %s", envName))
+			return err
+		}
+		success(fmt.Sprintf("Removed %s from %s feature list", branchName, envName))
+	}
+
+	// 7. Write metadata
+	writer := metadata.NewWriter(repo.Repository)
+	meta.UpdateMeta(userEmail, fmt.Sprintf("hitch demote %s", branchName))
+	if err := writer.Write(meta, fmt.Sprintf("Demote %s from %s", branchName, strings.Join(envs, ", ")), userName, userEmail); err != nil {
+		errorMsg("Failed to write metadata")
+		return err
+	}
+
+	success("Updated metadata")
+	for _, envName := range envs {
+		sendNotification(meta, notify.Event{
+			Event:       notify.EventDemote,
+			Environment: envName,
+			Branch:      branchName,
+			User:        userEmail,
+			Message:     fmt.Sprintf("%s demoted %s from %s", userEmail, branchName, envName),
+		})
+	}
+
+	// 8. Rebuild each environment (unless --metadata-only, --no-rebuild, or
+	// config says not to); one failing doesn't stop the others
+	if demoteMetaOnly {
+		metadataOnlyNote(envs...)
+		return nil
+	}
+	if skipRebuild(meta, demoteNoRebuild, demoteRebuild) {
+		fmt.Println()
+		warning(fmt.Sprintf("Skipped rebuilds (use 'hitch rebuild <environment>' for %s)", strings.Join(envs, ", ")))
+		return nil
+	}
+
+	var failed []string
+	for _, envName := range envs {
+		fmt.Println()
+		if err := runRebuildInternal(repo, envName, userEmail, userName, meta); err != nil {
+			failed = append(failed, envName)
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Println()
+		errorMsg(fmt.Sprintf("%s was demoted, but rebuilding %s failed", branchName, strings.Join(failed, ", ")))
+		return fmt.Errorf("failed to rebuild %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/DoomedRamen/hitch/internal/forge"
+	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/DoomedRamen/hitch/internal/notify"
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check Hitch metadata for problems",
+	Long: `Check Hitch metadata for problems.
+
+Runs a series of read-only checks against hitch.json and the repository
+and reports anything that will cause other commands to misbehave:
+- A hitch-metadata branch that exists on origin but not locally
+- Config values that aren't legal, such as an unknown conflict_strategy
+- Environment names that aren't valid branch names
+- Environments whose bases form a loop, such as one based on itself
+- Environment feature lists that disagree with branches' promoted_to
+- Tracked branches that were deleted and are in no environment
+- Features still in an environment after being merged to main
+- Shallow clones, where merges and ancestry checks can't see the full history
+
+With --notify-test, doctor also checks integrations over the network: each
+notification webhook gets a HEAD request (no event is sent) and the
+configured code host's token is tried with a lightweight API call. A health
+summary is printed and failures count as problems.
+
+With --fix, doctor repairs what it can: the local hitch-metadata branch is
+created from origin, illegal config values are reset to their defaults,
+promoted_to is reconciled with feature lists (feature lists win), and
+entries for deleted branches are removed. The metadata repairs are written
+to hitch-metadata as a single commit listing them.
+
+Exits non-zero if any problems are found.`,
+	Args: cobra.NoArgs,
+	RunE: runDoctor,
+}
+
+// doctorIssue is a single problem reported by a doctor check
+type doctorIssue struct {
+	Message string
+	Hint    string
+}
+
+// doctorCheck inspects the repository and metadata and returns any problems
+type doctorCheck func(repo *hitchgit.Repo, meta *metadata.Metadata) []doctorIssue
+
+var doctorChecks = []doctorCheck{
+	checkConfigValues,
+	checkEnvironmentNames,
+	checkBaseCycles,
+	checkPromotionConsistency,
+	checkOrphanedBranches,
+	checkMergedFeatures,
+	checkShallowClone,
+}
+
+var (
+	doctorFix        bool
+	doctorNotifyTest bool
+)
+
+func init() {
+	doctorCmd.Flags().BoolVar(&doctorFix, "fix", false, "Repair what can be repaired and commit the result")
+	doctorCmd.Flags().BoolVar(&doctorNotifyTest, "notify-test", false, "Also check that webhooks are reachable and the code host token works")
+	rootCmd.AddCommand(doctorCmd)
+}
+
+func runDoctor(cmd *cobra.Command, args []string) error {
+	// 1. Open Git repository
+	repo, err := openRepo()
+	if err != nil {
+		errorMsg("Not a Git repository")
+		return err
+	}
+
+	// 2. Read metadata, restoring the local branch from origin if needed
+	reader := metadata.NewReader(repo.Repository)
+	if !reader.Exists() {
+		if !metadataOnlyOnRemote(repo) {
+			errorMsg("Hitch is not initialized in this repository")
+			fmt.Println("\nRun 'hitch init' to initialize Hitch.")
+			return fmt.Errorf("hitch not initialized")
+		}
+		if !doctorFix {
+			warning(fmt.Sprintf("%s exists on origin but not locally", metadata.MetadataBranch))
+			fmt.Println("  Run 'hitch doctor --fix' or 'hitch sync' to create it")
+			fmt.Println()
+			return fmt.Errorf("doctor found 1 problem(s)")
+		}
+		remoteRef := "origin/" + metadata.MetadataBranch
+		if err := repo.CreateBranch(metadata.MetadataBranch, remoteRef); err != nil {
+			errorMsg(fmt.Sprintf("Failed to create local %s", metadata.MetadataBranch))
+			return err
+		}
+		success(fmt.Sprintf("Created local %s from %s", metadata.MetadataBranch, remoteRef))
+	}
+
+	// Config values are checked below rather than refused here, so they can
+	// be reported and repaired
+	meta, err := reader.ReadUnvalidated()
+	if err != nil {
+		errorMsg("Failed to read metadata")
+		return err
+	}
+
+	// 3. Repair what can be repaired automatically
+	if doctorFix {
+		if err := applyDoctorRepairs(repo, meta); err != nil {
+			return err
+		}
+	}
+
+	// 4. Run checks
+	issues := runDoctorChecks(repo, meta)
+	if doctorNotifyTest {
+		issues = append(issues, checkIntegrations(meta)...)
+	}
+	if len(issues) == 0 {
+		success("No problems found")
+		return nil
+	}
+
+	for _, issue := range issues {
+		warning(issue.Message)
+		if issue.Hint != "" {
+			fmt.Printf("  %s\n", issue.Hint)
+		}
+	}
+
+	fmt.Println()
+	return fmt.Errorf("doctor found %d problem(s)", len(issues))
+}
+
+// runDoctorChecks runs every registered check and collects the issues found
+func runDoctorChecks(repo *hitchgit.Repo, meta *metadata.Metadata) []doctorIssue {
+	issues := []doctorIssue{}
+	for _, check := range doctorChecks {
+		issues = append(issues, check(repo, meta)...)
+	}
+	return issues
+}
+
+// checkConfigValues reports config values that reading hitch.json would
+// refuse
+func checkConfigValues(repo *hitchgit.Repo, meta *metadata.Metadata) []doctorIssue {
+	issues := []doctorIssue{}
+	invalid := meta.InvalidConfigValues()
+	for _, problem := range invalid {
+		issues = append(issues, doctorIssue{
+			Message: problem,
+			Hint:    "Run 'hitch doctor --fix' to reset it to the default",
+		})
+	}
+	// Anything else, such as a negative count, needs a hand edit
+	if err := meta.ValidateConfig(); err != nil && len(invalid) == 0 {
+		issues = append(issues, doctorIssue{
+			Message: err.Error(),
+			Hint:    "Fix the value in hitch.json on the hitch-metadata branch",
+		})
+	}
+	return issues
+}
+
+// checkEnvironmentNames reports environments whose names can't be used as
+// hitched branch names
+func checkEnvironmentNames(repo *hitchgit.Repo, meta *metadata.Metadata) []doctorIssue {
+	issues := []doctorIssue{}
+	for _, name := range meta.EnvironmentNames() {
+		if err := metadata.ValidateEnvironmentName(name); err != nil {
+			issues = append(issues, doctorIssue{
+				Message: err.Error(),
+				Hint:    "Rename the environment in hitch.json on the hitch-metadata branch",
+			})
+		}
+	}
+	return issues
+}
+
+// checkBaseCycles reports environments whose bases lead back to themselves,
+// which rebuild refuses
+func checkBaseCycles(repo *hitchgit.Repo, meta *metadata.Metadata) []doctorIssue {
+	issues := []doctorIssue{}
+	for _, cycle := range meta.BaseCycles() {
+		issues = append(issues, doctorIssue{
+			Message: "Environment bases form a loop: " + describeBaseCycle(cycle),
+			Hint:    "Set each environment's base to a branch that isn't an environment in hitch.json on the hitch-metadata branch",
+		})
+	}
+	return issues
+}
+
+// describeBaseCycle shows a loop of bases, e.g. "dev -> qa -> dev"
+func describeBaseCycle(cycle []string) string {
+	return strings.Join(append(slices.Clone(cycle), cycle[0]), " -> ")
+}
+
+// checkPromotionConsistency reports features whose environment membership
+// disagrees with their branch's promoted_to
+func checkPromotionConsistency(repo *hitchgit.Repo, meta *metadata.Metadata) []doctorIssue {
+	issues := []doctorIssue{}
+	for _, problem := range meta.Inconsistencies() {
+		issues = append(issues, doctorIssue{
+			Message: problem,
+			Hint:    "Run 'hitch doctor --fix' to repair",
+		})
+	}
+	return issues
+}
+
+// checkOrphanedBranches reports tracked branches that no longer exist and
+// are in no environment
+func checkOrphanedBranches(repo *hitchgit.Repo, meta *metadata.Metadata) []doctorIssue {
+	issues := []doctorIssue{}
+	for _, branch := range meta.OrphanedBranches(repo.BranchExists) {
+		issues = append(issues, doctorIssue{
+			Message: fmt.Sprintf("%s is tracked in metadata but the branch was deleted", branch),
+			Hint:    "Run 'hitch doctor --fix' to remove the entry",
+		})
+	}
+	return issues
+}
+
+// checkMergedFeatures reports features that are already merged to main but
+// are still in an environment, so rebuilds merge them for nothing
+func checkMergedFeatures(repo *hitchgit.Repo, meta *metadata.Metadata) []doctorIssue {
+	issues := []doctorIssue{}
+	merged := meta.MergedFeaturesInEnvironments()
+	for _, envName := range meta.EnvironmentNames() {
+		for _, feature := range merged[envName] {
+			issues = append(issues, doctorIssue{
+				Message: fmt.Sprintf("%s is already merged to main but is still in %s", feature, envName),
+				Hint:    fmt.Sprintf("Run 'hitch demote %s from %s' to remove it", feature, envName),
+			})
+		}
+	}
+	return issues
+}
+
+// checkShallowClone reports a shallow clone, where rebuilds, releases, and
+// ancestry checks can't see the full history
+func checkShallowClone(repo *hitchgit.Repo, meta *metadata.Metadata) []doctorIssue {
+	if !repo.IsShallow() {
+		return []doctorIssue{}
+	}
+	return []doctorIssue{{
+		Message: "Repository is a shallow clone; merge bases and ancestry checks may be wrong",
+		Hint:    "Run 'git fetch --unshallow' to fetch the full history",
+	}}
+}
+
+// checkIntegrations contacts each notification webhook and the configured
+// code host, printing a health summary, and returns the ones that failed.
+// Unlike the other checks it needs the network, so it only runs with
+// --notify-test.
+func checkIntegrations(meta *metadata.Metadata) []doctorIssue {
+	issues := []doctorIssue{}
+	if isOffline() {
+		info("Offline mode: skipping webhook and code host checks")
+		fmt.Println()
+		return issues
+	}
+
+	total := 0
+	for _, hook := range meta.Config.NotificationWebhooks {
+		total++
+		if err := notify.Ping(hook); err != nil {
+			issues = append(issues, doctorIssue{
+				Message: err.Error(),
+				Hint:    "Fix or remove the webhook in config.notification_webhooks",
+			})
+			continue
+		}
+		success(fmt.Sprintf("Webhook %s is reachable", hook.URL))
+	}
+
+	f, err := newForge(meta.Config)
+	var missing *forge.MissingTokenError
+	switch {
+	case errors.As(err, &missing):
+		total++
+		issues = append(issues, doctorIssue{
+			Message: err.Error(),
+			Hint:    fmt.Sprintf("Export %s with an API token", missing.Env),
+		})
+	case err != nil:
+		total++
+		issues = append(issues, doctorIssue{Message: err.Error()})
+	case f != nil:
+		total++
+		if err := f.CheckAccess(); err != nil {
+			issues = append(issues, doctorIssue{
+				Message: fmt.Sprintf("%s API check failed: %v", f.Name(), err),
+				Hint:    "Check the token and project in the code host config",
+			})
+		} else {
+			success(fmt.Sprintf("%s API accepted the token", f.Name()))
+		}
+	}
+
+	if total == 0 {
+		info("No webhooks or code host integration configured")
+	} else {
+		info(fmt.Sprintf("Integrations: %d of %d healthy", total-len(issues), total))
+	}
+	fmt.Println()
+	return issues
+}
+
+// applyDoctorRepairs makes every repair doctor knows, and writes them to meta
+// as one commit listing them if anything changed
+func applyDoctorRepairs(repo *hitchgit.Repo, meta *metadata.Metadata) error {
+	repairs := meta.RepairConfig()
+	repairs = append(repairs, meta.Reconcile()...)
+	for _, branch := range meta.OrphanedBranches(repo.BranchExists) {
+		delete(meta.Branches, branch)
+		repairs = append(repairs, fmt.Sprintf("Removed %s, a deleted branch, from metadata", branch))
+	}
+	if len(repairs) == 0 {
+		return nil
+	}
+
+	if err := checkMetadataNotBehind(repo); err != nil {
+		return err
+	}
+
+	if err := checkNotFrozen(meta); err != nil {
+		return err
+	}
+
+	userEmail, err := repo.UserEmail()
+	if err != nil {
+		userEmailMissing()
+		return err
+	}
+	userName, _ := repo.UserName()
+
+	// Writing checks out hitch-metadata, so return to the current branch after
+	currentBranch, err := repo.CurrentBranch()
+	if err != nil {
+		currentBranch, _ = repo.CurrentCommitSHA()
+	}
+	defer restoreBranch(repo, currentBranch)
+
+	writer := metadata.NewWriter(repo.Repository)
+	meta.UpdateMeta(userEmail, "hitch doctor --fix")
+	message := fmt.Sprintf("Repair metadata (%d fixes)\n", len(repairs))
+	for _, repair := range repairs {
+		message += "\n- " + repair
+	}
+	if err := writer.Write(meta, message, userName, userEmail); err != nil {
+		errorMsg("Failed to write metadata")
+		return err
+	}
+
+	for _, repair := range repairs {
+		success(repair)
+	}
+	fmt.Println()
+	return nil
+}
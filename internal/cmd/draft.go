@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+)
+
+// releaseDraftFile is where `hitch release --draft` records the merge it left
+// on the base branch, in the git dir so it's never committed
+const releaseDraftFile = "hitch-release-draft.json"
+
+// draftRelease is a release merged locally by --draft and waiting for
+// --publish to push it and record it in metadata
+type draftRelease struct {
+	Branch    string    `json:"branch"`
+	Base      string    `json:"base"`
+	BranchSHA string    `json:"branch_sha"`
+	PreMerge  string    `json:"pre_merge"`
+	Merge     string    `json:"merge"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func draftReleasePath(repo *hitchgit.Repo) (string, error) {
+	gitDir, err := repo.GitDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(gitDir, releaseDraftFile), nil
+}
+
+// loadDraftRelease returns the pending draft release, or nil if there is
+// none. A draft whose merge is no longer the tip of its base, because the
+// base was reset or moved on, is discarded.
+func loadDraftRelease(repo *hitchgit.Repo) (*draftRelease, error) {
+	path, err := draftReleasePath(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read draft release: %w", err)
+	}
+
+	var draft draftRelease
+	if err := json.Unmarshal(data, &draft); err != nil {
+		return nil, fmt.Errorf("failed to parse draft release %s: %w", path, err)
+	}
+
+	if tip, err := repo.ResolveCommit(draft.Base); err != nil || tip != draft.Merge {
+		return nil, clearDraftRelease(repo)
+	}
+	return &draft, nil
+}
+
+// saveDraftRelease records draft for a later --publish
+func saveDraftRelease(repo *hitchgit.Repo, draft *draftRelease) error {
+	path, err := draftReleasePath(repo)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(draft, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode draft release: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write draft release: %w", err)
+	}
+	return nil
+}
+
+// clearDraftRelease removes the saved draft release, if any
+func clearDraftRelease(repo *hitchgit.Repo) error {
+	path, err := draftReleasePath(repo)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove draft release: %w", err)
+	}
+	return nil
+}
+
+// discardDraftHint tells the user how to throw away draft's merge
+func discardDraftHint(draft *draftRelease) {
+	fmt.Println("\nTo discard the draft instead:")
+	fmt.Printf("  git checkout %s && git reset --hard %s\n", draft.Base, draft.PreMerge)
+}
+
+// checkDraftCurrent refuses to publish a draft whose feature branch gained
+// commits after the draft merge, which the merge wouldn't include
+func checkDraftCurrent(repo *hitchgit.Repo, draft *draftRelease) error {
+	tip, err := repo.ResolveCommit(draft.Branch)
+	if err != nil {
+		errorMsg(fmt.Sprintf("Failed to read %s", draft.Branch))
+		return err
+	}
+	if tip == draft.BranchSHA {
+		return nil
+	}
+
+	errorMsg(fmt.Sprintf("%s has new commits since the draft was merged", draft.Branch))
+	discardDraftHint(draft)
+	fmt.Printf("Then draft it again: hitch release %s --draft\n", draft.Branch)
+	return fmt.Errorf("draft release of %s is out of date", draft.Branch)
+}
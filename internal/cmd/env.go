@@ -0,0 +1,519 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+var envCmd = &cobra.Command{
+	Use:   "env <command>",
+	Short: "Inspect environments",
+	Long: `Inspect environments.
+
+Available commands:
+  show <environment>           - Everything Hitch knows about one environment
+  reflog <environment>         - Commits recent rebuilds set the environment to
+  rollback <environment> <sha> - Reset the environment to an earlier build`,
+}
+
+var envReflogCmd = &cobra.Command{
+	Use:   "reflog <environment>",
+	Short: "List the commits recent rebuilds set an environment to",
+	Long: `List the commits recent rebuilds set an environment to.
+
+Every rebuild force-pushes the hitched branch, so its earlier tips are only
+in the local reflog of whoever rebuilt it. Hitch records the last 20 in
+metadata instead, newest first, with who made each one and which features
+it merged. Any of them can be restored with 'hitch env rollback'.
+
+Example:
+  hitch env reflog qa
+  hitch env reflog qa --json`,
+	Args: cobra.ExactArgs(1),
+	RunE: runEnvReflog,
+}
+
+var envRollbackCmd = &cobra.Command{
+	Use:   "rollback <environment> <sha>",
+	Short: "Reset an environment to an earlier build",
+	Long: `Reset an environment to an earlier build.
+
+Points the hitched branch back at a commit from 'hitch env reflog', for
+when a rebuild produced a bad build, and pushes it. The environment's
+features are left as they are, so demote whatever broke the build before
+the next rebuild merges it again.
+
+Example:
+  hitch env rollback qa 3f2a9c1`,
+	Args: cobra.ExactArgs(2),
+	RunE: runEnvRollback,
+}
+
+var envRollbackForce bool
+
+var envShowCmd = &cobra.Command{
+	Use:   "show <environment>",
+	Short: "Show everything about one environment",
+	Long: `Show everything about one environment.
+
+Where 'hitch status' summarizes every environment, this shows one in full:
+its base, its features in merge order with when each was promoted, any pin,
+and how far each is ahead of and behind the base, its lock with holder, host,
+reason, and context, its last rebuild, and whether it has drifted or needs a
+rebuild.
+
+Example:
+  hitch env show qa
+  hitch env show qa --json`,
+	Args: cobra.ExactArgs(1),
+	RunE: runEnvShow,
+}
+
+func init() {
+	envRollbackCmd.Flags().BoolVar(&envRollbackForce, "force", false, "Roll back even if the environment is locked by someone else or in a scheduled freeze")
+	envCmd.AddCommand(envShowCmd)
+	envCmd.AddCommand(envReflogCmd)
+	envCmd.AddCommand(envRollbackCmd)
+	rootCmd.AddCommand(envCmd)
+}
+
+// environmentDetail is the JSON view printed by env show --json
+type environmentDetail struct {
+	Name     string          `json:"name"`
+	Base     string          `json:"base"`
+	Features []featureDetail `json:"features"`
+	// Where the hitched branch is now, if it exists
+	Commit            string     `json:"commit,omitempty"`
+	LastRebuild       *time.Time `json:"last_rebuild,omitempty"`
+	LastRebuildCommit string     `json:"last_rebuild_commit,omitempty"`
+	Locked            bool       `json:"locked"`
+	LockedBy          string     `json:"locked_by,omitempty"`
+	LockedAt          *time.Time `json:"locked_at,omitempty"`
+	LockedReason      string     `json:"locked_reason,omitempty"`
+	LockedHost        string     `json:"locked_host,omitempty"`
+	LockedContext     string     `json:"locked_context,omitempty"`
+	StaleLock         bool       `json:"stale_lock"`
+	Drifted           bool       `json:"drifted"`
+	PendingRebuild    bool       `json:"pending_rebuild"`
+}
+
+// featureDetail is one feature of an environment, in merge order. Ahead and
+// Behind count commits relative to the environment's base, and are null if
+// the branch is missing.
+type featureDetail struct {
+	Name       string     `json:"name"`
+	Pin        string     `json:"pin,omitempty"`
+	PromotedAt *time.Time `json:"promoted_at,omitempty"`
+	Ahead      *int       `json:"ahead"`
+	Behind     *int       `json:"behind"`
+	Missing    bool       `json:"missing"`
+	Skipped    bool       `json:"skipped"`
+}
+
+func runEnvShow(cmd *cobra.Command, args []string) error {
+	// 1. Open Git repository
+	repo, err := openRepo()
+	if err != nil {
+		errorMsg("Not a Git repository")
+		return err
+	}
+
+	// 2. Read metadata
+	reader := metadata.NewReader(repo.Repository)
+	if !reader.Exists() {
+		errorMsg("Hitch is not initialized in this repository")
+		fmt.Println("\nRun 'hitch init' to initialize Hitch.")
+		return fmt.Errorf("hitch not initialized")
+	}
+
+	meta, err := reader.Read()
+	if err != nil {
+		errorMsg("Failed to read metadata")
+		return err
+	}
+
+	envName := meta.ResolveEnvironment(args[0])
+	if _, exists := meta.Environments[envName]; !exists {
+		errorMsg(fmt.Sprintf("Environment '%s' not found", envName))
+		fmt.Println("\nAvailable environments:")
+		for _, name := range meta.EnvironmentNames() {
+			fmt.Printf("  - %s\n", name)
+		}
+		return fmt.Errorf("environment not found")
+	}
+
+	// 3. Display
+	detail := describeEnvironment(meta, repo, envName)
+	if jsonOutput {
+		encoder := json.NewEncoder(jsonOut)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(detail)
+	}
+
+	displayEnvironmentDetail(repo, detail)
+	return nil
+}
+
+// describeEnvironment gathers envName's metadata, its derived state, and
+// how each feature compares with the base
+func describeEnvironment(meta *metadata.Metadata, repo *hitchgit.Repo, envName string) environmentDetail {
+	env := meta.Environments[envName]
+	state := computeEnvironmentState(meta, repo, envName)
+
+	detail := environmentDetail{
+		Name:              envName,
+		Base:              env.Base,
+		Features:          []featureDetail{},
+		LastRebuildCommit: env.LastRebuildCommit,
+		Locked:            env.Locked,
+		StaleLock:         state.StaleLock,
+		Drifted:           state.Drifted,
+		PendingRebuild:    state.PendingRebuild,
+	}
+	if commit, err := repo.ResolveCommit(envName); err == nil {
+		detail.Commit = commit
+	}
+	if !env.LastRebuild.IsZero() {
+		lastRebuild := env.LastRebuild.UTC()
+		detail.LastRebuild = &lastRebuild
+	}
+	if env.Locked {
+		lockedAt := env.LockedAt.UTC()
+		detail.LockedBy = env.LockedBy
+		detail.LockedAt = &lockedAt
+		detail.LockedReason = env.LockedReason
+		detail.LockedHost = env.LockedHost
+		detail.LockedContext = env.LockedContext
+	}
+
+	for _, feature := range meta.MergeOrder(env.Features) {
+		f := featureDetail{
+			Name:    feature,
+			Pin:     env.Pins[feature],
+			Skipped: slices.Contains(env.Skipped, feature),
+		}
+		if promoted, ok := promotedAt(meta, feature, envName); ok {
+			promoted = promoted.UTC()
+			f.PromotedAt = &promoted
+		}
+		if ahead, behind, err := repo.AheadBehind(env.MergeRef(feature), env.Base); err == nil {
+			f.Ahead, f.Behind = &ahead, &behind
+		} else {
+			f.Missing = !repo.BranchExists(feature)
+		}
+		detail.Features = append(detail.Features, f)
+	}
+
+	return detail
+}
+
+func displayEnvironmentDetail(repo *hitchgit.Repo, d environmentDetail) {
+	yesNo := func(b bool) string {
+		if b {
+			return color.YellowString("yes")
+		}
+		return "no"
+	}
+
+	color.New(color.Bold).Printf("Environment: %s\n", color.CyanString(d.Name))
+	fmt.Printf("  Base: %s\n", d.Base)
+	if d.Commit != "" {
+		fmt.Printf("  Commit: %s\n", shortSHA(repo, d.Commit))
+	} else {
+		fmt.Printf("  Commit: %s\n", color.RedString("(branch missing)"))
+	}
+
+	if d.LastRebuild != nil {
+		fmt.Printf("  Last rebuild: %s, %s (%s)\n", d.LastRebuild.Local().Format("2006-01-02 15:04"), formatTimeAgo(*d.LastRebuild), shortSHA(repo, d.LastRebuildCommit))
+	} else {
+		fmt.Println("  Last rebuild: never")
+	}
+	if d.Drifted {
+		fmt.Printf("  Drifted: %s (%s has moved since its last rebuild)\n", yesNo(true), d.Name)
+	} else {
+		fmt.Printf("  Drifted: %s\n", yesNo(false))
+	}
+	fmt.Printf("  Pending rebuild: %s\n", yesNo(d.PendingRebuild))
+
+	if d.Locked {
+		lock := color.RedString("locked by %s since %s (%s)", d.LockedBy, d.LockedAt.Local().Format("2006-01-02 15:04"), formatTimeAgo(*d.LockedAt))
+		if d.StaleLock {
+			lock += color.YellowString(" (STALE)")
+		}
+		fmt.Printf("  Lock: %s\n", lock)
+		if d.LockedReason != "" {
+			fmt.Printf("    Reason: %s\n", d.LockedReason)
+		}
+		if d.LockedHost != "" {
+			fmt.Printf("    Host: %s\n", d.LockedHost)
+		}
+		if d.LockedContext != "" {
+			fmt.Printf("    Context: %s\n", d.LockedContext)
+		}
+	} else {
+		fmt.Printf("  Lock: %s\n", color.GreenString("unlocked"))
+	}
+
+	fmt.Println()
+	if len(d.Features) == 0 {
+		fmt.Println("Features: (none)")
+		return
+	}
+
+	fmt.Println("Features (merge order):")
+	for i, f := range d.Features {
+		line := fmt.Sprintf("  %d. %s", i+1, f.Name)
+		if f.Pin != "" {
+			line += fmt.Sprintf(" (pinned at %s)", shortSHA(repo, f.Pin))
+		}
+		switch {
+		case f.Missing:
+			line += color.RedString(" (branch missing)")
+		case f.Ahead != nil:
+			line += fmt.Sprintf(", %d ahead / %d behind %s", *f.Ahead, *f.Behind, d.Base)
+		}
+		if f.PromotedAt != nil {
+			line += fmt.Sprintf(", promoted %s", formatTimeAgo(*f.PromotedAt))
+		}
+		if f.Skipped {
+			line += color.YellowString(" (skipped by last rebuild)")
+		}
+		fmt.Println(line)
+	}
+}
+
+// reflogLine is one entry of env reflog --json
+type reflogLine struct {
+	metadata.ReflogEntry
+	// Whether the hitched branch is at this commit now
+	Current bool `json:"current"`
+}
+
+func runEnvReflog(cmd *cobra.Command, args []string) error {
+	// 1. Open Git repository
+	repo, err := openRepo()
+	if err != nil {
+		errorMsg("Not a Git repository")
+		return err
+	}
+
+	// 2. Read metadata
+	reader := metadata.NewReader(repo.Repository)
+	if !reader.Exists() {
+		errorMsg("Hitch is not initialized in this repository")
+		fmt.Println("\nRun 'hitch init' to initialize Hitch.")
+		return fmt.Errorf("hitch not initialized")
+	}
+
+	meta, err := reader.Read()
+	if err != nil {
+		errorMsg("Failed to read metadata")
+		return err
+	}
+
+	envName := meta.ResolveEnvironment(args[0])
+	env, exists := meta.Environments[envName]
+	if !exists {
+		errorMsg(fmt.Sprintf("Environment '%s' not found", envName))
+		return &metadata.EnvironmentNotFoundError{Environment: envName}
+	}
+
+	// 3. Display
+	tip, _ := repo.ResolveCommit(envName)
+	lines := []reflogLine{}
+	for _, entry := range env.Reflog {
+		lines = append(lines, reflogLine{ReflogEntry: entry, Current: entry.Commit == tip})
+	}
+	if jsonOutput {
+		encoder := json.NewEncoder(jsonOut)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(lines)
+	}
+
+	if len(lines) == 0 {
+		info(fmt.Sprintf("No builds of %s recorded yet", envName))
+		return nil
+	}
+
+	color.New(color.Bold).Printf("Recent builds of %s (newest first):\n", color.CyanString(envName))
+	for _, line := range lines {
+		text := fmt.Sprintf("  %s  %s (%s)  %s", shortSHA(repo, line.Commit), line.At.Local().Format("2006-01-02 15:04"), formatTimeAgo(line.At), line.Action)
+		if line.By != "" {
+			text += " by " + line.By
+		}
+		text += fmt.Sprintf(", %d features", len(line.Features))
+		if line.Current {
+			text += color.GreenString(" (current)")
+		}
+		fmt.Println(text)
+	}
+	fmt.Printf("\nTo restore one: hitch env rollback %s <sha>\n", envName)
+	return nil
+}
+
+func runEnvRollback(cmd *cobra.Command, args []string) error {
+	// 1. Open Git repository
+	repo, err := openRepo()
+	if err != nil {
+		errorMsg("Not a Git repository")
+		return err
+	}
+
+	if err := checkNoInProgressOperation(repo); err != nil {
+		return err
+	}
+
+	// 2. Get current branch to return to
+	currentBranch, err := repo.CurrentBranch()
+	if err != nil {
+		errorMsg("Failed to get current branch")
+		return err
+	}
+	defer restoreBranch(repo, currentBranch)
+
+	// 3. Read metadata
+	reader := metadata.NewReader(repo.Repository)
+	if !reader.Exists() {
+		errorMsg("Hitch is not initialized in this repository")
+		fmt.Println("\nRun 'hitch init' to initialize Hitch.")
+		return fmt.Errorf("hitch not initialized")
+	}
+
+	meta, err := reader.Read()
+	if err != nil {
+		errorMsg("Failed to read metadata")
+		return err
+	}
+
+	envName := meta.ResolveEnvironment(args[0])
+	env, exists := meta.Environments[envName]
+	if !exists {
+		errorMsg(fmt.Sprintf("Environment '%s' not found", envName))
+		return &metadata.EnvironmentNotFoundError{Environment: envName}
+	}
+
+	if err := checkMetadataNotBehind(repo); err != nil {
+		return err
+	}
+
+	if err := checkNotFrozen(meta); err != nil {
+		return err
+	}
+
+	if err := checkFreezeWindow(meta, envName, envRollbackForce); err != nil {
+		return err
+	}
+
+	// 4. Find the build
+	entry, ok := env.FindReflogEntry(args[1])
+	if !ok {
+		errorMsg(fmt.Sprintf("%s is not a recorded build of %s", args[1], envName))
+		fmt.Printf("\nList the recorded builds with: hitch env reflog %s\n", envName)
+		return fmt.Errorf("no build %s of %s", args[1], envName)
+	}
+	if _, err := repo.ResolveCommit(entry.Commit); err != nil {
+		errorMsg(fmt.Sprintf("Commit %s is no longer in this repository", shortSHA(repo, entry.Commit)))
+		fmt.Printf("\nIt may still be on origin: git fetch origin %s\n", entry.Commit)
+		return err
+	}
+	if tip, err := repo.ResolveCommit(envName); err == nil && tip == entry.Commit {
+		info(fmt.Sprintf("%s is already at %s", envName, shortSHA(repo, entry.Commit)))
+		return nil
+	}
+
+	// 5. Get user info
+	userEmail, err := repo.UserEmail()
+	if err != nil {
+		userEmailMissing()
+		return err
+	}
+	userName, _ := repo.UserName()
+
+	if err := checkAdmin(meta, userEmail, fmt.Sprintf("roll back %s", envName)); err != nil {
+		return err
+	}
+
+	if env.Locked && env.LockedBy != userEmail && !envRollbackForce {
+		errorMsg(fmt.Sprintf("Environment '%s' is locked by %s", envName, env.LockedBy))
+		fmt.Println("\nWait for unlock, or roll back anyway with --force.")
+		return &metadata.EnvironmentLockedError{
+			Environment: envName,
+			LockedBy:    env.LockedBy,
+			LockedAt:    env.LockedAt,
+			Host:        env.LockedHost,
+			Context:     env.LockedContext,
+		}
+	}
+
+	// 6. Move the hitched branch, off it first so the worktree isn't stale
+	if currentBranch == envName {
+		if err := repo.Checkout(env.Base); err != nil {
+			errorMsg(fmt.Sprintf("Failed to switch from %s to %s", envName, env.Base))
+			return err
+		}
+	}
+	replaced, _ := repo.ResolveCommit(envName)
+	if err := repo.CreateBranch(envName, entry.Commit); err != nil {
+		errorMsg(fmt.Sprintf("Failed to reset %s", envName))
+		return err
+	}
+	success(fmt.Sprintf("Reset %s to %s", envName, shortSHA(repo, entry.Commit)))
+
+	// The lease is on the tip being replaced, so a build someone else pushed
+	// since isn't overwritten
+	pushCommand := fmt.Sprintf("git push --force-with-lease=%s:%s origin %s", envName, replaced, envName)
+	if !skipRemote(repo, "push of "+envName, pushCommand) {
+		var leaseErr *hitchgit.LeaseRejectedError
+		if err := repo.PushWithLease("origin", envName, replaced); errors.As(err, &leaseErr) {
+			if replaced == "" {
+				warning(fmt.Sprintf("origin already has a %s branch; the rollback was not pushed", envName))
+			} else {
+				warning(fmt.Sprintf("origin's %s has moved since %s; the rollback was not pushed", envName, shortSHA(repo, replaced)))
+			}
+			fmt.Println("Check what's on origin, then force the rollback if it should still win:")
+			fmt.Printf("  git push --force origin %s\n", envName)
+		} else if err != nil {
+			warning("Failed to push to remote")
+			pushRejectedHint(err)
+			fmt.Println("You may need to push manually:")
+			fmt.Printf("  %s\n", pushCommand)
+		} else {
+			success("Pushed " + envName + " branch to remote")
+		}
+	}
+
+	// 7. Write metadata
+	e := meta.Environments[envName]
+	e.LastRebuildCommit = entry.Commit
+	// Recorded for the build rolled back from, not this one
+	e.MergedCommits = nil
+	meta.Environments[envName] = e
+	meta.RecordTip(envName, metadata.ReflogEntry{
+		Commit:   entry.Commit,
+		At:       time.Now(),
+		By:       userEmail,
+		Action:   "rollback",
+		Features: entry.Features,
+	})
+
+	meta.UpdateMeta(userEmail, fmt.Sprintf("hitch env rollback %s %s", envName, args[1]))
+	writer := metadata.NewWriter(repo.Repository)
+	if err := writer.Write(meta, fmt.Sprintf("Roll back %s to %s", envName, shortSHA(repo, entry.Commit)), userName, userEmail); err != nil {
+		errorMsg("Failed to write metadata")
+		return err
+	}
+
+	success(fmt.Sprintf("Rolled %s back to the build of %s", envName, entry.At.Local().Format("2006-01-02 15:04")))
+	if len(env.Features) > 0 {
+		fmt.Printf("\nThe next rebuild merges %s's current features again; demote any that broke the build first.\n", envName)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/spf13/cobra"
+)
+
+var (
+	freezeReason  string
+	unfreezeForce bool
+)
+
+var freezeCmd = &cobra.Command{
+	Use:   "freeze --reason <reason>",
+	Short: "Put the repository in maintenance mode",
+	Long: `Put the repository in maintenance mode.
+
+While frozen, every command that changes metadata or hitched branches
+(promote, demote, rebuild, lock, release, cleanup, ...) refuses to run and
+prints the reason. Read-only commands such as status and locks still work.
+
+Example:
+  hitch freeze --reason "Migrating to the new CI"`,
+	Args: cobra.NoArgs,
+	RunE: runFreeze,
+}
+
+var unfreezeCmd = &cobra.Command{
+	Use:   "unfreeze",
+	Short: "Take the repository out of maintenance mode",
+	Long: `Take the repository out of maintenance mode.
+
+By default, only the user who froze the repository can unfreeze it.
+Use --force to unfreeze a repository frozen by someone else.`,
+	Args: cobra.NoArgs,
+	RunE: runUnfreeze,
+}
+
+func init() {
+	freezeCmd.Flags().StringVarP(&freezeReason, "reason", "r", "", "Reason for the freeze (required)")
+	unfreezeCmd.Flags().BoolVarP(&unfreezeForce, "force", "f", false, "Unfreeze even if frozen by another user")
+	rootCmd.AddCommand(freezeCmd)
+	rootCmd.AddCommand(unfreezeCmd)
+}
+
+// checkNotFrozen refuses to continue while the repository is in maintenance
+// mode. Commands that change metadata or hitched branches call it after
+// reading metadata.
+func checkNotFrozen(meta *metadata.Metadata) error {
+	if !meta.Frozen {
+		return nil
+	}
+
+	errorMsg(fmt.Sprintf("Hitch is in maintenance mode: %s", meta.FrozenReason))
+	fmt.Printf("\nFrozen by %s. Run 'hitch unfreeze' when maintenance is over.\n", meta.FrozenBy)
+	return &metadata.FrozenError{FrozenBy: meta.FrozenBy, Reason: meta.FrozenReason}
+}
+
+// checkFreezeWindow refuses to change envName during one of its scheduled
+// freeze windows, unless force
+func checkFreezeWindow(meta *metadata.Metadata, envName string, force bool) error {
+	window, until := meta.Environments[envName].ActiveFreeze(time.Now())
+	if window == nil {
+		return nil
+	}
+
+	msg := fmt.Sprintf("%s is in a scheduled freeze until %s", envName, until.Format(metadata.FreezeTimeFormat))
+	if force {
+		warning(msg + ", continuing because of --force")
+		return nil
+	}
+
+	errorMsg(msg)
+	if window.Reason != "" {
+		fmt.Printf("\nReason: %s\n", window.Reason)
+	}
+	fmt.Println("\nRun with --force to change it anyway.")
+	return &metadata.FreezeWindowError{Environment: envName, Until: until, Reason: window.Reason}
+}
+
+func runFreeze(cmd *cobra.Command, args []string) error {
+	if freezeReason == "" {
+		return fmt.Errorf("--reason is required")
+	}
+
+	// 1. Open Git repository
+	repo, err := openRepo()
+	if err != nil {
+		errorMsg("Not a Git repository")
+		return err
+	}
+
+	// 2. Get current branch to return to
+	currentBranch, err := repo.CurrentBranch()
+	if err != nil {
+		errorMsg("Failed to get current branch")
+		return err
+	}
+	defer restoreBranch(repo, currentBranch)
+
+	// 3. Read metadata
+	reader := metadata.NewReader(repo.Repository)
+	if !reader.Exists() {
+		errorMsg("Hitch is not initialized in this repository")
+		fmt.Println("\nRun 'hitch init' to initialize Hitch.")
+		return fmt.Errorf("hitch not initialized")
+	}
+
+	meta, err := reader.Read()
+	if err != nil {
+		errorMsg("Failed to read metadata")
+		return err
+	}
+
+	if err := checkMetadataNotBehind(repo); err != nil {
+		return err
+	}
+
+	// 4. Get user info
+	userEmail, err := repo.UserEmail()
+	if err != nil {
+		userEmailMissing()
+		return err
+	}
+	userName, _ := repo.UserName()
+
+	// 5. Freeze
+	if err := meta.Freeze(userEmail, freezeReason); err != nil {
+		errorMsg(fmt.Sprintf("Already frozen by %s: %s", meta.FrozenBy, meta.FrozenReason))
+		return err
+	}
+
+	// 6. Write metadata
+	meta.UpdateMeta(userEmail, "hitch freeze")
+
+	writer := metadata.NewWriter(repo.Repository)
+	if err := writer.Write(meta, "Freeze hitch (maintenance mode)", userName, userEmail); err != nil {
+		errorMsg("Failed to write metadata")
+		return err
+	}
+
+	success("Hitch is now in maintenance mode")
+	fmt.Printf("Reason: %s\n", freezeReason)
+	return nil
+}
+
+func runUnfreeze(cmd *cobra.Command, args []string) error {
+	// 1. Open Git repository
+	repo, err := openRepo()
+	if err != nil {
+		errorMsg("Not a Git repository")
+		return err
+	}
+
+	// 2. Get current branch to return to
+	currentBranch, err := repo.CurrentBranch()
+	if err != nil {
+		errorMsg("Failed to get current branch")
+		return err
+	}
+	defer restoreBranch(repo, currentBranch)
+
+	// 3. Read metadata
+	reader := metadata.NewReader(repo.Repository)
+	if !reader.Exists() {
+		errorMsg("Hitch is not initialized in this repository")
+		fmt.Println("\nRun 'hitch init' to initialize Hitch.")
+		return fmt.Errorf("hitch not initialized")
+	}
+
+	meta, err := reader.Read()
+	if err != nil {
+		errorMsg("Failed to read metadata")
+		return err
+	}
+
+	if err := checkMetadataNotBehind(repo); err != nil {
+		return err
+	}
+
+	// 4. Get user info
+	userEmail, err := repo.UserEmail()
+	if err != nil {
+		userEmailMissing()
+		return err
+	}
+	userName, _ := repo.UserName()
+
+	// 5. Check state and permissions
+	if !meta.Frozen {
+		warning("Hitch is not frozen")
+		return nil
+	}
+
+	if meta.FrozenBy != userEmail && !unfreezeForce {
+		errorMsg(fmt.Sprintf("Hitch was frozen by %s", meta.FrozenBy))
+		fmt.Println("Only the user who froze Hitch can unfreeze it.")
+		fmt.Println("Use --force to override")
+		return fmt.Errorf("permission denied")
+	}
+	// Even whoever froze Hitch needs to be an admin to unfreeze it
+	action := "unfreeze Hitch"
+	if meta.FrozenBy != userEmail {
+		action = fmt.Sprintf("unfreeze Hitch, frozen by %s", meta.FrozenBy)
+	}
+	if err := checkAdmin(meta, userEmail, action); err != nil {
+		return err
+	}
+
+	// 6. Unfreeze and write metadata
+	meta.Unfreeze()
+	meta.UpdateMeta(userEmail, "hitch unfreeze")
+
+	writer := metadata.NewWriter(repo.Repository)
+	if err := writer.Write(meta, "Unfreeze hitch", userName, userEmail); err != nil {
+		errorMsg("Failed to write metadata")
+		return err
+	}
+
+	success("Hitch is out of maintenance mode")
+	return nil
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/spf13/cobra"
+)
+
+var graphFormat string
+
+var graphCmd = &cobra.Command{
+	Use:   "graph",
+	Short: "Print a graph of environments and their features",
+	Long: `Print a graph of environments and their features.
+
+Emits a Graphviz DOT (default) or Mermaid description to stdout, for
+rendering in design docs:
+
+  hitch graph | dot -Tsvg > environments.svg
+  hitch graph --format mermaid
+
+Each environment is a box with an edge from its base branch, and each
+feature has an edge to every environment it is in. Features in more than
+one environment are highlighted.`,
+	Args: cobra.NoArgs,
+	RunE: runGraph,
+}
+
+func init() {
+	graphCmd.Flags().StringVar(&graphFormat, "format", "dot", "Output format: dot or mermaid")
+	rootCmd.AddCommand(graphCmd)
+}
+
+func runGraph(cmd *cobra.Command, args []string) error {
+	if graphFormat != "dot" && graphFormat != "mermaid" {
+		return fmt.Errorf("unknown graph format %q (use dot or mermaid)", graphFormat)
+	}
+
+	// 1. Open Git repository
+	repo, err := openRepo()
+	if err != nil {
+		errorMsg("Not a Git repository")
+		return err
+	}
+
+	// 2. Read metadata
+	reader := metadata.NewReader(repo.Repository)
+	if !reader.Exists() {
+		errorMsg("Hitch is not initialized in this repository")
+		fmt.Println("\nRun 'hitch init' to initialize Hitch.")
+		return fmt.Errorf("hitch not initialized")
+	}
+
+	meta, err := reader.Read()
+	if err != nil {
+		errorMsg("Failed to read metadata")
+		return err
+	}
+
+	// 3. Print the graph
+	g := buildEnvironmentGraph(meta)
+	if graphFormat == "mermaid" {
+		g.writeMermaid(cmd.OutOrStdout())
+	} else {
+		g.writeDOT(cmd.OutOrStdout())
+	}
+	return nil
+}
+
+// environmentGraph is what hitch graph draws: base branches, environments,
+// and features, each sorted by name
+type environmentGraph struct {
+	bases        []string
+	environments []string
+	features     []string
+	// baseOf maps an environment to its base branch
+	baseOf map[string]string
+	// in maps a feature to the environments it is in
+	in map[string][]string
+}
+
+func buildEnvironmentGraph(meta *metadata.Metadata) environmentGraph {
+	g := environmentGraph{
+		environments: meta.EnvironmentNames(),
+		baseOf:       map[string]string{},
+		in:           map[string][]string{},
+	}
+
+	for _, envName := range g.environments {
+		env := meta.Environments[envName]
+		g.baseOf[envName] = env.Base
+		if !slices.Contains(g.bases, env.Base) {
+			g.bases = append(g.bases, env.Base)
+		}
+		for _, feature := range env.Features {
+			if _, seen := g.in[feature]; !seen {
+				g.features = append(g.features, feature)
+			}
+			g.in[feature] = append(g.in[feature], envName)
+		}
+	}
+
+	slices.Sort(g.bases)
+	slices.Sort(g.features)
+	return g
+}
+
+// shared reports whether feature is in more than one environment
+func (g environmentGraph) shared(feature string) bool {
+	return len(g.in[feature]) > 1
+}
+
+// writeDOT writes the graph in Graphviz DOT. Node IDs are prefixed by kind,
+// since a base branch, an environment, and a feature may share a name.
+func (g environmentGraph) writeDOT(w io.Writer) {
+	fmt.Fprintln(w, "digraph hitch {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	for _, base := range g.bases {
+		fmt.Fprintf(w, "  %s [label=%s, shape=cylinder];\n", strconv.Quote("base:"+base), strconv.Quote(base))
+	}
+	for _, envName := range g.environments {
+		fmt.Fprintf(w, "  %s [label=%s, shape=box];\n", strconv.Quote("env:"+envName), strconv.Quote(envName))
+	}
+	for _, feature := range g.features {
+		style := ""
+		if g.shared(feature) {
+			style = ", style=filled, fillcolor=lightyellow"
+		}
+		fmt.Fprintf(w, "  %s [label=%s, shape=ellipse%s];\n", strconv.Quote("feature:"+feature), strconv.Quote(feature), style)
+	}
+	for _, envName := range g.environments {
+		fmt.Fprintf(w, "  %s -> %s [style=dashed];\n", strconv.Quote("base:"+g.baseOf[envName]), strconv.Quote("env:"+envName))
+	}
+	for _, feature := range g.features {
+		for _, envName := range g.in[feature] {
+			fmt.Fprintf(w, "  %s -> %s;\n", strconv.Quote("feature:"+feature), strconv.Quote("env:"+envName))
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// writeMermaid writes the graph as a Mermaid flowchart. Mermaid IDs can't
+// contain slashes, so nodes get positional IDs (b0, e0, f0) and names are
+// labels.
+func (g environmentGraph) writeMermaid(w io.Writer) {
+	ids := map[string]string{}
+	fmt.Fprintln(w, "graph LR")
+	for i, base := range g.bases {
+		ids["base:"+base] = fmt.Sprintf("b%d", i)
+		fmt.Fprintf(w, "  b%d[(\"%s\")]\n", i, base)
+	}
+	for i, envName := range g.environments {
+		ids["env:"+envName] = fmt.Sprintf("e%d", i)
+		fmt.Fprintf(w, "  e%d[\"%s\"]\n", i, envName)
+	}
+	for i, feature := range g.features {
+		ids["feature:"+feature] = fmt.Sprintf("f%d", i)
+		fmt.Fprintf(w, "  f%d([\"%s\"])\n", i, feature)
+	}
+	for _, envName := range g.environments {
+		fmt.Fprintf(w, "  %s -.-> %s\n", ids["base:"+g.baseOf[envName]], ids["env:"+envName])
+	}
+	for _, feature := range g.features {
+		for _, envName := range g.in[feature] {
+			fmt.Fprintf(w, "  %s --> %s\n", ids["feature:"+feature], ids["env:"+envName])
+		}
+	}
+
+	var shared []string
+	for _, feature := range g.features {
+		if g.shared(feature) {
+			shared = append(shared, ids["feature:"+feature])
+		}
+	}
+	if len(shared) > 0 {
+		fmt.Fprintln(w, "  classDef shared fill:#ffffe0")
+		fmt.Fprintf(w, "  class %s shared\n", strings.Join(shared, ","))
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"os"
 
-	hitchgit "github.com/DoomedRamen/hitch/internal/git"
 	"github.com/DoomedRamen/hitch/internal/metadata"
 	"github.com/spf13/cobra"
 )
@@ -47,7 +46,7 @@ func init() {
 
 func runHookPrePush(cmd *cobra.Command, args []string) error {
 	// 1. Open Git repository
-	repo, err := hitchgit.OpenRepo(".")
+	repo, err := openRepo()
 	if err != nil {
 		// Not a git repo, allow push
 		os.Exit(0)
@@ -1,8 +1,9 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
-	"os/exec"
+	"os"
 	"strings"
 
 	hitchgit "github.com/DoomedRamen/hitch/internal/git"
@@ -11,11 +12,13 @@ import (
 )
 
 var (
-	initEnvironments string
-	initBaseBranch   string
+	initEnvironments  string
+	initBaseBranch    string
 	initRetentionDays int
-	initStaleDays    int
-	initNoPush       bool
+	initStaleDays     int
+	initRepair        bool
+	initFromExport    string
+	initEnvBases      string
 )
 
 var initCmd = &cobra.Command{
@@ -29,21 +32,35 @@ This command:
 3. Writes initial configuration to hitch.json
 4. Pushes the metadata branch to remote
 
-After initialization, you can start promoting features to environments.`,
+After initialization, you can start promoting features to environments.
+
+Every environment is rebuilt from --base unless --env-base gives it its own,
+for repositories with independent release lines:
+
+  hitch init --environments dev,qa,backend-dev --env-base backend-dev=backend-main
+
+Use --repair on a fresh clone, or when the metadata branch is damaged. It
+never wipes existing state:
+- If hitch-metadata exists on origin but not locally, it is fetched and
+  created locally
+- If the local hitch.json can't be read, --from-export <file> commits a
+  saved copy of hitch.json on top of the existing branch history`,
 	RunE: runInit,
 }
 
 func init() {
 	initCmd.Flags().StringVar(&initEnvironments, "environments", "dev,qa", "Comma-separated list of environments")
 	initCmd.Flags().StringVar(&initBaseBranch, "base", "main", "Base branch name")
+	initCmd.Flags().StringVar(&initEnvBases, "env-base", "", "Comma-separated <env>=<branch> pairs for environments with their own base branch")
 	initCmd.Flags().IntVar(&initRetentionDays, "retention-days", 7, "Days to keep branches after merge")
 	initCmd.Flags().IntVar(&initStaleDays, "stale-days", 30, "Days before warning about inactive branches")
-	initCmd.Flags().BoolVar(&initNoPush, "no-push", false, "Don't push hitch-metadata to remote (local only)")
+	initCmd.Flags().BoolVar(&initRepair, "repair", false, "Set up or repair an existing hitch-metadata branch instead of creating one")
+	initCmd.Flags().StringVar(&initFromExport, "from-export", "", "With --repair, restore hitch.json from this file if the local copy is corrupted")
 }
 
 func runInit(cmd *cobra.Command, args []string) error {
 	// 1. Open Git repository
-	repo, err := hitchgit.OpenRepo(".")
+	repo, err := openRepo()
 	if err != nil {
 		errorMsg("Not a Git repository")
 		fmt.Println("\nPlease run 'hitch init' from within a Git repository.")
@@ -51,17 +68,36 @@ func runInit(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	// 2. Check if already initialized
+	if initFromExport != "" && !initRepair {
+		return fmt.Errorf("--from-export requires --repair")
+	}
+
+	if initRepair {
+		return repairMetadata(repo)
+	}
+
+	// 2. Environments are built from the base branch, so there must be one
+	if !repo.HasCommits() {
+		errorMsg("This repository has no commits yet")
+		fmt.Println("\nHitch builds environments from the base branch, so it needs a commit to start from.")
+		fmt.Println("Commit something first, then run hitch init:")
+		fmt.Printf("  git commit --allow-empty -m \"Initial commit\"\n")
+		return fmt.Errorf("repository has no commits")
+	}
+
+	// 3. Check if already initialized
 	reader := metadata.NewReader(repo.Repository)
 	if reader.Exists() {
 		warning("Hitch is already initialized in this repository")
 		fmt.Println("\nTo reinitialize, first delete the hitch-metadata branch:")
 		fmt.Println("  git branch -D hitch-metadata")
 		fmt.Println("  git push origin --delete hitch-metadata")
+		fmt.Println("\nTo check or repair the existing metadata instead:")
+		fmt.Println("  hitch init --repair")
 		return fmt.Errorf("hitch already initialized")
 	}
 
-	// 3. Get user info
+	// 4. Get user info
 	userName, err := repo.UserName()
 	if err != nil {
 		warning("Could not get git user.name, using default")
@@ -70,28 +106,49 @@ func runInit(cmd *cobra.Command, args []string) error {
 
 	userEmail, err := repo.UserEmail()
 	if err != nil {
-		errorMsg("Git user.email is not configured")
-		fmt.Println("\nPlease configure your Git user email:")
-		fmt.Println("  git config --global user.email \"you@example.com\"")
+		userEmailMissing()
 		return err
 	}
 
-	// 4. Parse environments
+	// 5. Parse environments
 	envList := strings.Split(initEnvironments, ",")
 	for i, env := range envList {
 		envList[i] = strings.TrimSpace(env)
 	}
 
+	envBases, err := parseEnvironmentBases(initEnvBases, envList)
+	if err != nil {
+		errorMsg(err.Error())
+		return err
+	}
+
+	bases := []string{initBaseBranch}
+	for _, base := range envBases {
+		bases = append(bases, base)
+	}
+
+	if err := validateEnvironmentNames(envList, bases...); err != nil {
+		errorMsg(err.Error())
+		fmt.Println("\nEnvironment names become branch names, so they must be simple")
+		fmt.Println("branch names without spaces or slashes (e.g. dev, qa, staging).")
+		return err
+	}
+
 	info(fmt.Sprintf("Initializing Hitch with environments: %s", strings.Join(envList, ", ")))
 
-	// 5. Create metadata
+	// 6. Create metadata
 	meta := metadata.NewMetadata(envList, initBaseBranch, userEmail)
 	meta.Config.RetentionDaysAfterMerge = initRetentionDays
 	meta.Config.StaleDaysNoActivity = initStaleDays
+	for env, base := range envBases {
+		if err := meta.SetEnvironmentBase(env, base); err != nil {
+			errorMsg(err.Error())
+			return err
+		}
+	}
 
-	// 6. Create hitch-metadata orphan branch using git command
-	// Note: go-git doesn't handle orphan branches well, so we use exec
-	if err := createOrphanBranch(repo, userName, userEmail, meta, initNoPush); err != nil {
+	// 7. Create the hitch-metadata orphan branch
+	if err := createOrphanBranch(repo, userName, userEmail, meta, isOffline()); err != nil {
 		errorMsg("Failed to create hitch-metadata branch")
 		return err
 	}
@@ -100,6 +157,11 @@ func runInit(cmd *cobra.Command, args []string) error {
 	fmt.Println()
 	fmt.Println("Environments configured:", strings.Join(envList, ", "))
 	fmt.Println("Base branch:", initBaseBranch)
+	for _, env := range envList {
+		if base, ok := envBases[env]; ok {
+			fmt.Printf("  %s is based on %s\n", env, base)
+		}
+	}
 	fmt.Println()
 	fmt.Println("Next steps:")
 	fmt.Println("  1. Create a feature branch: git checkout -b feature/my-feature")
@@ -109,63 +171,181 @@ func runInit(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-// createOrphanBranch creates the hitch-metadata orphan branch using git commands
-func createOrphanBranch(repo *hitchgit.Repo, userName, userEmail string, meta *metadata.Metadata, noPush bool) error {
-	// Remember current branch
+// repairMetadata sets up the local hitch-metadata branch from origin when it
+// is missing, or restores hitch.json from an export when it is corrupted.
+// Existing history is always kept.
+func repairMetadata(repo *hitchgit.Repo) error {
+	reader := metadata.NewReader(repo.Repository)
+
+	// 1. Local branch missing: create it from origin
+	if !reader.Exists() {
+		if isOffline() {
+			errorMsg("No local hitch-metadata branch, and offline mode prevents fetching it")
+			return fmt.Errorf("offline")
+		}
+
+		if !repo.RemoteExists("origin") {
+			errorMsg("No local hitch-metadata branch, and no origin remote to fetch it from")
+			fmt.Println("\nRun 'hitch init' to initialize Hitch.")
+			return fmt.Errorf("hitch not initialized")
+		}
+
+		if err := repo.Fetch("origin", metadata.MetadataBranch); err != nil {
+			errorMsg("No hitch-metadata branch found locally or on origin")
+			fmt.Println("\nRun 'hitch init' to initialize Hitch.")
+			return fmt.Errorf("hitch not initialized")
+		}
+
+		remoteRef := "origin/" + metadata.MetadataBranch
+		if err := repo.CreateBranch(metadata.MetadataBranch, remoteRef); err != nil {
+			errorMsg(fmt.Sprintf("Failed to create local %s", metadata.MetadataBranch))
+			return err
+		}
+		success(fmt.Sprintf("Created local %s from %s", metadata.MetadataBranch, remoteRef))
+	}
+
+	// 2. Local branch readable: nothing to repair
+	_, readErr := reader.Read()
+	if readErr == nil {
+		success("Metadata is valid")
+		return nil
+	}
+
+	// 3. Local branch corrupted: restore from an export
+	if initFromExport == "" {
+		errorMsg(fmt.Sprintf("%s on %s is unreadable: %v", metadata.MetadataFile, metadata.MetadataBranch, readErr))
+		fmt.Println("\nRestore it from a saved copy of hitch.json, for example the previous commit:")
+		fmt.Printf("  git show %s~1:%s > hitch-export.json\n", metadata.MetadataBranch, metadata.MetadataFile)
+		fmt.Println("  hitch init --repair --from-export hitch-export.json")
+		return readErr
+	}
+
+	data, err := os.ReadFile(initFromExport)
+	if err != nil {
+		errorMsg(fmt.Sprintf("Failed to read %s", initFromExport))
+		return err
+	}
+
+	meta, err := metadata.Parse(data)
+	if err != nil {
+		errorMsg(fmt.Sprintf("%s is not valid Hitch metadata", initFromExport))
+		return err
+	}
+
+	userEmail, err := repo.UserEmail()
+	if err != nil {
+		userEmailMissing()
+		return err
+	}
+	userName, _ := repo.UserName()
+
 	currentBranch, err := repo.CurrentBranch()
 	if err != nil {
-		// Maybe detached HEAD, get commit
-		currentCommit, err := repo.CurrentCommitSHA()
-		if err != nil {
-			return fmt.Errorf("failed to get current state: %w", err)
+		currentBranch, _ = repo.CurrentCommitSHA()
+	}
+	defer restoreBranch(repo, currentBranch)
+
+	writer := metadata.NewWriter(repo.Repository)
+	meta.UpdateMeta(userEmail, "hitch init --repair")
+	if err := writer.Write(meta, fmt.Sprintf("Repair %s from %s", metadata.MetadataFile, initFromExport), userName, userEmail); err != nil {
+		errorMsg("Failed to write metadata")
+		return err
+	}
+
+	success(fmt.Sprintf("Restored %s from %s", metadata.MetadataFile, initFromExport))
+	if !isOffline() && repo.RemoteExists("origin") {
+		fmt.Println("\nPublish the repair with:")
+		fmt.Printf("  git push origin %s\n", metadata.MetadataBranch)
+	}
+	return nil
+}
+
+// validateEnvironmentNames rejects environment names that can't safely be
+// used as hitched branch names, duplicates, and names that clash with the base
+func validateEnvironmentNames(envList []string, baseBranches ...string) error {
+	seen := make(map[string]bool)
+	for _, env := range envList {
+		if err := metadata.ValidateEnvironmentName(env); err != nil {
+			return err
 		}
-		currentBranch = currentCommit
+		for _, base := range baseBranches {
+			if env == base {
+				return &metadata.InvalidEnvironmentNameError{Environment: env, Reason: "must differ from the base branch"}
+			}
+		}
+		if seen[env] {
+			return &metadata.InvalidEnvironmentNameError{Environment: env, Reason: "listed more than once"}
+		}
+		seen[env] = true
 	}
+	return nil
+}
 
-	// Create orphan branch
-	cmd := exec.Command("git", "checkout", "--orphan", metadata.MetadataBranch)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to create orphan branch: %s", string(output))
+// parseEnvironmentBases parses --env-base, comma-separated <env>=<branch>
+// pairs, into a map from environment to base branch
+func parseEnvironmentBases(flag string, envList []string) (map[string]string, error) {
+	bases := make(map[string]string)
+	if flag == "" {
+		return bases, nil
 	}
+	for _, value := range strings.Split(flag, ",") {
+		env, base, ok := strings.Cut(value, "=")
+		env, base = strings.TrimSpace(env), strings.TrimSpace(base)
+		if !ok || env == "" || base == "" {
+			return nil, fmt.Errorf("--env-base must be <env>=<branch>, got %q", value)
+		}
 
-	// Remove all files from index
-	cmd = exec.Command("git", "rm", "-rf", "--cached", ".")
-	cmd.Run() // Ignore error, there might be no files
+		known := false
+		for _, name := range envList {
+			known = known || name == env
+		}
+		if !known {
+			return nil, fmt.Errorf("--env-base names %s, which is not in --environments", env)
+		}
+		if err := hitchgit.ValidBranchName(base); err != nil {
+			return nil, err
+		}
+		bases[env] = base
+	}
+	return bases, nil
+}
 
-	// Write hitch.json using metadata writer
+// createOrphanBranch creates the hitch-metadata orphan branch and pushes it.
+// The branch is written without checking it out, so the working tree and the
+// current branch are left alone.
+func createOrphanBranch(repo *hitchgit.Repo, userName, userEmail string, meta *metadata.Metadata, noPush bool) error {
 	writer := metadata.NewWriter(repo.Repository)
 	if err := writer.WriteInitial(meta, userName, userEmail); err != nil {
-		// Cleanup: return to original branch
-		exec.Command("git", "checkout", currentBranch).Run()
-		exec.Command("git", "branch", "-D", metadata.MetadataBranch).Run()
 		return fmt.Errorf("failed to write initial metadata: %w", err)
 	}
 
-	// Push to remote (unless --no-push specified)
-	if !noPush {
-		cmd = exec.Command("git", "push", "-u", "origin", metadata.MetadataBranch)
-		if output, err := cmd.CombinedOutput(); err != nil {
+	// Push to remote (unless --no-push specified or there is no remote)
+	if noPush {
+		offlineNotice("push to remote", fmt.Sprintf("git push -u origin %s", metadata.MetadataBranch))
+		fmt.Println()
+	} else if !repo.RemoteExists("origin") {
+		info("Skipped push to remote (no origin remote configured)")
+		fmt.Println()
+	} else {
+		// The lease on an empty hash refuses to overwrite a hitch-metadata
+		// branch someone else already pushed
+		var leaseErr *hitchgit.LeaseRejectedError
+		if err := repo.PushWithLease("origin", metadata.MetadataBranch, ""); errors.As(err, &leaseErr) {
+			warning("origin already has a hitch-metadata branch; the local one was not pushed")
+			fmt.Println("To use the existing metadata instead:")
+			fmt.Printf("  git branch -D %s && hitch init --repair\n", metadata.MetadataBranch)
+			fmt.Println()
+			// Don't fail, local init succeeded
+		} else if err != nil {
 			warning("Failed to push hitch-metadata branch to remote")
 			fmt.Println("You may need to push manually:")
 			fmt.Printf("  git push -u origin %s\n", metadata.MetadataBranch)
 			fmt.Println()
-			fmt.Println("Error:", string(output))
+			fmt.Println("Error:", err)
 			// Don't fail, local init succeeded
 		} else {
 			success("Pushed hitch-metadata to origin")
 		}
-	} else {
-		info("Skipped push to remote (--no-push specified)")
-		fmt.Println("To push later, run:")
-		fmt.Printf("  git push -u origin %s\n", metadata.MetadataBranch)
-		fmt.Println()
-	}
-
-	// Return to original branch
-	if err := repo.Checkout(currentBranch); err != nil {
-		warning(fmt.Sprintf("Failed to return to original branch %s", currentBranch))
-		fmt.Println("You may need to checkout manually:")
-		fmt.Printf("  git checkout %s\n", currentBranch)
 	}
 
 	return nil
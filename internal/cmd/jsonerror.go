@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/metadata"
+)
+
+// jsonError is the envelope written to stdout when a command fails in --json mode
+//
+//	{"error": {"type": "EnvironmentLockedError", "message": "..."}}
+type jsonError struct {
+	Error jsonErrorBody `json:"error"`
+}
+
+type jsonErrorBody struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// reportedError is returned by a command that already wrote its result as
+// JSON, so it fails without an error envelope following that result
+type reportedError struct {
+	error
+}
+
+func (e reportedError) Unwrap() error {
+	return e.error
+}
+
+// writeJSONError writes err to w as a JSON error envelope
+func writeJSONError(w io.Writer, err error) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(jsonError{Error: jsonErrorBody{
+		Type:    errorType(err),
+		Message: err.Error(),
+	}})
+}
+
+// errorType names the known error type carried by err, or "Error" for
+// untyped errors
+func errorType(err error) string {
+	var (
+		envNotFound    *metadata.EnvironmentNotFoundError
+		invalidEnv     *metadata.InvalidEnvironmentNameError
+		envLocked      *metadata.EnvironmentLockedError
+		frozen         *metadata.FrozenError
+		freezeWindow   *metadata.FreezeWindowError
+		permission     *metadata.PermissionError
+		branchNotFound *metadata.BranchNotFoundError
+		stackNotFound  *metadata.StackNotFoundError
+		staleMetadata  *metadata.StaleMetadataError
+		readErr        *metadata.MetadataReadError
+		writeErr       *metadata.MetadataWriteError
+		invalidMeta    *metadata.InvalidMetadataError
+		mergeConflict  *hitchgit.MergeConflictError
+		inProgress     *hitchgit.InProgressOperationError
+		leaseRejected  *hitchgit.LeaseRejectedError
+	)
+
+	switch {
+	case errors.As(err, &envNotFound):
+		return "EnvironmentNotFoundError"
+	case errors.As(err, &invalidEnv):
+		return "InvalidEnvironmentNameError"
+	case errors.As(err, &envLocked):
+		return "EnvironmentLockedError"
+	case errors.As(err, &frozen):
+		return "FrozenError"
+	case errors.As(err, &freezeWindow):
+		return "FreezeWindowError"
+	case errors.As(err, &permission):
+		return "PermissionError"
+	case errors.As(err, &branchNotFound):
+		return "BranchNotFoundError"
+	case errors.As(err, &stackNotFound):
+		return "StackNotFoundError"
+	case errors.As(err, &staleMetadata):
+		return "StaleMetadataError"
+	case errors.As(err, &readErr):
+		return "MetadataReadError"
+	case errors.As(err, &writeErr):
+		return "MetadataWriteError"
+	case errors.As(err, &invalidMeta):
+		return "InvalidMetadataError"
+	case errors.As(err, &mergeConflict):
+		return "MergeConflictError"
+	case errors.As(err, &inProgress):
+		return "InProgressOperationError"
+	case errors.As(err, &leaseRejected):
+		return "LeaseRejectedError"
+	default:
+		return "Error"
+	}
+}
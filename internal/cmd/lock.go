@@ -2,42 +2,53 @@ package cmd
 
 import (
 	"fmt"
+	"slices"
+	"strings"
 
-	hitchgit "github.com/DoomedRamen/hitch/internal/git"
 	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/DoomedRamen/hitch/internal/notify"
 	"github.com/spf13/cobra"
 )
 
 var (
-	lockReason string
-	lockForce  bool
+	lockReason  string
+	lockContext string
+	lockForce   bool
 )
 
 var lockCmd = &cobra.Command{
-	Use:   "lock <environment>",
-	Short: "Lock an environment to prevent modifications",
-	Long: `Lock an environment to prevent other users from modifying it.
+	Use:   "lock <environment>...",
+	Short: "Lock environments to prevent modifications",
+	Long: `Lock one or more environments to prevent other users from modifying them.
 
 Locked environments cannot be rebuilt or have features promoted/demoted
 until they are unlocked.
 
+Several environments are locked all-or-nothing, in a single metadata
+commit: if any of them can't be locked, none are.
+
+The lock records the host it was taken on. Pass --context to also record
+where it came from, such as a CI job URL, so a lock left behind by a dead
+runner can be traced.
+
 Example:
-  hitch lock dev --reason "Testing critical fix"`,
-	Args: cobra.ExactArgs(1),
+  hitch lock dev --reason "Testing critical fix"
+  hitch lock qa --reason "Deploying" --context "$CI_JOB_URL"
+  hitch lock dev qa staging --reason "Maintenance window"`,
+	Args: cobra.MinimumNArgs(1),
 	RunE: runLock,
 }
 
 func init() {
 	lockCmd.Flags().StringVarP(&lockReason, "reason", "r", "", "Reason for locking")
+	lockCmd.Flags().StringVar(&lockContext, "context", "", "Where the lock comes from, e.g. a CI job URL")
 	lockCmd.Flags().BoolVarP(&lockForce, "force", "f", false, "Force lock even if stale lock exists")
 	rootCmd.AddCommand(lockCmd)
 }
 
 func runLock(cmd *cobra.Command, args []string) error {
-	envName := args[0]
-
 	// 1. Open Git repository
-	repo, err := hitchgit.OpenRepo(".")
+	repo, err := openRepo()
 	if err != nil {
 		errorMsg("Not a Git repository")
 		return err
@@ -49,9 +60,7 @@ func runLock(cmd *cobra.Command, args []string) error {
 		errorMsg("Failed to get current branch")
 		return err
 	}
-	defer func() {
-		_ = repo.Checkout(currentBranch)
-	}()
+	defer restoreBranch(repo, currentBranch)
 
 	// 3. Read metadata
 	reader := metadata.NewReader(repo.Repository)
@@ -67,6 +76,16 @@ func runLock(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	envNames := resolveEnvironments(meta, args)
+
+	if err := checkMetadataNotBehind(repo); err != nil {
+		return err
+	}
+
+	if err := checkNotFrozen(meta); err != nil {
+		return err
+	}
+
 	// 4. Get user info
 	userEmail, err := repo.UserEmail()
 	if err != nil {
@@ -79,14 +98,76 @@ func runLock(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	// 5. Check if environment exists
-	_, exists := meta.Environments[envName]
-	if !exists {
+	// 5. Lock every environment, or none of them
+	var locked []string
+	var lockErr error
+	for _, envName := range envNames {
+		if err := lockEnvironment(meta, envName, userEmail); err != nil {
+			if lockErr == nil {
+				lockErr = err
+			}
+			continue
+		}
+		locked = append(locked, envName)
+	}
+
+	if lockErr != nil {
+		if len(locked) > 0 {
+			warning(fmt.Sprintf("Released %s: environments are locked all-or-nothing", strings.Join(locked, ", ")))
+		}
+		return lockErr
+	}
+
+	// 6. Update metadata
+	meta.UpdateMeta(userEmail, fmt.Sprintf("hitch lock %s", strings.Join(envNames, " ")))
+
+	message := fmt.Sprintf("Lock %s environment", envNames[0])
+	if len(envNames) > 1 {
+		message = fmt.Sprintf("Lock %s environments", strings.Join(envNames, ", "))
+	}
+
+	writer := metadata.NewWriter(repo.Repository)
+	if err := writer.Write(meta, message, userName, userEmail); err != nil {
+		errorMsg("Failed to update metadata")
+		return err
+	}
+
+	for _, envName := range envNames {
+		success(fmt.Sprintf("Locked %s environment", envName))
+	}
+	if lockReason != "" {
+		fmt.Printf("Reason: %s\n", lockReason)
+	}
+	if lockContext != "" {
+		fmt.Printf("Context: %s\n", lockContext)
+	}
+
+	for _, envName := range envNames {
+		message := fmt.Sprintf("%s locked %s", userEmail, envName)
+		if lockReason != "" {
+			message += ": " + lockReason
+		}
+		sendNotification(meta, notify.Event{
+			Event:       notify.EventLock,
+			Environment: envName,
+			User:        userEmail,
+			Message:     message,
+		})
+	}
+
+	return nil
+}
+
+// lockEnvironment locks envName in meta for user with the --reason and
+// --context flags, reporting why it can't
+func lockEnvironment(meta *metadata.Metadata, envName string, user string) error {
+	// Check if environment exists
+	if _, exists := meta.Environments[envName]; !exists {
 		errorMsg(fmt.Sprintf("Environment '%s' not found", envName))
 		return fmt.Errorf("environment not found")
 	}
 
-	// 6. Check for stale lock
+	// Check for stale lock
 	if meta.IsEnvironmentLocked(envName) && !lockForce {
 		env := meta.Environments[envName]
 		if meta.IsLockStale(envName) {
@@ -96,25 +177,28 @@ func runLock(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	// 7. Lock environment
-	if err := meta.LockEnvironment(envName, userEmail, lockReason); err != nil {
-		errorMsg(fmt.Sprintf("Failed to lock environment: %v", err))
+	if err := meta.LockEnvironment(envName, user, lockReason); err != nil {
+		errorMsg(fmt.Sprintf("Failed to lock %s: %v", envName, err))
 		return err
 	}
-
-	// 8. Update metadata
-	meta.UpdateMeta(userEmail, fmt.Sprintf("hitch lock %s", envName))
-
-	writer := metadata.NewWriter(repo.Repository)
-	if err := writer.Write(meta, userName, userEmail, fmt.Sprintf("Lock %s environment", envName)); err != nil {
-		errorMsg("Failed to update metadata")
-		return err
-	}
-
-	success(fmt.Sprintf("Locked %s environment", envName))
-	if lockReason != "" {
-		fmt.Printf("Reason: %s\n", lockReason)
+	if lockContext != "" {
+		if err := meta.SetLockContext(envName, lockContext); err != nil {
+			errorMsg(fmt.Sprintf("Failed to record lock context: %v", err))
+			return err
+		}
 	}
 
 	return nil
 }
+
+// resolveEnvironments resolves aliases in names, dropping repeats
+func resolveEnvironments(meta *metadata.Metadata, names []string) []string {
+	resolved := make([]string, 0, len(names))
+	for _, name := range names {
+		name = meta.ResolveEnvironment(name)
+		if !slices.Contains(resolved, name) {
+			resolved = append(resolved, name)
+		}
+	}
+	return resolved
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/spf13/cobra"
+)
+
+var locksCmd = &cobra.Command{
+	Use:   "locks",
+	Short: "Show lock state for every environment",
+	Long: `Show lock state for every environment.
+
+With --json, prints a stable, machine-readable array sorted by environment
+name, for deployment tooling that needs to check locks before acting:
+
+  [
+    {
+      "environment": "dev",
+      "locked": true,
+      "locked_by": "alice@example.com",
+      "locked_at": "2025-10-17T14:30:00Z",
+      "stale": false,
+      "timeout_minutes": 15
+    }
+  ]
+
+Timestamps are RFC3339 in UTC. locked_by and locked_at are null when the
+environment is unlocked. host and context, when known, say where the lock
+was taken.`,
+	Args: cobra.NoArgs,
+	RunE: runLocks,
+}
+
+func init() {
+	rootCmd.AddCommand(locksCmd)
+}
+
+// lockState is the JSON shape of one environment's lock
+type lockState struct {
+	Environment    string  `json:"environment"`
+	Locked         bool    `json:"locked"`
+	LockedBy       *string `json:"locked_by"`
+	LockedAt       *string `json:"locked_at"`
+	Stale          bool    `json:"stale"`
+	TimeoutMinutes int     `json:"timeout_minutes"`
+	Host           string  `json:"host,omitempty"`
+	Context        string  `json:"context,omitempty"`
+}
+
+func runLocks(cmd *cobra.Command, args []string) error {
+	// 1. Open Git repository
+	repo, err := openRepo()
+	if err != nil {
+		errorMsg("Not a Git repository")
+		return err
+	}
+
+	// 2. Read metadata
+	reader := metadata.NewReader(repo.Repository)
+	if !reader.Exists() {
+		errorMsg("Hitch is not initialized in this repository")
+		fmt.Println("\nRun 'hitch init' to initialize Hitch.")
+		return fmt.Errorf("hitch not initialized")
+	}
+
+	meta, err := reader.Read()
+	if err != nil {
+		errorMsg("Failed to read metadata")
+		return err
+	}
+
+	states := lockStates(meta)
+
+	// 3. Display locks
+	if jsonOutput {
+		encoder := json.NewEncoder(jsonOut)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(states)
+	}
+
+	out := cmd.OutOrStdout()
+	for _, s := range states {
+		switch {
+		case !s.Locked:
+			fmt.Fprintf(out, "%-12s unlocked\n", s.Environment)
+		case s.Stale:
+			fmt.Fprintf(out, "%-12s locked by %s since %s (stale)\n", s.Environment, *s.LockedBy, *s.LockedAt)
+		default:
+			fmt.Fprintf(out, "%-12s locked by %s since %s\n", s.Environment, *s.LockedBy, *s.LockedAt)
+		}
+	}
+
+	return nil
+}
+
+// lockStates returns the lock state of every environment, sorted by name
+func lockStates(meta *metadata.Metadata) []lockState {
+	names := meta.EnvironmentNames()
+
+	states := make([]lockState, 0, len(names))
+	for _, name := range names {
+		env := meta.Environments[name]
+		s := lockState{
+			Environment:    name,
+			Locked:         env.Locked,
+			Stale:          meta.IsLockStale(name),
+			TimeoutMinutes: int(meta.LockTimeout() / time.Minute),
+		}
+
+		if env.Locked {
+			lockedBy := env.LockedBy
+			lockedAt := env.LockedAt.UTC().Format(time.RFC3339)
+			s.LockedBy = &lockedBy
+			s.LockedAt = &lockedAt
+			s.Host = env.LockedHost
+			s.Context = env.LockedContext
+		}
+
+		states = append(states, s)
+	}
+
+	return states
+}
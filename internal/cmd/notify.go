@@ -0,0 +1,17 @@
+package cmd
+
+import (
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/DoomedRamen/hitch/internal/notify"
+)
+
+// sendNotification posts event to the configured webhooks that want it. A
+// failing webhook only warns; offline, nothing is sent.
+func sendNotification(meta *metadata.Metadata, event notify.Event) {
+	if len(meta.Config.NotificationWebhooks) == 0 || isOffline() {
+		return
+	}
+	for _, err := range notify.Send(meta.Config.NotificationWebhooks, event) {
+		warning(err.Error())
+	}
+}
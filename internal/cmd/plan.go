@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/metadata"
+)
+
+// rebuildPlan is what `hitch rebuild --plan` writes and `--apply` executes:
+// the exact commits a rebuild will merge, and the state it was planned from
+type rebuildPlan struct {
+	Environment    string         `json:"environment"`
+	MetadataCommit string         `json:"metadata_commit"`
+	Base           string         `json:"base"`
+	BaseCommit     string         `json:"base_commit"`
+	Features       []plannedMerge `json:"features"`
+	CreatedAt      time.Time      `json:"created_at"`
+	CreatedBy      string         `json:"created_by,omitempty"`
+}
+
+// plannedMerge is one feature in a rebuild plan, in merge order
+type plannedMerge struct {
+	Branch    string `json:"branch"`
+	Commit    string `json:"commit"`
+	Pinned    bool   `json:"pinned,omitempty"`
+	Conflicts bool   `json:"conflicts"`
+}
+
+// buildRebuildPlan resolves every commit a rebuild of envName would merge and
+// trial-merges each feature into the base to report conflicts
+func buildRebuildPlan(repo *hitchgit.Repo, envName string, env metadata.Environment, metadataCommit string, user string) (*rebuildPlan, error) {
+	baseCommit, err := repo.ResolveCommit(env.Base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve base branch %s: %w", env.Base, err)
+	}
+
+	plan := &rebuildPlan{
+		Environment:    envName,
+		MetadataCommit: metadataCommit,
+		Base:           env.Base,
+		BaseCommit:     baseCommit,
+		Features:       []plannedMerge{},
+		CreatedAt:      time.Now().UTC(),
+		CreatedBy:      user,
+	}
+
+	for _, feature := range env.Features {
+		commit, err := repo.ResolveCommit(env.MergeRef(feature))
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", feature, err)
+		}
+
+		conflicts, err := repo.WouldConflict(baseCommit, commit)
+		if err != nil {
+			return nil, err
+		}
+
+		_, pinned := env.Pins[feature]
+		plan.Features = append(plan.Features, plannedMerge{
+			Branch:    feature,
+			Commit:    commit,
+			Pinned:    pinned,
+			Conflicts: conflicts,
+		})
+	}
+
+	return plan, nil
+}
+
+// writeRebuildPlan saves plan as JSON to path
+func writeRebuildPlan(plan *rebuildPlan, path string) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode plan: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write plan: %w", err)
+	}
+	return nil
+}
+
+// readRebuildPlan loads a plan written by writeRebuildPlan
+func readRebuildPlan(path string) (*rebuildPlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan: %w", err)
+	}
+
+	var plan rebuildPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("failed to parse plan %s: %w", path, err)
+	}
+	return &plan, nil
+}
+
+// checkPlanCurrent refuses a plan if anything it was built from has changed:
+// the metadata, the base branch, or the commit any feature would merge
+func checkPlanCurrent(repo *hitchgit.Repo, plan *rebuildPlan, envName string, env metadata.Environment, metadataCommit string) error {
+	var changes []string
+
+	if plan.Environment != envName {
+		changes = append(changes, fmt.Sprintf("plan is for %s, not %s", plan.Environment, envName))
+	}
+	if plan.MetadataCommit != metadataCommit {
+		changes = append(changes, fmt.Sprintf("metadata moved from %s to %s", shortSHA(repo, plan.MetadataCommit), shortSHA(repo, metadataCommit)))
+	}
+	if baseCommit, err := repo.ResolveCommit(env.Base); err != nil || baseCommit != plan.BaseCommit {
+		changes = append(changes, fmt.Sprintf("%s is no longer at %s", env.Base, shortSHA(repo, plan.BaseCommit)))
+	}
+	for _, merge := range plan.Features {
+		if commit, err := repo.ResolveCommit(env.MergeRef(merge.Branch)); err != nil || commit != merge.Commit {
+			changes = append(changes, fmt.Sprintf("%s is no longer at %s", merge.Branch, shortSHA(repo, merge.Commit)))
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	errorMsg("The plan is out of date")
+	fmt.Println()
+	for _, change := range changes {
+		fmt.Printf("  - %s\n", change)
+	}
+	fmt.Println()
+	fmt.Printf("Make a new plan with: hitch rebuild %s --plan <file>\n", envName)
+	return fmt.Errorf("plan is out of date")
+}
+
+// plannedEnvironment returns env as the plan saw it: the planned base commit
+// and every feature pinned to its planned commit, so a rebuild of it merges
+// exactly what was reviewed
+func plannedEnvironment(plan *rebuildPlan, env metadata.Environment) metadata.Environment {
+	env.Base = plan.BaseCommit
+	env.Features = make([]string, 0, len(plan.Features))
+	env.Pins = make(map[string]string, len(plan.Features))
+	for _, merge := range plan.Features {
+		env.Features = append(env.Features, merge.Branch)
+		env.Pins[merge.Branch] = merge.Commit
+	}
+	return env
+}
+
+// displayRebuildPlan prints a plan for review
+func displayRebuildPlan(repo *hitchgit.Repo, plan *rebuildPlan) {
+	fmt.Printf("Plan for %s (base %s at %s, metadata %s):\n", plan.Environment, plan.Base, shortSHA(repo, plan.BaseCommit), shortSHA(repo, plan.MetadataCommit))
+	if len(plan.Features) == 0 {
+		info("  No features to merge")
+		return
+	}
+	for i, merge := range plan.Features {
+		status := "mergeable"
+		if merge.Conflicts {
+			status = "CONFLICTS with base"
+		}
+		fmt.Printf("  %d. %s at %s (%s)\n", i+1, merge.Branch, shortSHA(repo, merge.Commit), status)
+	}
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/metadata"
+)
+
+// postRebuildHookPath is the hook script run after a rebuild when the config
+// doesn't set post_rebuild_hook, relative to the repository root
+var postRebuildHookPath = filepath.Join(".hitch", "hooks", "post-rebuild")
+
+// runPostRebuildHook runs the post-rebuild hook, if there is one, for the
+// freshly rebuilt envName. A failing hook only warns unless --strict is set.
+func runPostRebuildHook(repo *hitchgit.Repo, meta *metadata.Metadata, envName string) error {
+	commit, err := repo.ResolveCommit(envName)
+	if err != nil {
+		return err
+	}
+
+	var cmd *exec.Cmd
+	var name string
+	if hook := meta.Config.PostRebuildHook; hook != "" {
+		// $1 and $2 are the environment and commit, as for the script
+		cmd = exec.Command("sh", "-c", hook, "post-rebuild", envName, commit)
+		name = hook
+	} else {
+		path := filepath.Join(repo.Root(), postRebuildHookPath)
+		if stat, err := os.Stat(path); err != nil || stat.IsDir() || stat.Mode()&0111 == 0 {
+			return nil
+		}
+		cmd = exec.Command(path, envName, commit)
+		name = postRebuildHookPath
+	}
+
+	cmd.Dir = repo.Root()
+	cmd.Env = append(os.Environ(), "HITCH_ENVIRONMENT="+envName, "HITCH_COMMIT="+commit)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	fmt.Println()
+	info(fmt.Sprintf("Running post-rebuild hook: %s", name))
+	if err := cmd.Run(); err != nil {
+		if rebuildStrict {
+			errorMsg(fmt.Sprintf("Post-rebuild hook failed: %v", err))
+			return fmt.Errorf("post-rebuild hook failed: %w", err)
+		}
+		warning(fmt.Sprintf("Post-rebuild hook failed: %v", err))
+		fmt.Printf("  %s was rebuilt; rerun the hook by hand if needed\n", envName)
+		return nil
+	}
+
+	success("Post-rebuild hook succeeded")
+	return nil
+}
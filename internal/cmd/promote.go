@@ -1,19 +1,28 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	hitchgit "github.com/DoomedRamen/hitch/internal/git"
 	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/DoomedRamen/hitch/internal/notify"
 	"github.com/spf13/cobra"
 )
 
 var (
 	promoteNoRebuild bool
+	promoteRebuild   bool
+	promoteCreate    bool
+	promoteFrom      string
+	promoteDryRun    bool
+	promoteForce     bool
+	promoteMetaOnly  bool
 )
 
 var promoteCmd = &cobra.Command{
-	Use:   "promote <branch> to <environment>",
+	Use:   "promote [<branch>[@<sha>]] to <environment>",
 	Short: "Add a feature branch to an environment",
 	Long: `Add a feature branch to an environment.
 
@@ -27,31 +36,104 @@ This command:
 7. Releases lock
 8. Returns you to your original branch
 
+Append @<sha> to pin the feature to a specific commit of the branch:
+rebuilds merge that commit instead of the moving tip. Promoting a pinned
+feature again without @<sha> unpins it.
+
+Leave out the branch to promote the feature branch you are on:
+  hitch promote to dev
+
+With --create, the branch is created first from the environment's base
+branch (or from --from <ref>). This refuses to run if the branch already
+exists.
+
+With --dry-run, nothing is written: the branch is trial-merged into the
+environment branch (or its base if it hasn't been built) and the result is
+reported. Add --json for a single machine-readable result; either way the
+exit status is non-zero if the merge would conflict.
+
+If config.auto_rebuild_on_promote is false, the environment isn't rebuilt
+unless --rebuild is given, as if --no-rebuild were the default.
+
+If config.require_up_to_date is set, a feature that doesn't contain the
+environment's base branch is refused until it's rebased; --force promotes
+it anyway.
+
+With --metadata-only, promote only records the feature in hitch.json, for
+teams whose environments are rebuilt by a separate CI job. Unlike
+--no-rebuild, no branch is looked at: the feature branch need not exist
+locally, the up-to-date policy isn't checked, and a pin must be a full SHA.
+
 Safety: Uses temporary branch for rebuild - original environment preserved until success!`,
-	Args: cobra.ExactArgs(3), // branch, "to", environment
+	Args: cobra.RangeArgs(2, 3), // [branch], "to", environment
 	RunE: runPromote,
 }
 
 func init() {
 	promoteCmd.Flags().BoolVar(&promoteNoRebuild, "no-rebuild", false, "Add to metadata but don't rebuild")
+	promoteCmd.Flags().BoolVar(&promoteRebuild, "rebuild", false, "Rebuild even if config.auto_rebuild_on_promote is false")
+	promoteCmd.Flags().BoolVar(&promoteCreate, "create", false, "Create the branch from the environment's base before promoting")
+	promoteCmd.Flags().StringVar(&promoteFrom, "from", "", "Ref to create the branch from (requires --create)")
+	promoteCmd.Flags().BoolVar(&promoteForce, "force", false, "Promote even if the branch is behind base under require_up_to_date, or during a scheduled freeze")
+	promoteCmd.Flags().BoolVar(&promoteDryRun, "dry-run", false, "Trial-merge into the environment and report conflicts without changing anything")
+	promoteCmd.Flags().BoolVar(&promoteMetaOnly, "metadata-only", false, "Only record the promotion in metadata, without touching or checking any branch")
 	rootCmd.AddCommand(promoteCmd)
 }
 
 func runPromote(cmd *cobra.Command, args []string) error {
+	// Without a branch, the current branch is promoted (resolved below)
+	if len(args) == 2 && args[0] == "to" {
+		args = append([]string{""}, args...)
+	}
 	if len(args) != 3 || args[1] != "to" {
-		return fmt.Errorf("usage: hitch promote <branch> to <environment>")
+		return fmt.Errorf("usage: hitch promote <branch>[@<sha>] to <environment>")
 	}
 
-	branchName := args[0]
+	var branchName, pinRev string
+	if args[0] != "" {
+		var err error
+		if branchName, pinRev, err = metadata.ParseFeatureRef(args[0]); err != nil {
+			return err
+		}
+	}
+	pinned := pinRev != ""
 	envName := args[2]
 
+	if pinned && promoteCreate {
+		return fmt.Errorf("cannot pin a branch created with --create")
+	}
+	if branchName == "" && promoteCreate {
+		return fmt.Errorf("--create needs the name of the branch to create")
+	}
+
+	if promoteFrom != "" && !promoteCreate {
+		return fmt.Errorf("--from requires --create")
+	}
+	if promoteDryRun && promoteCreate {
+		return fmt.Errorf("--dry-run cannot be combined with --create")
+	}
+	if promoteRebuild && promoteNoRebuild {
+		return fmt.Errorf("--rebuild cannot be combined with --no-rebuild")
+	}
+	if promoteMetaOnly && (promoteCreate || promoteDryRun || promoteRebuild) {
+		return fmt.Errorf("--metadata-only cannot be combined with --create, --dry-run, or --rebuild")
+	}
+	if promoteMetaOnly && pinned && !isFullSHA(pinRev) {
+		return fmt.Errorf("--metadata-only can't resolve %s; pin a full commit SHA", pinRev)
+	}
+
 	// 1. Open Git repository
-	repo, err := hitchgit.OpenRepo(".")
+	repo, err := openRepo()
 	if err != nil {
 		errorMsg("Not a Git repository")
 		return err
 	}
 
+	if err := checkNoInProgressOperation(repo); err != nil {
+		return err
+	}
+	warnIfShallow(repo)
+
 	// 2. Remember current branch (will return here at end)
 	currentBranch, err := repo.CurrentBranch()
 	if err != nil {
@@ -59,9 +141,7 @@ func runPromote(cmd *cobra.Command, args []string) error {
 		currentBranch = currentCommit
 	}
 
-	defer func() {
-		repo.Checkout(currentBranch)
-	}()
+	defer restoreBranch(repo, currentBranch)
 
 	// 3. Read metadata
 	reader := metadata.NewReader(repo.Repository)
@@ -77,6 +157,29 @@ func runPromote(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	envName = meta.ResolveEnvironment(envName)
+
+	if !promoteDryRun {
+		if err := checkMetadataNotBehind(repo); err != nil {
+			return err
+		}
+
+		if err := checkNotFrozen(meta); err != nil {
+			return err
+		}
+	}
+
+	if branchName == "" {
+		if repo.IsDetachedHead() || !meta.IsFeatureBranch(currentBranch) {
+			errorMsg("You are not on a feature branch")
+			fmt.Println("\nName the branch to promote: hitch promote <branch> to <environment>")
+			return fmt.Errorf("no branch to promote")
+		}
+		branchName = currentBranch
+		args[0] = branchName
+		info(fmt.Sprintf("Promoting the current branch, %s", branchName))
+	}
+
 	// 4. Validate environment exists
 	_, exists := meta.Environments[envName]
 	if !exists {
@@ -88,54 +191,128 @@ func runPromote(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("environment not found")
 	}
 
-	// 5. Validate branch exists
-	if !repo.BranchExists(branchName) {
+	if !promoteDryRun {
+		if err := checkFreezeWindow(meta, envName, promoteForce); err != nil {
+			return err
+		}
+	}
+
+	// 5. Create the branch (--create) or validate it exists
+	if promoteMetaOnly {
+		// Left to whatever rebuilds the environment
+	} else if promoteCreate {
+		if err := createPromotedBranch(repo, branchName, meta.Environments[envName].Base); err != nil {
+			return err
+		}
+	} else if !repo.BranchExists(branchName) {
 		errorMsg(fmt.Sprintf("Branch '%s' not found", branchName))
 		fmt.Println("\nMake sure the branch exists locally or remotely:")
 		fmt.Printf("  git branch -a | grep %s\n", branchName)
 		return fmt.Errorf("branch not found")
 	}
 
+	pinSHA := ""
+	if pinned && promoteMetaOnly {
+		pinSHA = pinRev
+	} else if pinned {
+		pinSHA, err = resolvePin(repo, branchName, pinRev)
+		if err != nil {
+			return err
+		}
+	}
+
+	if meta.Config.RequireUpToDate && !promoteForce && !promoteMetaOnly {
+		if err := checkUpToDate(repo, args[0], pinSHA, meta.Environments[envName].Base); err != nil {
+			return err
+		}
+	}
+
+	if promoteDryRun {
+		return performDryRunPromote(repo, branchName, pinSHA, envName, meta.Environments[envName])
+	}
+
 	// 6. Get user info
 	userEmail, err := repo.UserEmail()
 	if err != nil {
-		errorMsg("Git user.email is not configured")
+		userEmailMissing()
 		return err
 	}
 
 	userName, _ := repo.UserName()
 
-	// 7. Check if already in environment
+	// 7. Check if already in environment (with the same pin)
 	env := meta.Environments[envName]
+	alreadyIn := false
 	for _, feature := range env.Features {
 		if feature == branchName {
-			warning(fmt.Sprintf("%s is already in %s", branchName, envName))
-			return nil
+			alreadyIn = true
+			break
+		}
+	}
+
+	if alreadyIn && env.Pins[branchName] == pinSHA {
+		warning(fmt.Sprintf("%s is already in %s", args[0], envName))
+		return nil
+	}
+
+	if !alreadyIn && !promoteMetaOnly {
+		source := branchName
+		if pinSHA != "" {
+			source = pinSHA
+		}
+		for _, duplicate := range duplicateFeatures(repo, env, branchName, source) {
+			warning(fmt.Sprintf("%s is at the same commit as %s, which is already in %s", args[0], duplicate, envName))
 		}
 	}
 
-	fmt.Printf("Promoting %s to %s...\n\n", branchName, envName)
+	fmt.Printf("Promoting %s to %s...\n\n", args[0], envName)
 
-	// 8. Add to metadata
-	if err := meta.AddBranchToEnvironment(envName, branchName, userEmail); err != nil {
-		errorMsg("Failed to add branch to environment")
+	// 8. Add to metadata and record the pin
+	if !alreadyIn {
+		if err := meta.AddBranchToEnvironment(envName, branchName, userEmail); err != nil {
+			errorMsg("Failed to add branch to environment")
+			return err
+		}
+
+		success(fmt.Sprintf("Added %s to %s feature list", branchName, envName))
+	}
+
+	if err := meta.PinFeature(envName, branchName, pinSHA); err != nil {
+		errorMsg("Failed to update pin")
 		return err
 	}
 
-	success(fmt.Sprintf("Added %s to %s feature list", branchName, envName))
+	if pinSHA != "" {
+		success(fmt.Sprintf("Pinned %s at %s", branchName, shortSHA(repo, pinSHA)))
+	} else if alreadyIn {
+		success(fmt.Sprintf("Unpinned %s; %s now tracks its tip", branchName, envName))
+	}
 
 	// 9. Write metadata
 	writer := metadata.NewWriter(repo.Repository)
-	meta.UpdateMeta(userEmail, fmt.Sprintf("hitch promote %s to %s", branchName, envName))
-	if err := writer.Write(meta, fmt.Sprintf("Promote %s to %s", branchName, envName), userName, userEmail); err != nil {
+	meta.UpdateMeta(userEmail, fmt.Sprintf("hitch promote %s to %s", args[0], envName))
+	if err := writer.Write(meta, fmt.Sprintf("Promote %s to %s", args[0], envName), userName, userEmail); err != nil {
 		errorMsg("Failed to write metadata")
 		return err
 	}
 
 	success("Updated metadata")
-
-	// 10. Rebuild environment (unless --no-rebuild)
-	if promoteNoRebuild {
+	sendNotification(meta, notify.Event{
+		Event:       notify.EventPromote,
+		Environment: envName,
+		Branch:      branchName,
+		Commit:      pinSHA,
+		User:        userEmail,
+		Message:     fmt.Sprintf("%s promoted %s to %s", userEmail, args[0], envName),
+	})
+
+	// 10. Rebuild environment (unless --metadata-only, --no-rebuild, or
+	// config says not to)
+	if promoteMetaOnly {
+		metadataOnlyNote(envName)
+		return nil
+	}
+	if skipRebuild(meta, promoteNoRebuild, promoteRebuild) {
 		fmt.Println()
 		warning(fmt.Sprintf("Skipped rebuild (use 'hitch rebuild %s' to rebuild)", envName))
 		return nil
@@ -147,18 +324,233 @@ func runPromote(cmd *cobra.Command, args []string) error {
 	return runRebuildInternal(repo, envName, userEmail, userName, meta)
 }
 
+// skipRebuild decides whether promote or demote leaves the rebuild for later:
+// always with --no-rebuild, never with --rebuild, and otherwise unless
+// config.auto_rebuild_on_promote is set
+func skipRebuild(meta *metadata.Metadata, noRebuild bool, rebuild bool) bool {
+	switch {
+	case noRebuild:
+		return true
+	case rebuild:
+		return false
+	}
+	if !meta.Config.AutoRebuildOnPromote {
+		info("config.auto_rebuild_on_promote is off; pass --rebuild to rebuild right away")
+		return true
+	}
+	return false
+}
+
+// metadataOnlyNote reminds the user that a --metadata-only change leaves
+// envs to be rebuilt elsewhere
+func metadataOnlyNote(envs ...string) {
+	fmt.Println()
+	info(fmt.Sprintf("Recorded in metadata only; %s left for an out-of-band rebuild", strings.Join(envs, ", ")))
+}
+
+// isFullSHA reports whether sha, as returned by ParseFeatureRef, is
+// unabbreviated: the only pin --metadata-only accepts since it can't look
+// the commit up
+func isFullSHA(sha string) bool {
+	return len(sha) == 40
+}
+
+// checkUpToDate refuses a feature (or its pin) that doesn't contain base,
+// for config.require_up_to_date
+func checkUpToDate(repo *hitchgit.Repo, feature string, pinSHA string, base string) error {
+	branchName, _, _ := metadata.ParseFeatureRef(feature)
+	ref := branchName
+	if pinSHA != "" {
+		ref = pinSHA
+	}
+
+	upToDate, err := repo.IsAncestor(base, ref)
+	if err != nil {
+		errorMsg(fmt.Sprintf("Failed to check %s against %s", feature, base))
+		return err
+	}
+	if upToDate {
+		return nil
+	}
+
+	errorMsg(fmt.Sprintf("%s is behind %s", feature, base))
+	fmt.Println("\nThis repository requires features to be up to date with base (config.require_up_to_date).")
+	fmt.Println("Rebase it first:")
+	fmt.Printf("  git checkout %s\n", branchName)
+	fmt.Printf("  git rebase %s\n", base)
+	fmt.Println("\nOr promote it anyway with --force.")
+	return fmt.Errorf("%s is not up to date with %s", feature, base)
+}
+
+// duplicateFeatures returns env's features, other than branchName, that
+// would merge the same commit as source: usually the same work promoted
+// again under a new branch name
+func duplicateFeatures(repo *hitchgit.Repo, env metadata.Environment, branchName string, source string) []string {
+	commit, err := repo.ResolveCommit(source)
+	if err != nil {
+		return nil
+	}
+
+	var duplicates []string
+	for _, feature := range env.Features {
+		if feature == branchName {
+			continue
+		}
+		if other, err := repo.ResolveCommit(env.MergeRef(feature)); err == nil && other == commit {
+			duplicates = append(duplicates, feature)
+		}
+	}
+	return duplicates
+}
+
+// promoteCheck is the --dry-run --json result of a promote
+type promoteCheck struct {
+	Branch      string   `json:"branch"`
+	Environment string   `json:"environment"`
+	Mergeable   bool     `json:"mergeable"`
+	Conflicts   []string `json:"conflicts"`
+}
+
+// performDryRunPromote trial-merges branchName (or its pin) into what envName
+// was last built as and reports whether a promote would conflict, without
+// writing metadata. The rebuild after a real promote merges onto a fresh
+// base, so this can't see conflicts with features merged since.
+func performDryRunPromote(repo *hitchgit.Repo, branchName string, pinSHA string, envName string, env metadata.Environment) error {
+	target := envName
+	if !repo.BranchExists(target) {
+		target = env.Base
+	}
+	source := branchName
+	if pinSHA != "" {
+		source = pinSHA
+	}
+
+	conflicts, err := repo.ConflictingFiles(target, source)
+	if err != nil {
+		errorMsg(fmt.Sprintf("Trial merge of %s into %s failed", branchName, target))
+		return err
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(jsonOut)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(promoteCheck{
+			Branch:      branchName,
+			Environment: envName,
+			Mergeable:   len(conflicts) == 0,
+			Conflicts:   conflicts,
+		}); err != nil {
+			return err
+		}
+		if len(conflicts) > 0 {
+			return reportedError{fmt.Errorf("promote would conflict")}
+		}
+		return nil
+	}
+
+	fmt.Printf("Dry run: simulating promote of %s to %s\n\n", branchName, envName)
+
+	if len(conflicts) > 0 {
+		errorMsg(fmt.Sprintf("%s would conflict with %s", branchName, target))
+		for _, file := range conflicts {
+			fmt.Printf("  - %s\n", file)
+		}
+		return fmt.Errorf("promote would conflict")
+	}
+	success(fmt.Sprintf("%s merges cleanly into %s", branchName, target))
+
+	fmt.Println("\nDry run complete. No changes made.")
+	return nil
+}
+
+// resolvePin resolves rev to a full commit SHA and checks that it belongs to
+// branch, so a pin can't point at an unrelated commit
+func resolvePin(repo *hitchgit.Repo, branch string, rev string) (string, error) {
+	sha, err := repo.ResolveCommit(rev)
+	if err != nil {
+		errorMsg(fmt.Sprintf("Commit '%s' not found", rev))
+		return "", err
+	}
+
+	onBranch, err := repo.IsAncestor(sha, branch)
+	if err != nil {
+		errorMsg(fmt.Sprintf("Failed to check %s against %s", rev, branch))
+		return "", err
+	}
+	if !onBranch {
+		errorMsg(fmt.Sprintf("Commit %s is not on %s", shortSHA(repo, sha), branch))
+		return "", fmt.Errorf("pin is not on branch")
+	}
+
+	return sha, nil
+}
+
+// shortSHA abbreviates a commit SHA for display, unambiguously within repo
+// if there is one; repo is nil when git mustn't be consulted
+func shortSHA(repo *hitchgit.Repo, sha string) string {
+	if repo == nil {
+		return hitchgit.AbbreviateSHA(sha)
+	}
+	return repo.ShortSHA(sha)
+}
+
+// createPromotedBranch creates branchName from --from, or from base if not given,
+// refusing if the branch already exists
+func createPromotedBranch(repo *hitchgit.Repo, branchName string, base string) error {
+	if repo.BranchExists(branchName) {
+		errorMsg(fmt.Sprintf("Branch '%s' already exists", branchName))
+		fmt.Println("\nDrop --create to promote the existing branch.")
+		return fmt.Errorf("branch already exists")
+	}
+
+	if err := hitchgit.ValidBranchName(branchName); err != nil {
+		errorMsg(fmt.Sprintf("Invalid branch name '%s'", branchName))
+		return err
+	}
+
+	from := promoteFrom
+	if from == "" {
+		from = base
+	}
+
+	if err := repo.CreateBranch(branchName, from); err != nil {
+		errorMsg(fmt.Sprintf("Failed to create %s from %s", branchName, from))
+		return err
+	}
+
+	success(fmt.Sprintf("Created %s from %s", branchName, from))
+	return nil
+}
+
 // runRebuildInternal is a helper that rebuilds without checking locks (caller handles locking)
 func runRebuildInternal(repo *hitchgit.Repo, envName string, userEmail string, userName string, meta *metadata.Metadata) error {
 	env := meta.Environments[envName]
+	env.Features = meta.MergeOrder(env.Features)
 
-	// Lock environment
-	if err := meta.LockEnvironment(envName, userEmail, "Rebuilding after promote"); err != nil {
-		// Check if we're the lock holder
-		if !meta.IsLockedByUser(envName, userEmail) {
-			errorMsg("Failed to acquire lock")
+	// Someone else's lock stops the rebuild, as it does a standalone one; the
+	// metadata change that triggered it is already written
+	if err := checkRebuildLock(meta, envName, env, userEmail); err != nil {
+		fmt.Printf("\n%s was not rebuilt. Once the lock is released, run:\n", envName)
+		fmt.Printf("  hitch rebuild %s\n", envName)
+		return err
+	}
+	if !repo.IsBare() {
+		if err := checkCleanWorktree(repo); err != nil {
+			fmt.Printf("\n%s was not rebuilt. Once your changes are committed or stashed, run:\n", envName)
+			fmt.Printf("  hitch rebuild %s\n", envName)
 			return err
 		}
 	}
+	if err := checkPinsExist(repo, envName, env); err != nil {
+		fmt.Printf("\n%s was not rebuilt\n", envName)
+		return err
+	}
+
+	// Lock environment
+	if err := meta.LockEnvironment(envName, userEmail, "Rebuilding after promote"); err != nil {
+		errorMsg("Failed to acquire lock")
+		return err
+	}
 
 	// Write metadata with lock
 	writer := metadata.NewWriter(repo.Repository)
@@ -175,6 +567,11 @@ func runRebuildInternal(repo *hitchgit.Repo, envName string, userEmail string, u
 		writer.Write(meta, fmt.Sprintf("Unlock %s after rebuild", envName), userName, userEmail)
 	}()
 
-	// Perform rebuild
-	return performRebuild(repo, envName, env, meta, userEmail)
+	// Perform rebuild, in a clone if there's no working tree to merge in
+	if repo.IsBare() {
+		_, err := performCloneRebuild(repo, envName, env, meta, userEmail)
+		return err
+	}
+	_, err := performRebuild(repo, envName, env, meta, userEmail, nil)
+	return err
 }
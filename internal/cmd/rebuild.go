@@ -1,17 +1,36 @@
 package cmd
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/logging"
 	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/DoomedRamen/hitch/internal/notify"
 	"github.com/spf13/cobra"
 )
 
 var (
-	rebuildDryRun bool
-	rebuildForce  bool
+	rebuildDryRun    bool
+	rebuildForce     bool
+	rebuildPlanFile  string
+	rebuildApplyFile string
+	rebuildStrict    bool
+	rebuildFeatures  string
+	rebuildClone     bool
+	rebuildContinue  bool
+	rebuildAbort     bool
+	rebuildOutdated  bool
+	rebuildKeepTemp  bool
+	rebuildIncrement bool
 )
 
 var rebuildCmd = &cobra.Command{
@@ -31,27 +50,122 @@ This command:
 
 Safety (always enabled):
 - Original hitched branch is never touched until rebuild succeeds
-- If ANY merge fails, temp branch is deleted and original is preserved`,
+- If ANY merge fails, the original is preserved and the temp branch is
+  kept for --continue
+
+For review gates, --plan <file> writes the exact commits a rebuild would
+merge, in order and with their mergeability, without changing anything.
+--apply <file> then rebuilds exactly that plan, and refuses if the metadata,
+base branch, or any feature has moved since the plan was made.
+
+After a successful rebuild, the post-rebuild hook runs: config
+post_rebuild_hook if set, otherwise an executable .hitch/hooks/post-rebuild.
+It gets the environment and new commit as arguments and as HITCH_ENVIRONMENT
+and HITCH_COMMIT. A failing hook is a warning, or an error with --strict.
+
+For declarative environments, --features-from <file> rebuilds from the
+features listed in the file, one branch per line in merge order ('#' starts
+a comment), and updates the environment's feature list in metadata to match.
+
+With --clone, the merges run in a throwaway clone of the repository, so
+checkouts, temp branches, and conflicts never touch your repository; only
+metadata and the rebuilt hitched branch are written back. The hitched branch
+is pushed from the clone and copied back into your repository, then the
+clone is deleted. The post-rebuild hook runs in the clone.
+
+When a merge conflicts and can't be resolved interactively, the rebuild
+stops but keeps its temp branch, and records which features are already
+merged in .git/hitch-rebuild-state.json. Fix the conflicting feature (for
+example by rebasing it), then run 'hitch rebuild <env> --continue' to merge
+the remaining features onto the temp branch without re-merging the others.
+'hitch rebuild <env> --abort' deletes the temp branch and the saved state.
+Rebuilds that can't be continued (--apply, --clone) delete their temp branch
+on a conflict unless --keep-temp is given; with --clone it is copied back
+into your repository.
+
+For scheduled jobs, --if-outdated rebuilds only when the result would
+change: the base or a feature has commits the hitched branch lacks, the
+feature list changed since the last rebuild, or the hitched branch drifted.
+Otherwise it reports the environment is up to date and exits successfully.
+
+For a routine promote, --incremental merges just the features the hitched
+branch doesn't have yet onto its current tip, instead of rebuilding from the
+base. It rebuilds from scratch instead when the hitched branch drifted, a
+feature was demoted, or the base has new commits since the last rebuild, and
+when one of the new features conflicts.`,
 	Args: cobra.ExactArgs(1),
 	RunE: runRebuild,
 }
 
 func init() {
 	rebuildCmd.Flags().BoolVar(&rebuildDryRun, "dry-run", false, "Simulate rebuild without making changes")
-	rebuildCmd.Flags().BoolVar(&rebuildForce, "force", false, "Rebuild even if environment is locked")
+	rebuildCmd.Flags().BoolVar(&rebuildForce, "force", false, "Rebuild even if the environment is locked or in a scheduled freeze")
+	rebuildCmd.Flags().BoolVar(&rebuildStrict, "strict", false, "Fail if the post-rebuild hook fails, instead of warning")
+	rebuildCmd.Flags().StringVar(&rebuildPlanFile, "plan", "", "Write a rebuild plan to this file instead of rebuilding")
+	rebuildCmd.Flags().StringVar(&rebuildFeatures, "features-from", "", "Rebuild with exactly the features listed in this file, and record them in metadata")
+	rebuildCmd.Flags().BoolVar(&rebuildClone, "clone", false, "Merge in a temporary clone instead of this repository")
+	rebuildCmd.Flags().StringVar(&rebuildApplyFile, "apply", "", "Rebuild exactly the plan in this file, if nothing changed since it was made")
+	rebuildCmd.Flags().BoolVar(&rebuildContinue, "continue", false, "Resume a rebuild that stopped on a merge conflict")
+	rebuildCmd.Flags().BoolVar(&rebuildAbort, "abort", false, "Give up a rebuild that stopped on a merge conflict and delete its temp branch")
+	rebuildCmd.Flags().BoolVar(&rebuildOutdated, "if-outdated", false, "Only rebuild if the base or a feature has new commits, the feature list changed, or the branch drifted")
+	rebuildCmd.Flags().BoolVar(&rebuildKeepTemp, "keep-temp", false, "Keep the temp branch when a merge conflicts, to inspect it")
+	rebuildCmd.Flags().BoolVar(&rebuildIncrement, "incremental", false, "Merge only new features onto the current hitched branch, if nothing else changed")
 	rootCmd.AddCommand(rebuildCmd)
 }
 
 func runRebuild(cmd *cobra.Command, args []string) error {
 	envName := args[0]
 
+	if rebuildPlanFile != "" && (rebuildApplyFile != "" || rebuildDryRun) {
+		return fmt.Errorf("--plan cannot be combined with --apply or --dry-run")
+	}
+	if rebuildApplyFile != "" && rebuildDryRun {
+		return fmt.Errorf("--apply cannot be combined with --dry-run")
+	}
+	if rebuildFeatures != "" && (rebuildPlanFile != "" || rebuildApplyFile != "") {
+		return fmt.Errorf("--features-from cannot be combined with --plan or --apply")
+	}
+	if rebuildClone && (rebuildDryRun || rebuildPlanFile != "") {
+		return fmt.Errorf("--clone cannot be combined with --dry-run or --plan")
+	}
+	if rebuildKeepTemp && (rebuildDryRun || rebuildPlanFile != "") {
+		return fmt.Errorf("--keep-temp cannot be combined with --dry-run or --plan")
+	}
+	if rebuildIncrement && (rebuildDryRun || rebuildPlanFile != "" || rebuildApplyFile != "" || rebuildFeatures != "" || rebuildClone) {
+		return fmt.Errorf("--incremental cannot be combined with --dry-run, --plan, --apply, --features-from, or --clone")
+	}
+	if rebuildContinue && rebuildAbort {
+		return fmt.Errorf("--continue cannot be combined with --abort")
+	}
+	if (rebuildContinue || rebuildAbort) && (rebuildDryRun || rebuildPlanFile != "" || rebuildApplyFile != "" || rebuildFeatures != "" || rebuildClone || rebuildOutdated || rebuildIncrement) {
+		return fmt.Errorf("--continue and --abort cannot be combined with other rebuild options")
+	}
+	if rebuildOutdated && (rebuildPlanFile != "" || rebuildApplyFile != "" || rebuildFeatures != "") {
+		return fmt.Errorf("--if-outdated cannot be combined with --plan, --apply, or --features-from")
+	}
+
 	// 1. Open Git repository
-	repo, err := hitchgit.OpenRepo(".")
+	repo, err := openRepo()
 	if err != nil {
 		errorMsg("Not a Git repository")
 		return err
 	}
 
+	if rebuildAbort {
+		return abortRebuild(repo, envName)
+	}
+
+	if err := checkNoInProgressOperation(repo); err != nil {
+		return err
+	}
+	// Rebuilding in place checks out other branches in this worktree
+	if !rebuildDryRun && rebuildPlanFile == "" && !rebuildClone && !repo.IsBare() {
+		if err := checkCleanWorktree(repo); err != nil {
+			return err
+		}
+	}
+	warnIfShallow(repo)
+
 	// 2. Remember current branch
 	currentBranch, err := repo.CurrentBranch()
 	if err != nil {
@@ -60,9 +174,7 @@ func runRebuild(cmd *cobra.Command, args []string) error {
 	}
 
 	// ALWAYS return to original branch
-	defer func() {
-		repo.Checkout(currentBranch)
-	}()
+	defer restoreBranch(repo, currentBranch)
 
 	// 3. Read metadata
 	reader := metadata.NewReader(repo.Repository)
@@ -78,6 +190,18 @@ func runRebuild(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	envName = meta.ResolveEnvironment(envName)
+
+	if !rebuildDryRun && rebuildPlanFile == "" {
+		if err := checkMetadataNotBehind(repo); err != nil {
+			return err
+		}
+
+		if err := checkNotFrozen(meta); err != nil {
+			return err
+		}
+	}
+
 	// 4. Validate environment exists
 	env, exists := meta.Environments[envName]
 	if !exists {
@@ -89,33 +213,168 @@ func runRebuild(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("environment not found")
 	}
 
+	if cycle := meta.BaseCycle(envName); cycle != nil {
+		errorMsg(fmt.Sprintf("Can't rebuild %s: environment bases form a loop (%s)", envName, describeBaseCycle(cycle)))
+		fmt.Println("\nRun 'hitch doctor' for details.")
+		return fmt.Errorf("circular base for %s", envName)
+	}
+
+	if !rebuildDryRun && rebuildPlanFile == "" {
+		if err := checkFreezeWindow(meta, envName, rebuildForce); err != nil {
+			return err
+		}
+	}
+
+	// Shared features first, in the same order in every environment; a
+	// feature file or plan below sets its own order
+	env.Features = meta.MergeOrder(env.Features)
+
+	// Checked before taking the lock, so an up-to-date environment isn't
+	// touched at all
+	if rebuildOutdated {
+		reasons := rebuildReasons(repo, meta, envName, env)
+		if len(reasons) == 0 {
+			success(fmt.Sprintf("%s is up to date", envName))
+			return nil
+		}
+		info(fmt.Sprintf("%s is outdated:", envName))
+		for _, reason := range reasons {
+			fmt.Printf("  - %s\n", reason)
+		}
+		fmt.Println()
+	}
+
+	// Decided before the lock too, so the output explains a full rebuild
+	// before it starts
+	var incremental []string
+	if rebuildIncrement && !repo.IsBare() {
+		features, reason := incrementalFeatures(repo, meta, envName, env)
+		if reason != "" {
+			info(fmt.Sprintf("Rebuilding %s from scratch: %s", envName, reason))
+			fmt.Println()
+		} else {
+			incremental = features
+			if incremental == nil {
+				incremental = []string{}
+			}
+		}
+	}
+
 	// 5. Get user info
 	userEmail, err := repo.UserEmail()
 	if err != nil {
-		errorMsg("Git user.email is not configured")
+		userEmailMissing()
 		return err
 	}
 
-	// 6. Check/acquire lock
-	if env.Locked && !rebuildForce {
-		if env.LockedBy != userEmail {
-			errorMsg(fmt.Sprintf("Environment '%s' is locked", envName))
-			fmt.Println()
-			fmt.Printf("Locked by: %s\n", env.LockedBy)
-			fmt.Printf("Locked at: %s\n", env.LockedAt.Format("2006-01-02 15:04:05"))
-			fmt.Println()
+	// Like git rebase, a stopped rebuild must be continued or aborted before
+	// another one starts
+	var resume *rebuildState
+	if !rebuildDryRun && rebuildPlanFile == "" {
+		state, err := loadRebuildState(repo)
+		if err != nil {
+			errorMsg("Failed to read rebuild state")
+			return err
+		}
 
-			if meta.IsLockStale(envName) {
-				fmt.Printf("This lock is stale (older than %d minutes).\n", meta.Config.LockTimeoutMinutes)
-				fmt.Printf("To force rebuild: hitch rebuild %s --force\n", envName)
-			} else {
-				fmt.Printf("Wait for unlock or contact %s\n", env.LockedBy)
+		switch {
+		case rebuildContinue && (state == nil || state.Environment != envName):
+			errorMsg(fmt.Sprintf("No stopped rebuild of %s to continue", envName))
+			return fmt.Errorf("no rebuild of %s in progress", envName)
+		case rebuildContinue:
+			if state.Features != nil {
+				env.Features = state.Features
 			}
+			if err := checkRebuildStateCurrent(repo, state, env); err != nil {
+				return err
+			}
+			resume = state
+		case state != nil:
+			errorMsg(fmt.Sprintf("A rebuild of %s stopped on a conflict and is still in progress", state.Environment))
+			fmt.Printf("\nRun 'hitch rebuild %s --continue' or 'hitch rebuild %s --abort' first.\n", state.Environment, state.Environment)
+			return fmt.Errorf("a rebuild of %s is in progress", state.Environment)
+		case rebuildApplyFile == "" && !rebuildClone && !repo.IsBare():
+			resume = newRebuildState(envName, env)
+		}
+	}
+
+	// The feature file replaces the environment's feature list. Metadata only
+	// keeps the new list once the rebuild swaps in the new hitched branch; a
+	// rebuild stopped on a conflict carries it in its state for --continue.
+	var featureList []string
+	if rebuildFeatures != "" {
+		features, err := readFeatureList(repo, rebuildFeatures)
+		if err != nil {
+			errorMsg(fmt.Sprintf("Invalid feature file %s", rebuildFeatures))
+			return err
+		}
+
+		featureList = features
+		env.Features = features
+		if resume != nil {
+			resume.Features = features
+		}
+		info(fmt.Sprintf("Using %d features from %s", len(features), rebuildFeatures))
+		fmt.Println()
+	} else if rebuildContinue && resume.Features != nil {
+		featureList = resume.Features
+	}
+
+	// Plans are checked against the metadata commit before the lock below
+	// writes a new one
+	if rebuildPlanFile != "" || rebuildApplyFile != "" {
+		metadataCommit, err := reader.Commit()
+		if err != nil {
+			errorMsg("Failed to read metadata")
+			return err
+		}
+
+		if rebuildPlanFile != "" {
+			plan, err := buildRebuildPlan(repo, envName, env, metadataCommit, userEmail)
+			if err != nil {
+				errorMsg("Failed to build rebuild plan")
+				return err
+			}
+			if err := writeRebuildPlan(plan, rebuildPlanFile); err != nil {
+				errorMsg("Failed to write rebuild plan")
+				return err
+			}
+			displayRebuildPlan(repo, plan)
+			fmt.Println()
+			success(fmt.Sprintf("Wrote plan to %s", rebuildPlanFile))
+			fmt.Printf("To apply it: hitch rebuild %s --apply %s\n", envName, rebuildPlanFile)
+			return nil
+		}
+
+		plan, err := readRebuildPlan(rebuildApplyFile)
+		if err != nil {
+			errorMsg("Failed to read rebuild plan")
+			return err
+		}
+		if err := checkPlanCurrent(repo, plan, envName, env, metadataCommit); err != nil {
+			return err
+		}
+		displayRebuildPlan(repo, plan)
+		fmt.Println()
+		env = plannedEnvironment(plan, env)
+	}
+
+	// Pinned commits can be garbage-collected or force-pushed away; better
+	// to say so now than to fail mid-merge
+	if err := checkPinsExist(repo, envName, env); err != nil {
+		return err
+	}
 
-			return fmt.Errorf("environment locked")
+	// 6. Check/acquire lock
+	if !rebuildForce {
+		if err := checkRebuildLock(meta, envName, env, userEmail); err != nil {
+			return err
 		}
 	}
 
+	// Set once the rebuilt hitched branch has replaced the old one
+	var swapped bool
+
 	// Lock environment
 	if !rebuildDryRun {
 		if err := meta.LockEnvironment(envName, userEmail, "Rebuilding environment"); err != nil {
@@ -138,6 +397,29 @@ func runRebuild(cmd *cobra.Command, args []string) error {
 			meta.UpdateMeta(userEmail, fmt.Sprintf("hitch rebuild %s (unlock)", envName))
 			writer.Write(meta, fmt.Sprintf("Unlock %s after rebuild", envName), userName, userEmail)
 		}()
+
+		if featureList != nil {
+			previous := meta.Clone()
+			added, removed, err := meta.SetEnvironmentFeatures(envName, featureList, userEmail)
+			if err != nil {
+				errorMsg("Failed to update features")
+				return err
+			}
+			for _, feature := range added {
+				success(fmt.Sprintf("Added %s to %s feature list", feature, envName))
+			}
+			for _, feature := range removed {
+				success(fmt.Sprintf("Removed %s from %s feature list", feature, envName))
+			}
+
+			// Runs before the unlock above, so the unlock write keeps the
+			// old list unless the new hitched branch was swapped in
+			defer func() {
+				if !swapped {
+					*meta = *previous
+				}
+			}()
+		}
 	}
 
 	// 7. Perform rebuild
@@ -145,53 +427,248 @@ func runRebuild(cmd *cobra.Command, args []string) error {
 		return performDryRunRebuild(repo, envName, env, meta)
 	}
 
-	return performRebuild(repo, envName, env, meta, userEmail)
+	// A bare repository has no working tree to merge in
+	var result *rebuildResult
+	switch {
+	case rebuildClone || repo.IsBare():
+		result, err = performCloneRebuild(repo, envName, env, meta, userEmail)
+	case incremental != nil:
+		result, err = performIncrementalRebuild(repo, envName, env, meta, userEmail, incremental, resume)
+	default:
+		result, err = performRebuild(repo, envName, env, meta, userEmail, resume)
+	}
+	swapped = result != nil && result.Commit != ""
+
+	return reportRebuild(result, err)
 }
 
-func performRebuild(repo *hitchgit.Repo, envName string, env metadata.Environment, meta *metadata.Metadata, userEmail string) error {
-	fmt.Printf("Rebuilding %s environment...\n\n", envName)
+// rebuildResult is what a rebuild did: the features merged onto the new
+// hitched branch in order, the ones skipped, and the commit it ended on, or
+// the feature it stopped on
+type rebuildResult struct {
+	Environment string        `json:"environment"`
+	Merged      []string      `json:"merged"`
+	Skipped     []string      `json:"skipped"`
+	Conflict    string        `json:"conflict,omitempty"`
+	Commit      string        `json:"commit,omitempty"`
+	Duration    time.Duration `json:"-"`
 
-	baseBranch := env.Base
-	tempBranch := envName + "-hitch-temp"
+	// commits maps each feature in Merged to the commit merged for it
+	commits map[string]string
+}
 
-	// 1. Checkout and pull base branch
-	success("Checked out base branch: " + baseBranch)
-	if err := repo.Checkout(baseBranch); err != nil {
-		errorMsg("Failed to checkout base branch")
+// merged adds feature, merged at mergeRef, to r
+func (r *rebuildResult) merged(repo *hitchgit.Repo, feature string, mergeRef string) {
+	r.Merged = append(r.Merged, feature)
+	if commit, err := repo.ResolveCommit(mergeRef); err == nil {
+		if r.commits == nil {
+			r.commits = map[string]string{}
+		}
+		r.commits[feature] = commit
+	}
+}
+
+// MarshalJSON writes Duration as whole milliseconds
+func (r rebuildResult) MarshalJSON() ([]byte, error) {
+	type plain rebuildResult
+	return json.Marshal(struct {
+		plain
+		DurationMS int64 `json:"duration_ms"`
+	}{plain(r), r.Duration.Milliseconds()})
+}
+
+// reportRebuild prints result as the --json output of a rebuild. A rebuild
+// that stopped on a conflict or a failing hook still has a result, so its
+// error exits non-zero without the error envelope; one that failed before
+// that has none.
+func reportRebuild(result *rebuildResult, err error) error {
+	if !jsonOutput || result == nil {
 		return err
 	}
 
-	// Pull latest (ignore errors if no remote)
-	repo.Pull("origin", baseBranch)
+	encoder := json.NewEncoder(jsonOut)
+	encoder.SetIndent("", "  ")
+	if encodeErr := encoder.Encode(result); encodeErr != nil {
+		return encodeErr
+	}
+	if err != nil {
+		return reportedError{err}
+	}
+	return nil
+}
 
-	// 2. Create temp branch
-	success("Created temp branch: " + tempBranch)
+// performCloneRebuild runs performRebuild in a throwaway clone of repo, so
+// none of its checkouts or merges happen in repo, then copies the rebuilt
+// hitched branch back into repo
+func performCloneRebuild(repo *hitchgit.Repo, envName string, env metadata.Environment, meta *metadata.Metadata, userEmail string) (*rebuildResult, error) {
+	// A checked-out hitched branch is updated with its worktree when copied
+	// back, so uncommitted changes on it are refused before anything is
+	// pushed or recorded
+	if current, err := repo.CurrentBranch(); err == nil && current == envName && !repo.IsBare() {
+		dirty, err := repo.HasUncommittedChanges("HEAD")
+		if err != nil {
+			errorMsg("Failed to check for uncommitted changes")
+			return nil, err
+		}
+		if dirty {
+			errorMsg(fmt.Sprintf("You have %s checked out with uncommitted changes", envName))
+			fmt.Printf("\nCommit or stash them, or check out another branch, then run 'hitch rebuild %s --clone' again.\n", envName)
+			return nil, fmt.Errorf("uncommitted changes on %s", envName)
+		}
+	}
 
-	// Delete temp branch if it exists
-	repo.DeleteBranch(tempBranch, true)
+	dir, err := os.MkdirTemp("", "hitch-rebuild-")
+	if err != nil {
+		errorMsg("Failed to create a directory for the clone")
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
 
-	if err := repo.CreateBranch(tempBranch, baseBranch); err != nil {
-		errorMsg("Failed to create temp branch")
-		return err
+	clone, err := hitchgit.CloneLocal(repo.Root(), filepath.Join(dir, "repo"))
+	if err != nil {
+		errorMsg("Failed to clone the repository")
+		return nil, err
 	}
+	clone.SetAuthor(repo.Author())
+	info(fmt.Sprintf("Rebuilding in a temporary clone: %s", clone.Root()))
+	fmt.Println()
 
-	if err := repo.Checkout(tempBranch); err != nil {
-		errorMsg("Failed to checkout temp branch")
-		return err
+	result, rebuildErr := performRebuild(clone, envName, env, meta, userEmail, nil)
+
+	// The clone is about to go, so a kept temp branch is copied back
+	if rebuildKeepTemp && result != nil && result.Conflict != "" {
+		tempBranch := envName + "-hitch-temp"
+		if err := repo.FetchBranchFrom(clone.Root(), tempBranch); err != nil {
+			warning(fmt.Sprintf("Failed to copy %s back from the clone: %v", tempBranch, err))
+		} else {
+			success(fmt.Sprintf("Copied %s back from the clone", tempBranch))
+		}
+	}
+
+	// Copied back whenever the clone produced a new hitched branch, even if
+	// only the post-rebuild hook failed
+	before := env.LastRebuildCommit
+	after := meta.Environments[envName].LastRebuildCommit
+	if after != "" && after != before {
+		if err := repo.FetchBranchFrom(clone.Root(), envName); err != nil {
+			errorMsg(fmt.Sprintf("Failed to copy the rebuilt %s branch back from the clone", envName))
+			return nil, err
+		}
+		success(fmt.Sprintf("Updated local %s from the clone", envName))
+	}
+
+	return result, rebuildErr
+}
+
+// performRebuild rebuilds envName on a temp branch and swaps it in once every
+// feature merged. With a state, a conflict stops the rebuild but keeps the
+// temp branch and saves the state for --continue; a state with merged
+// features resumes on the existing temp branch. Without one, a conflict
+// deletes the temp branch. The result is nil if the rebuild failed before
+// merging or swapping branches finished for a reason other than a conflict.
+func performRebuild(repo *hitchgit.Repo, envName string, env metadata.Environment, meta *metadata.Metadata, userEmail string, state *rebuildState) (*rebuildResult, error) {
+	defer logging.Timer("rebuild " + envName)()
+	start := time.Now()
+	result := &rebuildResult{Environment: envName, Merged: []string{}}
+
+	baseBranch := env.Base
+	tempBranch := envName + "-hitch-temp"
+
+	// Every saved state records the conflict it stopped on
+	resuming := state != nil && state.Conflict != ""
+
+	if resuming {
+		fmt.Printf("Continuing rebuild of %s environment...\n\n", envName)
+
+		if err := repo.Checkout(tempBranch); err != nil {
+			errorMsg("Failed to checkout temp branch")
+			return nil, err
+		}
+		success("Checked out temp branch: " + tempBranch)
+	} else {
+		if err := startRebuild(repo, envName, baseBranch, tempBranch); err != nil {
+			return nil, err
+		}
+		if state != nil {
+			state.BaseCommit, _ = repo.ResolveCommit(baseBranch)
+		}
 	}
 
 	// 3. Merge all features
+	skipped := []string{}
+	if resuming {
+		skipped = append(skipped, state.Skipped...)
+	}
+	result.Skipped = skipped
 	if len(env.Features) == 0 {
 		info("No features to merge")
 	} else {
 		fmt.Println("Merging features into temp branch:")
-		for _, feature := range env.Features {
-			if err := repo.Merge(feature, ""); err != nil {
+		for i, feature := range env.Features {
+			mergeRef, mergeMsg := env.MergeRef(feature), ""
+			if resuming && slices.Contains(state.Merged, feature) {
+				info(fmt.Sprintf("  Already merged %s", feature))
+				result.merged(repo, feature, mergeRef)
+				continue
+			}
+			if slices.Contains(skipped, feature) {
+				warning(fmt.Sprintf("  Skipped %s (conflicts, skipped earlier)", feature))
+				continue
+			}
+
+			if mergeRef != feature {
+				mergeMsg = fmt.Sprintf("Merge %s at %s", feature, shortSHA(repo, mergeRef))
+			}
+
+			if showProgress() {
+				fmt.Printf("  [%d/%d] Merging %s...\n", i+1, len(env.Features), feature)
+			}
+			mergeDone := logging.StartPhase("merge " + feature)
+			changed, err := repo.MergeChanges(mergeRef, mergeMsg)
+			mergeDone()
+			if err != nil {
+				// Interactive runs may skip the feature or resolve it by hand
+				var conflict *hitchgit.MergeConflictError
+				if errors.As(err, &conflict) && isInteractive() {
+					action, promptErr := resolveConflictInteractively(repo, feature, mergeRef)
+					if promptErr != nil {
+						warning(fmt.Sprintf("Failed to read answer: %v", promptErr))
+					}
+					switch action {
+					case conflictSkip:
+						warning(fmt.Sprintf("  Skipped %s (conflicts)", feature))
+						skipped = append(skipped, feature)
+						result.Skipped = skipped
+						continue
+					case conflictResolved:
+						success(fmt.Sprintf("  Merged %s%s (conflicts resolved by hand)", feature, pinSuffix(repo, env, feature)))
+						result.merged(repo, feature, mergeRef)
+						if state != nil {
+							state.recordMerge(repo, feature, mergeRef)
+						}
+						continue
+					}
+				}
+
 				// Merge failed!
 				errorMsg(fmt.Sprintf("Merge conflict when adding %s", feature))
+				sendNotification(meta, notify.Event{
+					Event:       notify.EventConflict,
+					Environment: envName,
+					Branch:      feature,
+					User:        userEmail,
+					Message:     fmt.Sprintf("%s conflicts with %s; %s was not rebuilt", feature, envName, envName),
+				})
 				fmt.Println()
 				fmt.Printf("The branch %s conflicts with the current %s environment.\n", feature, envName)
 				fmt.Println()
+
+				result.Conflict = feature
+				result.Duration = time.Since(start)
+				if state != nil {
+					return result, stopRebuild(repo, envName, baseBranch, feature, skipped, state)
+				}
+
 				fmt.Println("To resolve:")
 				fmt.Printf("  1. git checkout %s\n", feature)
 				fmt.Printf("  2. git rebase %s\n", baseBranch)
@@ -201,25 +678,46 @@ func performRebuild(repo *hitchgit.Repo, envName string, env metadata.Environmen
 				fmt.Println()
 
 				// Cleanup
-				repo.Checkout(baseBranch)
-				repo.DeleteBranch(tempBranch, true)
+				if repo.IsMerging() {
+					repo.MergeAbort()
+				}
+				repo.CheckoutForce(baseBranch)
 
 				fmt.Println("✓ Original", envName, "branch is unchanged")
-				fmt.Println("✓ Temp branch", tempBranch, "has been deleted")
+				if rebuildKeepTemp {
+					keptTempBranch(tempBranch, feature)
+				} else {
+					repo.DeleteBranch(tempBranch, true)
+					fmt.Println("✓ Temp branch", tempBranch, "has been deleted")
+				}
 
-				return fmt.Errorf("merge conflict")
+				return result, fmt.Errorf("merge conflict")
+			}
+			if changed {
+				success(fmt.Sprintf("  Merged %s%s (no conflicts)", feature, pinSuffix(repo, env, feature)))
+			} else {
+				info(fmt.Sprintf("  %s already included (no changes)", feature))
+			}
+			result.merged(repo, feature, mergeRef)
+			if state != nil {
+				state.recordMerge(repo, feature, mergeRef)
 			}
-			success(fmt.Sprintf("  Merged %s (no conflicts)", feature))
 		}
 	}
 
 	// 4. All merges succeeded! Swap branches
 	success("All merges successful")
+	return finishRebuild(repo, envName, baseBranch, tempBranch, meta, userEmail, result, state, start)
+}
 
+// finishRebuild swaps tempBranch in as envName once every merge succeeded,
+// records the new commit in meta, pushes it, and runs the post-rebuild hook.
+// A saved state is cleared once the swap is done.
+func finishRebuild(repo *hitchgit.Repo, envName string, baseBranch string, tempBranch string, meta *metadata.Metadata, userEmail string, result *rebuildResult, state *rebuildState, start time.Time) (*rebuildResult, error) {
 	// Checkout base to allow deleting env branch
-	if err := repo.Checkout(baseBranch); err != nil {
+	if err := repo.CheckoutForce(baseBranch); err != nil {
 		errorMsg("Failed to checkout base branch")
-		return err
+		return nil, err
 	}
 
 	// Delete old hitched branch
@@ -230,29 +728,318 @@ func performRebuild(repo *hitchgit.Repo, envName string, env metadata.Environmen
 	}
 
 	// Rename temp to env
-	cmd := exec.Command("git", "branch", "-m", tempBranch, envName)
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if err := repo.RenameBranch(tempBranch, envName); err != nil {
 		errorMsg("Failed to rename temp branch")
-		return fmt.Errorf("rename failed: %s", string(output))
+		return nil, err
 	}
 
 	success(fmt.Sprintf("Swapped %s → %s", tempBranch, envName))
 
-	// 5. Push to remote (ignore errors if no remote)
-	if err := repo.Push("origin", envName, true); err != nil {
-		warning("Failed to push to remote (this is OK if no remote configured)")
-		fmt.Println("You may need to push manually:")
-		fmt.Printf("  git push --force-with-lease origin %s\n", envName)
-	} else {
-		success("Pushed " + envName + " branch to remote")
+	if state != nil {
+		if err := clearRebuildState(repo); err != nil {
+			warning(fmt.Sprintf("Failed to clear rebuild state: %v", err))
+		}
+	}
+
+	// Recorded in metadata by the unlock write that ends every rebuild
+	if commit, err := repo.ResolveCommit(envName); err == nil {
+		result.Commit = commit
+		e := meta.Environments[envName]
+		e.LastRebuild = time.Now()
+		e.LastRebuildCommit = commit
+		e.Skipped = nil
+		if len(result.Skipped) > 0 {
+			e.Skipped = result.Skipped
+		}
+		e.MergedCommits = result.commits
+		meta.Environments[envName] = e
+		meta.RecordTip(envName, metadata.ReflogEntry{
+			Commit:   commit,
+			At:       e.LastRebuild,
+			By:       userEmail,
+			Action:   "rebuild",
+			Features: slices.Clone(result.Merged),
+		})
 	}
 
+	// 5. Push to remote
+	if !skipRemote(repo, "push of "+envName, fmt.Sprintf("git push --force-with-lease origin %s", envName)) {
+		if err := repo.Push("origin", envName, true); err != nil {
+			warning("Failed to push to remote")
+			pushRejectedHint(err)
+			fmt.Println("You may need to push manually:")
+			fmt.Printf("  git push --force-with-lease origin %s\n", envName)
+		} else {
+			success("Pushed " + envName + " branch to remote")
+		}
+	}
+
+	result.Duration = time.Since(start)
+
 	fmt.Println()
-	success(fmt.Sprintf("%s environment rebuilt with %d features", envName, len(env.Features)))
+	if len(result.Skipped) > 0 {
+		success(fmt.Sprintf("%s environment rebuilt with %d features (%d skipped)", envName, len(result.Merged), len(result.Skipped)))
+		fmt.Printf("  Skipped: %s\n", strings.Join(result.Skipped, ", "))
+		fmt.Printf("  Resolve the conflicts, then run: hitch rebuild %s\n", envName)
+	} else {
+		success(fmt.Sprintf("%s environment rebuilt with %d features", envName, len(result.Merged)))
+	}
+	if showProgress() {
+		fmt.Printf("  Took %s\n", result.Duration.Round(time.Millisecond))
+	}
+
+	sendNotification(meta, notify.Event{
+		Event:       notify.EventRebuild,
+		Environment: envName,
+		Commit:      result.Commit,
+		User:        userEmail,
+		Message:     fmt.Sprintf("%s rebuilt %s with %d features", userEmail, envName, len(result.Merged)),
+	})
+
+	return result, runPostRebuildHook(repo, meta, envName)
+}
+
+// incrementalFeatures returns the features an incremental rebuild of envName
+// would merge onto its current tip: those with commits the hitched branch
+// doesn't have, in merge order. When only a full rebuild gives the same
+// result, because the branch drifted, a feature was demoted or moved back,
+// or the base moved, it returns why instead.
+func incrementalFeatures(repo *hitchgit.Repo, meta *metadata.Metadata, envName string, env metadata.Environment) ([]string, string) {
+	if env.LastRebuildCommit == "" || !repo.BranchExists(envName) {
+		return nil, fmt.Sprintf("%s has never been rebuilt", envName)
+	}
+	if computeEnvironmentState(meta, repo, envName).Drifted {
+		return nil, fmt.Sprintf("%s has moved since its last rebuild", envName)
+	}
+	if meta.DemotedSinceRebuild(envName) {
+		return nil, "a feature was demoted since the last rebuild"
+	}
+	if merged, err := repo.IsAncestor(env.Base, envName); err != nil || !merged {
+		return nil, fmt.Sprintf("%s has commits %s doesn't", env.Base, envName)
+	}
+
+	var features []string
+	for _, feature := range env.Features {
+		mergeRef := env.MergeRef(feature)
+		merged, err := repo.IsAncestor(mergeRef, envName)
+		if err != nil {
+			return nil, fmt.Sprintf("%s can't be compared with %s", feature, envName)
+		}
+
+		// Merging onto the tip only adds commits, so the ones the last
+		// rebuild merged must all still be wanted
+		recorded, ok := env.MergedCommits[feature]
+		if !ok && merged {
+			return nil, fmt.Sprintf("the last rebuild didn't record the commit it merged for %s", feature)
+		}
+		if ok {
+			if kept, err := repo.IsAncestor(recorded, mergeRef); err != nil || !kept {
+				return nil, fmt.Sprintf("%s was moved back or rewritten since the last rebuild", feature)
+			}
+		}
+
+		if !merged {
+			features = append(features, feature)
+		}
+	}
+	return features, ""
+}
+
+// performIncrementalRebuild merges features onto envName's current tip on a
+// temp branch and swaps it in, instead of rebuilding from the base. If a
+// feature conflicts, envName is left alone and it falls back to a full
+// rebuild with state.
+func performIncrementalRebuild(repo *hitchgit.Repo, envName string, env metadata.Environment, meta *metadata.Metadata, userEmail string, features []string, state *rebuildState) (*rebuildResult, error) {
+	defer logging.Timer("incremental rebuild " + envName)()
+	start := time.Now()
+	tempBranch := envName + "-hitch-temp"
+
+	fmt.Printf("Incrementally rebuilding %s environment...\n\n", envName)
+
+	if err := repo.CheckoutNew(tempBranch, envName, true); err != nil {
+		errorMsg("Failed to create temp branch")
+		return nil, err
+	}
+	success(fmt.Sprintf("Created temp branch %s from %s", tempBranch, envName))
+
+	if len(features) == 0 {
+		info("No new features to merge")
+	} else {
+		fmt.Println("Merging new features into temp branch:")
+	}
+	for _, feature := range features {
+		mergeRef, mergeMsg := env.MergeRef(feature), ""
+		if mergeRef != feature {
+			mergeMsg = fmt.Sprintf("Merge %s at %s", feature, shortSHA(repo, mergeRef))
+		}
+
+		mergeDone := logging.StartPhase("merge " + feature)
+		changed, err := repo.MergeChanges(mergeRef, mergeMsg)
+		mergeDone()
+		if err != nil {
+			if repo.IsMerging() {
+				repo.MergeAbort()
+			}
+			repo.CheckoutForce(env.Base)
+			repo.DeleteBranch(tempBranch, true)
+
+			warning(fmt.Sprintf("  %s conflicts with the current %s; rebuilding from scratch instead", feature, envName))
+			fmt.Println()
+			return performRebuild(repo, envName, env, meta, userEmail, state)
+		}
+		if changed {
+			success(fmt.Sprintf("  Merged %s%s (no conflicts)", feature, pinSuffix(repo, env, feature)))
+		} else {
+			info(fmt.Sprintf("  %s already included (no changes)", feature))
+		}
+	}
+
+	// Every feature is now on the hitched branch, including any the last
+	// rebuild skipped; the ones not merged again are as the last rebuild
+	// recorded them
+	result := &rebuildResult{Environment: envName, Merged: []string{}, Skipped: []string{}}
+	for _, feature := range env.Features {
+		if commit, ok := env.MergedCommits[feature]; ok && !slices.Contains(features, feature) {
+			result.merged(repo, feature, commit)
+		} else {
+			result.merged(repo, feature, env.MergeRef(feature))
+		}
+	}
+	success("All merges successful")
+	return finishRebuild(repo, envName, env.Base, tempBranch, meta, userEmail, result, nil, start)
+}
+
+// rebuildReasons lists why envName's hitched branch is out of date with
+// what a rebuild would produce. Features skipped for conflicts by the last
+// rebuild are left out, since rebuilding wouldn't merge them either.
+func rebuildReasons(repo *hitchgit.Repo, meta *metadata.Metadata, envName string, env metadata.Environment) []string {
+	if !repo.BranchExists(envName) {
+		return []string{fmt.Sprintf("the %s branch does not exist", envName)}
+	}
+
+	var reasons []string
+	if computeEnvironmentState(meta, repo, envName).Drifted {
+		reasons = append(reasons, fmt.Sprintf("%s has moved since its last rebuild", envName))
+	}
+	if meta.PendingRebuild(envName) {
+		reasons = append(reasons, "the feature list changed since the last rebuild")
+	}
+
+	refs := append([]string{env.Base}, env.Features...)
+	for _, ref := range refs {
+		if slices.Contains(env.Skipped, ref) {
+			continue
+		}
+		merged, err := repo.IsAncestor(env.MergeRef(ref), envName)
+		if err == nil && !merged {
+			merged = mergedByLastRebuild(repo, env, ref)
+		}
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s can't be compared with %s", ref, envName))
+		} else if !merged {
+			reasons = append(reasons, fmt.Sprintf("%s has commits %s doesn't", ref, envName))
+		}
+	}
+
+	return reasons
+}
+
+// mergedByLastRebuild reports whether the last rebuild of env merged feature
+// at the commit it's at now. Its changes can then be on the hitched branch
+// without it being an ancestor, when they were already there.
+func mergedByLastRebuild(repo *hitchgit.Repo, env metadata.Environment, feature string) bool {
+	recorded, ok := env.MergedCommits[feature]
+	if !ok {
+		return false
+	}
+	commit, err := repo.ResolveCommit(env.MergeRef(feature))
+	return err == nil && commit == recorded
+}
+
+// startRebuild checks out and pulls baseBranch and creates a fresh
+// tempBranch from it for the merges
+func startRebuild(repo *hitchgit.Repo, envName string, baseBranch string, tempBranch string) error {
+	fmt.Printf("Rebuilding %s environment...\n\n", envName)
+
+	// 1. Checkout and pull base branch
+	success("Checked out base branch: " + baseBranch)
+	if err := repo.Checkout(baseBranch); err != nil {
+		errorMsg("Failed to checkout base branch")
+		return err
+	}
+
+	// Pull latest (ignore errors, e.g. when the base isn't on origin yet).
+	// An applied plan checks out its base commit, which is left as planned.
+	if !isOffline() && repo.RemoteExists("origin") && !repo.IsDetachedHead() {
+		repo.Pull("origin", baseBranch)
+	}
+
+	// Only worth counting when someone will see the warning
+	if logging.Enabled(logging.LevelInfo) {
+		if count, err := repo.CommitCount(baseBranch); err == nil && count > hitchgit.LargeHistoryCommits {
+			logging.Infof("%s has %d commits; go-git operations may be slow on histories this large", baseBranch, count)
+		}
+	}
+
+	// 2. Create temp branch, replacing any left over from an earlier run
+	success("Created temp branch: " + tempBranch)
+
+	if err := repo.CheckoutNew(tempBranch, baseBranch, true); err != nil {
+		errorMsg("Failed to create temp branch")
+		return err
+	}
 
 	return nil
 }
 
+// stopRebuild leaves a rebuild that conflicted on feature for --continue:
+// the merge is aborted, the temp branch is kept, and state is saved
+func stopRebuild(repo *hitchgit.Repo, envName string, baseBranch string, feature string, skipped []string, state *rebuildState) error {
+	if repo.IsMerging() {
+		repo.MergeAbort()
+	}
+	repo.CheckoutForce(baseBranch)
+
+	state.Skipped = skipped
+	state.Conflict = feature
+	if err := saveRebuildState(repo, state); err != nil {
+		warning(fmt.Sprintf("Failed to save rebuild state: %v", err))
+		fmt.Println("✓ Original", envName, "branch is unchanged")
+		if rebuildKeepTemp {
+			keptTempBranch(state.TempBranch, feature)
+		} else {
+			repo.DeleteBranch(state.TempBranch, true)
+			fmt.Println("✓ Temp branch", state.TempBranch, "has been deleted")
+		}
+		return fmt.Errorf("merge conflict")
+	}
+
+	fmt.Println("To resolve:")
+	fmt.Printf("  1. git checkout %s\n", feature)
+	fmt.Printf("  2. git rebase %s\n", baseBranch)
+	fmt.Println("  3. Resolve conflicts and continue rebase")
+	fmt.Println("  4. git push --force-with-lease")
+	fmt.Printf("  5. hitch rebuild %s --continue\n", envName)
+	fmt.Println()
+	fmt.Printf("To give up instead: hitch rebuild %s --abort\n", envName)
+	fmt.Println()
+
+	fmt.Println("✓ Original", envName, "branch is unchanged")
+	fmt.Printf("✓ Temp branch %s kept with %d features merged\n", state.TempBranch, len(state.Merged))
+
+	return fmt.Errorf("merge conflict")
+}
+
+// keptTempBranch tells the user how to look at the conflict on a temp branch
+// kept by --keep-temp
+func keptTempBranch(tempBranch string, feature string) {
+	fmt.Printf("✓ Temp branch %s kept, with every feature before %s merged\n", tempBranch, feature)
+	fmt.Println()
+	fmt.Println("To inspect the conflict:")
+	fmt.Printf("  git checkout %s && git merge %s\n", tempBranch, feature)
+	fmt.Printf("When done: git merge --abort && git checkout - && git branch -D %s\n", tempBranch)
+}
+
 func performDryRunRebuild(repo *hitchgit.Repo, envName string, env metadata.Environment, meta *metadata.Metadata) error {
 	fmt.Printf("Dry run: simulating rebuild of %s environment\n\n", envName)
 
@@ -268,7 +1055,7 @@ func performDryRunRebuild(repo *hitchgit.Repo, envName string, env metadata.Envi
 		fmt.Println("Checking if features are mergeable:")
 		for _, feature := range env.Features {
 			// TODO: Actually check if merge would succeed
-			info(fmt.Sprintf("  - %s (would merge)", feature))
+			info(fmt.Sprintf("  - %s%s (would merge)", feature, pinSuffix(repo, env, feature)))
 		}
 	}
 
@@ -281,3 +1068,182 @@ func performDryRunRebuild(repo *hitchgit.Repo, envName string, env metadata.Envi
 
 	return nil
 }
+
+// readFeatureList reads a --features-from file: one branch per line, in
+// merge order, with blank lines and '#' comments ignored. Every branch must
+// exist and be listed once.
+func readFeatureList(repo *hitchgit.Repo, path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read feature file: %w", err)
+	}
+
+	features := []string{}
+	seen := make(map[string]bool)
+	for i, line := range strings.Split(string(data), "\n") {
+		branch := strings.TrimSpace(stripComment(line))
+		if branch == "" {
+			continue
+		}
+
+		if err := hitchgit.ValidBranchName(branch); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		if seen[branch] {
+			return nil, fmt.Errorf("%s:%d: %s is listed more than once", path, i+1, branch)
+		}
+		if !repo.BranchExists(branch) {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, &metadata.BranchNotFoundError{Branch: branch})
+		}
+		seen[branch] = true
+		features = append(features, branch)
+	}
+
+	return features, nil
+}
+
+// stripComment drops a '#' comment from line. A '#' only starts a comment
+// at the start of the line or after whitespace, since branch names such as
+// fix/#123 can contain one.
+func stripComment(line string) string {
+	for i, r := range line {
+		if r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// checkPinsExist reports every feature of env whose pinned commit is no
+// longer in the repository
+func checkPinsExist(repo *hitchgit.Repo, envName string, env metadata.Environment) error {
+	missing := []string{}
+	for _, feature := range env.Features {
+		sha, ok := env.Pins[feature]
+		if !ok {
+			continue
+		}
+		if _, err := repo.ResolveCommit(sha); err != nil {
+			errorMsg(fmt.Sprintf("Pinned commit %s for %s no longer exists", hitchgit.AbbreviateSHA(sha), feature))
+			missing = append(missing, feature)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	fmt.Println("\nThe commit may have been garbage-collected or force-pushed away. Pin another commit or unpin:")
+	for _, feature := range missing {
+		fmt.Printf("  hitch promote %s@<sha> to %s\n", feature, envName)
+		fmt.Printf("  hitch promote %s to %s\n", feature, envName)
+	}
+	return fmt.Errorf("pinned commits missing for %s", strings.Join(missing, ", "))
+}
+
+// pinSuffix describes feature's pin in env for display, e.g. " (pinned at abc1234)"
+func pinSuffix(repo *hitchgit.Repo, env metadata.Environment, feature string) string {
+	if sha, ok := env.Pins[feature]; ok {
+		return fmt.Sprintf(" (pinned at %s)", shortSHA(repo, sha))
+	}
+	return ""
+}
+
+// Outcomes of resolveConflictInteractively
+const (
+	conflictAbort    = "abort"
+	conflictSkip     = "skip"
+	conflictResolved = "resolved"
+)
+
+// resolveConflictInteractively asks what to do about a conflicted merge of
+// feature at mergeRef: abort the rebuild, skip the feature (aborting its
+// merge) and carry on, or open a shell to resolve and commit the merge by
+// hand. The shell only resolves it if mergeRef ends up merged into HEAD; a
+// merge aborted in the shell asks again.
+func resolveConflictInteractively(repo *hitchgit.Repo, feature string, mergeRef string) (string, error) {
+	for {
+		fmt.Println()
+		warning(fmt.Sprintf("Merging %s conflicts", feature))
+		fmt.Print("[a]bort the rebuild, [s]kip this feature, or open a s[h]ell to resolve it? [a/s/h]: ")
+		answer, err := readAnswer()
+		if err != nil {
+			return conflictAbort, err
+		}
+
+		switch answer {
+		case "s", "skip":
+			if repo.IsMerging() {
+				if err := repo.MergeAbort(); err != nil {
+					return conflictAbort, err
+				}
+			}
+			return conflictSkip, nil
+		case "h", "shell":
+			fmt.Println("Resolve the conflicts and commit, then exit the shell to continue.")
+			runShell(repo.Root())
+			if repo.IsMerging() {
+				info("The merge is still in progress")
+				continue
+			}
+			if merged, err := repo.IsAncestor(mergeRef, "HEAD"); err != nil || !merged {
+				info(fmt.Sprintf("%s isn't merged; run 'git merge %s' in the shell to try again", feature, mergeRef))
+				continue
+			}
+			return conflictResolved, nil
+		default:
+			return conflictAbort, nil
+		}
+	}
+}
+
+// runShell opens the user's shell in dir and waits for it to exit
+func runShell(dir string) {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "sh"
+	}
+
+	cmd := exec.Command(shell)
+	cmd.Dir = dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		warning(fmt.Sprintf("Shell exited with an error: %v", err))
+	}
+}
+
+// checkRebuildLock refuses to rebuild envName while someone else holds its
+// lock. A stale lock is refused too; only hitch rebuild --force overrides it.
+func checkRebuildLock(meta *metadata.Metadata, envName string, env metadata.Environment, userEmail string) error {
+	if !env.Locked || env.LockedBy == userEmail {
+		return nil
+	}
+
+	errorMsg(fmt.Sprintf("Environment '%s' is locked", envName))
+	fmt.Println()
+	fmt.Printf("Locked by: %s\n", env.LockedBy)
+	fmt.Printf("Locked at: %s\n", env.LockedAt.Format("2006-01-02 15:04:05"))
+	if env.LockedHost != "" {
+		fmt.Printf("Host: %s\n", env.LockedHost)
+	}
+	if env.LockedContext != "" {
+		fmt.Printf("Context: %s\n", env.LockedContext)
+	}
+	fmt.Println()
+
+	if meta.IsLockStale(envName) {
+		fmt.Printf("This lock is stale (older than %d minutes).\n", meta.Config.LockTimeoutMinutes)
+		fmt.Printf("To force rebuild: hitch rebuild %s --force\n", envName)
+	} else {
+		fmt.Printf("Wait for unlock or contact %s\n", env.LockedBy)
+	}
+
+	return &metadata.EnvironmentLockedError{
+		Environment: envName,
+		LockedBy:    env.LockedBy,
+		LockedAt:    env.LockedAt,
+		Host:        env.LockedHost,
+		Context:     env.LockedContext,
+	}
+}
@@ -1,18 +1,32 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/DoomedRamen/hitch/internal/forge"
 	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/logging"
 	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/DoomedRamen/hitch/internal/notify"
 	"github.com/spf13/cobra"
 )
 
 var (
-	releaseNoDelete bool
-	releaseMessage  string
-	releaseSquash   bool
+	releaseNoDelete  bool
+	releaseDelete    bool
+	releaseMessage   string
+	releaseSquash    bool
+	releaseDryRun    bool
+	releaseRetain    int
+	releaseChangelog string
+	releaseBase      string
+	releaseDraft     bool
+	releasePublish   bool
 )
 
 var releaseCmd = &cobra.Command{
@@ -20,36 +34,111 @@ var releaseCmd = &cobra.Command{
 	Short: "Merge a feature branch to the base branch (main)",
 	Long: `Merge a feature branch to the base branch (typically main).
 
+The base is the one the branch's environments are rebuilt from, so in a
+repository with several release lines each feature is released to its own.
+If its environments have different bases, name one with --base.
+
 This command:
 1. Validates branch is in at least one environment (safety check)
 2. Merges branch into base branch (main)
-3. Pushes base branch to remote
+3. Pushes base branch to remote (rolling back the local merge if the push fails)
 4. Removes branch from all environments
 5. Records merge timestamp in metadata
 6. Marks branch for cleanup after retention period
+7. With a forge (GitLab) configured, comments on and closes the branch's
+   open merge request
+
+Safety: Ensures feature has been tested in at least one environment before release.
+
+Use --changelog <file> to prepend a dated line naming the feature and who
+released it to a file (relative to the repository root), included in the
+merge commit:
+
+  - 2025-10-17: feature/user-auth (released by alice@example.com)
 
-Safety: Ensures feature has been tested in at least one environment before release.`,
+Use --delete-branch to delete the feature branch locally and on origin as
+soon as it is released, and stop tracking it, instead of leaving it for
+hitch cleanup.
+
+Use --dry-run to run the safety checks and a trial merge against a temporary
+copy of the base branch, without changing any branch or metadata.
+
+For a review gate, release in two steps. --draft merges into the local base
+branch but doesn't push or touch metadata, so the merge can be reviewed;
+--publish then pushes it and records the release, as long as neither the
+base nor the feature branch has moved since the draft.`,
 	Args: cobra.ExactArgs(1),
 	RunE: runRelease,
 }
 
 func init() {
 	releaseCmd.Flags().BoolVar(&releaseNoDelete, "no-delete", false, "Don't mark branch for cleanup after merge")
+	releaseCmd.Flags().BoolVar(&releaseDelete, "delete-branch", false, "Delete the branch locally and on origin right after the release")
 	releaseCmd.Flags().StringVar(&releaseMessage, "message", "", "Custom merge commit message")
 	releaseCmd.Flags().BoolVar(&releaseSquash, "squash", false, "Squash commits before merging")
+	releaseCmd.Flags().IntVar(&releaseRetain, "retain-days", -1, "Days to keep this branch after merge (overrides retention_days_after_merge)")
+	releaseCmd.Flags().StringVar(&releaseChangelog, "changelog", "", "Prepend a dated entry to this file on the base branch, as part of the merge commit")
+	releaseCmd.Flags().StringVar(&releaseBase, "base", "", "Branch to release into (default: the base of the branch's environments)")
+	releaseCmd.Flags().BoolVar(&releaseDryRun, "dry-run", false, "Check for conflicts and show what would happen without making changes")
+	releaseCmd.Flags().BoolVar(&releaseDraft, "draft", false, "Merge into the local base branch only; push and record it later with --publish")
+	releaseCmd.Flags().BoolVar(&releasePublish, "publish", false, "Push and record a release merged earlier with --draft")
 	rootCmd.AddCommand(releaseCmd)
 }
 
 func runRelease(cmd *cobra.Command, args []string) error {
 	branchName := args[0]
 
+	if releaseChangelog != "" {
+		if err := validateChangelogPath(releaseChangelog); err != nil {
+			return err
+		}
+	}
+
+	if cmd.Flags().Changed("retain-days") {
+		if releaseRetain < 0 {
+			return fmt.Errorf("--retain-days must be zero or more")
+		}
+		if releaseNoDelete {
+			return fmt.Errorf("--retain-days can't be combined with --no-delete")
+		}
+		if releaseDelete {
+			return fmt.Errorf("--retain-days can't be combined with --delete-branch")
+		}
+	}
+	if releaseDelete && releaseNoDelete {
+		return fmt.Errorf("--delete-branch can't be combined with --no-delete")
+	}
+	if releaseDraft && releasePublish {
+		return fmt.Errorf("--draft can't be combined with --publish")
+	}
+	if (releaseDraft || releasePublish) && releaseDryRun {
+		return fmt.Errorf("--draft and --publish can't be combined with --dry-run")
+	}
+	if releaseDraft && (releaseDelete || releaseNoDelete || cmd.Flags().Changed("retain-days")) {
+		return fmt.Errorf("--delete-branch, --no-delete, and --retain-days take effect when the draft is published; pass them to --publish")
+	}
+	if releasePublish && (releaseMessage != "" || releaseSquash || releaseChangelog != "") {
+		return fmt.Errorf("--message, --squash, and --changelog shape the draft merge; pass them to --draft")
+	}
+
 	// 1. Open Git repository
-	repo, err := hitchgit.OpenRepo(".")
+	repo, err := openRepo()
 	if err != nil {
 		errorMsg("Not a Git repository")
 		return err
 	}
 
+	if repo.IsBare() {
+		errorMsg("hitch release merges into the base branch, which needs a working tree")
+		fmt.Println("\nRun it from a clone of this bare repository.")
+		return fmt.Errorf("cannot release in a bare repository")
+	}
+
+	if err := checkNoInProgressOperation(repo); err != nil {
+		return err
+	}
+	warnIfShallow(repo)
+
 	// 2. Remember current branch (will return here at end)
 	currentBranch, err := repo.CurrentBranch()
 	if err != nil {
@@ -57,9 +146,9 @@ func runRelease(cmd *cobra.Command, args []string) error {
 		currentBranch = currentCommit
 	}
 
-	defer func() {
-		repo.Checkout(currentBranch)
-	}()
+	// A deleted feature branch can't be returned to, so then this becomes
+	// the base it was released into
+	defer func() { restoreBranch(repo, currentBranch) }()
 
 	// 3. Read metadata
 	reader := metadata.NewReader(repo.Repository)
@@ -75,6 +164,22 @@ func runRelease(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	if !releaseDryRun {
+		if err := checkMetadataNotBehind(repo); err != nil {
+			return err
+		}
+
+		if err := checkNotFrozen(meta); err != nil {
+			return err
+		}
+	}
+
+	// Never delete an environment, base, or the metadata branch
+	if releaseDelete && !meta.IsFeatureBranch(branchName) {
+		errorMsg(fmt.Sprintf("%s is not a feature branch, so --delete-branch won't delete it", branchName))
+		return fmt.Errorf("refusing to delete protected branch %s", branchName)
+	}
+
 	// 4. Validate branch exists in metadata
 	branchInfo, exists := meta.Branches[branchName]
 	if !exists {
@@ -94,7 +199,11 @@ func runRelease(cmd *cobra.Command, args []string) error {
 
 	// 6. Check if already merged to main
 	if branchInfo.MergedToMainAt != nil {
-		warning(fmt.Sprintf("%s was already merged to main on %s", branchName, branchInfo.MergedToMainAt.Format("2006-01-02")))
+		mergedInto := branchInfo.MergedInto
+		if mergedInto == "" {
+			mergedInto = meta.Config.BaseBranch
+		}
+		warning(fmt.Sprintf("%s was already merged to %s on %s", branchName, mergedInto, branchInfo.MergedToMainAt.Format("2006-01-02")))
 		fmt.Println("\nNothing to do. Use 'hitch cleanup' to remove stale branches.")
 		return nil
 	}
@@ -107,17 +216,63 @@ func runRelease(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("branch not found")
 	}
 
-	// 8. Get user info
+	// A draft merge waits on its base branch until it's published, and no
+	// other release may merge on top of it meanwhile
+	draft, err := loadDraftRelease(repo)
+	if err != nil {
+		errorMsg("Failed to read draft release")
+		return err
+	}
+	switch {
+	case releasePublish && (draft == nil || draft.Branch != branchName):
+		errorMsg(fmt.Sprintf("No draft release of %s to publish", branchName))
+		fmt.Printf("\nDraft one first: hitch release %s --draft\n", branchName)
+		return fmt.Errorf("no draft release of %s", branchName)
+	case releasePublish && releaseBase != "" && releaseBase != draft.Base:
+		return fmt.Errorf("the draft of %s was merged into %s, not %s", branchName, draft.Base, releaseBase)
+	case !releasePublish && !releaseDryRun && draft != nil:
+		errorMsg(fmt.Sprintf("A draft release of %s into %s is waiting to be published", draft.Branch, draft.Base))
+		fmt.Printf("\nPublish it first: hitch release %s --publish\n", draft.Branch)
+		discardDraftHint(draft)
+		return fmt.Errorf("a draft release of %s is pending", draft.Branch)
+	}
+
+	// 8. Pick the base to release into
+	baseBranch := releaseBase
+	if releasePublish {
+		baseBranch = draft.Base
+	}
+	if baseBranch == "" {
+		baseBranch, err = meta.ReleaseBase(branchName)
+		if err != nil {
+			errorMsg(err.Error())
+			fmt.Printf("\nChoose one with: hitch release %s --base <branch>\n", branchName)
+			return err
+		}
+	}
+	if !repo.BranchExists(baseBranch) {
+		errorMsg(fmt.Sprintf("Base branch '%s' not found", baseBranch))
+		return &metadata.BranchNotFoundError{Branch: baseBranch}
+	}
+
+	if releaseDryRun {
+		return performDryRunRelease(repo, branchName, baseBranch, branchInfo, meta)
+	}
+
+	// Merging checks out the base branch in this worktree
+	if err := checkCleanWorktree(repo); err != nil {
+		return err
+	}
+
+	// 9. Get user info
 	userEmail, err := repo.UserEmail()
 	if err != nil {
-		errorMsg("Git user.email is not configured")
+		userEmailMissing()
 		return err
 	}
 
 	userName, _ := repo.UserName()
 
-	baseBranch := meta.Config.BaseBranch
-
 	fmt.Printf("Releasing %s to %s...\n\n", branchName, baseBranch)
 
 	// Show which environments it's in
@@ -133,20 +288,179 @@ func runRelease(cmd *cobra.Command, args []string) error {
 		fmt.Println(" environment")
 	}
 
-	// 9. Checkout base branch
+	// 10-12. Merge into base, or pick up the draft merge
+	var preMergeSHA string
+	if releasePublish {
+		if err := checkDraftCurrent(repo, draft); err != nil {
+			return err
+		}
+		preMergeSHA = draft.PreMerge
+		success(fmt.Sprintf("Draft merge %s is still the tip of %s", shortSHA(repo, draft.Merge), baseBranch))
+	} else {
+		preMergeSHA, err = mergeRelease(repo, branchName, baseBranch, userEmail)
+		if err != nil {
+			return err
+		}
+	}
+
+	if releaseDraft {
+		return saveDraft(repo, branchName, baseBranch, preMergeSHA)
+	}
+
+	// 13. Push base branch to remote
+	if !skipRemote(repo, "push of "+baseBranch, fmt.Sprintf("git push origin %s", baseBranch)) {
+		if err := repo.Push("origin", baseBranch, false); err != nil {
+			errorMsg(fmt.Sprintf("Failed to push %s to remote", baseBranch))
+			pushRejectedHint(err)
+
+			if releasePublish {
+				fmt.Println("\nThe draft is kept. Fix the remote problem, then retry:")
+				fmt.Printf("  hitch release %s --publish\n", branchName)
+				return err
+			}
+
+			// Roll back the local merge so local base and metadata stay consistent
+			// and the next release attempt starts from a clean base
+			if resetErr := repo.ResetHard(preMergeSHA); resetErr != nil {
+				warning(fmt.Sprintf("Failed to roll back %s: %v", baseBranch, resetErr))
+				fmt.Println("\nYour local base branch still contains the merge. Reset it manually:")
+				fmt.Printf("  git checkout %s\n", baseBranch)
+				fmt.Printf("  git reset --hard %s\n", preMergeSHA)
+				return err
+			}
+
+			fmt.Printf("\nRolled back local %s to %s. Nothing was released.\n", baseBranch, preMergeSHA)
+			fmt.Println("Fix the remote problem, then retry:")
+			fmt.Printf("  hitch release %s\n", branchName)
+			return err
+		}
+
+		success(fmt.Sprintf("Pushed %s to remote", baseBranch))
+	}
+
+	// 14. Remove from all environments
+	for _, env := range branchInfo.PromotedTo {
+		if err := meta.RemoveBranchFromEnvironment(env, branchName, userEmail); err != nil {
+			warning(fmt.Sprintf("Failed to remove %s from %s", branchName, env))
+		}
+	}
+
+	success("Removed " + branchName + " from all environments")
+
+	// 15. Update branch metadata - mark as merged, starting from the info
+	// the removals above updated
+	branchInfo = meta.Branches[branchName]
+	now := time.Now()
+	branchInfo.MergedToMainAt = &now
+	branchInfo.MergedToMainBy = userEmail
+	branchInfo.MergedInto = baseBranch
+
+	if releaseRetain >= 0 {
+		retainDays := releaseRetain
+		branchInfo.RetentionDays = &retainDays
+	}
+
+	meta.Branches[branchName] = branchInfo
+
+	// Calculate cleanup eligibility date
+	if releaseDelete {
+		delete(meta.Branches, branchName)
+	} else if !releaseNoDelete {
+		cleanupDate := meta.CleanupDate(branchName, now)
+		branchInfo.EligibleForCleanupAt = &cleanupDate
+		meta.Branches[branchName] = branchInfo
+	}
+
+	// 16. Write metadata
+	writer := metadata.NewWriter(repo.Repository)
+	meta.UpdateMeta(userEmail, fmt.Sprintf("hitch release %s", branchName))
+	if err := writer.Write(meta, fmt.Sprintf("Release %s to %s", branchName, baseBranch), userName, userEmail); err != nil {
+		errorMsg("Failed to write metadata")
+		return err
+	}
+
+	if releaseDelete {
+		success(fmt.Sprintf("Updated metadata (stopped tracking %s)", branchName))
+	} else {
+		success("Updated metadata (marked merged_to_main_at)")
+	}
+
+	if releasePublish {
+		if err := clearDraftRelease(repo); err != nil {
+			warning(fmt.Sprintf("Failed to clear draft release: %v", err))
+		}
+	}
+
+	sendNotification(meta, notify.Event{
+		Event:   notify.EventRelease,
+		Branch:  branchName,
+		User:    userEmail,
+		Message: fmt.Sprintf("%s released %s to %s", userEmail, branchName, baseBranch),
+	})
+
+	// 17. Close the pull request, if a forge is configured
+	closePullRequest(meta.Config, branchName, baseBranch, userEmail)
+
+	// 18. Delete the branch right away (--delete-branch)
+	if releaseDelete {
+		if currentBranch == branchName {
+			currentBranch = baseBranch
+		}
+		deleteReleasedBranch(repo, branchName)
+	}
+
+	fmt.Println()
+	fmt.Printf("Success! %s is now in %s\n", branchName, baseBranch)
+
+	// Show cleanup info
+	if releaseDelete {
+		return nil
+	}
+	if !releaseNoDelete {
+		retentionDays := meta.RetentionDays(branchName)
+		if retentionDays == 1 {
+			fmt.Printf("\nThe branch will be eligible for cleanup in 1 day.\n")
+		} else {
+			fmt.Printf("\nThe branch will be eligible for cleanup in %d days.\n", retentionDays)
+		}
+		fmt.Println("Use 'hitch cleanup' to delete stale branches.")
+	} else {
+		fmt.Println("\nBranch will not be automatically cleaned up (--no-delete specified).")
+	}
+
+	return nil
+}
+
+// mergeRelease checks out and pulls baseBranch and merges branchName into
+// it, adding the --changelog entry to the merge commit. It returns the base's
+// tip before the merge, for rolling it back.
+func mergeRelease(repo *hitchgit.Repo, branchName string, baseBranch string, userEmail string) (string, error) {
+	// Checkout base branch
 	if err := repo.Checkout(baseBranch); err != nil {
 		errorMsg(fmt.Sprintf("Failed to checkout %s", baseBranch))
-		return err
+		return "", err
 	}
 
 	success(fmt.Sprintf("Checked out %s", baseBranch))
 
-	// 10. Pull latest base branch
-	if err := repo.Pull("origin", baseBranch); err != nil {
+	// Pull latest base branch
+	if isOffline() {
+		info(fmt.Sprintf("Skipped pull of %s (offline mode)", baseBranch))
+	} else if !repo.RemoteExists("origin") {
+		info(fmt.Sprintf("Skipped pull of %s (no origin remote configured)", baseBranch))
+	} else if err := repo.Pull("origin", baseBranch); err != nil {
 		warning("Failed to pull latest changes (continuing anyway)")
 	}
 
-	// 11. Merge branch into base
+	// Remember the pre-merge tip so a failed push can be rolled back
+	preMergeSHA, err := repo.CurrentCommitSHA()
+	if err != nil {
+		errorMsg(fmt.Sprintf("Failed to read %s tip", baseBranch))
+		return "", err
+	}
+
+	// Merge branch into base
+	defer logging.StartPhase("merge " + branchName)()
 	mergeMsg := releaseMessage
 	if mergeMsg == "" {
 		mergeMsg = fmt.Sprintf("Merge %s into %s", branchName, baseBranch)
@@ -162,7 +476,7 @@ func runRelease(cmd *cobra.Command, args []string) error {
 			fmt.Println("  # resolve conflicts")
 			fmt.Println("  git commit")
 			fmt.Printf("  hitch release %s\n", branchName)
-			return err
+			return "", err
 		}
 	} else {
 		// Regular merge
@@ -174,69 +488,210 @@ func runRelease(cmd *cobra.Command, args []string) error {
 			fmt.Println("  # resolve conflicts")
 			fmt.Println("  git commit")
 			fmt.Printf("  hitch release %s\n", branchName)
-			return err
+			return "", err
 		}
 	}
 
 	success(fmt.Sprintf("Merged %s into %s", branchName, baseBranch))
 
-	// 12. Push base branch to remote
-	if err := repo.Push("origin", baseBranch, false); err != nil {
-		errorMsg(fmt.Sprintf("Failed to push %s to remote", baseBranch))
-		fmt.Println("\nPush manually:")
-		fmt.Printf("  git push origin %s\n", baseBranch)
+	// Record the release in the changelog as part of the merge commit
+	if releaseChangelog != "" {
+		if err := addChangelogEntry(repo, releaseChangelog, branchName, userEmail); err != nil {
+			errorMsg(fmt.Sprintf("Failed to update %s", releaseChangelog))
+			if resetErr := repo.ResetHard(preMergeSHA); resetErr != nil {
+				warning(fmt.Sprintf("Failed to roll back %s: %v", baseBranch, resetErr))
+			}
+			return "", err
+		}
+		success(fmt.Sprintf("Added release entry to %s", releaseChangelog))
+	}
+
+	return preMergeSHA, nil
+}
+
+// saveDraft records the merge mergeRelease just made as a draft release and
+// tells the user how to publish it
+func saveDraft(repo *hitchgit.Repo, branchName string, baseBranch string, preMergeSHA string) error {
+	merge, err := repo.ResolveCommit(baseBranch)
+	if err != nil {
+		errorMsg(fmt.Sprintf("Failed to read %s tip", baseBranch))
+		return err
+	}
+	branchSHA, err := repo.ResolveCommit(branchName)
+	if err != nil {
+		errorMsg(fmt.Sprintf("Failed to read %s", branchName))
+		return err
+	}
+
+	draft := &draftRelease{
+		Branch:    branchName,
+		Base:      baseBranch,
+		BranchSHA: branchSHA,
+		PreMerge:  preMergeSHA,
+		Merge:     merge,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := saveDraftRelease(repo, draft); err != nil {
+		errorMsg("Failed to save draft release")
+		if resetErr := repo.ResetHard(preMergeSHA); resetErr != nil {
+			warning(fmt.Sprintf("Failed to roll back %s: %v", baseBranch, resetErr))
+		}
+		return err
+	}
+
+	fmt.Println()
+	success(fmt.Sprintf("Draft merge ready on %s; run `hitch release %s --publish` to push", baseBranch, branchName))
+	fmt.Println("Nothing was pushed and metadata is unchanged.")
+	discardDraftHint(draft)
+	return nil
+}
+
+// deleteReleasedBranch deletes a released branch locally and on origin. The
+// release is already recorded, so failures only warn.
+func deleteReleasedBranch(repo *hitchgit.Repo, branch string) {
+	if err := repo.DeleteBranch(branch, true); err != nil {
+		warning(fmt.Sprintf("Failed to delete local branch %s: %v", branch, err))
+		fmt.Printf("  Delete it by hand: git branch -D %s\n", branch)
+	} else {
+		success(fmt.Sprintf("Deleted local branch %s", branch))
+	}
+
+	if skipRemote(repo, "remote delete of "+branch, fmt.Sprintf("git push origin --delete %s", branch)) {
+		return
+	}
+	if err := repo.DeleteRemoteBranch("origin", branch); errors.Is(err, hitchgit.ErrRemoteBranchNotFound) {
+		// This is OK if the branch was never pushed
+		info(fmt.Sprintf("%s is not on origin", branch))
+		return
+	} else if err != nil {
+		warning(fmt.Sprintf("Failed to delete %s on origin: %v", branch, err))
+		fmt.Printf("  Delete it by hand: git push origin --delete %s\n", branch)
+		return
+	}
+	success(fmt.Sprintf("Deleted %s on origin", branch))
+}
+
+// performDryRunRelease trial-merges branchName into the base branch and reports
+// what a real release would do, without changing branches or metadata
+func performDryRunRelease(repo *hitchgit.Repo, branchName string, baseBranch string, branchInfo metadata.BranchInfo, meta *metadata.Metadata) error {
+	fmt.Printf("Dry run: simulating release of %s to %s\n\n", branchName, baseBranch)
+
+	success(fmt.Sprintf("Validated %s is in %s", branchName, strings.Join(branchInfo.PromotedTo, ", ")))
+
+	conflict, err := repo.WouldConflict(baseBranch, branchName)
+	if err != nil {
+		errorMsg(fmt.Sprintf("Trial merge of %s into %s failed", branchName, baseBranch))
 		return err
 	}
+	if conflict {
+		errorMsg(fmt.Sprintf("%s would conflict with %s", branchName, baseBranch))
+		fmt.Println("\nResolve the conflicts before releasing, for example:")
+		fmt.Printf("  git checkout %s\n", branchName)
+		fmt.Printf("  git merge %s\n", baseBranch)
+		return fmt.Errorf("release would conflict")
+	}
+	success(fmt.Sprintf("%s merges cleanly into %s", branchName, baseBranch))
+
+	if releaseSquash {
+		info(fmt.Sprintf("Would squash merge %s into %s", branchName, baseBranch))
+	} else {
+		info(fmt.Sprintf("Would merge %s into %s", branchName, baseBranch))
+	}
 
-	success(fmt.Sprintf("Pushed %s to remote", baseBranch))
+	if releaseChangelog != "" {
+		info(fmt.Sprintf("Would add a release entry to %s", releaseChangelog))
+	}
+
+	if isOffline() {
+		info(fmt.Sprintf("Would skip push of %s (offline mode)", baseBranch))
+	} else if !repo.RemoteExists("origin") {
+		info(fmt.Sprintf("Would skip push of %s (no origin remote configured)", baseBranch))
+	} else {
+		info(fmt.Sprintf("Would push %s to remote", baseBranch))
+	}
 
-	// 13. Remove from all environments
 	for _, env := range branchInfo.PromotedTo {
-		if err := meta.RemoveBranchFromEnvironment(env, branchName, userEmail); err != nil {
-			warning(fmt.Sprintf("Failed to remove %s from %s", branchName, env))
+		info(fmt.Sprintf("Would remove %s from %s", branchName, env))
+	}
+
+	if releaseDelete {
+		info(fmt.Sprintf("Would delete %s locally and on origin, and stop tracking it", branchName))
+	} else if releaseNoDelete {
+		info("Would not mark the branch for cleanup (--no-delete)")
+	} else {
+		retentionDays := meta.RetentionDays(branchName)
+		if releaseRetain >= 0 {
+			retentionDays = releaseRetain
 		}
+		info(fmt.Sprintf("Would mark %s eligible for cleanup in %d days", branchName, retentionDays))
 	}
 
-	success("Removed " + branchName + " from all environments")
+	fmt.Println()
+	info("Dry run complete. No branches or metadata changed.")
+	info("Run without --dry-run to release.")
 
-	// 14. Update branch metadata - mark as merged
-	now := time.Now()
-	branchInfo.MergedToMainAt = &now
-	branchInfo.MergedToMainBy = userEmail
+	return nil
+}
 
-	// Calculate cleanup eligibility date
-	if !releaseNoDelete {
-		cleanupDate := now.Add(time.Duration(meta.Config.RetentionDaysAfterMerge) * 24 * time.Hour)
-		branchInfo.EligibleForCleanupAt = &cleanupDate
+// validateChangelogPath requires the changelog to be a path inside the repository
+func validateChangelogPath(path string) error {
+	clean := filepath.Clean(path)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("--changelog must be a path inside the repository: %s", path)
 	}
+	return nil
+}
 
-	meta.Branches[branchName] = branchInfo
+// addChangelogEntry prepends a dated release line for branch to the changelog
+// file and folds it into the merge commit just made
+func addChangelogEntry(repo *hitchgit.Repo, changelog string, branch string, user string) error {
+	path := filepath.Join(repo.Root(), changelog)
 
-	// 15. Write metadata
-	writer := metadata.NewWriter(repo.Repository)
-	meta.UpdateMeta(userEmail, fmt.Sprintf("hitch release %s", branchName))
-	if err := writer.Write(meta, fmt.Sprintf("Release %s to %s", branchName, baseBranch), userName, userEmail); err != nil {
-		errorMsg("Failed to write metadata")
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
-	success("Updated metadata (marked merged_to_main_at)")
+	entry := fmt.Sprintf("- %s: %s (released by %s)\n", time.Now().Format("2006-01-02"), branch, user)
+	if err := os.WriteFile(path, append([]byte(entry), existing...), 0644); err != nil {
+		return err
+	}
 
-	fmt.Println()
-	fmt.Printf("Success! %s is now in %s\n", branchName, baseBranch)
+	return repo.AmendWithFiles(changelog)
+}
 
-	// Show cleanup info
-	if !releaseNoDelete {
-		retentionDays := meta.Config.RetentionDaysAfterMerge
-		if retentionDays == 1 {
-			fmt.Printf("\nThe branch will be eligible for cleanup in 1 day.\n")
-		} else {
-			fmt.Printf("\nThe branch will be eligible for cleanup in %d days.\n", retentionDays)
+// newForge builds the configured code host integration; tests replace it
+// with a fake
+var newForge = forge.New
+
+// closePullRequest comments on and closes branch's open pull request on the
+// configured forge. The release has already happened, so problems only warn.
+func closePullRequest(cfg metadata.Config, branch string, base string, user string) {
+	f, err := newForge(cfg)
+	if f == nil && err == nil {
+		return
+	}
+	if isOffline() {
+		offlineNotice("closing the pull request", fmt.Sprintf("close the pull request for %s by hand", branch))
+		return
+	}
+	if err != nil {
+		warning(fmt.Sprintf("Skipped closing the pull request: %v", err))
+		return
+	}
+
+	comment := fmt.Sprintf("Released to `%s` by %s with hitch; closing this %s.", base, user, f.Name())
+	if err := f.CommentOnPR(branch, comment); err != nil {
+		if errors.Is(err, forge.ErrNoPullRequest) {
+			info(fmt.Sprintf("No open %s for %s", f.Name(), branch))
+			return
 		}
-		fmt.Println("Use 'hitch cleanup' to delete stale branches.")
-	} else {
-		fmt.Println("\nBranch will not be automatically cleaned up (--no-delete specified).")
+		warning(fmt.Sprintf("Failed to comment on the %s for %s: %v", f.Name(), branch, err))
+	}
+	if err := f.ClosePR(branch); err != nil {
+		warning(fmt.Sprintf("Failed to close the %s for %s: %v", f.Name(), branch, err))
+		return
 	}
 
-	return nil
+	success(fmt.Sprintf("Closed the %s for %s", f.Name(), branch))
 }
@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/metadata"
+)
+
+// restoreBranch returns the user to branch when a command finishes. A failed
+// merge can leave the branch Hitch switched to mid-merge with a dirty
+// worktree, which makes the checkout fail; in that case the merge is aborted
+// and the checkout retried. Leftover changes are only discarded on a branch
+// Hitch owns, a temp branch or the metadata branch: on any other branch they
+// may be the user's own work, so they're left for the user. If anything goes
+// wrong, the user is told which branch they ended up on.
+func restoreBranch(repo *hitchgit.Repo, branch string) {
+	current := currentRef(repo)
+	if current == branch {
+		return
+	}
+
+	recovered := false
+	if repo.IsMerging() {
+		fmt.Println()
+		warning(fmt.Sprintf("A merge was left in progress on %s, aborting it", current))
+		if err := repo.MergeAbort(); err != nil {
+			warning(err.Error())
+		}
+		recovered = true
+	}
+
+	err := repo.Checkout(branch)
+	if err != nil && isHitchBranch(current) {
+		warning(fmt.Sprintf("Failed to return to %s: %v", branch, err))
+		cleanupWorktree(repo, current)
+		recovered = true
+		err = repo.Checkout(branch)
+	}
+
+	if err == nil && currentRef(repo) == branch {
+		if recovered {
+			success(fmt.Sprintf("Returned to %s", branch))
+		}
+		return
+	}
+
+	errorMsg(fmt.Sprintf("Could not return to %s; you are on %s", branch, currentRef(repo)))
+	fmt.Println("To return manually:")
+	fmt.Println("  git merge --abort   # if a merge is in progress")
+	fmt.Println("  git stash           # if you have uncommitted changes")
+	fmt.Printf("  git checkout %s\n", branch)
+}
+
+// isHitchBranch reports whether name is a branch Hitch owns and may reset:
+// an environment's temp branch or the metadata branch
+func isHitchBranch(name string) bool {
+	return name == metadata.MetadataBranch || strings.HasSuffix(name, "-hitch-temp")
+}
+
+// cleanupWorktree discards changes left behind on current, a branch Hitch
+// owns; see isHitchBranch
+func cleanupWorktree(repo *hitchgit.Repo, current string) {
+	if err := repo.ResetHard("HEAD"); err != nil {
+		warning(fmt.Sprintf("Failed to reset %s: %v", current, err))
+	}
+}
+
+// checkCleanWorktree refuses to continue with uncommitted changes to tracked
+// files, for commands that check out other branches and merge in this
+// worktree, where the changes would get in the way or be lost
+func checkCleanWorktree(repo *hitchgit.Repo) error {
+	dirty, err := repo.HasUncommittedChanges("HEAD")
+	if err != nil {
+		errorMsg("Failed to check for uncommitted changes")
+		return err
+	}
+	if !dirty {
+		return nil
+	}
+
+	errorMsg(fmt.Sprintf("You have uncommitted changes on %s", currentRef(repo)))
+	fmt.Println("\nCommit or stash them, then run this command again.")
+	return fmt.Errorf("uncommitted changes in the working tree")
+}
+
+// currentRef returns the current branch name, or the commit SHA when HEAD is detached
+func currentRef(repo *hitchgit.Repo) string {
+	if branch, err := repo.CurrentBranch(); err == nil {
+		return branch
+	}
+	sha, _ := repo.CurrentCommitSHA()
+	return sha
+}
+
+// warnIfShallow warns that merges and ancestry checks may go wrong when the
+// repository is a shallow clone, as CI checkouts often are
+func warnIfShallow(repo *hitchgit.Repo) {
+	if !repo.IsShallow() {
+		return
+	}
+	warning("This repository is a shallow clone: merge bases and ancestry checks may be wrong")
+	fmt.Println("  Fetch the full history with: git fetch --unshallow")
+}
+
+// abortCommands tells the user how to abandon each in-progress operation
+var abortCommands = map[string]string{
+	"merge":       "git merge --abort",
+	"rebase":      "git rebase --abort",
+	"cherry-pick": "git cherry-pick --abort",
+	"revert":      "git revert --abort",
+	"bisect":      "git bisect reset",
+}
+
+// checkNoInProgressOperation refuses to continue while the repository is
+// mid-merge, mid-rebase, etc., since switching branches and merging on top of
+// that state would corrupt it
+func checkNoInProgressOperation(repo *hitchgit.Repo) error {
+	operation, inProgress := repo.InProgressOperation()
+	if !inProgress {
+		return nil
+	}
+
+	errorMsg(fmt.Sprintf("A %s is in progress on %s", operation, currentRef(repo)))
+	fmt.Println("\nFinish it, or abandon it with:")
+	fmt.Printf("  %s\n", abortCommands[operation])
+	fmt.Println("then run this command again.")
+	return &hitchgit.InProgressOperationError{Operation: operation}
+}
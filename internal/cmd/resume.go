@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/metadata"
+)
+
+// rebuildStateFile is where a rebuild stopped by a conflict records its
+// progress, in the git dir so it's never committed
+const rebuildStateFile = "hitch-rebuild-state.json"
+
+// rebuildState is the progress of a rebuild that stopped on a conflict, so
+// `hitch rebuild --continue` can pick up on the temp branch where it left off
+type rebuildState struct {
+	Environment string    `json:"environment"`
+	Base        string    `json:"base"`
+	TempBranch  string    `json:"temp_branch"`
+	Merged      []string  `json:"merged"`
+	Skipped     []string  `json:"skipped,omitempty"`
+	Conflict    string    `json:"conflict,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	// BaseCommit is the commit of Base the temp branch was started from, and
+	// Commits the commit merged for each feature in Merged
+	BaseCommit string            `json:"base_commit,omitempty"`
+	Commits    map[string]string `json:"commits,omitempty"`
+	// Features is the --features-from list, recorded in metadata only once
+	// the rebuild finishes
+	Features []string `json:"features,omitempty"`
+}
+
+// newRebuildState starts tracking a fresh rebuild of envName
+func newRebuildState(envName string, env metadata.Environment) *rebuildState {
+	return &rebuildState{
+		Environment: envName,
+		Base:        env.Base,
+		TempBranch:  envName + "-hitch-temp",
+		Merged:      []string{},
+		StartedAt:   time.Now().UTC(),
+	}
+}
+
+// recordMerge notes that feature was merged onto the temp branch at mergeRef
+func (s *rebuildState) recordMerge(repo *hitchgit.Repo, feature string, mergeRef string) {
+	s.Merged = append(s.Merged, feature)
+	if commit, err := repo.ResolveCommit(mergeRef); err == nil {
+		if s.Commits == nil {
+			s.Commits = map[string]string{}
+		}
+		s.Commits[feature] = commit
+	}
+}
+
+func rebuildStatePath(repo *hitchgit.Repo) (string, error) {
+	gitDir, err := repo.GitDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(gitDir, rebuildStateFile), nil
+}
+
+// loadRebuildState returns the saved rebuild state, or nil if no rebuild is
+// in progress
+func loadRebuildState(repo *hitchgit.Repo) (*rebuildState, error) {
+	path, err := rebuildStatePath(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rebuild state: %w", err)
+	}
+
+	var state rebuildState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse rebuild state %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// saveRebuildState records state for a later --continue
+func saveRebuildState(repo *hitchgit.Repo, state *rebuildState) error {
+	path, err := rebuildStatePath(repo)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode rebuild state: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write rebuild state: %w", err)
+	}
+	return nil
+}
+
+// clearRebuildState removes the saved rebuild state, if any
+func clearRebuildState(repo *hitchgit.Repo) error {
+	path, err := rebuildStatePath(repo)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove rebuild state: %w", err)
+	}
+	return nil
+}
+
+// checkRebuildStateCurrent refuses to continue a rebuild whose temp branch
+// no longer matches the environment: a feature already merged onto it was
+// dropped or has moved, or the base has moved since the rebuild started
+func checkRebuildStateCurrent(repo *hitchgit.Repo, state *rebuildState, env metadata.Environment) error {
+	if !repo.BranchExists(state.TempBranch) {
+		errorMsg(fmt.Sprintf("Temp branch %s no longer exists", state.TempBranch))
+		fmt.Printf("\nStart over with: hitch rebuild %s --abort && hitch rebuild %s\n", state.Environment, state.Environment)
+		return fmt.Errorf("temp branch %s not found", state.TempBranch)
+	}
+
+	var changes []string
+	if state.BaseCommit != "" {
+		if commit, err := repo.ResolveCommit(state.Base); err != nil || commit != state.BaseCommit {
+			changes = append(changes, fmt.Sprintf("%s moved since the rebuild started from %s", state.Base, shortSHA(repo, state.BaseCommit)))
+		}
+	}
+	for _, feature := range state.Merged {
+		if !slices.Contains(env.Features, feature) {
+			changes = append(changes, fmt.Sprintf("%s was merged but is no longer in %s", feature, state.Environment))
+			continue
+		}
+		merged, ok := state.Commits[feature]
+		if !ok {
+			continue
+		}
+		if commit, err := repo.ResolveCommit(env.MergeRef(feature)); err != nil || commit != merged {
+			changes = append(changes, fmt.Sprintf("%s was merged at %s but has moved since", feature, shortSHA(repo, merged)))
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	errorMsg(fmt.Sprintf("%s changed since the rebuild started", state.Environment))
+	fmt.Println()
+	for _, change := range changes {
+		fmt.Printf("  - %s\n", change)
+	}
+	fmt.Printf("\nStart over with: hitch rebuild %s --abort && hitch rebuild %s\n", state.Environment, state.Environment)
+	return fmt.Errorf("rebuild state is out of date")
+}
+
+// abortRebuild throws away a stopped rebuild: its temp branch and its state.
+// It runs before the usual in-progress checks, so it also gets the user out
+// of a merge they started by hand on the temp branch.
+func abortRebuild(repo *hitchgit.Repo, envName string) error {
+	if reader := metadata.NewReader(repo.Repository); reader.Exists() {
+		if meta, err := reader.Read(); err == nil {
+			envName = meta.ResolveEnvironment(envName)
+		}
+	}
+
+	state, err := loadRebuildState(repo)
+	if err != nil {
+		errorMsg("Failed to read rebuild state")
+		return err
+	}
+	if state == nil {
+		warning("No rebuild in progress")
+		return nil
+	}
+	if state.Environment != envName {
+		errorMsg(fmt.Sprintf("The rebuild in progress is for %s, not %s", state.Environment, envName))
+		return fmt.Errorf("no rebuild of %s in progress", envName)
+	}
+
+	if current, err := repo.CurrentBranch(); err == nil && current == state.TempBranch {
+		if repo.IsMerging() {
+			repo.MergeAbort()
+		}
+		if err := repo.CheckoutForce(state.Base); err != nil {
+			errorMsg(fmt.Sprintf("Failed to leave %s", state.TempBranch))
+			return err
+		}
+	}
+
+	if repo.BranchExists(state.TempBranch) {
+		if err := repo.DeleteBranch(state.TempBranch, true); err != nil {
+			errorMsg(fmt.Sprintf("Failed to delete %s", state.TempBranch))
+			return err
+		}
+		success("Deleted temp branch " + state.TempBranch)
+	}
+
+	if err := clearRebuildState(repo); err != nil {
+		errorMsg("Failed to clear rebuild state")
+		return err
+	}
+
+	success(fmt.Sprintf("Aborted the rebuild of %s; %s is unchanged", envName, envName))
+	return nil
+}
@@ -1,40 +1,126 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/logging"
+	"github.com/DoomedRamen/hitch/internal/version"
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
 )
 
-const version = "1.0.0"
-
 var (
-	verbose bool
-	noColor bool
+	verbose     bool
+	noColor     bool
+	noPush      bool
+	jsonOutput  bool
+	outputFile  string
+	repoPath    string
+	authorName  string
+	authorEmail string
+	timings     bool
 )
 
+// jsonOut receives JSON output. In --json mode human-readable output is
+// redirected to stderr so that stdout carries nothing but JSON.
+var jsonOut io.Writer = os.Stdout
+
+// jsonFile is the --output file JSON is written to instead of stdout, if any
+var jsonFile *os.File
+
 // rootCmd represents the base command
 var rootCmd = &cobra.Command{
 	Use:     "hitch",
 	Short:   "Git workflow manager for multi-environment development",
-	Version: version,
-	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+	Version: version.String(),
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 		if noColor {
 			color.NoColor = true
 		}
+		if verbose || os.Getenv("HITCH_VERBOSE") == "1" {
+			logging.SetLevel(logging.LevelDebug)
+		}
+		logging.RecordPhases(timings)
+		if jsonOutput {
+			color.NoColor = true
+			cmd.SilenceUsage = true
+			os.Stdout = os.Stderr
+		}
+		if outputFile != "" {
+			if !jsonOutput {
+				return fmt.Errorf("--output requires --json")
+			}
+			if err := openOutputFile(outputFile); err != nil {
+				return err
+			}
+		}
+		return nil
 	},
 }
 
-// Execute runs the root command
+// openOutputFile creates path, and any missing parent directories, and
+// sends JSON output there
+func openOutputFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	jsonFile = f
+	jsonOut = f
+	return nil
+}
+
+// Execute runs the root command. In --json mode a failing command also
+// writes a JSON error envelope to stdout (or the --output file), unless it
+// already wrote its result.
 func Execute() error {
-	return rootCmd.Execute()
+	realStdout := os.Stdout
+	defer func() { os.Stdout = realStdout }()
+
+	jsonOut = rootCmd.OutOrStdout()
+
+	start := time.Now()
+	err := rootCmd.Execute()
+
+	// On stderr, so stdout (and --json output) is unchanged
+	if timings {
+		printTimings(os.Stderr, time.Since(start))
+		logging.RecordPhases(false)
+	}
+	var reported reportedError
+	if err != nil && jsonOutput && !errors.As(err, &reported) {
+		writeJSONError(jsonOut, err)
+	}
+
+	if jsonFile != nil {
+		if closeErr := jsonFile.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to write output file: %w", closeErr)
+		}
+		jsonFile = nil
+	}
+	return err
 }
 
 func init() {
-	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose output")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose output: log git commands and timings to stderr (or set HITCH_VERBOSE=1)")
 	rootCmd.PersistentFlags().BoolVar(&noColor, "no-color", false, "Disable colored output")
+	rootCmd.PersistentFlags().BoolVar(&timings, "timings", false, "Print how long each phase (metadata reads and writes, checkouts, merges, pushes) took to stderr")
+	rootCmd.PersistentFlags().BoolVar(&jsonOutput, "json", false, "Output as JSON; failures print {\"error\": {\"type\", \"message\"}} to stdout")
+	rootCmd.PersistentFlags().StringVarP(&outputFile, "output", "o", "", "With --json, write the JSON to this file instead of stdout, creating parent directories")
+	rootCmd.PersistentFlags().StringVarP(&repoPath, "repo", "C", "", "Run as if hitch was started in this repository (or set HITCH_REPO)")
+	rootCmd.PersistentFlags().BoolVar(&noPush, "no-push", false, "Work offline: skip all pulls, pushes, and fetches (or set HITCH_OFFLINE=1)")
+	rootCmd.PersistentFlags().StringVar(&authorName, "author-name", "", "Attribute metadata and merge commits to this name instead of git's user.name (or set HITCH_AUTHOR_NAME)")
+	rootCmd.PersistentFlags().StringVar(&authorEmail, "author-email", "", "Attribute metadata and merge commits to this email instead of git's user.email (or set HITCH_AUTHOR_EMAIL)")
 
 	// Add subcommands
 	rootCmd.AddCommand(initCmd)
@@ -42,6 +128,131 @@ func init() {
 	rootCmd.AddCommand(hookCmd)
 }
 
+// openRepo opens the repository hitch operates on: the one given by -C/--repo
+// or HITCH_REPO, otherwise the current directory. Any --author-name or
+// --author-email override is applied to it.
+func openRepo() (*hitchgit.Repo, error) {
+	path := repoPath
+	if path == "" {
+		path = os.Getenv("HITCH_REPO")
+	}
+	if path == "" {
+		path = "."
+	}
+
+	repo, err := hitchgit.OpenRepo(path)
+	if err != nil {
+		return nil, err
+	}
+	repo.SetAuthor(authorOverride(authorName, "HITCH_AUTHOR_NAME"), authorOverride(authorEmail, "HITCH_AUTHOR_EMAIL"))
+	return repo, nil
+}
+
+// authorOverride returns the identity override from flag, or from the
+// environment variable env if the flag is unset. Automated runs use it to
+// attribute commits to the developer who triggered them rather than the
+// bot's git user.
+func authorOverride(flag string, env string) string {
+	if flag != "" {
+		return flag
+	}
+	return os.Getenv(env)
+}
+
+// isOffline reports whether remote operations should be skipped, either via
+// --no-push or HITCH_OFFLINE=1
+func isOffline() bool {
+	return noPush || os.Getenv("HITCH_OFFLINE") == "1"
+}
+
+// offlineNotice tells the user which remote step was skipped in offline mode
+// and how to sync it later
+func offlineNotice(skipped string, syncCmd string) {
+	info(fmt.Sprintf("Skipped %s (offline mode)", skipped))
+	fmt.Printf("  To sync later: %s\n", syncCmd)
+}
+
+// skipRemote reports whether the remote step described by skipped should be
+// skipped, either because of offline mode or because no origin remote is
+// configured, and tells the user why
+func skipRemote(repo *hitchgit.Repo, skipped string, syncCmd string) bool {
+	if isOffline() {
+		offlineNotice(skipped, syncCmd)
+		return true
+	}
+	if !repo.RemoteExists("origin") {
+		info(fmt.Sprintf("Skipped %s (no origin remote configured)", skipped))
+		return true
+	}
+	return false
+}
+
+// pushRejectedHint explains a push the remote refused, if err says why
+func pushRejectedHint(err error) {
+	var rejected *hitchgit.PushRejectedError
+	if errors.As(err, &rejected) {
+		fmt.Println(rejected.Hint())
+	}
+}
+
+// stdinIsTerminal reports whether stdin is a terminal. Tests replace it to
+// drive prompts from a script.
+var stdinIsTerminal = func() bool {
+	stat, err := os.Stdin.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// isInteractive reports whether hitch may stop to ask the user questions
+func isInteractive() bool {
+	return !jsonOutput && stdinIsTerminal()
+}
+
+// showProgress reports whether to print progress such as rebuild merge
+// counters, which only clutter the stderr of --json runs
+func showProgress() bool {
+	return !jsonOutput
+}
+
+// confirm asks a yes/no question on stdin and reports whether the user
+// answered yes. Anything other than "y" or "yes" counts as no.
+func confirm(prompt string) (bool, error) {
+	fmt.Printf("%s [y/N]: ", prompt)
+	response, err := readAnswer()
+	if err != nil {
+		return false, err
+	}
+	return response == "y" || response == "yes", nil
+}
+
+// readAnswer reads one line from stdin, trimmed and lowercased
+func readAnswer() (string, error) {
+	line, err := readLine()
+	return strings.ToLower(line), err
+}
+
+// readLine reads one line from stdin, trimmed. It reads a byte at a time so
+// answers to later prompts stay unread.
+func readLine() (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			if buf[0] == '\n' {
+				break
+			}
+			line = append(line, buf[0])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(string(line)), nil
+}
+
 // Helper functions for colored output
 
 func success(msg string) {
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	setupName  string
+	setupEmail string
+)
+
+var setupCmd = &cobra.Command{
+	Use:   "setup",
+	Short: "Configure the git identity Hitch records",
+	Long: `Configure the git identity Hitch records.
+
+Hitch attributes locks, promotions, and releases to git's user.email, and
+refuses to change anything without it. setup shows the identity in use and,
+if user.email is missing, asks for it (or takes --email) and saves it to this
+repository's git config.
+
+Examples:
+  hitch setup
+  hitch setup --email alice@example.com --name "Alice Smith"`,
+	Args: cobra.NoArgs,
+	RunE: runSetup,
+}
+
+func init() {
+	setupCmd.Flags().StringVar(&setupName, "name", "", "Set user.name in this repository's git config")
+	setupCmd.Flags().StringVar(&setupEmail, "email", "", "Set user.email in this repository's git config")
+	rootCmd.AddCommand(setupCmd)
+}
+
+func runSetup(cmd *cobra.Command, args []string) error {
+	// 1. Open Git repository
+	repo, err := openRepo()
+	if err != nil {
+		errorMsg("Not a Git repository")
+		return err
+	}
+
+	name, email := setupName, setupEmail
+
+	// 2. Nothing given: show the identity, or ask for a missing email
+	if name == "" && email == "" {
+		if current, err := repo.UserEmail(); err == nil {
+			userName, _ := repo.UserName()
+			success(fmt.Sprintf("Hitch records changes as %s <%s>", userName, current))
+			fmt.Println("\nTo change it: hitch setup --email <email> --name <name>")
+			return nil
+		}
+
+		if !isInteractive() {
+			userEmailMissing()
+			return fmt.Errorf("git user.email not configured")
+		}
+
+		fmt.Print("Email for Hitch to record your changes as: ")
+		if email, err = readLine(); err != nil {
+			return err
+		}
+		if email == "" {
+			info("Nothing changed")
+			return nil
+		}
+		fmt.Print("Name (leave empty to keep the current one): ")
+		if name, err = readLine(); err != nil {
+			return err
+		}
+	}
+
+	// 3. Save it
+	if email != "" && !strings.Contains(email, "@") {
+		errorMsg(fmt.Sprintf("%q doesn't look like an email address", email))
+		return fmt.Errorf("invalid email %q", email)
+	}
+
+	if err := repo.SetUser(name, email); err != nil {
+		errorMsg("Failed to update git config")
+		return err
+	}
+
+	if email != "" {
+		success(fmt.Sprintf("Set user.email to %s", email))
+	}
+	if name != "" {
+		success(fmt.Sprintf("Set user.name to %s", name))
+	}
+	fmt.Println("\nThis applies to this repository only. To set it everywhere:")
+	fmt.Println("  git config --global user.email \"you@example.com\"")
+
+	return nil
+}
+
+// userEmailMissing explains how to fix a missing git user.email, which every
+// command that changes metadata needs
+func userEmailMissing() {
+	errorMsg("Git user.email is not configured")
+	fmt.Println("\nSet it for this repository with:")
+	fmt.Println("  hitch setup --email you@example.com")
+	fmt.Println("or everywhere with:")
+	fmt.Println("  git config --global user.email \"you@example.com\"")
+}
@@ -0,0 +1,262 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/spf13/cobra"
+)
+
+var (
+	promoteStackNoRebuild bool
+	promoteStackForce     bool
+	promoteStackRebuild   bool
+)
+
+var stackCmd = &cobra.Command{
+	Use:   "stack <name> <branch>...",
+	Short: "Define a stack of dependent feature branches",
+	Long: `Define a stack of dependent feature branches.
+
+List the branches in dependency order: each branch builds on the ones
+before it. A stack is promoted as a unit with 'hitch promote-stack', which
+keeps its branches merged in this order. Running this again with the same
+name replaces the stack.
+
+Example:
+  hitch stack checkout feature/cart-api feature/cart-ui feature/checkout`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: runStack,
+}
+
+var promoteStackCmd = &cobra.Command{
+	Use:   "promote-stack <stack> to <environment>",
+	Short: "Promote every branch of a stack to an environment",
+	Long: `Promote every branch of a stack to an environment.
+
+All branches of the stack are added to the environment as a unit, ordered
+as in the stack so each one is merged after the branches it depends on,
+and the environment is rebuilt once, unless config.auto_rebuild_on_promote
+is false and --rebuild isn't given.`,
+	Args: cobra.ExactArgs(3), // stack, "to", environment
+	RunE: runPromoteStack,
+}
+
+func init() {
+	promoteStackCmd.Flags().BoolVar(&promoteStackNoRebuild, "no-rebuild", false, "Add to metadata but don't rebuild")
+	promoteStackCmd.Flags().BoolVar(&promoteStackRebuild, "rebuild", false, "Rebuild even if config.auto_rebuild_on_promote is false")
+	promoteStackCmd.Flags().BoolVar(&promoteStackForce, "force", false, "Promote even during a scheduled freeze")
+	rootCmd.AddCommand(stackCmd)
+	rootCmd.AddCommand(promoteStackCmd)
+}
+
+func runStack(cmd *cobra.Command, args []string) error {
+	stackName := args[0]
+	branches := args[1:]
+	for _, ref := range branches {
+		if _, pin, err := metadata.ParseFeatureRef(ref); err != nil {
+			return err
+		} else if pin != "" {
+			return fmt.Errorf("stack branches can't be pinned; drop @%s from %s", pin, ref)
+		}
+	}
+
+	// 1. Open Git repository
+	repo, err := openRepo()
+	if err != nil {
+		errorMsg("Not a Git repository")
+		return err
+	}
+
+	// 2. Get current branch to return to
+	currentBranch, err := repo.CurrentBranch()
+	if err != nil {
+		errorMsg("Failed to get current branch")
+		return err
+	}
+	defer restoreBranch(repo, currentBranch)
+
+	// 3. Read metadata
+	reader := metadata.NewReader(repo.Repository)
+	if !reader.Exists() {
+		errorMsg("Hitch is not initialized in this repository")
+		fmt.Println("\nRun 'hitch init' to initialize Hitch.")
+		return fmt.Errorf("hitch not initialized")
+	}
+
+	meta, err := reader.Read()
+	if err != nil {
+		errorMsg("Failed to read metadata")
+		return err
+	}
+
+	if err := checkMetadataNotBehind(repo); err != nil {
+		return err
+	}
+
+	if err := checkNotFrozen(meta); err != nil {
+		return err
+	}
+
+	// 4. Validate branches exist
+	for _, branch := range branches {
+		if !repo.BranchExists(branch) {
+			errorMsg(fmt.Sprintf("Branch '%s' not found", branch))
+			return &metadata.BranchNotFoundError{Branch: branch}
+		}
+	}
+
+	// 5. Get user info
+	userEmail, err := repo.UserEmail()
+	if err != nil {
+		userEmailMissing()
+		return err
+	}
+	userName, _ := repo.UserName()
+
+	// 6. Define stack
+	if err := meta.SetStack(stackName, branches); err != nil {
+		errorMsg(fmt.Sprintf("Failed to define stack: %v", err))
+		return err
+	}
+
+	// 7. Write metadata
+	meta.UpdateMeta(userEmail, fmt.Sprintf("hitch stack %s %s", stackName, strings.Join(branches, " ")))
+
+	writer := metadata.NewWriter(repo.Repository)
+	if err := writer.Write(meta, fmt.Sprintf("Define stack %s", stackName), userName, userEmail); err != nil {
+		errorMsg("Failed to write metadata")
+		return err
+	}
+
+	success(fmt.Sprintf("Stack %s: %s", stackName, strings.Join(branches, " → ")))
+	return nil
+}
+
+func runPromoteStack(cmd *cobra.Command, args []string) error {
+	if len(args) != 3 || args[1] != "to" {
+		return fmt.Errorf("usage: hitch promote-stack <stack> to <environment>")
+	}
+	if promoteStackRebuild && promoteStackNoRebuild {
+		return fmt.Errorf("--rebuild cannot be combined with --no-rebuild")
+	}
+
+	stackName := args[0]
+	envName := args[2]
+
+	// 1. Open Git repository
+	repo, err := openRepo()
+	if err != nil {
+		errorMsg("Not a Git repository")
+		return err
+	}
+
+	if err := checkNoInProgressOperation(repo); err != nil {
+		return err
+	}
+	warnIfShallow(repo)
+
+	// 2. Remember current branch (will return here at end)
+	currentBranch, err := repo.CurrentBranch()
+	if err != nil {
+		currentCommit, _ := repo.CurrentCommitSHA()
+		currentBranch = currentCommit
+	}
+
+	defer restoreBranch(repo, currentBranch)
+
+	// 3. Read metadata
+	reader := metadata.NewReader(repo.Repository)
+	if !reader.Exists() {
+		errorMsg("Hitch is not initialized in this repository")
+		fmt.Println("\nRun 'hitch init' to initialize Hitch.")
+		return fmt.Errorf("hitch not initialized")
+	}
+
+	meta, err := reader.Read()
+	if err != nil {
+		errorMsg("Failed to read metadata")
+		return err
+	}
+
+	envName = meta.ResolveEnvironment(envName)
+
+	if err := checkMetadataNotBehind(repo); err != nil {
+		return err
+	}
+
+	if err := checkNotFrozen(meta); err != nil {
+		return err
+	}
+
+	// 4. Validate environment and stack exist
+	if _, exists := meta.Environments[envName]; !exists {
+		errorMsg(fmt.Sprintf("Environment '%s' not found", envName))
+		return &metadata.EnvironmentNotFoundError{Environment: envName}
+	}
+	if err := checkFreezeWindow(meta, envName, promoteStackForce); err != nil {
+		return err
+	}
+
+	members, exists := meta.Stacks[stackName]
+	if !exists {
+		errorMsg(fmt.Sprintf("Stack '%s' not found", stackName))
+		fmt.Printf("\nDefine it with: hitch stack %s <branch>...\n", stackName)
+		return &metadata.StackNotFoundError{Stack: stackName}
+	}
+
+	// 5. Every member must exist before any is promoted
+	for _, branch := range members {
+		if !repo.BranchExists(branch) {
+			errorMsg(fmt.Sprintf("Branch '%s' of stack %s not found", branch, stackName))
+			return &metadata.BranchNotFoundError{Branch: branch}
+		}
+	}
+
+	// 6. Get user info
+	userEmail, err := repo.UserEmail()
+	if err != nil {
+		userEmailMissing()
+		return err
+	}
+
+	userName, _ := repo.UserName()
+
+	fmt.Printf("Promoting stack %s to %s...\n\n", stackName, envName)
+
+	// 7. Add to metadata in stack order
+	added, err := meta.PromoteStack(envName, stackName, userEmail)
+	if err != nil {
+		errorMsg("Failed to add stack to environment")
+		return err
+	}
+
+	for _, branch := range added {
+		success(fmt.Sprintf("Added %s to %s feature list", branch, envName))
+	}
+	if len(added) == 0 {
+		info(fmt.Sprintf("Every branch of %s is already in %s; reordering only", stackName, envName))
+	}
+
+	// 8. Write metadata
+	writer := metadata.NewWriter(repo.Repository)
+	meta.UpdateMeta(userEmail, fmt.Sprintf("hitch promote-stack %s to %s", stackName, envName))
+	if err := writer.Write(meta, fmt.Sprintf("Promote stack %s to %s", stackName, envName), userName, userEmail); err != nil {
+		errorMsg("Failed to write metadata")
+		return err
+	}
+
+	success("Updated metadata")
+
+	// 9. Rebuild environment (unless --no-rebuild or config says not to)
+	if skipRebuild(meta, promoteStackNoRebuild, promoteStackRebuild) {
+		fmt.Println()
+		warning(fmt.Sprintf("Skipped rebuild (use 'hitch rebuild %s' to rebuild)", envName))
+		return nil
+	}
+
+	fmt.Println()
+
+	return runRebuildInternal(repo, envName, userEmail, userName, meta)
+}
@@ -1,7 +1,11 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	hitchgit "github.com/DoomedRamen/hitch/internal/git"
@@ -11,9 +15,14 @@ import (
 )
 
 var (
-	statusStale bool
-	statusEnv   string
-	statusJSON  bool
+	statusStale            bool
+	statusEnv              string
+	statusNoGit            bool
+	statusEnvironmentsOnly bool
+	statusBranchesOnly     bool
+	statusCompact          bool
+	statusAge              string
+	statusAt               string
 )
 
 var statusCmd = &cobra.Command{
@@ -24,19 +33,56 @@ var statusCmd = &cobra.Command{
 Displays:
 - Which features are in each environment
 - Lock status
-- Optionally, stale branches`,
+- Features whose branch no longer exists in git (skip with --no-git-check)
+- Optionally, stale branches
+
+--environments-only shows just the environments, and --branches-only just
+the tracked branches and the environments each is in, in both human and
+JSON output.
+
+--compact prints one line per environment, without features, for dashboards
+and narrow terminals:
+
+  dev  [unlocked]  4 features  built 2 hours ago
+
+--age <duration> flags features promoted to an environment longer ago than
+the duration (e.g. 14d, 36h), so forgotten features get released or dropped.
+
+--at <ref-or-date> shows the metadata as it was at an earlier
+hitch-metadata commit, e.g. hitch-metadata~5, a SHA, or a date like
+2025-10-17 (the last commit that day). Branches are not checked against git.`,
 	RunE: runStatus,
 }
 
 func init() {
 	statusCmd.Flags().BoolVar(&statusStale, "stale", false, "Include stale branch analysis")
 	statusCmd.Flags().StringVar(&statusEnv, "env", "", "Show only specific environment")
-	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Output as JSON")
+	statusCmd.Flags().BoolVar(&statusNoGit, "no-git-check", false, "Don't check that feature branches still exist (faster on huge repos)")
+	statusCmd.Flags().BoolVar(&statusEnvironmentsOnly, "environments-only", false, "Show only the environments")
+	statusCmd.Flags().BoolVar(&statusBranchesOnly, "branches-only", false, "Show only the tracked branches")
+	statusCmd.Flags().BoolVar(&statusCompact, "compact", false, "Show one line per environment, without features")
+	statusCmd.Flags().StringVar(&statusAge, "age", "", "Flag features in an environment for longer than this (e.g. 14d, 36h)")
+	statusCmd.Flags().StringVar(&statusAt, "at", "", "Show the metadata as of this hitch-metadata commit or date (e.g. hitch-metadata~3, 2025-10-17)")
 }
 
 func runStatus(cmd *cobra.Command, args []string) error {
+	if statusEnvironmentsOnly && statusBranchesOnly {
+		return fmt.Errorf("--environments-only cannot be combined with --branches-only")
+	}
+	if statusEnvironmentsOnly && statusStale {
+		return fmt.Errorf("--environments-only cannot be combined with --stale")
+	}
+	if statusCompact && statusBranchesOnly {
+		return fmt.Errorf("--compact cannot be combined with --branches-only")
+	}
+
+	maxAge, err := parseAge(statusAge)
+	if err != nil {
+		return err
+	}
+
 	// 1. Open Git repository
-	repo, err := hitchgit.OpenRepo(".")
+	repo, err := openRepo()
 	if err != nil {
 		errorMsg("Not a Git repository")
 		return err
@@ -45,70 +91,250 @@ func runStatus(cmd *cobra.Command, args []string) error {
 	// 2. Read metadata
 	reader := metadata.NewReader(repo.Repository)
 	if !reader.Exists() {
+		// A fresh clone has origin's metadata but no local branch yet
+		if metadataOnlyOnRemote(repo) {
+			errorMsg("Hitch metadata exists on origin but not locally")
+			fmt.Println("\nRun 'hitch sync' to create the local hitch-metadata branch.")
+			return fmt.Errorf("hitch-metadata not synced from origin")
+		}
 		errorMsg("Hitch is not initialized in this repository")
 		fmt.Println("\nRun 'hitch init' to initialize Hitch.")
 		return fmt.Errorf("hitch not initialized")
 	}
 
-	meta, err := reader.Read()
+	var meta *metadata.Metadata
+	if statusAt != "" {
+		meta, err = reader.ReadAt(statusAt)
+	} else {
+		meta, err = reader.Read()
+	}
 	if err != nil {
 		errorMsg("Failed to read metadata")
 		return err
 	}
 
+	if statusEnv != "" {
+		statusEnv = meta.ResolveEnvironment(statusEnv)
+	}
+
+	// Noted in human output when it's a tracked feature
+	current := ""
+	if !repo.IsDetachedHead() {
+		current, _ = repo.CurrentBranch()
+	}
+
+	// Today's branches say nothing about a past state
+	if statusNoGit || statusAt != "" {
+		repo = nil
+	}
+	if statusAt != "" {
+		current = ""
+		if !jsonOutput {
+			info(fmt.Sprintf("Metadata as of %s: last changed %s by %s (%s)", statusAt,
+				meta.Meta.LastModifiedAt.Local().Format("2006-01-02 15:04"), meta.Meta.LastModifiedBy, meta.Meta.LastCommand))
+			fmt.Println()
+		}
+	}
+
 	// 3. Display status
-	if statusJSON {
-		return displayJSONStatus(meta)
+	if jsonOutput {
+		return displayJSONStatus(meta, repo, maxAge)
+	}
+
+	if statusBranchesOnly {
+		displayBranchTable(meta)
+		if statusStale {
+			displayStaleBranches(meta)
+		}
+		return nil
+	}
+
+	if statusCompact {
+		displayCompactStatus(meta, repo, maxAge)
+		return nil
+	}
+
+	return displayHumanStatus(meta, repo, current, maxAge)
+}
+
+// parseAge parses a --age duration: anything time.ParseDuration accepts, or
+// a whole number of days like "14d". An empty age is 0, meaning no limit.
+func parseAge(age string) (time.Duration, error) {
+	if age == "" {
+		return 0, nil
+	}
+
+	var d time.Duration
+	if days, ok := strings.CutSuffix(age, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid --age %q: expected a duration like 14d or 36h", age)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		parsed, err := time.ParseDuration(age)
+		if err != nil {
+			return 0, fmt.Errorf("invalid --age %q: expected a duration like 14d or 36h", age)
+		}
+		d = parsed
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid --age %q: must be positive", age)
 	}
+	return d, nil
+}
+
+// promotedAt returns when feature was promoted to envName, from the branch's
+// promotion history, or false if it has no promotion still in effect there
+func promotedAt(meta *metadata.Metadata, feature string, envName string) (time.Time, bool) {
+	for _, event := range meta.Branches[feature].PromotedHistory {
+		if event.Environment == envName && event.DemotedAt == nil {
+			return event.PromotedAt, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// isOld reports whether feature has been in envName for longer than maxAge.
+// A maxAge of 0 flags nothing.
+func isOld(meta *metadata.Metadata, feature string, envName string, maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return false
+	}
+	promoted, ok := promotedAt(meta, feature, envName)
+	return ok && time.Since(promoted) > maxAge
+}
+
+// environmentState holds the derived state of an environment that both the
+// human and JSON status views show
+type environmentState struct {
+	StaleLock      bool
+	Drifted        bool
+	PendingRebuild bool
+	// No features, but some were promoted to it once. A never-used
+	// environment, even one rebuilt empty, is empty but not emptied.
+	Emptied bool
+}
 
-	return displayHumanStatus(meta)
+// computeEnvironmentState derives envName's state from metadata and, if repo
+// is non-nil, from its hitched branch: it has drifted if the branch no longer
+// points at the commit its last rebuild produced
+func computeEnvironmentState(meta *metadata.Metadata, repo *hitchgit.Repo, envName string) environmentState {
+	env := meta.Environments[envName]
+	state := environmentState{
+		StaleLock:      meta.IsLockStale(envName),
+		PendingRebuild: meta.PendingRebuild(envName),
+		Emptied:        len(env.Features) == 0 && env.EverHadFeatures(),
+	}
+
+	if repo != nil && env.LastRebuildCommit != "" {
+		if tip, err := repo.ResolveCommit(envName); err == nil && tip != env.LastRebuildCommit {
+			state.Drifted = true
+		}
+	}
+
+	return state
 }
 
-func displayHumanStatus(meta *metadata.Metadata) error {
+// displayHumanStatus prints every environment. If repo is non-nil, features
+// whose branch no longer exists are flagged, and so are features older than
+// a non-zero maxAge. If current, the checked-out branch, is a tracked
+// feature, its environments are noted first.
+func displayHumanStatus(meta *metadata.Metadata, repo *hitchgit.Repo, current string, maxAge time.Duration) error {
 	color.New(color.Bold).Println("Hitch Status")
 	fmt.Println()
 
-	// Display each environment
-	for envName, env := range meta.Environments {
+	if meta.Frozen && !statusEnvironmentsOnly {
+		fmt.Println(color.RedString("Maintenance mode: %s (frozen by %s)", meta.FrozenReason, meta.FrozenBy))
+		fmt.Println()
+	}
+
+	if note := currentFeatureNote(meta, current); note != "" && !statusEnvironmentsOnly {
+		info(note)
+		fmt.Println()
+	}
+
+	// Display each environment in a stable order
+	for _, envName := range meta.EnvironmentNames() {
+		env := meta.Environments[envName]
+
 		// Skip if filtering by specific environment
 		if statusEnv != "" && envName != statusEnv {
 			continue
 		}
 
+		state := computeEnvironmentState(meta, repo, envName)
+
 		// Environment header
 		lockStatus := color.GreenString("unlocked")
 		if env.Locked {
 			lockStatus = color.RedString("locked by %s since %s", env.LockedBy, env.LockedAt.Format("15:04:05"))
-			if meta.IsLockStale(envName) {
+			if env.LockedHost != "" {
+				lockStatus += color.RedString(" on %s", env.LockedHost)
+			}
+			if state.StaleLock {
 				lockStatus += color.YellowString(" (STALE)")
 			}
 		}
 
 		fmt.Printf("Environment: %s (%s)\n", color.CyanString(envName), lockStatus)
 		fmt.Printf("  Base: %s\n", env.Base)
+		if env.Locked && env.LockedContext != "" {
+			fmt.Printf("  Lock context: %s\n", env.LockedContext)
+		}
 
 		if len(env.Features) == 0 {
-			fmt.Println("  Features: (none)")
+			if state.Emptied {
+				fmt.Println("  Features: (none)")
+			} else {
+				fmt.Println("  Features: (none, never used)")
+			}
 		} else {
 			fmt.Println("  Features:")
-			for _, feature := range env.Features {
+			for _, feature := range sortedFeatures(env) {
 				// Get promotion time if available
 				branchInfo, exists := meta.Branches[feature]
 				timeStr := ""
-				if exists {
-					for _, event := range branchInfo.PromotedHistory {
-						if event.Environment == envName && event.DemotedAt == nil {
-							timeStr = fmt.Sprintf(" (promoted %s)", formatTimeAgo(event.PromotedAt))
-							break
-						}
-					}
+				if promoted, ok := promotedAt(meta, feature, envName); ok {
+					timeStr = fmt.Sprintf(" (promoted %s)", formatTimeAgo(promoted))
+				}
+				if isOld(meta, feature, envName, maxAge) {
+					timeStr += color.YellowString(" (older than %s)", statusAge)
+				}
+				missing := ""
+				if repo != nil && !repo.BranchExists(feature) {
+					missing = color.RedString(" (branch missing)")
 				}
-				fmt.Printf("    - %s%s\n", feature, timeStr)
+				merged := ""
+				if exists && branchInfo.MergedToMainAt != nil {
+					merged = color.YellowString(" (already merged to main)")
+				}
+				fmt.Printf("    - %s%s%s%s%s\n", feature, pinSuffix(repo, env, feature), missing, merged, timeStr)
+			}
+			if contributors := meta.Contributors(envName); len(contributors) > 0 {
+				fmt.Printf("  Contributors: %s\n", strings.Join(contributors, ", "))
 			}
 		}
 
 		if !env.LastRebuild.IsZero() {
-			fmt.Printf("  Last rebuild: %s\n", formatTimeAgo(env.LastRebuild))
+			commit := ""
+			if env.LastRebuildCommit != "" {
+				commit = fmt.Sprintf(" (%s)", shortSHA(repo, env.LastRebuildCommit))
+			}
+			fmt.Printf("  Last rebuild: %s%s\n", formatTimeAgo(env.LastRebuild), commit)
+		}
+		if len(env.Skipped) > 0 {
+			fmt.Printf("  %s\n", color.YellowString("Skipped by last rebuild (conflicts): %s", strings.Join(env.Skipped, ", ")))
+		}
+		if state.PendingRebuild {
+			fmt.Printf("  %s\n", color.YellowString("Pending rebuild: features changed since the last rebuild"))
+		}
+		if state.Drifted {
+			fmt.Printf("  %s\n", color.YellowString("Drifted: %s has moved since its last rebuild", envName))
+		}
+		if state.Emptied {
+			fmt.Printf("  %s\n", color.YellowString("Emptied: %s had features but has none now; if that's unexpected, check 'git log hitch-metadata'", envName))
 		}
 
 		fmt.Println()
@@ -122,59 +348,154 @@ func displayHumanStatus(meta *metadata.Metadata) error {
 	return nil
 }
 
-func displayStaleBranches(meta *metadata.Metadata) {
-	safeTodelete := []string{}
-	inactive := []string{}
-
-	for branchName, info := range meta.Branches {
-		// Safe to delete if merged + past retention period + not in any env
-		if info.MergedToMainAt != nil {
-			daysSinceMerge := int(time.Since(*info.MergedToMainAt).Hours() / 24)
-			if daysSinceMerge > meta.Config.RetentionDaysAfterMerge {
-				// Check not in any environment
-				inEnv := false
-				for _, env := range meta.Environments {
-					for _, f := range env.Features {
-						if f == branchName {
-							inEnv = true
-							break
-						}
-					}
-					if inEnv {
-						break
-					}
-				}
-				if !inEnv {
-					safeTodelete = append(safeTodelete, fmt.Sprintf("%s (merged %d days ago)", branchName, daysSinceMerge))
-				}
+// displayCompactStatus prints one line per environment: its lock, how many
+// features it has, and when it was last built, plus any warnings
+func displayCompactStatus(meta *metadata.Metadata, repo *hitchgit.Repo, maxAge time.Duration) {
+	names := meta.EnvironmentNames()
+	if statusEnv != "" {
+		names = []string{statusEnv}
+	}
+
+	width := 0
+	for _, envName := range names {
+		width = max(width, len(envName))
+	}
+	merged := meta.MergedFeaturesInEnvironments()
+
+	for _, envName := range names {
+		env, ok := meta.Environments[envName]
+		if !ok {
+			continue
+		}
+		state := computeEnvironmentState(meta, repo, envName)
+
+		lock := color.GreenString("[unlocked]")
+		if env.Locked {
+			lock = color.RedString("[locked by %s]", env.LockedBy)
+			if state.StaleLock {
+				lock += color.YellowString(" (STALE)")
+			}
+		}
+
+		features := fmt.Sprintf("%d features", len(env.Features))
+		if len(env.Features) == 1 {
+			features = "1 feature"
+		}
+
+		built := "never built"
+		if !env.LastRebuild.IsZero() {
+			built = "built " + formatTimeAgo(env.LastRebuild)
+		}
+
+		var notes []string
+		if state.PendingRebuild {
+			notes = append(notes, "pending rebuild")
+		}
+		if state.Drifted {
+			notes = append(notes, "drifted")
+		}
+		if state.Emptied {
+			notes = append(notes, "emptied")
+		}
+		if len(env.Skipped) > 0 {
+			notes = append(notes, fmt.Sprintf("%d skipped", len(env.Skipped)))
+		}
+		if len(merged[envName]) > 0 {
+			notes = append(notes, fmt.Sprintf("%d already merged to main", len(merged[envName])))
+		}
+		old := 0
+		for _, feature := range env.Features {
+			if isOld(meta, feature, envName, maxAge) {
+				old++
 			}
 		}
+		if old > 0 {
+			notes = append(notes, fmt.Sprintf("%d older than %s", old, statusAge))
+		}
+		warn := ""
+		if len(notes) > 0 {
+			warn = "  " + color.YellowString(strings.Join(notes, ", "))
+		}
+
+		fmt.Printf("%-*s  %s  %s  %s%s\n", width, envName, lock, features, built, warn)
+	}
+}
+
+// currentFeatureNote describes which environments the checked-out branch is
+// in, or returns "" if it isn't a tracked feature
+func currentFeatureNote(meta *metadata.Metadata, current string) string {
+	if current == "" || !meta.IsFeatureBranch(current) {
+		return ""
+	}
+	if _, tracked := meta.Branches[current]; !tracked {
+		return ""
+	}
+
+	envs := meta.EnvironmentsContaining(current)
+	if len(envs) == 0 {
+		return fmt.Sprintf("You are on %s, which is not in any environment", current)
+	}
+	return fmt.Sprintf("You are on %s, which is in: %s", current, strings.Join(envs, ", "))
+}
+
+// displayBranchTable prints every tracked branch with the environments it
+// is in and whether it was merged to the base
+func displayBranchTable(meta *metadata.Metadata) {
+	color.New(color.Bold).Println("Tracked Branches")
+	fmt.Println()
+
+	names := make([]string, 0, len(meta.Branches))
+	width := 0
+	for name := range meta.Branches {
+		names = append(names, name)
+		width = max(width, len(name))
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		fmt.Println("  (none)")
+		fmt.Println()
+		return
+	}
+
+	for _, name := range names {
+		branch := meta.Branches[name]
+		envs := "(no environments)"
+		if len(branch.PromotedTo) > 0 {
+			envs = strings.Join(branch.PromotedTo, ", ")
+		}
 
-		// Warn about inactive branches
-		if info.MergedToMainAt == nil && !info.LastCommitAt.IsZero() {
-			daysSinceCommit := int(time.Since(info.LastCommitAt).Hours() / 24)
-			if daysSinceCommit > meta.Config.StaleDaysNoActivity {
-				inactive = append(inactive, fmt.Sprintf("%s (last commit %d days ago)", branchName, daysSinceCommit))
+		notes := ""
+		if branch.MergedToMainAt != nil {
+			notes = color.GreenString("  merged %s", formatTimeAgo(*branch.MergedToMainAt))
+			if branch.IsEligibleForCleanup() {
+				notes += color.GreenString(", eligible for cleanup")
 			}
 		}
+		fmt.Printf("  %-*s  %s%s\n", width, name, envs, notes)
 	}
+	fmt.Println()
+}
+
+func displayStaleBranches(meta *metadata.Metadata) {
+	safeToDelete, inactive := splitStaleBranches(meta)
 
-	if len(safeTodelete) > 0 || len(inactive) > 0 {
+	if len(safeToDelete) > 0 || len(inactive) > 0 {
 		color.New(color.Bold).Println("Stale Branches")
 		fmt.Println()
 
-		if len(safeTodelete) > 0 {
+		if len(safeToDelete) > 0 {
 			fmt.Println("Safe to delete (merged to main):")
-			for _, branch := range safeTodelete {
-				fmt.Printf("  ✓ %s\n", branch)
+			for _, stale := range safeToDelete {
+				fmt.Printf("  ✓ %s (merged %d days ago)\n", stale.Branch, stale.DaysSinceMerge)
 			}
 			fmt.Println()
 		}
 
 		if len(inactive) > 0 {
 			fmt.Println("Inactive branches (no recent commits):")
-			for _, branch := range inactive {
-				fmt.Printf("  ? %s\n", branch)
+			for _, stale := range inactive {
+				fmt.Printf("  ? %s (last commit %d days ago)\n", stale.Branch, stale.DaysSinceCommit)
 			}
 			fmt.Println()
 		}
@@ -183,9 +504,153 @@ func displayStaleBranches(meta *metadata.Metadata) {
 	}
 }
 
-func displayJSONStatus(meta *metadata.Metadata) error {
-	// TODO: Implement JSON output
-	return fmt.Errorf("JSON output not yet implemented")
+// environmentStatus is the JSON view of one environment
+type environmentStatus struct {
+	Name          string            `json:"name"`
+	Base          string            `json:"base"`
+	Features      []string          `json:"features"`
+	Contributors  []string          `json:"contributors"`
+	Pins          map[string]string `json:"pins,omitempty"`
+	Skipped       []string          `json:"skipped,omitempty"`
+	Locked        bool              `json:"locked"`
+	LockedBy      string            `json:"locked_by,omitempty"`
+	LockedAt      *time.Time        `json:"locked_at,omitempty"`
+	LockedHost    string            `json:"locked_host,omitempty"`
+	LockedContext string            `json:"locked_context,omitempty"`
+	LastRebuild   *time.Time        `json:"last_rebuild,omitempty"`
+	// Only with --age
+	FeatureAges []featureAge `json:"feature_ages,omitempty"`
+	// Derived from the fields above (and git, unless --no-git-check)
+	StaleLock      bool `json:"stale_lock"`
+	Drifted        bool `json:"drifted"`
+	PendingRebuild bool `json:"pending_rebuild"`
+	Emptied        bool `json:"emptied"`
+}
+
+// featureAge is how long a feature has been in an environment, in seconds,
+// and whether that is longer than --age
+type featureAge struct {
+	Name       string    `json:"name"`
+	PromotedAt time.Time `json:"promoted_at"`
+	Age        int64     `json:"age"`
+	Old        bool      `json:"old"`
+}
+
+// branchStatus is the JSON view of one tracked branch
+type branchStatus struct {
+	Name               string     `json:"name"`
+	PromotedTo         []string   `json:"promoted_to"`
+	MergedToMainAt     *time.Time `json:"merged_to_main_at,omitempty"`
+	EligibleForCleanup bool       `json:"eligible_for_cleanup"`
+}
+
+// statusView is the JSON view printed by status --json
+type statusView struct {
+	Frozen       bool                `json:"frozen"`
+	FrozenBy     string              `json:"frozen_by,omitempty"`
+	FrozenReason string              `json:"frozen_reason,omitempty"`
+	Environments []environmentStatus `json:"environments"`
+	Branches     []branchStatus      `json:"branches"`
+}
+
+func displayJSONStatus(meta *metadata.Metadata, repo *hitchgit.Repo, maxAge time.Duration) error {
+	view := statusView{
+		Frozen:       meta.Frozen,
+		FrozenBy:     meta.FrozenBy,
+		FrozenReason: meta.FrozenReason,
+		Environments: []environmentStatus{},
+		Branches:     []branchStatus{},
+	}
+
+	for _, envName := range meta.EnvironmentNames() {
+		if statusEnv != "" && envName != statusEnv {
+			continue
+		}
+
+		env := meta.Environments[envName]
+		s := environmentStatus{
+			Name:         envName,
+			Base:         env.Base,
+			Features:     sortedFeatures(env),
+			Contributors: meta.Contributors(envName),
+			Pins:         env.Pins,
+			Skipped:      env.Skipped,
+			Locked:       env.Locked,
+			LockedBy:     env.LockedBy,
+		}
+		if env.Locked {
+			lockedAt := env.LockedAt.UTC()
+			s.LockedAt = &lockedAt
+			s.LockedHost = env.LockedHost
+			s.LockedContext = env.LockedContext
+		}
+		if !env.LastRebuild.IsZero() {
+			lastRebuild := env.LastRebuild.UTC()
+			s.LastRebuild = &lastRebuild
+		}
+		if maxAge > 0 {
+			for _, feature := range s.Features {
+				if promoted, ok := promotedAt(meta, feature, envName); ok {
+					s.FeatureAges = append(s.FeatureAges, featureAge{
+						Name:       feature,
+						PromotedAt: promoted.UTC(),
+						Age:        int64(time.Since(promoted).Seconds()),
+						Old:        isOld(meta, feature, envName, maxAge),
+					})
+				}
+			}
+		}
+
+		state := computeEnvironmentState(meta, repo, envName)
+		s.StaleLock = state.StaleLock
+		s.Drifted = state.Drifted
+		s.PendingRebuild = state.PendingRebuild
+		s.Emptied = state.Emptied
+
+		view.Environments = append(view.Environments, s)
+	}
+
+	branchNames := make([]string, 0, len(meta.Branches))
+	for name := range meta.Branches {
+		branchNames = append(branchNames, name)
+	}
+	sort.Strings(branchNames)
+
+	for _, name := range branchNames {
+		branch := meta.Branches[name]
+		b := branchStatus{
+			Name:               name,
+			PromotedTo:         append([]string{}, branch.PromotedTo...),
+			EligibleForCleanup: branch.IsEligibleForCleanup(),
+		}
+		if branch.MergedToMainAt != nil {
+			mergedAt := branch.MergedToMainAt.UTC()
+			b.MergedToMainAt = &mergedAt
+		}
+		view.Branches = append(view.Branches, b)
+	}
+
+	encoder := json.NewEncoder(jsonOut)
+	encoder.SetIndent("", "  ")
+	switch {
+	case statusEnvironmentsOnly:
+		return encoder.Encode(struct {
+			Environments []environmentStatus `json:"environments"`
+		}{view.Environments})
+	case statusBranchesOnly:
+		return encoder.Encode(struct {
+			Branches []branchStatus `json:"branches"`
+		}{view.Branches})
+	}
+	return encoder.Encode(view)
+}
+
+// sortedFeatures returns env's features sorted by name for display. The
+// stored order is left alone because rebuilds merge in that order.
+func sortedFeatures(env metadata.Environment) []string {
+	features := append([]string{}, env.Features...)
+	sort.Strings(features)
+	return features
 }
 
 func formatTimeAgo(t time.Time) string {
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/spf13/cobra"
+)
+
+var allowStaleMetadata bool
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Fetch and fast-forward the hitch-metadata branch",
+	Long: `Fetch the hitch-metadata branch from origin and fast-forward the local copy.
+
+Commands that change metadata refuse to run when the local hitch-metadata
+branch is behind origin, because writing on top of stale metadata would
+diverge from other users' changes. Run this command to catch up.
+
+If the local branch has commits that origin doesn't, they are pushed, but
+only if origin hasn't moved since the fetch. If the branches have diverged,
+nothing is changed and you'll be told how to reconcile them.`,
+	Args: cobra.NoArgs,
+	RunE: runSync,
+}
+
+func init() {
+	rootCmd.PersistentFlags().BoolVar(&allowStaleMetadata, "allow-stale-metadata", false, "Write metadata even if hitch-metadata is behind origin")
+	rootCmd.AddCommand(syncCmd)
+}
+
+func runSync(cmd *cobra.Command, args []string) error {
+	// 1. Open Git repository
+	repo, err := openRepo()
+	if err != nil {
+		errorMsg("Not a Git repository")
+		return err
+	}
+
+	if isOffline() {
+		errorMsg("Cannot sync in offline mode")
+		return fmt.Errorf("offline")
+	}
+
+	if !repo.RemoteExists("origin") {
+		errorMsg("No origin remote configured; nothing to sync with")
+		return fmt.Errorf("no origin remote")
+	}
+
+	// 2. Fetch remote metadata
+	if err := repo.Fetch("origin", metadata.MetadataBranch); err != nil {
+		errorMsg(fmt.Sprintf("Failed to fetch %s from origin", metadata.MetadataBranch))
+		return err
+	}
+
+	remoteRef := "origin/" + metadata.MetadataBranch
+	lease := repo.RemoteTrackingSHA("origin", metadata.MetadataBranch)
+
+	// 3. Create the local branch if this is a fresh clone
+	reader := metadata.NewReader(repo.Repository)
+	if !reader.Exists() {
+		if err := repo.CreateBranch(metadata.MetadataBranch, remoteRef); err != nil {
+			errorMsg(fmt.Sprintf("Failed to create local %s", metadata.MetadataBranch))
+			return err
+		}
+		success(fmt.Sprintf("Created local %s from %s", metadata.MetadataBranch, remoteRef))
+		return nil
+	}
+
+	// 4. Compare and fast-forward
+	warnIfShallow(repo)
+	ahead, behind, err := repo.AheadBehind(metadata.MetadataBranch, remoteRef)
+	if err != nil {
+		errorMsg("Failed to compare local and remote metadata")
+		return err
+	}
+
+	switch {
+	case ahead == 0 && behind == 0:
+		success("Metadata is up to date")
+	case ahead == 0:
+		if err := repo.FastForwardBranch(metadata.MetadataBranch, remoteRef); err != nil {
+			errorMsg("Failed to fast-forward metadata")
+			return err
+		}
+		success(fmt.Sprintf("Fast-forwarded %s by %d commit(s)", metadata.MetadataBranch, behind))
+	case behind == 0:
+		if err := pushMetadata(repo, lease); err != nil {
+			return err
+		}
+		success(fmt.Sprintf("Pushed %d local %s commit(s) to origin", ahead, metadata.MetadataBranch))
+	default:
+		errorMsg(fmt.Sprintf("Local %s has diverged from origin (%d ahead, %d behind)", metadata.MetadataBranch, ahead, behind))
+		fmt.Println("\nReconcile manually, for example:")
+		fmt.Printf("  git checkout %s\n", metadata.MetadataBranch)
+		fmt.Printf("  git rebase %s   # resolve hitch.json conflicts\n", remoteRef)
+		fmt.Printf("  git push origin %s\n", metadata.MetadataBranch)
+		return fmt.Errorf("metadata diverged")
+	}
+
+	return nil
+}
+
+// pushMetadata publishes hitch-metadata to origin with a lease on expected,
+// the origin hash recorded when the metadata was read. If someone else pushed
+// in the meantime the push is refused instead of clobbering their changes.
+func pushMetadata(repo *hitchgit.Repo, expected string) error {
+	err := repo.PushWithLease("origin", metadata.MetadataBranch, expected)
+	if err == nil {
+		return nil
+	}
+
+	var leaseErr *hitchgit.LeaseRejectedError
+	if errors.As(err, &leaseErr) {
+		errorMsg(fmt.Sprintf("Someone else pushed %s since it was read", metadata.MetadataBranch))
+		fmt.Println("\nRun 'hitch sync' to pick up their changes, then retry.")
+	} else {
+		errorMsg(fmt.Sprintf("Failed to push %s to origin", metadata.MetadataBranch))
+	}
+	return err
+}
+
+// checkMetadataNotBehind fetches hitch-metadata and refuses to continue if the
+// local branch is behind origin. It is skipped in offline mode or with
+// --allow-stale-metadata, when there is no origin remote, and when the
+// remote can't be reached
+func checkMetadataNotBehind(repo *hitchgit.Repo) error {
+	if isOffline() || allowStaleMetadata || !repo.RemoteExists("origin") {
+		return nil
+	}
+
+	if err := repo.Fetch("origin", metadata.MetadataBranch); err != nil {
+		if verbose {
+			warning(fmt.Sprintf("Could not fetch %s to check for newer metadata: %v", metadata.MetadataBranch, err))
+		}
+		return nil
+	}
+
+	_, behind, err := repo.AheadBehind(metadata.MetadataBranch, "origin/"+metadata.MetadataBranch)
+	if err != nil {
+		return nil
+	}
+
+	if behind > 0 {
+		staleErr := &metadata.StaleMetadataError{Behind: behind}
+		errorMsg(staleErr.Error())
+		fmt.Println("\nTo proceed anyway, pass --allow-stale-metadata")
+		return staleErr
+	}
+
+	return nil
+}
+
+// metadataOnlyOnRemote reports whether origin/hitch-metadata was fetched but
+// there is no local hitch-metadata branch, as on a fresh clone
+func metadataOnlyOnRemote(repo *hitchgit.Repo) bool {
+	return repo.RemoteTrackingSHA("origin", metadata.MetadataBranch) != "" &&
+		!metadata.NewReader(repo.Repository).Exists()
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/DoomedRamen/hitch/internal/logging"
+)
+
+// timingPrecision is what --timings rounds durations to
+const timingPrecision = 100 * time.Microsecond
+
+// printTimings writes the phases recorded during a command and how long the
+// whole command took. Time not spent in any phase is shown as "other", so
+// the rows add up to the total.
+func printTimings(w io.Writer, total time.Duration) {
+	phases := logging.Phases()
+
+	width := len("other")
+	var timed time.Duration
+	for _, phase := range phases {
+		width = max(width, len(phase.Name))
+		timed += phase.Duration
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Timings:")
+	for _, phase := range phases {
+		fmt.Fprintf(w, "  %-*s  %s\n", width, phase.Name, phase.Duration.Round(timingPrecision))
+	}
+	fmt.Fprintf(w, "  %-*s  %s\n", width, "other", max(total-timed, 0).Round(timingPrecision))
+	fmt.Fprintf(w, "  %-*s  %s\n", width, "total", total.Round(timingPrecision))
+}
@@ -2,25 +2,31 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
-	hitchgit "github.com/DoomedRamen/hitch/internal/git"
 	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/DoomedRamen/hitch/internal/notify"
 	"github.com/spf13/cobra"
 )
 
 var unlockForce bool
 
 var unlockCmd = &cobra.Command{
-	Use:   "unlock <environment>",
-	Short: "Unlock an environment",
-	Long: `Unlock an environment to allow modifications.
+	Use:   "unlock <environment>...",
+	Short: "Unlock environments",
+	Long: `Unlock one or more environments to allow modifications.
 
 By default, you can only unlock environments that you locked yourself.
 Use --force to unlock environments locked by others (requires admin).
 
+Several environments are unlocked all-or-nothing, in a single metadata
+commit: if any of them can't be unlocked, none are. Environments that
+aren't locked are skipped with a warning.
+
 Example:
-  hitch unlock dev`,
-	Args: cobra.ExactArgs(1),
+  hitch unlock dev
+  hitch unlock dev qa staging`,
+	Args: cobra.MinimumNArgs(1),
 	RunE: runUnlock,
 }
 
@@ -30,10 +36,8 @@ func init() {
 }
 
 func runUnlock(cmd *cobra.Command, args []string) error {
-	envName := args[0]
-
 	// 1. Open Git repository
-	repo, err := hitchgit.OpenRepo(".")
+	repo, err := openRepo()
 	if err != nil {
 		errorMsg("Not a Git repository")
 		return err
@@ -45,9 +49,7 @@ func runUnlock(cmd *cobra.Command, args []string) error {
 		errorMsg("Failed to get current branch")
 		return err
 	}
-	defer func() {
-		_ = repo.Checkout(currentBranch)
-	}()
+	defer restoreBranch(repo, currentBranch)
 
 	// 3. Read metadata
 	reader := metadata.NewReader(repo.Repository)
@@ -63,6 +65,16 @@ func runUnlock(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	envNames := resolveEnvironments(meta, args)
+
+	if err := checkMetadataNotBehind(repo); err != nil {
+		return err
+	}
+
+	if err := checkNotFrozen(meta); err != nil {
+		return err
+	}
+
 	// 4. Get user info
 	userEmail, err := repo.UserEmail()
 	if err != nil {
@@ -75,43 +87,104 @@ func runUnlock(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	// 5. Check if environment exists
+	// 5. Unlock every environment, or none of them
+	var unlocked []string
+	var unlockErr error
+	for _, envName := range envNames {
+		wasLocked, err := unlockEnvironment(meta, envName, userEmail)
+		if err != nil {
+			if unlockErr == nil {
+				unlockErr = err
+			}
+			continue
+		}
+		if wasLocked {
+			unlocked = append(unlocked, envName)
+		}
+	}
+
+	if unlockErr != nil {
+		if len(unlocked) > 0 {
+			warning(fmt.Sprintf("Kept %s locked: environments are unlocked all-or-nothing", strings.Join(unlocked, ", ")))
+		}
+		return unlockErr
+	}
+	if len(unlocked) == 0 {
+		return nil
+	}
+
+	// 6. Update metadata
+	meta.UpdateMeta(userEmail, fmt.Sprintf("hitch unlock %s", strings.Join(unlocked, " ")))
+
+	message := fmt.Sprintf("Unlock %s environment", unlocked[0])
+	if len(unlocked) > 1 {
+		message = fmt.Sprintf("Unlock %s environments", strings.Join(unlocked, ", "))
+	}
+
+	writer := metadata.NewWriter(repo.Repository)
+	if err := writer.Write(meta, message, userName, userEmail); err != nil {
+		errorMsg("Failed to update metadata")
+		return err
+	}
+
+	for _, envName := range unlocked {
+		success(fmt.Sprintf("Unlocked %s environment", envName))
+		sendNotification(meta, notify.Event{
+			Event:       notify.EventUnlock,
+			Environment: envName,
+			User:        userEmail,
+			Message:     fmt.Sprintf("%s unlocked %s", userEmail, envName),
+		})
+	}
+
+	return nil
+}
+
+// unlockEnvironment unlocks envName in meta if user may, reporting whether
+// it was locked at all
+func unlockEnvironment(meta *metadata.Metadata, envName string, user string) (bool, error) {
+	// Check if environment exists
 	env, exists := meta.Environments[envName]
 	if !exists {
 		errorMsg(fmt.Sprintf("Environment '%s' not found", envName))
-		return fmt.Errorf("environment not found")
+		return false, fmt.Errorf("environment not found")
 	}
 
-	// 6. Check if locked
+	// Check if locked
 	if !env.Locked {
 		warning(fmt.Sprintf("Environment '%s' is not locked", envName))
-		return nil
+		return false, nil
 	}
 
-	// 7. Check permissions
-	if env.LockedBy != userEmail && !unlockForce {
+	// Check permissions
+	if env.LockedBy != user && !unlockForce {
 		errorMsg(fmt.Sprintf("Environment '%s' is locked by %s", envName, env.LockedBy))
 		fmt.Println("You can only unlock environments you locked yourself.")
 		fmt.Println("Use --force to override (admin only)")
-		return fmt.Errorf("permission denied")
+		return false, fmt.Errorf("permission denied")
+	}
+	if env.LockedBy != user {
+		if err := checkAdmin(meta, user, fmt.Sprintf("unlock %s, locked by %s", envName, env.LockedBy)); err != nil {
+			return false, err
+		}
 	}
 
-	// 8. Unlock environment
 	if err := meta.UnlockEnvironment(envName); err != nil {
-		errorMsg(fmt.Sprintf("Failed to unlock environment: %v", err))
-		return err
+		errorMsg(fmt.Sprintf("Failed to unlock %s: %v", envName, err))
+		return false, err
 	}
 
-	// 9. Update metadata
-	meta.UpdateMeta(userEmail, fmt.Sprintf("hitch unlock %s", envName))
+	return true, nil
+}
 
-	writer := metadata.NewWriter(repo.Repository)
-	if err := writer.Write(meta, userName, userEmail, fmt.Sprintf("Unlock %s environment", envName)); err != nil {
-		errorMsg("Failed to update metadata")
-		return err
+// checkAdmin refuses action unless user is in config.admins, when any are
+// configured
+func checkAdmin(meta *metadata.Metadata, user string, action string) error {
+	if meta.IsAdmin(user) {
+		return nil
 	}
 
-	success(fmt.Sprintf("Unlocked %s environment", envName))
-
-	return nil
+	errorMsg(fmt.Sprintf("Only admins can %s", action))
+	fmt.Printf("\n%s is not in config.admins. Ask one of them: %s\n", user, strings.Join(meta.Config.Admins, ", "))
+	return &metadata.PermissionError{User: user, Action: action}
 }
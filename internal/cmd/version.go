@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+
+	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/DoomedRamen/hitch/internal/version"
+	"github.com/spf13/cobra"
+)
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Show Hitch version and build information",
+	Long: `Show Hitch version and build information.
+
+Includes the commit and date the binary was built from, the Go toolchain,
+the detected git CLI version, and the hitch.json schema version this build
+reads and writes. Please include this output in bug reports.`,
+	Args: cobra.NoArgs,
+	RunE: runVersion,
+}
+
+func init() {
+	rootCmd.AddCommand(versionCmd)
+}
+
+func runVersion(cmd *cobra.Command, args []string) error {
+	out := cmd.OutOrStdout()
+	build := version.Get()
+
+	commit := build.Commit
+	if commit == "" {
+		commit = "unknown"
+	}
+	date := build.Date
+	if date == "" {
+		date = "unknown"
+	}
+
+	gitVersion, err := hitchgit.CLIVersion()
+	if err != nil {
+		gitVersion = "not found"
+	}
+
+	fmt.Fprintf(out, "Hitch %s\n", build.Version)
+	fmt.Fprintf(out, "Build: %s\n", commit)
+	fmt.Fprintf(out, "Built at: %s\n", date)
+	fmt.Fprintf(out, "Go version: %s\n", build.GoVersion)
+	fmt.Fprintf(out, "OS/Arch: %s\n", build.Platform)
+	fmt.Fprintf(out, "Git version: %s\n", gitVersion)
+	fmt.Fprintf(out, "Metadata schema: %s\n", metadata.SchemaVersion)
+
+	return nil
+}
@@ -0,0 +1,43 @@
+//go:build dockertest
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/DoomedRamen/hitch/internal/version"
+)
+
+func TestVersionCommand(t *testing.T) {
+	original := version.Version
+	version.Version = "1.2.3-test"
+	t.Cleanup(func() { version.Version = original })
+
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	rootCmd.SetArgs([]string{"version"})
+	t.Cleanup(func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetArgs(nil)
+	})
+
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("version command failed: %v", err)
+	}
+
+	output := out.String()
+	if !strings.Contains(output, "Hitch 1.2.3-test") {
+		t.Errorf("Expected configured version in output, got:\n%s", output)
+	}
+
+	if !strings.Contains(output, "Metadata schema: "+metadata.SchemaVersion) {
+		t.Errorf("Expected metadata schema version in output, got:\n%s", output)
+	}
+
+	if !strings.Contains(output, "Go version: go") {
+		t.Errorf("Expected Go version in output, got:\n%s", output)
+	}
+}
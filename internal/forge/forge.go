@@ -0,0 +1,61 @@
+// Package forge lets commands update the code host's pull requests without
+// knowing which host the project is on.
+package forge
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/DoomedRamen/hitch/internal/metadata"
+)
+
+// ErrNoPullRequest is returned when a branch has no open pull request
+var ErrNoPullRequest = errors.New("no open pull request")
+
+// Forge is a code host whose pull requests hitch updates on release
+type Forge interface {
+	// Name describes the host's pull requests in messages, e.g.
+	// "GitLab merge request"
+	Name() string
+	// CommentOnPR comments on branch's open pull request
+	CommentOnPR(branch string, body string) error
+	// ClosePR closes branch's open pull request
+	ClosePR(branch string) error
+	// CheckAccess makes a lightweight API call to confirm the token works
+	CheckAccess() error
+}
+
+// MissingTokenError is returned when a forge is configured but the
+// environment variable holding its API token is not set
+type MissingTokenError struct {
+	Name string
+	Env  string
+}
+
+func (e *MissingTokenError) Error() string {
+	return fmt.Sprintf("%s integration is configured but %s is not set", e.Name, e.Env)
+}
+
+// New returns the forge configured in cfg, or nil if none is. GitLab is the
+// only provider so far; others are added here as they get a config block.
+func New(cfg metadata.Config) (Forge, error) {
+	switch {
+	case cfg.GitLab != nil:
+		return newGitLab(cfg.GitLab)
+	default:
+		return nil, nil
+	}
+}
+
+// token reads an API token from env, or fallback if env is empty
+func token(name string, env string, fallback string) (string, error) {
+	if env == "" {
+		env = fallback
+	}
+	value := os.Getenv(env)
+	if value == "" {
+		return "", &MissingTokenError{Name: name, Env: env}
+	}
+	return value, nil
+}
@@ -0,0 +1,35 @@
+//go:build dockertest
+
+package forge_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DoomedRamen/hitch/internal/forge"
+	"github.com/DoomedRamen/hitch/internal/metadata"
+)
+
+func TestNewSelectsProvider(t *testing.T) {
+	f, err := forge.New(metadata.Config{})
+	if f != nil || err != nil {
+		t.Errorf("Expected no forge without config, got %v, %v", f, err)
+	}
+
+	cfg := metadata.Config{GitLab: &metadata.GitLabConfig{ProjectID: "group/app", TokenEnv: "HITCH_TEST_GITLAB_TOKEN"}}
+
+	t.Setenv("HITCH_TEST_GITLAB_TOKEN", "")
+	var missing *forge.MissingTokenError
+	if _, err := forge.New(cfg); !errors.As(err, &missing) || missing.Env != "HITCH_TEST_GITLAB_TOKEN" {
+		t.Errorf("Expected a MissingTokenError for HITCH_TEST_GITLAB_TOKEN, got %v", err)
+	}
+
+	t.Setenv("HITCH_TEST_GITLAB_TOKEN", "secret")
+	f, err = forge.New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if f.Name() != "GitLab merge request" {
+		t.Errorf("Expected the GitLab forge, got %q", f.Name())
+	}
+}
@@ -0,0 +1,67 @@
+package forge
+
+import (
+	"errors"
+
+	"github.com/DoomedRamen/hitch/internal/gitlab"
+	"github.com/DoomedRamen/hitch/internal/metadata"
+)
+
+// gitLab adapts the GitLab client to Forge, where pull requests are merge
+// requests looked up by source branch
+type gitLab struct {
+	client *gitlab.Client
+	iids   map[string]int
+}
+
+func newGitLab(cfg *metadata.GitLabConfig) (Forge, error) {
+	tok, err := token("GitLab", cfg.TokenEnv, gitlab.DefaultTokenEnv)
+	if err != nil {
+		return nil, err
+	}
+	return &gitLab{
+		client: gitlab.NewClient(cfg.BaseURL, cfg.ProjectID, tok),
+		iids:   make(map[string]int),
+	}, nil
+}
+
+func (g *gitLab) Name() string {
+	return "GitLab merge request"
+}
+
+func (g *gitLab) CommentOnPR(branch string, body string) error {
+	iid, err := g.mergeRequest(branch)
+	if err != nil {
+		return err
+	}
+	return g.client.Comment(iid, body)
+}
+
+func (g *gitLab) ClosePR(branch string) error {
+	iid, err := g.mergeRequest(branch)
+	if err != nil {
+		return err
+	}
+	return g.client.Close(iid)
+}
+
+func (g *gitLab) CheckAccess() error {
+	return g.client.CheckAccess()
+}
+
+// mergeRequest finds branch's open merge request, remembering it so a
+// comment followed by a close looks it up once
+func (g *gitLab) mergeRequest(branch string) (int, error) {
+	if iid, ok := g.iids[branch]; ok {
+		return iid, nil
+	}
+	iid, _, err := g.client.OpenMergeRequest(branch)
+	if errors.Is(err, gitlab.ErrNoMergeRequest) {
+		return 0, ErrNoPullRequest
+	}
+	if err != nil {
+		return 0, err
+	}
+	g.iids[branch] = iid
+	return iid, nil
+}
@@ -1,35 +1,62 @@
 package git
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/DoomedRamen/hitch/internal/logging"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/filesystem"
 )
 
 // Repo wraps a git repository with helpful methods
 type Repo struct {
 	*git.Repository
 	workdir string
+	bare    bool
+
+	// Set by SetAuthor to attribute commits to someone other than the
+	// configured git user
+	authorName  string
+	authorEmail string
 }
 
-// OpenRepo opens a git repository in the current or specified directory
+// OpenRepo opens the git repository containing the current or specified
+// directory, searching parent directories like git does
 func OpenRepo(path string) (*Repo, error) {
 	if path == "" {
 		path = "."
 	}
 
-	repo, err := git.PlainOpen(path)
+	repo, err := git.PlainOpenWithOptions(path, &git.PlainOpenOptions{DetectDotGit: true})
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		// Dot-git detection only finds a .git directory; path may be the
+		// repository itself if it's bare
+		repo, err = git.PlainOpen(path)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("not a git repository (or any parent): %w", err)
 	}
 
-	// Get the worktree path from go-git
+	// Shelled-out git commands run in the worktree root, not path, so they
+	// act on the same files as go-git whatever subdirectory hitch started in.
+	// A bare repository has no worktree; they run in the repository itself.
 	worktree, err := repo.Worktree()
+	if errors.Is(err, git.ErrIsBareRepository) {
+		storage, ok := repo.Storer.(*filesystem.Storage)
+		if !ok {
+			return nil, fmt.Errorf("bare repository at %s is not on disk", path)
+		}
+		return &Repo{Repository: repo, workdir: storage.Filesystem().Root(), bare: true}, nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get worktree: %w", err)
 	}
@@ -40,6 +67,195 @@ func OpenRepo(path string) (*Repo, error) {
 	}, nil
 }
 
+// CloneLocal clones the repository at src into dst, which must not exist yet,
+// for work that must not touch src. Every local branch of src is a local
+// branch of the clone, the clone's origin is src's origin (it has none if src
+// has none), and src's user name and email are copied so commits made in the
+// clone are attributed the same way. src's merge drivers are copied too, so
+// merges in the clone resolve files as they would in src.
+func CloneLocal(src string, dst string) (*Repo, error) {
+	source, err := OpenRepo(src)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"clone", "--quiet"}
+	if cfg, err := source.Config(); err == nil {
+		if cfg.User.Name != "" {
+			args = append(args, "-c", "user.name="+cfg.User.Name)
+		}
+		if cfg.User.Email != "" {
+			args = append(args, "-c", "user.email="+cfg.User.Email)
+		}
+	}
+	args = append(args, source.Root(), dst)
+
+	if output, err := source.runGit(args...); err != nil {
+		return nil, fmt.Errorf("failed to clone %s: %s", source.Root(), string(output))
+	}
+
+	clone, err := OpenRepo(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	// A plain clone only has src's HEAD branch locally
+	if output, err := clone.runGit("fetch", "--quiet", "--update-head-ok", "origin", "+refs/heads/*:refs/heads/*"); err != nil {
+		return nil, fmt.Errorf("failed to copy branches into clone: %s", string(output))
+	}
+
+	if url := source.remoteURL("origin"); url != "" {
+		_, err = clone.runGit("remote", "set-url", "origin", url)
+	} else {
+		_, err = clone.runGit("remote", "remove", "origin")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up clone's origin: %w", err)
+	}
+
+	if err := copyMergeDrivers(source, clone); err != nil {
+		return nil, err
+	}
+
+	return clone, nil
+}
+
+// copyMergeDrivers copies src's merge.* config, where the custom merge
+// drivers named in .gitattributes are defined, and its info/attributes,
+// neither of which git clone copies
+func copyMergeDrivers(src *Repo, clone *Repo) error {
+	// Exits non-zero when nothing matches
+	output, _ := src.runGit("config", "--local", "-z", "--get-regexp", `^merge\.`)
+	for _, entry := range strings.Split(string(output), "\x00") {
+		key, value, ok := strings.Cut(entry, "\n")
+		if !ok {
+			continue
+		}
+		if out, err := clone.runGit("config", "--add", key, value); err != nil {
+			return fmt.Errorf("failed to copy %s into clone: %s", key, string(out))
+		}
+	}
+
+	srcDir, err := src.GitDir()
+	if err != nil {
+		return err
+	}
+	attributes, err := os.ReadFile(filepath.Join(srcDir, "info", "attributes"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read info/attributes: %w", err)
+	}
+
+	cloneDir, err := clone.GitDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(cloneDir, "info"), 0755); err != nil {
+		return fmt.Errorf("failed to copy info/attributes into clone: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(cloneDir, "info", "attributes"), attributes, 0644); err != nil {
+		return fmt.Errorf("failed to copy info/attributes into clone: %w", err)
+	}
+	return nil
+}
+
+// remoteURL returns the first URL of remote name, made absolute if it is a
+// relative path, or "" if there is no such remote
+func (r *Repo) remoteURL(name string) string {
+	remote, err := r.Remote(name)
+	if err != nil || len(remote.Config().URLs) == 0 {
+		return ""
+	}
+
+	url := remote.Config().URLs[0]
+	if !strings.Contains(url, ":") && !filepath.IsAbs(url) {
+		url = filepath.Join(r.workdir, url)
+	}
+	return url
+}
+
+// Root returns the absolute path of the repository's working tree, or of
+// the repository itself if it is bare
+func (r *Repo) Root() string {
+	return r.workdir
+}
+
+// IsBare reports whether the repository has no working tree, as on a git
+// server. Anything that checks out or merges needs a clone of it.
+func (r *Repo) IsBare() bool {
+	return r.bare
+}
+
+// runGit runs a git command in the repository root and returns its combined
+// output. Every shelled-out command goes through here so --verbose can log it.
+func (r *Repo) runGit(args ...string) ([]byte, error) {
+	start := time.Now()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.workdir
+	if env := r.authorEnv(); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		logging.Debugf("git %s (%s, failed: %v)", strings.Join(args, " "), time.Since(start).Round(time.Millisecond), err)
+	} else {
+		logging.Debugf("git %s (%s)", strings.Join(args, " "), time.Since(start).Round(time.Millisecond))
+	}
+
+	return output, err
+}
+
+// CLIVersion returns the version reported by the git executable on PATH
+// (e.g. "2.43.0"), which hitch shells out to for merges and pushes
+func CLIVersion() (string, error) {
+	output, err := exec.Command("git", "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run git --version: %w", err)
+	}
+	return strings.TrimPrefix(strings.TrimSpace(string(output)), "git version "), nil
+}
+
+// ValidBranchName checks that name is a legal branch name, following the
+// rules of `git check-ref-format --branch` without shelling out
+func ValidBranchName(name string) error {
+	if name == "" {
+		return fmt.Errorf("branch name cannot be empty")
+	}
+
+	if name == "@" || name == "HEAD" {
+		return fmt.Errorf("%q is reserved by git", name)
+	}
+
+	if strings.HasPrefix(name, "-") {
+		return fmt.Errorf("%q cannot start with '-'", name)
+	}
+
+	if strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".") || strings.HasSuffix(name, ".lock") {
+		return fmt.Errorf("%q cannot end with '/', '.' or '.lock'", name)
+	}
+
+	if strings.Contains(name, "..") || strings.Contains(name, "//") || strings.Contains(name, "@{") {
+		return fmt.Errorf("%q cannot contain '..', '//' or '@{'", name)
+	}
+
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return fmt.Errorf("%q contains invalid character %q", name, c)
+		}
+	}
+
+	for _, component := range strings.Split(name, "/") {
+		if strings.HasPrefix(component, ".") {
+			return fmt.Errorf("%q has a path component starting with '.'", name)
+		}
+	}
+
+	return nil
+}
+
 // CurrentBranch returns the name of the current branch
 func (r *Repo) CurrentBranch() (string, error) {
 	head, err := r.Head()
@@ -72,6 +288,14 @@ func (r *Repo) CurrentCommitSHA() (string, error) {
 	return head.Hash().String(), nil
 }
 
+// HasCommits reports whether HEAD points at a commit. It doesn't in a
+// freshly initialized repository, or on an orphan branch before its first
+// commit.
+func (r *Repo) HasCommits() bool {
+	_, err := r.Head()
+	return err == nil
+}
+
 // BranchExists checks if a branch exists (local or remote)
 func (r *Repo) BranchExists(name string) bool {
 	// Check local
@@ -85,8 +309,12 @@ func (r *Repo) BranchExists(name string) bool {
 	return err == nil
 }
 
-// UserName returns the configured git user name
+// UserName returns the author set by SetAuthor, or the configured git user name
 func (r *Repo) UserName() (string, error) {
+	if r.authorName != "" {
+		return r.authorName, nil
+	}
+
 	cfg, err := r.Config()
 	if err != nil {
 		return "", fmt.Errorf("failed to get git config: %w", err)
@@ -95,13 +323,47 @@ func (r *Repo) UserName() (string, error) {
 	if cfg.User.Name != "" {
 		return cfg.User.Name, nil
 	}
+	if name := r.configValue("user.name"); name != "" {
+		return name, nil
+	}
 
 	// Fallback to system username
 	return os.Getenv("USER"), nil
 }
 
-// UserEmail returns the configured git user email
+// SetAuthor overrides the identity hitch works as: UserName and UserEmail
+// return it, and commits made by git commands (such as merges) are authored
+// by it. Empty values keep the configured git user. The committer is still
+// the configured git user.
+func (r *Repo) SetAuthor(name string, email string) {
+	r.authorName = name
+	r.authorEmail = email
+}
+
+// Author returns the identity set by SetAuthor
+func (r *Repo) Author() (name string, email string) {
+	return r.authorName, r.authorEmail
+}
+
+// authorEnv returns the environment that makes git author commits as the
+// identity set by SetAuthor
+func (r *Repo) authorEnv() []string {
+	var env []string
+	if r.authorName != "" {
+		env = append(env, "GIT_AUTHOR_NAME="+r.authorName)
+	}
+	if r.authorEmail != "" {
+		env = append(env, "GIT_AUTHOR_EMAIL="+r.authorEmail)
+	}
+	return env
+}
+
+// UserEmail returns the author set by SetAuthor, or the configured git user email
 func (r *Repo) UserEmail() (string, error) {
+	if r.authorEmail != "" {
+		return r.authorEmail, nil
+	}
+
 	cfg, err := r.Config()
 	if err != nil {
 		return "", fmt.Errorf("failed to get git config: %w", err)
@@ -110,17 +372,50 @@ func (r *Repo) UserEmail() (string, error) {
 	if cfg.User.Email != "" {
 		return cfg.User.Email, nil
 	}
+	if email := r.configValue("user.email"); email != "" {
+		return email, nil
+	}
 
 	return "", fmt.Errorf("git user.email not configured")
 }
 
+// configValue returns key as git itself resolves it, or "" if it is unset.
+// Unlike go-git's repository config, this sees global and system config and
+// follows include and includeIf, which per-directory identities rely on.
+func (r *Repo) configValue(key string) string {
+	output, err := r.runGit("config", "--get", key)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// SetUser writes user.name and user.email to the repository's git config.
+// An empty value leaves that setting as it is.
+func (r *Repo) SetUser(name string, email string) error {
+	cfg, err := r.Config()
+	if err != nil {
+		return fmt.Errorf("failed to get git config: %w", err)
+	}
+
+	if name != "" {
+		cfg.User.Name = name
+	}
+	if email != "" {
+		cfg.User.Email = email
+	}
+
+	if err := r.SetConfig(cfg); err != nil {
+		return fmt.Errorf("failed to write git config: %w", err)
+	}
+	return nil
+}
+
 // HasUncommittedChanges checks if a branch has uncommitted changes
 // Note: This requires executing git commands as go-git doesn't support this well
 func (r *Repo) HasUncommittedChanges(branch string) (bool, error) {
 	// Use git command for this
-	cmd := exec.Command("git", "diff", "--quiet", branch)
-	cmd.Dir = r.workdir
-	err := cmd.Run()
+	_, err := r.runGit("diff", "--quiet", branch)
 
 	if err != nil {
 		// Non-zero exit code means there are changes
@@ -131,9 +426,7 @@ func (r *Repo) HasUncommittedChanges(branch string) (bool, error) {
 	}
 
 	// Also check staged changes
-	cmd = exec.Command("git", "diff", "--cached", "--quiet", branch)
-	cmd.Dir = r.workdir
-	err = cmd.Run()
+	_, err = r.runGit("diff", "--cached", "--quiet", branch)
 
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
@@ -145,28 +438,75 @@ func (r *Repo) HasUncommittedChanges(branch string) (bool, error) {
 	return false, nil
 }
 
-// Checkout checks out a branch or commit
+// Checkout checks out a branch or commit. It refuses to overwrite
+// uncommitted changes; see CheckoutForce.
 func (r *Repo) Checkout(ref string) error {
+	return r.checkout(ref, false)
+}
+
+// CheckoutForce checks out a branch or commit, discarding uncommitted
+// changes and any conflicted merge state in the worktree. Use it only where
+// that state is known to be disposable, such as a failed rebuild's temp
+// branch.
+func (r *Repo) CheckoutForce(ref string) error {
+	if err := r.checkout(ref, true); err != nil {
+		return err
+	}
+
+	// go-git leaves a CLI merge's state behind, which would make the next
+	// commit a merge commit
+	gitDir, err := r.GitDir()
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"MERGE_HEAD", "MERGE_MSG", "MERGE_MODE"} {
+		if err := os.Remove(filepath.Join(gitDir, name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to clear merge state: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *Repo) checkout(ref string, force bool) error {
+	defer logging.Timer("checkout " + ref + " (go-git)")()
+	defer logging.StartPhase("checkout " + ref)()
+
 	worktree, err := r.Worktree()
 	if err != nil {
 		return fmt.Errorf("failed to get worktree: %w", err)
 	}
 
+	// go-git moves HEAD before updating the worktree and leaves it moved if
+	// the update fails, e.g. on uncommitted changes, so a failed checkout
+	// puts HEAD back without touching the index or worktree
+	head, err := r.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return fmt.Errorf("failed to read HEAD: %w", err)
+	}
+	restoreHead := func() {
+		if err := r.Storer.SetReference(head); err != nil {
+			logging.Debugf("failed to restore HEAD (%s): %v", head, err)
+		}
+	}
+
 	// Try as branch first
 	branchRef := plumbing.NewBranchReferenceName(ref)
 	err = worktree.Checkout(&git.CheckoutOptions{
 		Branch: branchRef,
-		Force:  false,
+		Force:  force,
 	})
 
 	if err != nil {
+		restoreHead()
+
 		// Try as commit hash
 		hash := plumbing.NewHash(ref)
 		err = worktree.Checkout(&git.CheckoutOptions{
 			Hash:  hash,
-			Force: false,
+			Force: force,
 		})
 		if err != nil {
+			restoreHead()
 			return fmt.Errorf("failed to checkout %s: %w", ref, err)
 		}
 	}
@@ -174,8 +514,17 @@ func (r *Repo) Checkout(ref string) error {
 	return nil
 }
 
+// RemoteExists reports whether a remote with the given name is configured
+func (r *Repo) RemoteExists(name string) bool {
+	_, err := r.Remote(name)
+	return err == nil
+}
+
 // Pull pulls changes from remote
 func (r *Repo) Pull(remoteName string, branchName string) error {
+	defer logging.Timer(fmt.Sprintf("pull %s %s (go-git)", remoteName, branchName))()
+	defer logging.StartPhase("pull " + branchName)()
+
 	worktree, err := r.Worktree()
 	if err != nil {
 		return fmt.Errorf("failed to get worktree: %w", err)
@@ -201,6 +550,9 @@ func (r *Repo) Pull(remoteName string, branchName string) error {
 // Push pushes changes to remote
 // Uses force-with-lease for safety
 func (r *Repo) Push(remoteName string, branchName string, force bool) error {
+	defer logging.Timer(fmt.Sprintf("push %s %s force=%t (go-git)", remoteName, branchName, force))()
+	defer logging.StartPhase("push " + branchName)()
+
 	refSpec := config.RefSpec(fmt.Sprintf("refs/heads/%s:refs/heads/%s", branchName, branchName))
 
 	pushOptions := &git.PushOptions{
@@ -220,22 +572,244 @@ func (r *Repo) Push(remoteName string, branchName string, force bool) error {
 	}
 
 	if err != nil {
+		if rejected := ClassifyPushRejection(remoteName, branchName, err.Error()); rejected != nil {
+			return rejected
+		}
 		return fmt.Errorf("failed to push: %w", err)
 	}
 
 	return nil
 }
 
+// PushWithLease pushes branchName to remote only if the remote branch is
+// still at expected, the hash it had when it was last read. An empty expected
+// means the remote branch must not exist yet. If someone else moved the remote
+// branch in the meantime the push is refused with *LeaseRejectedError rather
+// than overwriting their work.
+// Note: This uses git command as go-git doesn't support --force-with-lease
+func (r *Repo) PushWithLease(remoteName string, branchName string, expected string) error {
+	defer logging.StartPhase("push " + branchName)()
+
+	ref := "refs/heads/" + branchName
+	output, err := r.runGit("push", fmt.Sprintf("--force-with-lease=%s:%s", ref, expected), remoteName, ref+":"+ref)
+	if err != nil {
+		if strings.Contains(string(output), "stale info") {
+			return &LeaseRejectedError{Remote: remoteName, Branch: branchName}
+		}
+		if rejected := ClassifyPushRejection(remoteName, branchName, string(output)); rejected != nil {
+			return rejected
+		}
+		return fmt.Errorf("failed to push %s to %s: %s", branchName, remoteName, string(output))
+	}
+	return nil
+}
+
+// RemoteTrackingSHA returns the hash of remoteName/branchName as of the last
+// fetch, or "" if there is no such remote-tracking branch
+func (r *Repo) RemoteTrackingSHA(remoteName string, branchName string) string {
+	ref, err := r.Reference(plumbing.NewRemoteReferenceName(remoteName, branchName), true)
+	if err != nil {
+		return ""
+	}
+	return ref.Hash().String()
+}
+
+// Fetch fetches a branch from remote, updating its remote-tracking ref
+func (r *Repo) Fetch(remoteName string, branchName string) error {
+	defer logging.StartPhase("fetch " + branchName)()
+
+	refSpec := fmt.Sprintf("+refs/heads/%s:refs/remotes/%s/%s", branchName, remoteName, branchName)
+	output, err := r.runGit("fetch", remoteName, refSpec)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s from %s: %s", branchName, remoteName, string(output))
+	}
+	return nil
+}
+
+// FetchBranchFrom sets local branchName to branchName in the repository at
+// source (a path or URL), creating or force-updating it. git fetch won't
+// update the checked-out branch, so that one is fetched and then moved with
+// its worktree by git reset --keep, which refuses to lose local changes.
+func (r *Repo) FetchBranchFrom(source string, branchName string) error {
+	ref := "refs/heads/" + branchName
+	if current, err := r.CurrentBranch(); err == nil && current == branchName && !r.IsBare() {
+		if output, err := r.runGit("fetch", "--quiet", source, ref); err != nil {
+			return fmt.Errorf("failed to fetch %s from %s: %s", branchName, source, string(output))
+		}
+		if output, err := r.runGit("reset", "--quiet", "--keep", "FETCH_HEAD"); err != nil {
+			return fmt.Errorf("failed to update checked-out %s: %s", branchName, string(output))
+		}
+		return nil
+	}
+
+	output, err := r.runGit("fetch", "--quiet", source, "+"+ref+":"+ref)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s from %s: %s", branchName, source, string(output))
+	}
+	return nil
+}
+
+// AheadBehind counts the commits in local that aren't in upstream (ahead)
+// and the commits in upstream that aren't in local (behind)
+func (r *Repo) AheadBehind(local string, upstream string) (ahead int, behind int, err error) {
+	output, err := r.runGit("rev-list", "--left-right", "--count", local+"..."+upstream)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to compare %s with %s: %s", local, upstream, string(output))
+	}
+
+	if _, err := fmt.Sscanf(string(output), "%d\t%d", &ahead, &behind); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse rev-list output %q: %w", string(output), err)
+	}
+
+	return ahead, behind, nil
+}
+
+// ResolveCommit returns the full SHA of the commit rev refers to. rev may be a
+// branch, tag, or full or abbreviated SHA.
+func (r *Repo) ResolveCommit(rev string) (string, error) {
+	output, err := r.runGit("rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("%s is not a commit", rev)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// LocalBranches returns the names of all local branches, sorted
+func (r *Repo) LocalBranches() ([]string, error) {
+	output, err := r.runGit("for-each-ref", "--format=%(refname:short)", "refs/heads")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list branches: %s", strings.TrimSpace(string(output)))
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// RecentCommits returns the abbreviated SHAs of the last n commits on ref,
+// newest first
+func (r *Repo) RecentCommits(ref string, n int) ([]string, error) {
+	output, err := r.runGit("log", "--format=%h", "-n", strconv.Itoa(n), ref, "--")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list commits of %s: %s", ref, strings.TrimSpace(string(output)))
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// ShortSHALength is the minimum length of abbreviated commit SHAs in output
+const ShortSHALength = 7
+
+// AbbreviateSHA cuts sha to ShortSHALength characters without checking that
+// the prefix is unique. Prefer Repo.ShortSHA when a repository is at hand.
+func AbbreviateSHA(sha string) string {
+	if len(sha) > ShortSHALength {
+		return sha[:ShortSHALength]
+	}
+	return sha
+}
+
+// ShortSHA abbreviates hash for display to the shortest prefix of at least
+// ShortSHALength characters that is unambiguous in the repository, like
+// `git rev-parse --short`. Full SHAs belong in metadata and JSON output.
+func (r *Repo) ShortSHA(hash string) string {
+	output, err := r.runGit("rev-parse", "--verify", "--quiet", fmt.Sprintf("--short=%d", ShortSHALength), hash)
+	if err != nil {
+		return AbbreviateSHA(hash)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// IsShallow reports whether the repository is a shallow clone (e.g. made
+// with --depth). Merge bases, ancestry, and ahead/behind counts can be wrong
+// in one, since history beyond the shallow boundary is missing.
+func (r *Repo) IsShallow() bool {
+	gitDir, err := r.GitDir()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(gitDir, "shallow"))
+	return err == nil
+}
+
+// IsAncestor reports whether ancestor is reachable from ref
+func (r *Repo) IsAncestor(ancestor string, ref string) (bool, error) {
+	output, err := r.runGit("merge-base", "--is-ancestor", ancestor, ref)
+	if err == nil {
+		return true, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to check whether %s is in %s: %s", ancestor, ref, string(output))
+}
+
+// LargeHistoryCommits is the commit count above which go-git history walks
+// become noticeably slower than the git CLI
+const LargeHistoryCommits = 50000
+
+// CommitCount returns the number of commits reachable from ref. It uses the
+// git CLI, which reads the commit-graph and stays fast on huge histories.
+func (r *Repo) CommitCount(ref string) (int, error) {
+	output, err := r.runGit("rev-list", "--count", ref)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count commits in %s: %s", ref, string(output))
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse rev-list output %q: %w", string(output), err)
+	}
+
+	return count, nil
+}
+
+// CommitTime returns when the commit ref points to was committed
+func (r *Repo) CommitTime(ref string) (time.Time, error) {
+	output, err := r.runGit("log", "-1", "--format=%ct", ref, "--")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read the commit time of %s: %s", ref, strings.TrimSpace(string(output)))
+	}
+
+	seconds, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse log output %q: %w", string(output), err)
+	}
+
+	return time.Unix(seconds, 0), nil
+}
+
+// FastForwardBranch moves branch forward to upstream, refusing if branch has
+// commits that upstream doesn't (i.e. if it isn't a fast-forward)
+func (r *Repo) FastForwardBranch(branch string, upstream string) error {
+	ahead, _, err := r.AheadBehind(branch, upstream)
+	if err != nil {
+		return err
+	}
+	if ahead > 0 {
+		return fmt.Errorf("cannot fast-forward %s: it has %d commit(s) not in %s", branch, ahead, upstream)
+	}
+
+	// A checked-out branch must move its worktree too
+	args := []string{"update-ref", "refs/heads/" + branch, upstream}
+	if current, err := r.CurrentBranch(); err == nil && current == branch {
+		args = []string{"merge", "--ff-only", upstream}
+	}
+	output, err := r.runGit(args...)
+	if err != nil {
+		return fmt.Errorf("failed to fast-forward %s: %s", branch, string(output))
+	}
+
+	return nil
+}
+
 // CreateBranch creates a new branch
 func (r *Repo) CreateBranch(name string, fromRef string) error {
 	// Get the commit to branch from
+	// fromRef may be a branch, remote-tracking branch (origin/x), or commit
 	var hash plumbing.Hash
 	if fromRef != "" {
-		ref, err := r.Reference(plumbing.NewBranchReferenceName(fromRef), true)
+		resolved, err := r.ResolveRevision(plumbing.Revision(fromRef))
 		if err != nil {
 			return fmt.Errorf("failed to get reference for %s: %w", fromRef, err)
 		}
-		hash = ref.Hash()
+		hash = *resolved
 	} else {
 		head, err := r.Head()
 		if err != nil {
@@ -258,13 +832,60 @@ func (r *Repo) CreateBranch(name string, fromRef string) error {
 	return nil
 }
 
+// CheckoutNew creates branch name at fromRef (HEAD if empty) and checks it
+// out. With force, an existing branch of that name is moved to fromRef,
+// like `git checkout -B`; without it, an existing branch is an error. If the
+// checkout fails, HEAD is put back and the branch is removed again (or
+// moved back to where it was), so no stray branch is left behind.
+func (r *Repo) CheckoutNew(name string, fromRef string, force bool) error {
+	defer logging.StartPhase("create " + name)()
+
+	refName := plumbing.NewBranchReferenceName(name)
+
+	// go-git moves HEAD before updating the worktree, so a failed checkout
+	// can leave HEAD on the new branch
+	head, err := r.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return fmt.Errorf("failed to get HEAD: %w", err)
+	}
+
+	previous, err := r.Reference(refName, false)
+	if err == nil && !force {
+		return fmt.Errorf("branch %s already exists", name)
+	}
+	if err != nil {
+		previous = nil
+	}
+
+	if err := r.CreateBranch(name, fromRef); err != nil {
+		return err
+	}
+
+	worktree, err := r.Worktree()
+	if err == nil {
+		err = worktree.Checkout(&git.CheckoutOptions{
+			Branch: refName,
+			Force:  false,
+		})
+	}
+	if err != nil {
+		r.Storer.SetReference(head)
+		if previous != nil {
+			r.Storer.SetReference(previous)
+		} else {
+			r.Storer.RemoveReference(refName)
+		}
+		return fmt.Errorf("failed to checkout new branch %s: %w", name, err)
+	}
+
+	return nil
+}
+
 // DeleteBranch deletes a branch
 func (r *Repo) DeleteBranch(name string, force bool) error {
 	// For force delete, we need to use git command
 	if force {
-		cmd := exec.Command("git", "branch", "-D", name)
-		cmd.Dir = r.workdir
-		output, err := cmd.CombinedOutput()
+		output, err := r.runGit("branch", "-D", name)
 		if err != nil {
 			return fmt.Errorf("failed to delete branch %s: %s", name, string(output))
 		}
@@ -280,19 +901,69 @@ func (r *Repo) DeleteBranch(name string, force bool) error {
 	return nil
 }
 
-// DeleteRemoteBranch deletes a branch from remote
+// RenameBranch renames a local branch, replacing newName if it exists
+func (r *Repo) RenameBranch(oldName string, newName string) error {
+	output, err := r.runGit("branch", "-M", oldName, newName)
+	if err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %s", oldName, newName, string(output))
+	}
+	return nil
+}
+
+// ErrRemoteBranchNotFound is returned by DeleteRemoteBranch when the remote
+// has no such branch, e.g. because it was never pushed
+var ErrRemoteBranchNotFound = errors.New("remote branch not found")
+
+// RemoteRetryDelays are the waits before each retry of a failed remote
+// branch delete; a transient network error shouldn't leave a branch behind
+var RemoteRetryDelays = []time.Duration{time.Second, 3 * time.Second}
+
+// DeleteRemoteBranch deletes a branch from remote, retrying failures other
+// than the branch not existing (ErrRemoteBranchNotFound)
 func (r *Repo) DeleteRemoteBranch(remoteName string, branchName string) error {
-	cmd := exec.Command("git", "push", remoteName, "--delete", branchName)
-	cmd.Dir = r.workdir
-	output, err := cmd.CombinedOutput()
+	var output []byte
+	var err error
+	for attempt := 0; ; attempt++ {
+		output, err = r.runGit("push", remoteName, "--delete", branchName)
+		if err == nil {
+			return nil
+		}
+		if strings.Contains(string(output), "remote ref does not exist") {
+			return fmt.Errorf("%w: %s on %s", ErrRemoteBranchNotFound, branchName, remoteName)
+		}
+		if attempt == len(RemoteRetryDelays) {
+			break
+		}
+		logging.Debugf("retrying delete of %s on %s in %s", branchName, remoteName, RemoteRetryDelays[attempt])
+		time.Sleep(RemoteRetryDelays[attempt])
+	}
+	return fmt.Errorf("failed to delete remote branch %s: %s", branchName, strings.TrimSpace(string(output)))
+}
+
+// CreateTag creates a lightweight tag name pointing at rev
+func (r *Repo) CreateTag(name string, rev string) error {
+	output, err := r.runGit("tag", name, rev)
+	if err != nil {
+		return fmt.Errorf("failed to create tag %s: %s", name, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// PushTag pushes tag name to remote
+func (r *Repo) PushTag(remoteName string, name string) error {
+	defer logging.StartPhase("push tag " + name)()
+
+	output, err := r.runGit("push", remoteName, "refs/tags/"+name+":refs/tags/"+name)
 	if err != nil {
-		return fmt.Errorf("failed to delete remote branch %s: %s", branchName, string(output))
+		return fmt.Errorf("failed to push tag %s to %s: %s", name, remoteName, strings.TrimSpace(string(output)))
 	}
 	return nil
 }
 
 // Merge merges a branch into the current branch with an optional message
-// Note: This uses git command as go-git's merge support is limited
+// Note: This uses git command as go-git's merge support is limited. Content
+// merges must always go through git, never go-git, so merge drivers and
+// merge attributes from .gitattributes (e.g. merge=union) are honored.
 func (r *Repo) Merge(branch string, message string) error {
 	args := []string{"merge", "--no-ff"}
 	if message != "" {
@@ -300,9 +971,7 @@ func (r *Repo) Merge(branch string, message string) error {
 	}
 	args = append(args, branch)
 
-	cmd := exec.Command("git", args...)
-	cmd.Dir = r.workdir
-	output, err := cmd.CombinedOutput()
+	output, err := r.runGit(args...)
 
 	if err != nil {
 		// Check if it's a merge conflict
@@ -321,9 +990,7 @@ func (r *Repo) Merge(branch string, message string) error {
 // MergeSquash squash merges a branch into the current branch
 func (r *Repo) MergeSquash(branch string, message string) error {
 	// Squash merge
-	cmd := exec.Command("git", "merge", "--squash", branch)
-	cmd.Dir = r.workdir
-	output, err := cmd.CombinedOutput()
+	output, err := r.runGit("merge", "--squash", branch)
 
 	if err != nil {
 		// Check if it's a merge conflict
@@ -342,9 +1009,7 @@ func (r *Repo) MergeSquash(branch string, message string) error {
 		commitMsg = fmt.Sprintf("Squash merge %s", branch)
 	}
 
-	cmd = exec.Command("git", "commit", "-m", commitMsg)
-	cmd.Dir = r.workdir
-	output, err = cmd.CombinedOutput()
+	output, err = r.runGit("commit", "-m", commitMsg)
 
 	if err != nil {
 		return fmt.Errorf("failed to commit squashed changes: %s", string(output))
@@ -353,11 +1018,69 @@ func (r *Repo) MergeSquash(branch string, message string) error {
 	return nil
 }
 
+// WouldConflict reports whether merging branch into base would conflict. The
+// trial merge runs in a temporary detached worktree, so the repository's own
+// branches, index, and worktree are never touched.
+func (r *Repo) WouldConflict(base string, branch string) (bool, error) {
+	conflicts, err := r.ConflictingFiles(base, branch)
+	return len(conflicts) > 0, err
+}
+
+// ConflictingFiles trial-merges branch into base, as WouldConflict does, and
+// returns the paths that would conflict; it's empty if the merge is clean
+func (r *Repo) ConflictingFiles(base string, branch string) ([]string, error) {
+	dir, err := os.MkdirTemp("", "hitch-trial-merge-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trial merge directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if output, err := r.runGit("worktree", "add", "--detach", dir, base); err != nil {
+		return nil, fmt.Errorf("failed to create trial worktree for %s: %s", base, string(output))
+	}
+	defer r.runGit("worktree", "remove", "--force", dir)
+
+	output, err := r.runGit("-C", dir, "merge", "--no-commit", "--no-ff", branch)
+	if err == nil {
+		return []string{}, nil
+	}
+	if !strings.Contains(string(output), "CONFLICT") {
+		return nil, fmt.Errorf("trial merge of %s into %s failed: %s", branch, base, string(output))
+	}
+
+	output, err = r.runGit("-C", dir, "diff", "--name-only", "--diff-filter=U")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list conflicts: %s", string(output))
+	}
+	conflicts := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			conflicts = append(conflicts, line)
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil, fmt.Errorf("trial merge of %s into %s conflicted without unmerged paths", branch, base)
+	}
+	return conflicts, nil
+}
+
+// AmendWithFiles stages paths and folds them into the last commit, keeping its message
+func (r *Repo) AmendWithFiles(paths ...string) error {
+	args := append([]string{"add", "--"}, paths...)
+	if output, err := r.runGit(args...); err != nil {
+		return fmt.Errorf("failed to stage %s: %s", strings.Join(paths, ", "), string(output))
+	}
+
+	if output, err := r.runGit("commit", "--amend", "--no-edit"); err != nil {
+		return fmt.Errorf("failed to amend commit: %s", string(output))
+	}
+
+	return nil
+}
+
 // MergeAbort aborts an in-progress merge
 func (r *Repo) MergeAbort() error {
-	cmd := exec.Command("git", "merge", "--abort")
-	cmd.Dir = r.workdir
-	output, err := cmd.CombinedOutput()
+	output, err := r.runGit("merge", "--abort")
 
 	if err != nil {
 		return fmt.Errorf("failed to abort merge: %s", string(output))
@@ -366,6 +1089,97 @@ func (r *Repo) MergeAbort() error {
 	return nil
 }
 
+// IsMerging reports whether a merge is in progress (MERGE_HEAD exists)
+func (r *Repo) IsMerging() bool {
+	_, err := r.runGit("rev-parse", "-q", "--verify", "MERGE_HEAD")
+	return err == nil
+}
+
+// inProgressMarkers maps files or directories in the git dir to the
+// operation they indicate, in the order they are checked
+var inProgressMarkers = []struct {
+	path      string
+	operation string
+}{
+	{"rebase-merge", "rebase"},
+	{"rebase-apply", "rebase"},
+	{"MERGE_HEAD", "merge"},
+	{"CHERRY_PICK_HEAD", "cherry-pick"},
+	{"REVERT_HEAD", "revert"},
+	{"BISECT_LOG", "bisect"},
+}
+
+// GitDir returns the absolute path of the repository's .git directory
+func (r *Repo) GitDir() (string, error) {
+	output, err := r.runGit("rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return "", fmt.Errorf("failed to find git dir: %s", string(output))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// InProgressOperation reports whether the repository is in the middle of a
+// merge, rebase, cherry-pick, revert, or bisect, and which one
+func (r *Repo) InProgressOperation() (string, bool) {
+	gitDir, err := r.GitDir()
+	if err != nil {
+		return "", false
+	}
+
+	for _, marker := range inProgressMarkers {
+		if _, err := os.Stat(filepath.Join(gitDir, marker.path)); err == nil {
+			return marker.operation, true
+		}
+	}
+
+	return "", false
+}
+
+// MergeChanges merges branch like Merge, but only if it changes something.
+// It reports false, without leaving a commit, when branch is already an
+// ancestor of HEAD or when the merge would leave the tree as it was (its
+// changes are already there, e.g. cherry-picked).
+func (r *Repo) MergeChanges(branch string, message string) (bool, error) {
+	if included, err := r.IsAncestor(branch, "HEAD"); err == nil && included {
+		return false, nil
+	}
+
+	before, err := r.ResolveCommit("HEAD")
+	if err != nil {
+		return false, err
+	}
+
+	if err := r.Merge(branch, message); err != nil {
+		return false, err
+	}
+
+	output, err := r.runGit("rev-parse", before+"^{tree}", "HEAD^{tree}")
+	if err != nil {
+		return true, nil
+	}
+	trees := strings.Fields(string(output))
+	if len(trees) != 2 || trees[0] != trees[1] {
+		return true, nil
+	}
+
+	if err := r.ResetHard(before); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// ResetHard resets the current branch, index, and worktree to ref
+// Note: This uses git command so the reset matches what the user would run
+func (r *Repo) ResetHard(ref string) error {
+	output, err := r.runGit("reset", "--hard", ref)
+
+	if err != nil {
+		return fmt.Errorf("failed to reset to %s: %s", ref, string(output))
+	}
+
+	return nil
+}
+
 // MergeConflictError is returned when a merge results in conflicts
 type MergeConflictError struct {
 	Branch  string
@@ -375,3 +1189,98 @@ type MergeConflictError struct {
 func (e *MergeConflictError) Error() string {
 	return fmt.Sprintf("merge conflict when merging %s: %s", e.Branch, e.Message)
 }
+
+// InProgressOperationError is returned when a command refuses to run because
+// a merge, rebase, or similar operation hasn't been finished
+type InProgressOperationError struct {
+	Operation string
+}
+
+func (e *InProgressOperationError) Error() string {
+	return fmt.Sprintf("a %s is in progress; finish or abort it first", e.Operation)
+}
+
+// LeaseRejectedError is returned by PushWithLease when the remote branch
+// moved since it was read
+type LeaseRejectedError struct {
+	Remote string
+	Branch string
+}
+
+func (e *LeaseRejectedError) Error() string {
+	return fmt.Sprintf("%s/%s was updated by someone else since it was read", e.Remote, e.Branch)
+}
+
+// PushRejection is why a remote refused a push
+type PushRejection string
+
+const (
+	// PushNonFastForward means the remote branch has commits the pushed one
+	// doesn't
+	PushNonFastForward PushRejection = "non-fast-forward"
+	// PushProtected means a branch protection rule or server hook refused it
+	PushProtected PushRejection = "protected"
+	// PushAuth means the remote refused the credentials or their access
+	PushAuth PushRejection = "auth"
+)
+
+// pushRejectionPatterns map lowercase fragments of go-git errors and git push
+// output, including the messages of GitHub, GitLab, and Bitbucket, to why
+// the push was refused. Protection is checked first, since a protected
+// branch refusal can also mention a non-fast-forward update.
+var pushRejectionPatterns = []struct {
+	reason    PushRejection
+	fragments []string
+}{
+	{PushProtected, []string{"protected branch", "pre-receive hook declined", "hook declined", "not allowed to push", "not allowed to force push", "gh006"}},
+	{PushAuth, []string{"authentication required", "authentication failed", "authorization failed", "permission denied", "could not read username", "access denied", "error: 403", "returned error: 403"}},
+	{PushNonFastForward, []string{"non-fast-forward", "fetch first", "updates were rejected"}},
+}
+
+// PushRejectedError is returned when a remote refuses a push for a reason
+// the user can do something about
+type PushRejectedError struct {
+	Remote string
+	Branch string
+	Reason PushRejection
+	// Output is the remote's own message
+	Output string
+}
+
+func (e *PushRejectedError) Error() string {
+	switch e.Reason {
+	case PushProtected:
+		return fmt.Sprintf("%s refused the push of %s: the branch is protected", e.Remote, e.Branch)
+	case PushAuth:
+		return fmt.Sprintf("%s refused the push of %s: not authorized", e.Remote, e.Branch)
+	default:
+		return fmt.Sprintf("%s refused the push of %s: %s/%s has commits the local branch doesn't", e.Remote, e.Branch, e.Remote, e.Branch)
+	}
+}
+
+// Hint says what to do about the rejection
+func (e *PushRejectedError) Hint() string {
+	switch e.Reason {
+	case PushProtected:
+		return fmt.Sprintf("%s is protected on %s; ask an admin to allow the push, or push it manually with the right permissions", e.Branch, e.Remote)
+	case PushAuth:
+		return fmt.Sprintf("Check your credentials (SSH key or access token) and that you have write access to %s", e.Remote)
+	default:
+		return fmt.Sprintf("Pull %s from %s first, then try again", e.Branch, e.Remote)
+	}
+}
+
+// ClassifyPushRejection returns a *PushRejectedError if output, a push error
+// or git's output, shows one of the common reasons a remote refuses a push,
+// or nil otherwise
+func ClassifyPushRejection(remoteName string, branchName string, output string) *PushRejectedError {
+	lower := strings.ToLower(output)
+	for _, pattern := range pushRejectionPatterns {
+		for _, fragment := range pattern.fragments {
+			if strings.Contains(lower, fragment) {
+				return &PushRejectedError{Remote: remoteName, Branch: branchName, Reason: pattern.reason, Output: strings.TrimSpace(output)}
+			}
+		}
+	}
+	return nil
+}
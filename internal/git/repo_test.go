@@ -3,9 +3,13 @@
 package git_test
 
 import (
+	"errors"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DoomedRamen/hitch/internal/git"
 	"github.com/DoomedRamen/hitch/internal/testutil"
@@ -33,6 +37,41 @@ func TestOpenRepoNonExistent(t *testing.T) {
 	}
 }
 
+func TestOpenRepoFromSubdirectory(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+
+	if err := testRepo.CreateBranch("feature/subdir", true); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	if err := testRepo.Repo.Checkout("main"); err != nil {
+		t.Fatalf("Failed to checkout main: %v", err)
+	}
+
+	subdir := filepath.Join(testRepo.Path, "services", "api")
+	if err := os.MkdirAll(subdir, 0755); err != nil {
+		t.Fatalf("Failed to create subdirectory: %v", err)
+	}
+
+	repo, err := git.OpenRepo(subdir)
+	if err != nil {
+		t.Fatalf("Failed to open repository from subdirectory: %v", err)
+	}
+	if repo.Root() != testRepo.Path {
+		t.Errorf("Expected root %s, got %s", testRepo.Path, repo.Root())
+	}
+
+	// The CLI merge must act on the repository root, where go-git sees it
+	if err := repo.Merge("feature/subdir", ""); err != nil {
+		t.Fatalf("Failed to merge from subdirectory: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(testRepo.Path, "feature-subdir.txt")); err != nil {
+		t.Errorf("Expected merged file in repository root: %v", err)
+	}
+	if merged, err := repo.IsAncestor("feature/subdir", "main"); err != nil || !merged {
+		t.Errorf("Expected feature/subdir to be merged into main (err: %v)", err)
+	}
+}
+
 func TestCurrentBranch(t *testing.T) {
 	testRepo := testutil.NewTestRepo(t)
 
@@ -87,6 +126,34 @@ func TestCurrentCommitSHA(t *testing.T) {
 	}
 }
 
+func TestShortSHA(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+
+	sha, err := testRepo.Repo.CurrentCommitSHA()
+	if err != nil {
+		t.Fatalf("Failed to get commit SHA: %v", err)
+	}
+
+	short := testRepo.Repo.ShortSHA(sha)
+	if len(short) < git.ShortSHALength || !strings.HasPrefix(sha, short) {
+		t.Fatalf("Expected a prefix of %s at least %d long, got %q", sha, git.ShortSHALength, short)
+	}
+
+	resolved, err := testRepo.Repo.ResolveCommit(short)
+	if err != nil {
+		t.Fatalf("Failed to resolve %s: %v", short, err)
+	}
+	if resolved != sha {
+		t.Errorf("Expected %s to resolve to %s, got %s", short, sha, resolved)
+	}
+
+	// Unknown hashes still get a fixed-length abbreviation
+	unknown := strings.Repeat("ab", 20)
+	if got := testRepo.Repo.ShortSHA(unknown); got != unknown[:git.ShortSHALength] {
+		t.Errorf("Expected %s, got %q", unknown[:git.ShortSHALength], got)
+	}
+}
+
 func TestBranchExists(t *testing.T) {
 	testRepo := testutil.NewTestRepo(t)
 
@@ -196,6 +263,28 @@ func TestCheckout(t *testing.T) {
 	}
 }
 
+func TestCheckoutRefusedKeepsHead(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+
+	if err := testRepo.CreateBranch("feature/other", false); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	path := filepath.Join(testRepo.Path, "README.md")
+	if err := os.WriteFile(path, []byte("uncommitted\n"), 0644); err != nil {
+		t.Fatalf("Failed to edit README.md: %v", err)
+	}
+
+	if err := testRepo.Repo.Checkout("feature/other"); err == nil {
+		t.Fatal("Expected checkout over uncommitted changes to fail")
+	}
+	if branch, _ := testRepo.Repo.CurrentBranch(); branch != "main" {
+		t.Errorf("Expected a refused checkout to stay on main, got %s", branch)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "uncommitted\n" {
+		t.Errorf("Expected the uncommitted change to be kept, got %q", content)
+	}
+}
+
 func TestCheckoutNonExistent(t *testing.T) {
 	testRepo := testutil.NewTestRepo(t)
 
@@ -498,3 +587,616 @@ func TestMergeConflictErrorMessage(t *testing.T) {
 		t.Errorf("Expected error message '%s', got '%s'", expectedMsg, err.Error())
 	}
 }
+
+func TestValidBranchName(t *testing.T) {
+	valid := []string{"main", "dev", "feature/login", "bug-123", "release_1.2"}
+	for _, name := range valid {
+		if err := git.ValidBranchName(name); err != nil {
+			t.Errorf("Expected %q to be valid, got: %v", name, err)
+		}
+	}
+
+	invalid := []string{"", "my env", "a..b", "feature//x", "feature/", "-x", "x.lock", "x.", "a@{1}", "a~b", "a^b", "a:b", "a?b", "a*b", "a[b", "a\\b", "feature/.x", "@"}
+	for _, name := range invalid {
+		if err := git.ValidBranchName(name); err == nil {
+			t.Errorf("Expected %q to be rejected", name)
+		}
+	}
+}
+
+func TestWouldConflict(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+
+	if err := testRepo.CreateBranch("feature/clean", true); err != nil {
+		t.Fatalf("Failed to create clean branch: %v", err)
+	}
+
+	if err := testRepo.Repo.CreateBranch("feature/conflict", "main"); err != nil {
+		t.Fatalf("Failed to create conflicting branch: %v", err)
+	}
+	if err := testRepo.CommitFile("README.md", "main change\n", "Change README on main"); err != nil {
+		t.Fatalf("Failed to commit on main: %v", err)
+	}
+	if err := testRepo.Repo.Checkout("feature/conflict"); err != nil {
+		t.Fatalf("Failed to checkout feature/conflict: %v", err)
+	}
+	if err := testRepo.CommitFile("README.md", "feature change\n", "Change README on feature"); err != nil {
+		t.Fatalf("Failed to commit on feature: %v", err)
+	}
+	if err := testRepo.Repo.Checkout("main"); err != nil {
+		t.Fatalf("Failed to checkout main: %v", err)
+	}
+
+	mainBefore, _ := testRepo.Repo.CurrentCommitSHA()
+
+	conflict, err := testRepo.Repo.WouldConflict("main", "feature/clean")
+	if err != nil {
+		t.Fatalf("WouldConflict failed: %v", err)
+	}
+	if conflict {
+		t.Error("Expected feature/clean to merge cleanly")
+	}
+
+	conflict, err = testRepo.Repo.WouldConflict("main", "feature/conflict")
+	if err != nil {
+		t.Fatalf("WouldConflict failed: %v", err)
+	}
+	if !conflict {
+		t.Error("Expected feature/conflict to conflict")
+	}
+
+	// The trial merges must not touch the repository
+	if branch, _ := testRepo.GetCurrentBranch(); branch != "main" {
+		t.Errorf("Expected to still be on main, got %s", branch)
+	}
+	if mainAfter, _ := testRepo.Repo.CurrentCommitSHA(); mainAfter != mainBefore {
+		t.Errorf("Expected main to stay at %s, got %s", mainBefore, mainAfter)
+	}
+	if dirty, _ := testRepo.Repo.HasUncommittedChanges("main"); dirty {
+		t.Error("Expected a clean worktree after trial merges")
+	}
+}
+
+func TestCommitCount(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+
+	count, err := testRepo.Repo.CommitCount("main")
+	if err != nil {
+		t.Fatalf("CommitCount failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 commit on main, got %d", count)
+	}
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := testRepo.CommitFile(name, "content\n", "Add "+name); err != nil {
+			t.Fatalf("Failed to commit %s: %v", name, err)
+		}
+	}
+
+	count, err = testRepo.Repo.CommitCount("main")
+	if err != nil {
+		t.Fatalf("CommitCount failed: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("Expected 3 commits on main, got %d", count)
+	}
+
+	if count, _ := testRepo.Repo.CommitCount("main~1"); count != 2 {
+		t.Errorf("Expected 2 commits reachable from main~1, got %d", count)
+	}
+
+	if _, err := testRepo.Repo.CommitCount("does-not-exist"); err == nil {
+		t.Error("Expected error for unknown ref")
+	}
+}
+
+func TestCommitTime(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+
+	cmd := exec.Command("git", "commit", "--allow-empty", "-m", "Dated commit")
+	cmd.Dir = testRepo.Path
+	cmd.Env = append(os.Environ(), "GIT_COMMITTER_DATE=2024-03-01T12:00:00Z")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to commit: %v: %s", err, output)
+	}
+
+	when, err := testRepo.Repo.CommitTime("main")
+	if err != nil {
+		t.Fatalf("CommitTime failed: %v", err)
+	}
+	if want := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC); !when.Equal(want) {
+		t.Errorf("Expected %s, got %s", want, when)
+	}
+
+	if _, err := testRepo.Repo.CommitTime("does-not-exist"); err == nil {
+		t.Error("Expected error for unknown ref")
+	}
+}
+
+func TestRemoteExists(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+
+	if testRepo.Repo.RemoteExists("origin") {
+		t.Error("Expected no origin remote in a fresh repository")
+	}
+
+	cmd := exec.Command("git", "remote", "add", "origin", t.TempDir())
+	cmd.Dir = testRepo.Path
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to add remote: %v\n%s", err, output)
+	}
+
+	if !testRepo.Repo.RemoteExists("origin") {
+		t.Error("Expected origin remote to exist after adding it")
+	}
+	if testRepo.Repo.RemoteExists("upstream") {
+		t.Error("Expected no upstream remote")
+	}
+}
+
+func TestPushWithLease(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+
+	remote := t.TempDir()
+	run := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+	run(remote, "init", "--bare", "--initial-branch=main")
+	run(testRepo.Path, "remote", "add", "origin", remote)
+
+	// An empty lease only succeeds while the remote branch doesn't exist
+	if err := testRepo.Repo.PushWithLease("origin", "main", ""); err != nil {
+		t.Fatalf("Initial push failed: %v", err)
+	}
+	if err := testRepo.CommitFile("second.txt", "second\n", "Second commit"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	var leaseErr *git.LeaseRejectedError
+	if err := testRepo.Repo.PushWithLease("origin", "main", ""); !errors.As(err, &leaseErr) {
+		t.Fatalf("Expected LeaseRejectedError when the branch already exists, got %v", err)
+	}
+
+	run(testRepo.Path, "fetch", "origin")
+	lease := testRepo.Repo.RemoteTrackingSHA("origin", "main")
+	if lease != run(remote, "rev-parse", "main") {
+		t.Fatalf("Expected RemoteTrackingSHA to match pushed main, got %q", lease)
+	}
+
+	// Someone else advances the remote after we read it
+	other := t.TempDir()
+	run(other, "clone", remote, ".")
+	run(other, "-c", "user.email=other@example.com", "-c", "user.name=Other", "commit", "--allow-empty", "-m", "Concurrent change")
+	run(other, "push", "origin", "main")
+	otherTip := run(other, "rev-parse", "HEAD")
+
+	if err := testRepo.CommitFile("local.txt", "local\n", "Local change"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if err := testRepo.Repo.PushWithLease("origin", "main", lease); !errors.As(err, &leaseErr) {
+		t.Fatalf("Expected LeaseRejectedError after a concurrent push, got %v", err)
+	}
+	if tip := run(remote, "rev-parse", "main"); tip != otherTip {
+		t.Errorf("Expected the concurrent push to survive, remote main is %s", tip)
+	}
+
+	if sha := testRepo.Repo.RemoteTrackingSHA("origin", "missing"); sha != "" {
+		t.Errorf("Expected empty hash for unknown remote branch, got %q", sha)
+	}
+}
+
+func TestInProgressOperation(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+
+	if op, ok := testRepo.Repo.InProgressOperation(); ok {
+		t.Fatalf("Expected no operation in progress, got %s", op)
+	}
+
+	if err := testRepo.Repo.CreateBranch("feature/conflict", "main"); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	if err := testRepo.CommitFile("README.md", "main change\n", "Change README on main"); err != nil {
+		t.Fatalf("Failed to commit on main: %v", err)
+	}
+	if err := testRepo.Repo.Checkout("feature/conflict"); err != nil {
+		t.Fatalf("Failed to checkout feature/conflict: %v", err)
+	}
+	if err := testRepo.CommitFile("README.md", "feature change\n", "Change README on feature"); err != nil {
+		t.Fatalf("Failed to commit on feature: %v", err)
+	}
+
+	if err := testRepo.Repo.Merge("main", ""); err == nil {
+		t.Fatal("Expected merge to conflict")
+	}
+
+	op, ok := testRepo.Repo.InProgressOperation()
+	if !ok || op != "merge" {
+		t.Errorf("Expected merge in progress, got %q (%t)", op, ok)
+	}
+
+	if err := testRepo.Repo.MergeAbort(); err != nil {
+		t.Fatalf("Failed to abort merge: %v", err)
+	}
+	if op, ok := testRepo.Repo.InProgressOperation(); ok {
+		t.Errorf("Expected no operation after abort, got %s", op)
+	}
+}
+
+func TestIsShallow(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+
+	if testRepo.Repo.IsShallow() {
+		t.Fatal("Expected a full repository not to be shallow")
+	}
+
+	if err := testRepo.CommitFile("second.txt", "second\n", "Second commit"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "shallow")
+	if output, err := exec.Command("git", "clone", "--quiet", "--depth", "1", "file://"+testRepo.Path, dir).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to make shallow clone: %v\n%s", err, output)
+	}
+
+	shallow, err := git.OpenRepo(dir)
+	if err != nil {
+		t.Fatalf("Failed to open shallow clone: %v", err)
+	}
+	if !shallow.IsShallow() {
+		t.Error("Expected a --depth 1 clone to be shallow")
+	}
+}
+
+func TestCheckoutNew(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+	repo := testRepo.Repo
+
+	if err := repo.CheckoutNew("feature/new", "main", false); err != nil {
+		t.Fatalf("CheckoutNew failed: %v", err)
+	}
+	if current, _ := repo.CurrentBranch(); current != "feature/new" {
+		t.Errorf("Expected to be on feature/new, got %s", current)
+	}
+	// Moved off main, so resetting it to main below would be noticed
+	if err := testRepo.CommitFile("new.txt", "new\n", "Add new.txt"); err != nil {
+		t.Fatalf("Failed to commit on feature/new: %v", err)
+	}
+	if err := repo.Checkout("main"); err != nil {
+		t.Fatalf("Failed to checkout main: %v", err)
+	}
+
+	// Without force an existing branch is left alone
+	if err := repo.CheckoutNew("feature/new", "main", false); err == nil {
+		t.Error("Expected CheckoutNew of an existing branch to fail without force")
+	}
+
+	// A failed checkout leaves no stray branch behind...
+	if err := os.WriteFile(filepath.Join(testRepo.Path, "README.md"), []byte("uncommitted\n"), 0644); err != nil {
+		t.Fatalf("Failed to modify README: %v", err)
+	}
+	if err := repo.CheckoutNew("feature/stray", "main", false); err == nil {
+		t.Fatal("Expected CheckoutNew to fail with uncommitted changes")
+	}
+	if repo.BranchExists("feature/stray") {
+		t.Error("Expected the branch to be removed after the failed checkout")
+	}
+	if current, _ := repo.CurrentBranch(); current != "main" {
+		t.Errorf("Expected to still be on main, got %q", current)
+	}
+
+	// ...and puts a forced branch back where it was
+	before, err := repo.ResolveCommit("feature/new")
+	if err != nil {
+		t.Fatalf("Failed to resolve feature/new: %v", err)
+	}
+	if main, _ := repo.ResolveCommit("main"); main == before {
+		t.Fatal("Expected feature/new to be ahead of main before the forced checkout")
+	}
+	if err := repo.CheckoutNew("feature/new", "main", true); err == nil {
+		t.Fatal("Expected CheckoutNew to fail with uncommitted changes")
+	}
+	if after, _ := repo.ResolveCommit("feature/new"); after != before {
+		t.Errorf("Expected feature/new to stay at %s, got %s", before, after)
+	}
+	if current, _ := repo.CurrentBranch(); current != "main" {
+		t.Errorf("Expected to still be on main, got %s", current)
+	}
+}
+
+func TestSetUser(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+	if out, err := exec.Command("git", "-C", testRepo.Path, "config", "--unset", "user.email").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to unset user.email: %v\n%s", err, out)
+	}
+
+	repo, err := git.OpenRepo(testRepo.Path)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	if _, err := repo.UserEmail(); err == nil {
+		t.Fatal("Expected no user.email before SetUser")
+	}
+
+	if err := repo.SetUser("", "setup@example.com"); err != nil {
+		t.Fatalf("SetUser failed: %v", err)
+	}
+
+	// Persisted: a fresh open, and git itself, read it back
+	reopened, err := git.OpenRepo(testRepo.Path)
+	if err != nil {
+		t.Fatalf("Failed to reopen repository: %v", err)
+	}
+	if email, err := reopened.UserEmail(); err != nil || email != "setup@example.com" {
+		t.Errorf("Expected setup@example.com, got %q (%v)", email, err)
+	}
+	if name, _ := reopened.UserName(); name != "Test User" {
+		t.Errorf("Expected an empty name to keep Test User, got %q", name)
+	}
+
+	out, err := exec.Command("git", "-C", testRepo.Path, "config", "--get", "commit.gpgsign").Output()
+	if err != nil || strings.TrimSpace(string(out)) != "false" {
+		t.Errorf("Expected other git config to be kept, got %q (%v)", out, err)
+	}
+}
+
+func TestOpenBareRepo(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+
+	bare := filepath.Join(t.TempDir(), "app.git")
+	if out, err := exec.Command("git", "clone", "--quiet", "--bare", testRepo.Path, bare).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to clone bare repository: %v\n%s", err, out)
+	}
+
+	repo, err := git.OpenRepo(bare)
+	if err != nil {
+		t.Fatalf("Failed to open bare repository: %v", err)
+	}
+	if !repo.IsBare() {
+		t.Error("Expected IsBare to be true")
+	}
+	if repo.Root() != bare {
+		t.Errorf("Expected Root %s, got %s", bare, repo.Root())
+	}
+	if branch, err := repo.CurrentBranch(); err != nil || branch != "main" {
+		t.Errorf("Expected HEAD to name main, got %q (%v)", branch, err)
+	}
+
+	if testRepo.Repo.IsBare() {
+		t.Error("Expected a repository with a working tree not to be bare")
+	}
+}
+
+func TestDeleteRemoteBranchErrors(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+
+	retryDelays := git.RemoteRetryDelays
+	git.RemoteRetryDelays = []time.Duration{time.Millisecond}
+	t.Cleanup(func() { git.RemoteRetryDelays = retryDelays })
+
+	remote := t.TempDir()
+	for _, args := range [][]string{
+		{"-C", remote, "init", "--quiet", "--bare"},
+		{"-C", testRepo.Path, "remote", "add", "origin", remote},
+		{"-C", testRepo.Path, "push", "--quiet", "origin", "main:feature/pushed"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+	}
+
+	if err := testRepo.Repo.DeleteRemoteBranch("origin", "feature/pushed"); err != nil {
+		t.Fatalf("DeleteRemoteBranch failed: %v", err)
+	}
+
+	err := testRepo.Repo.DeleteRemoteBranch("origin", "feature/pushed")
+	if !errors.Is(err, git.ErrRemoteBranchNotFound) {
+		t.Errorf("Expected ErrRemoteBranchNotFound for a missing branch, got %v", err)
+	}
+
+	if out, err := exec.Command("git", "-C", testRepo.Path, "remote", "set-url", "origin", filepath.Join(t.TempDir(), "gone.git")).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to break origin: %v\n%s", err, out)
+	}
+	err = testRepo.Repo.DeleteRemoteBranch("origin", "feature/other")
+	if err == nil || errors.Is(err, git.ErrRemoteBranchNotFound) {
+		t.Errorf("Expected an unreachable remote to be a real failure, got %v", err)
+	}
+}
+
+func TestRemoteRoundTrip(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+
+	if _, err := testRepo.RemoteSHA("main"); err == nil {
+		t.Error("Expected RemoteSHA to fail before AddRemote")
+	}
+
+	remote, err := testRepo.AddRemote()
+	if err != nil {
+		t.Fatalf("AddRemote failed: %v", err)
+	}
+	if _, err := testRepo.RemoteSHA("main"); err == nil {
+		t.Error("Expected RemoteSHA to fail for a branch that was never pushed")
+	}
+
+	if err := testRepo.PushBranch("main"); err != nil {
+		t.Fatalf("PushBranch failed: %v", err)
+	}
+	local, _ := testRepo.Repo.CurrentCommitSHA()
+	if pushed, err := testRepo.RemoteSHA("main"); err != nil || pushed != local {
+		t.Errorf("Expected origin/main at %s after push, got %s (%v)", local, pushed, err)
+	}
+
+	// Someone else pushes to the same remote
+	clone := t.TempDir()
+	for _, args := range [][]string{
+		{"clone", "--quiet", remote, clone},
+		{"-C", clone, "-c", "user.name=Other", "-c", "user.email=other@example.com", "commit", "--quiet", "--allow-empty", "-m", "Upstream change"},
+		{"-C", clone, "push", "--quiet", "origin", "main"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+	}
+
+	upstream, err := testRepo.RemoteSHA("main")
+	if err != nil || upstream == local {
+		t.Fatalf("Expected the other clone's push to move origin/main, got %s (%v)", upstream, err)
+	}
+
+	if err := testRepo.Repo.Fetch("origin", "main"); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if got := testRepo.Repo.RemoteTrackingSHA("origin", "main"); got != upstream {
+		t.Errorf("Expected fetch to update origin/main to %s, got %s", upstream, got)
+	}
+}
+
+func TestClassifyPushRejection(t *testing.T) {
+	tests := []struct {
+		output string
+		reason git.PushRejection
+	}{
+		{"non-fast-forward update: refs/heads/main", git.PushNonFastForward},
+		{" ! [rejected]        main -> main (fetch first)\nerror: failed to push some refs", git.PushNonFastForward},
+		{"remote: error: GH006: Protected branch update failed for refs/heads/main.\n ! [remote rejected] main -> main (protected branch hook declined)", git.PushProtected},
+		{"remote: GitLab: You are not allowed to force push code to a protected branch on this project.", git.PushProtected},
+		{" ! [remote rejected] dev -> dev (pre-receive hook declined)", git.PushProtected},
+		{"authentication required", git.PushAuth},
+		{"git@github.com: Permission denied (publickey).\nfatal: Could not read from remote repository.", git.PushAuth},
+		{"fatal: unable to access 'https://example.com/app.git/': The requested URL returned error: 403", git.PushAuth},
+	}
+
+	for _, tt := range tests {
+		rejected := git.ClassifyPushRejection("origin", "main", tt.output)
+		if rejected == nil || rejected.Reason != tt.reason {
+			t.Errorf("Expected %q to be a %s rejection, got %v", tt.output, tt.reason, rejected)
+			continue
+		}
+		if rejected.Hint() == "" {
+			t.Errorf("Expected a hint for %s", tt.reason)
+		}
+	}
+
+	if rejected := git.ClassifyPushRejection("origin", "main", "fatal: the remote end hung up unexpectedly"); rejected != nil {
+		t.Errorf("Expected an unrelated failure not to be classified, got %v", rejected)
+	}
+}
+
+func TestPushRejectedByHook(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+	remote, err := testRepo.AddRemote()
+	if err != nil {
+		t.Fatalf("AddRemote failed: %v", err)
+	}
+
+	// A server-side hook standing in for branch protection
+	hook := filepath.Join(remote, "hooks", "pre-receive")
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\necho 'main is a protected branch' >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatalf("Failed to write hook: %v", err)
+	}
+
+	var rejected *git.PushRejectedError
+	if err := testRepo.Repo.Push("origin", "main", false); !errors.As(err, &rejected) || rejected.Reason != git.PushProtected {
+		t.Errorf("Expected Push to return a protected-branch PushRejectedError, got %v", err)
+	}
+	err = testRepo.Repo.PushWithLease("origin", "main", "")
+	if !errors.As(err, &rejected) || rejected.Reason != git.PushProtected {
+		t.Fatalf("Expected PushWithLease to return a protected-branch PushRejectedError, got %v", err)
+	}
+	if !strings.Contains(rejected.Hint(), "protected") {
+		t.Errorf("Expected the hint to mention protection, got %q", rejected.Hint())
+	}
+}
+
+func TestCheckoutForce(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+
+	if err := testRepo.CreateBranch("feature/conflict", false); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	if err := testRepo.CommitFile("conflict.txt", "main content\n", "Add conflict.txt on main"); err != nil {
+		t.Fatalf("Failed to commit on main: %v", err)
+	}
+	if err := testRepo.Repo.Checkout("feature/conflict"); err != nil {
+		t.Fatalf("Failed to checkout feature branch: %v", err)
+	}
+	if err := testRepo.CommitFile("conflict.txt", "feature content\n", "Add conflict.txt on feature"); err != nil {
+		t.Fatalf("Failed to commit on feature: %v", err)
+	}
+	if err := testRepo.Repo.Checkout("main"); err != nil {
+		t.Fatalf("Failed to checkout main: %v", err)
+	}
+
+	// Leave main mid-merge, with conflict markers in the worktree
+	if _, ok := testRepo.Repo.Merge("feature/conflict", "").(*git.MergeConflictError); !ok {
+		t.Fatal("Expected a merge conflict")
+	}
+
+	if err := testRepo.Repo.Checkout("feature/conflict"); err == nil {
+		t.Fatal("Expected checkout over a conflicted worktree to fail")
+	}
+
+	if err := testRepo.Repo.CheckoutForce("feature/conflict"); err != nil {
+		t.Fatalf("CheckoutForce failed: %v", err)
+	}
+	if branch, _ := testRepo.Repo.CurrentBranch(); branch != "feature/conflict" {
+		t.Errorf("Expected to be on feature/conflict, got %s", branch)
+	}
+	if testRepo.Repo.IsMerging() {
+		t.Error("Expected CheckoutForce to clear the merge in progress")
+	}
+	content, err := os.ReadFile(filepath.Join(testRepo.Path, "conflict.txt"))
+	if err != nil || string(content) != "feature content\n" {
+		t.Errorf("Expected the worktree to match feature/conflict, got %q (%v)", content, err)
+	}
+	if dirty, err := testRepo.Repo.HasUncommittedChanges("feature/conflict"); err != nil || dirty {
+		t.Errorf("Expected a clean worktree after CheckoutForce, got dirty=%v err=%v", dirty, err)
+	}
+}
+
+func TestUserIdentityFromIncludeIf(t *testing.T) {
+	testRepo := testutil.NewTestRepo(t)
+	for _, key := range []string{"user.name", "user.email"} {
+		if out, err := exec.Command("git", "-C", testRepo.Path, "config", "--unset", key).CombinedOutput(); err != nil {
+			t.Fatalf("Failed to unset %s: %v\n%s", key, err, out)
+		}
+	}
+
+	// The identity lives in a file included only for this directory
+	identity := filepath.Join(t.TempDir(), "work.gitconfig")
+	if err := os.WriteFile(identity, []byte("[user]\n\tname = Work Person\n\temail = work@example.com\n"), 0644); err != nil {
+		t.Fatalf("Failed to write identity config: %v", err)
+	}
+	dir, err := filepath.EvalSymlinks(testRepo.Path)
+	if err != nil {
+		t.Fatalf("Failed to resolve repository path: %v", err)
+	}
+	if out, err := exec.Command("git", "-C", testRepo.Path, "config", "includeIf.gitdir:"+dir+"/.path", identity).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to add includeIf: %v\n%s", err, out)
+	}
+
+	repo, err := git.OpenRepo(testRepo.Path)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	if email, err := repo.UserEmail(); err != nil || email != "work@example.com" {
+		t.Errorf("Expected work@example.com from the included config, got %q (%v)", email, err)
+	}
+	if name, _ := repo.UserName(); name != "Work Person" {
+		t.Errorf("Expected Work Person from the included config, got %q", name)
+	}
+
+	// Outside the included directory there is still no identity
+	if out, err := exec.Command("git", "-C", testRepo.Path, "config", "--remove-section", "includeIf.gitdir:"+dir+"/").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to remove includeIf: %v\n%s", err, out)
+	}
+	if _, err := repo.UserEmail(); err == nil {
+		t.Error("Expected no user.email without the include")
+	}
+}
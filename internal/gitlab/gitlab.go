@@ -0,0 +1,135 @@
+package gitlab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DoomedRamen/hitch/internal/logging"
+)
+
+// DefaultBaseURL is the GitLab instance used when none is configured
+const DefaultBaseURL = "https://gitlab.com"
+
+// DefaultTokenEnv is the environment variable the API token is read from
+// when none is configured
+const DefaultTokenEnv = "GITLAB_TOKEN"
+
+// ErrNoMergeRequest is returned when a branch has no open merge request
+var ErrNoMergeRequest = errors.New("no open merge request")
+
+// Client calls the GitLab REST API (v4) for a single project
+type Client struct {
+	baseURL string
+	project string
+	token   string
+	http    *http.Client
+}
+
+// NewClient returns a client for project (its numeric ID or path, e.g.
+// "group/app") on the GitLab instance at baseURL, authenticating with token
+func NewClient(baseURL string, project string, token string) *Client {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		project: project,
+		token:   token,
+		http:    &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// APIError is returned when GitLab answers a request with an error status
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("GitLab API returned %d: %s", e.Status, e.Message)
+}
+
+// mergeRequest is the part of a GitLab merge request hitch uses
+type mergeRequest struct {
+	IID    int    `json:"iid"`
+	WebURL string `json:"web_url"`
+}
+
+// OpenMergeRequest returns the IID and URL of branch's open merge request,
+// or ErrNoMergeRequest if it has none
+func (c *Client) OpenMergeRequest(branch string) (int, string, error) {
+	query := url.Values{"state": {"opened"}, "source_branch": {branch}}
+	var requests []mergeRequest
+	if err := c.do(http.MethodGet, "/merge_requests?"+query.Encode(), nil, &requests); err != nil {
+		return 0, "", err
+	}
+	if len(requests) == 0 {
+		return 0, "", ErrNoMergeRequest
+	}
+	return requests[0].IID, requests[0].WebURL, nil
+}
+
+// CheckAccess fetches the project, to confirm the token is accepted and can
+// see it
+func (c *Client) CheckAccess() error {
+	return c.do(http.MethodGet, "", nil, nil)
+}
+
+// Comment adds a comment to merge request iid
+func (c *Client) Comment(iid int, body string) error {
+	return c.do(http.MethodPost, fmt.Sprintf("/merge_requests/%d/notes", iid), url.Values{"body": {body}}, nil)
+}
+
+// Close closes merge request iid
+func (c *Client) Close(iid int) error {
+	return c.do(http.MethodPut, fmt.Sprintf("/merge_requests/%d", iid), url.Values{"state_event": {"close"}}, nil)
+}
+
+// do sends a request to path under the project and decodes a JSON response
+// into out, if given
+func (c *Client) do(method string, path string, form url.Values, out interface{}) error {
+	defer logging.Timer(fmt.Sprintf("gitlab %s %s", method, path))()
+
+	endpoint := fmt.Sprintf("%s/api/v4/projects/%s%s", c.baseURL, url.PathEscape(c.project), path)
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return fmt.Errorf("failed to build GitLab request: %w", err)
+	}
+	req.Header.Set("PRIVATE-TOKEN", c.token)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach GitLab: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read GitLab response: %w", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		return &APIError{Status: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("failed to parse GitLab response: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+//go:build dockertest
+
+package gitlab_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DoomedRamen/hitch/internal/gitlab"
+)
+
+func TestOpenMergeRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("PRIVATE-TOKEN"); got != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message":"401 Unauthorized"}`))
+			return
+		}
+		if r.URL.EscapedPath() != "/api/v4/projects/group%2Fapp/merge_requests" {
+			t.Errorf("Unexpected path %s", r.URL.EscapedPath())
+		}
+		if r.URL.Query().Get("source_branch") == "feature/open" {
+			w.Write([]byte(`[{"iid": 7, "web_url": "https://gitlab.example.com/group/app/-/merge_requests/7"}]`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	client := gitlab.NewClient(server.URL, "group/app", "secret")
+
+	iid, webURL, err := client.OpenMergeRequest("feature/open")
+	if err != nil {
+		t.Fatalf("OpenMergeRequest failed: %v", err)
+	}
+	if iid != 7 || webURL == "" {
+		t.Errorf("Expected merge request !7, got !%d %q", iid, webURL)
+	}
+
+	if _, _, err := client.OpenMergeRequest("feature/none"); !errors.Is(err, gitlab.ErrNoMergeRequest) {
+		t.Errorf("Expected ErrNoMergeRequest, got %v", err)
+	}
+
+	var apiErr *gitlab.APIError
+	unauthorized := gitlab.NewClient(server.URL, "group/app", "wrong")
+	if _, _, err := unauthorized.OpenMergeRequest("feature/open"); !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized {
+		t.Errorf("Expected a 401 APIError, got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Level controls which messages are emitted
+type Level int
+
+const (
+	// LevelDebug shows everything, including git commands and timings (--verbose)
+	LevelDebug Level = iota
+	// LevelInfo shows informational messages
+	LevelInfo
+	// LevelWarn shows only warnings (the default)
+	LevelWarn
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+}
+
+var (
+	mu    sync.Mutex
+	out   io.Writer = os.Stderr
+	level           = LevelWarn
+)
+
+// SetLevel sets the minimum level that is emitted
+func SetLevel(l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	level = l
+}
+
+// SetOutput sets where log lines are written (stderr by default)
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// Enabled reports whether messages at l would be emitted
+func Enabled(l Level) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return l >= level
+}
+
+// Debugf logs a debug message, shown only with --verbose
+func Debugf(format string, args ...interface{}) {
+	logf(LevelDebug, format, args...)
+}
+
+// Infof logs an informational message
+func Infof(format string, args ...interface{}) {
+	logf(LevelInfo, format, args...)
+}
+
+// Warnf logs a warning
+func Warnf(format string, args ...interface{}) {
+	logf(LevelWarn, format, args...)
+}
+
+// Timer logs how long an operation took when the returned func is called
+//
+//	defer logging.Timer("rebuild dev")()
+func Timer(operation string) func() {
+	start := time.Now()
+	return func() {
+		Debugf("%s took %s", operation, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// Phase is one timed step of a command, shown by --timings
+type Phase struct {
+	Name     string
+	Duration time.Duration
+}
+
+var (
+	recording bool
+	depth     int
+	phases    []Phase
+)
+
+// RecordPhases turns phase recording on or off, discarding any phases
+// recorded so far
+func RecordPhases(on bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	recording = on
+	depth = 0
+	phases = nil
+}
+
+// StartPhase times a step of a command for --timings until the returned func
+// is called. A phase started inside another is part of the outer one and
+// isn't recorded on its own, so recorded phases never overlap.
+//
+//	defer logging.StartPhase("write metadata")()
+func StartPhase(name string) func() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !recording {
+		return func() {}
+	}
+	depth++
+	nested := depth > 1
+	start := time.Now()
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if depth > 0 {
+			depth--
+		}
+		if recording && !nested {
+			phases = append(phases, Phase{Name: name, Duration: time.Since(start)})
+		}
+	}
+}
+
+// Phases returns the phases recorded so far, in the order they ended
+func Phases() []Phase {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]Phase(nil), phases...)
+}
+
+func logf(l Level, format string, args ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if l < level {
+		return
+	}
+
+	fmt.Fprintf(out, "[%s] %s\n", levelNames[l], fmt.Sprintf(format, args...))
+}
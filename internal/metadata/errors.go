@@ -14,18 +14,78 @@ func (e *EnvironmentNotFoundError) Error() string {
 	return fmt.Sprintf("environment '%s' not found", e.Environment)
 }
 
+// InvalidEnvironmentNameError is returned when an environment name cannot be
+// used as the name of its hitched branch
+type InvalidEnvironmentNameError struct {
+	Environment string
+	Reason      string
+}
+
+func (e *InvalidEnvironmentNameError) Error() string {
+	return fmt.Sprintf("invalid environment name '%s': %s", e.Environment, e.Reason)
+}
+
 // EnvironmentLockedError is returned when an environment is locked by another user
 type EnvironmentLockedError struct {
 	Environment string
 	LockedBy    string
 	LockedAt    time.Time
+	Host        string
+	Context     string
 }
 
 func (e *EnvironmentLockedError) Error() string {
-	return fmt.Sprintf("environment '%s' is locked by %s (since %s)",
+	msg := fmt.Sprintf("environment '%s' is locked by %s (since %s)",
 		e.Environment, e.LockedBy, e.LockedAt.Format(time.RFC3339))
+	if e.Host != "" {
+		msg += fmt.Sprintf(" on %s", e.Host)
+	}
+	if e.Context != "" {
+		msg += fmt.Sprintf(": %s", e.Context)
+	}
+	return msg
+}
+
+// FrozenError is returned when the repository is in maintenance mode
+type FrozenError struct {
+	FrozenBy string
+	Reason   string
+}
+
+func (e *FrozenError) Error() string {
+	return fmt.Sprintf("hitch is in maintenance mode: %s (frozen by %s)", e.Reason, e.FrozenBy)
+}
+
+// PermissionError is returned when a user who isn't in config.admins tries
+// something only admins may do
+type PermissionError struct {
+	User   string
+	Action string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("permission denied: %s is not an admin and can't %s", e.User, e.Action)
 }
 
+// FreezeWindowError is returned when an environment is in one of its
+// scheduled freeze windows
+type FreezeWindowError struct {
+	Environment string
+	Until       time.Time
+	Reason      string
+}
+
+func (e *FreezeWindowError) Error() string {
+	msg := fmt.Sprintf("%s is in a scheduled freeze until %s", e.Environment, e.Until.Format(FreezeTimeFormat))
+	if e.Reason != "" {
+		msg += fmt.Sprintf(": %s", e.Reason)
+	}
+	return msg
+}
+
+// FreezeTimeFormat is how the end of a scheduled freeze is shown
+const FreezeTimeFormat = "Mon 2006-01-02 15:04 MST"
+
 // BranchNotFoundError is returned when a branch doesn't exist
 type BranchNotFoundError struct {
 	Branch string
@@ -35,6 +95,25 @@ func (e *BranchNotFoundError) Error() string {
 	return fmt.Sprintf("branch '%s' not found", e.Branch)
 }
 
+// StackNotFoundError is returned when a stack doesn't exist
+type StackNotFoundError struct {
+	Stack string
+}
+
+func (e *StackNotFoundError) Error() string {
+	return fmt.Sprintf("stack '%s' not found", e.Stack)
+}
+
+// StaleMetadataError is returned when the local hitch-metadata branch is
+// behind the remote, so writing would diverge from other users' changes
+type StaleMetadataError struct {
+	Behind int
+}
+
+func (e *StaleMetadataError) Error() string {
+	return fmt.Sprintf("your metadata is stale (%d commit(s) behind origin/%s), run 'hitch sync'", e.Behind, MetadataBranch)
+}
+
 // MetadataReadError is returned when metadata cannot be read
 type MetadataReadError struct {
 	Reason string
@@ -3,10 +3,23 @@
 package metadata_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/DoomedRamen/hitch/internal/testutil"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
 func TestMetadataInitialization(t *testing.T) {
@@ -112,6 +125,36 @@ func TestAddBranchToEnvironment(t *testing.T) {
 	}
 }
 
+func TestEverHadFeatures(t *testing.T) {
+	user := "test@example.com"
+	meta := metadata.NewMetadata([]string{"dev", "qa"}, "main", user)
+
+	if err := meta.AddBranchToEnvironment("dev", "feature/test", user); err != nil {
+		t.Fatalf("Failed to add branch to environment: %v", err)
+	}
+	if err := meta.RemoveBranchFromEnvironment("dev", "feature/test", user); err != nil {
+		t.Fatalf("Failed to remove branch from environment: %v", err)
+	}
+	delete(meta.Branches, "feature/test")
+	if !meta.Environments["dev"].EverHadFeatures() {
+		t.Error("Expected dev to remember it had features after its branch was untracked")
+	}
+
+	// An empty rebuild doesn't count, one with features does
+	if err := meta.RecordTip("qa", metadata.ReflogEntry{Commit: "abc"}); err != nil {
+		t.Fatalf("Failed to record tip: %v", err)
+	}
+	if meta.Environments["qa"].EverHadFeatures() {
+		t.Error("Expected qa, only rebuilt empty, never to have had features")
+	}
+	if err := meta.RecordTip("qa", metadata.ReflogEntry{Commit: "def", Features: []string{"feature/old"}}); err != nil {
+		t.Fatalf("Failed to record tip: %v", err)
+	}
+	if !meta.Environments["qa"].EverHadFeatures() {
+		t.Error("Expected a reflog entry with features to count")
+	}
+}
+
 func TestRemoveBranchFromEnvironment(t *testing.T) {
 	environments := []string{"dev"}
 	baseBranch := "main"
@@ -275,3 +318,986 @@ func TestEnvironmentNotFound(t *testing.T) {
 		t.Error("Expected error when locking non-existent environment")
 	}
 }
+
+func TestValidateEnvironmentName(t *testing.T) {
+	valid := []string{"dev", "qa", "staging", "prod-eu", "release_2"}
+	for _, name := range valid {
+		if err := metadata.ValidateEnvironmentName(name); err != nil {
+			t.Errorf("Expected %q to be valid, got: %v", name, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"my env",
+		"feature/x",
+		"dev..qa",
+		".hidden",
+		"-dev",
+		"dev.lock",
+		"dev~1",
+		"dev:qa",
+		"HEAD",
+		"hitch-metadata",
+		"dev-hitch-temp",
+	}
+	for _, name := range invalid {
+		err := metadata.ValidateEnvironmentName(name)
+		if err == nil {
+			t.Errorf("Expected %q to be rejected", name)
+			continue
+		}
+		var nameErr *metadata.InvalidEnvironmentNameError
+		if !errors.As(err, &nameErr) {
+			t.Errorf("Expected InvalidEnvironmentNameError for %q, got %T", name, err)
+		}
+	}
+}
+
+func TestStaleBranchesRespectsEligibility(t *testing.T) {
+	meta := metadata.NewMetadata([]string{"dev"}, "main", "test@example.com")
+	meta.Config.RetentionDaysAfterMerge = 7
+
+	longAgo := time.Now().Add(-30 * 24 * time.Hour)
+	eligible := longAgo.Add(7 * 24 * time.Hour)
+
+	// Released normally, retention passed
+	meta.Branches["feature/released"] = metadata.BranchInfo{
+		MergedToMainAt:       &longAgo,
+		EligibleForCleanupAt: &eligible,
+	}
+
+	// Released with --no-delete: merged long ago but no eligibility date
+	meta.Branches["feature/keep"] = metadata.BranchInfo{
+		MergedToMainAt: &longAgo,
+	}
+
+	safe, _ := meta.StaleBranches()
+
+	if len(safe) != 1 || safe[0] != "feature/released" {
+		t.Errorf("Expected only feature/released to be safe to delete, got %v", safe)
+	}
+
+	for _, branch := range safe {
+		if branch == "feature/keep" {
+			t.Error("A --no-delete branch must never be listed as safe to delete")
+		}
+	}
+}
+
+func TestStaleBranchDetails(t *testing.T) {
+	meta := metadata.NewMetadata([]string{"dev"}, "main", "test@example.com")
+	meta.Config.StaleDaysNoActivity = 30
+
+	mergedAt := time.Now().Add(-10 * 24 * time.Hour)
+	eligibleAt := time.Now().Add(-3 * 24 * time.Hour)
+	notYet := time.Now().Add(3 * 24 * time.Hour)
+
+	// Merged and past retention, not in any environment
+	meta.Branches["feature/done"] = metadata.BranchInfo{
+		MergedToMainAt:       &mergedAt,
+		EligibleForCleanupAt: &eligibleAt,
+	}
+
+	// Merged and past retention, but re-added to an environment
+	meta.Branches["feature/in-env"] = metadata.BranchInfo{
+		MergedToMainAt:       &mergedAt,
+		EligibleForCleanupAt: &eligibleAt,
+	}
+	env := meta.Environments["dev"]
+	env.Features = append(env.Features, "feature/in-env")
+	meta.Environments["dev"] = env
+
+	// Merged but still within retention
+	meta.Branches["feature/recent"] = metadata.BranchInfo{
+		MergedToMainAt:       &mergedAt,
+		EligibleForCleanupAt: &notYet,
+	}
+
+	// Unmerged with no commits for 45 days
+	meta.Branches["feature/abandoned"] = metadata.BranchInfo{
+		LastCommitAt: time.Now().Add(-45 * 24 * time.Hour),
+	}
+
+	// Unmerged with a recent commit
+	meta.Branches["feature/active"] = metadata.BranchInfo{
+		LastCommitAt: time.Now().Add(-2 * 24 * time.Hour),
+	}
+
+	details := meta.StaleBranchDetails()
+	byName := map[string]metadata.StaleBranch{}
+	for _, d := range details {
+		byName[d.Branch] = d
+	}
+
+	if len(details) != 3 {
+		t.Fatalf("Expected 3 stale branches, got %d: %+v", len(details), details)
+	}
+
+	done := byName["feature/done"]
+	if done.Reason != metadata.StaleMerged || done.InEnvironment || !done.SafeToDelete() {
+		t.Errorf("feature/done should be merged, not in env, and safe: %+v", done)
+	}
+	if done.DaysSinceMerge != 10 {
+		t.Errorf("Expected 10 days since merge, got %d", done.DaysSinceMerge)
+	}
+
+	inEnv := byName["feature/in-env"]
+	if inEnv.Reason != metadata.StaleMerged || !inEnv.InEnvironment || inEnv.SafeToDelete() {
+		t.Errorf("feature/in-env should be merged, in env, and not safe: %+v", inEnv)
+	}
+
+	abandoned := byName["feature/abandoned"]
+	if abandoned.Reason != metadata.StaleInactive || abandoned.SafeToDelete() {
+		t.Errorf("feature/abandoned should be inactive and not safe: %+v", abandoned)
+	}
+	if abandoned.DaysSinceCommit != 45 {
+		t.Errorf("Expected 45 days since commit, got %d", abandoned.DaysSinceCommit)
+	}
+
+	safe, inactive := meta.StaleBranches()
+	if len(safe) != 1 || safe[0] != "feature/done" {
+		t.Errorf("Expected safe [feature/done], got %v", safe)
+	}
+	if len(inactive) != 1 || inactive[0] != "feature/abandoned" {
+		t.Errorf("Expected inactive [feature/abandoned], got %v", inactive)
+	}
+}
+
+func TestEnvironmentAliases(t *testing.T) {
+	meta := metadata.NewMetadata([]string{"dev", "test"}, "main", "test@example.com")
+
+	if err := meta.SetAlias("qa", "test"); err != nil {
+		t.Fatalf("Failed to set alias: %v", err)
+	}
+
+	if got := meta.ResolveEnvironment("qa"); got != "test" {
+		t.Errorf("Expected qa to resolve to test, got %s", got)
+	}
+	if got := meta.ResolveEnvironment("dev"); got != "dev" {
+		t.Errorf("Expected dev to resolve to itself, got %s", got)
+	}
+	if got := meta.ResolveEnvironment("staging"); got != "staging" {
+		t.Errorf("Expected unknown name to fall through unchanged, got %s", got)
+	}
+
+	var notFound *metadata.EnvironmentNotFoundError
+	if err := meta.SetAlias("stage", "staging"); !errors.As(err, &notFound) {
+		t.Errorf("Expected EnvironmentNotFoundError for missing target, got %v", err)
+	}
+
+	var invalid *metadata.InvalidEnvironmentNameError
+	if err := meta.SetAlias("dev", "test"); !errors.As(err, &invalid) {
+		t.Errorf("Expected InvalidEnvironmentNameError when alias shadows an environment, got %v", err)
+	}
+	if err := meta.SetAlias("team/qa", "test"); !errors.As(err, &invalid) {
+		t.Errorf("Expected InvalidEnvironmentNameError for invalid alias, got %v", err)
+	}
+}
+
+func TestClearEnvironment(t *testing.T) {
+	meta := metadata.NewMetadata([]string{"dev", "qa"}, "main", "test@example.com")
+	for _, branch := range []string{"feature/a", "feature/b"} {
+		if err := meta.AddBranchToEnvironment("dev", branch, "test@example.com"); err != nil {
+			t.Fatalf("Failed to add %s: %v", branch, err)
+		}
+	}
+	if err := meta.AddBranchToEnvironment("qa", "feature/a", "test@example.com"); err != nil {
+		t.Fatalf("Failed to add feature/a to qa: %v", err)
+	}
+
+	removed, err := meta.ClearEnvironment("dev", "other@example.com")
+	if err != nil {
+		t.Fatalf("ClearEnvironment failed: %v", err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("Expected 2 features removed, got %v", removed)
+	}
+	if features := meta.Environments["dev"].Features; len(features) != 0 {
+		t.Errorf("Expected dev to be empty, got %v", features)
+	}
+
+	for _, branch := range removed {
+		history := meta.Branches[branch].PromotedHistory
+		for _, event := range history {
+			if event.Environment == "dev" && (event.DemotedAt == nil || event.DemotedBy != "other@example.com") {
+				t.Errorf("Expected %s's dev promotion to be marked demoted, got %+v", branch, event)
+			}
+		}
+	}
+
+	if promoted := meta.Branches["feature/a"].PromotedTo; len(promoted) != 1 || promoted[0] != "qa" {
+		t.Errorf("Expected feature/a to remain in qa, got %v", promoted)
+	}
+
+	var notFound *metadata.EnvironmentNotFoundError
+	if _, err := meta.ClearEnvironment("staging", "test@example.com"); !errors.As(err, &notFound) {
+		t.Errorf("Expected EnvironmentNotFoundError, got %v", err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	meta := metadata.NewMetadata([]string{"dev", "qa"}, "main", "test@example.com")
+	if err := meta.AddBranchToEnvironment("dev", "feature/ok", "test@example.com"); err != nil {
+		t.Fatalf("Failed to add feature/ok: %v", err)
+	}
+
+	// In dev's features, but promoted_to was never updated
+	dev := meta.Environments["dev"]
+	dev.Features = append(dev.Features, "feature/half-written", "feature/untracked")
+	meta.Environments["dev"] = dev
+	meta.Branches["feature/half-written"] = metadata.BranchInfo{PromotedTo: []string{}}
+
+	// Claims to be in qa and a deleted environment, but neither lists it
+	meta.Branches["feature/ghost"] = metadata.BranchInfo{PromotedTo: []string{"qa", "staging"}}
+
+	if problems := meta.Inconsistencies(); len(problems) != 4 {
+		t.Fatalf("Expected 4 inconsistencies, got %d: %v", len(problems), problems)
+	}
+	if got := meta.Branches["feature/ghost"].PromotedTo; len(got) != 2 {
+		t.Fatalf("Inconsistencies must not modify metadata, got promoted_to %v", got)
+	}
+
+	repairs := meta.Reconcile()
+	if len(repairs) != 4 {
+		t.Errorf("Expected 4 repairs, got %d: %v", len(repairs), repairs)
+	}
+
+	for _, branch := range []string{"feature/ok", "feature/half-written", "feature/untracked"} {
+		if got := meta.Branches[branch].PromotedTo; len(got) != 1 || got[0] != "dev" {
+			t.Errorf("Expected %s promoted_to [dev], got %v", branch, got)
+		}
+	}
+	if got := meta.Branches["feature/ghost"].PromotedTo; len(got) != 0 {
+		t.Errorf("Expected feature/ghost promoted_to to be emptied, got %v", got)
+	}
+	if got := meta.Environments["dev"].Features; len(got) != 3 {
+		t.Errorf("Expected dev features to be left alone, got %v", got)
+	}
+
+	if again := meta.Reconcile(); len(again) != 0 {
+		t.Errorf("Expected reconciled metadata to be consistent, got %v", again)
+	}
+}
+
+func TestRetentionDaysOverride(t *testing.T) {
+	meta := metadata.NewMetadata([]string{"dev"}, "main", "test@example.com")
+	meta.Config.RetentionDaysAfterMerge = 7
+
+	thirty := 30
+	meta.Branches["hotfix/login"] = metadata.BranchInfo{RetentionDays: &thirty}
+	meta.Branches["experiment/x"] = metadata.BranchInfo{}
+
+	if got := meta.RetentionDays("hotfix/login"); got != 30 {
+		t.Errorf("Expected override of 30 days, got %d", got)
+	}
+	if got := meta.RetentionDays("experiment/x"); got != 7 {
+		t.Errorf("Expected global 7 days, got %d", got)
+	}
+	if got := meta.RetentionDays("untracked"); got != 7 {
+		t.Errorf("Expected global 7 days for untracked branch, got %d", got)
+	}
+
+	mergedAt := time.Now().Add(-10 * 24 * time.Hour)
+	hotfixCleanup := meta.CleanupDate("hotfix/login", mergedAt)
+	experimentCleanup := meta.CleanupDate("experiment/x", mergedAt)
+
+	if want := mergedAt.Add(30 * 24 * time.Hour); !hotfixCleanup.Equal(want) {
+		t.Errorf("Expected hotfix cleanup at %v, got %v", want, hotfixCleanup)
+	}
+
+	// Merged 10 days ago: the 7-day branch is stale, the 30-day one isn't
+	meta.Branches["hotfix/login"] = metadata.BranchInfo{RetentionDays: &thirty, MergedToMainAt: &mergedAt, EligibleForCleanupAt: &hotfixCleanup}
+	meta.Branches["experiment/x"] = metadata.BranchInfo{MergedToMainAt: &mergedAt, EligibleForCleanupAt: &experimentCleanup}
+
+	safe, _ := meta.StaleBranches()
+	if len(safe) != 1 || safe[0] != "experiment/x" {
+		t.Errorf("Expected only experiment/x to be stale, got %v", safe)
+	}
+}
+
+func TestStacks(t *testing.T) {
+	meta := metadata.NewMetadata([]string{"dev", "qa"}, "main", "test@example.com")
+	stack := []string{"feature/api", "feature/ui", "feature/flow"}
+
+	if err := meta.SetStack("checkout", stack); err != nil {
+		t.Fatalf("Failed to define stack: %v", err)
+	}
+	if err := meta.SetStack("other", []string{"feature/ui"}); err == nil {
+		t.Error("Expected a branch to belong to only one stack")
+	}
+	if err := meta.SetStack("dupes", []string{"feature/x", "feature/x"}); err == nil {
+		t.Error("Expected duplicate branches to be rejected")
+	}
+
+	// A member already in dev, behind an unrelated feature, gets reordered
+	meta.AddBranchToEnvironment("dev", "feature/ui", "test@example.com")
+	meta.AddBranchToEnvironment("dev", "feature/unrelated", "test@example.com")
+
+	added, err := meta.PromoteStack("dev", "checkout", "test@example.com")
+	if err != nil {
+		t.Fatalf("Failed to promote stack: %v", err)
+	}
+	if len(added) != 2 || added[0] != "feature/api" || added[1] != "feature/flow" {
+		t.Errorf("Expected feature/api and feature/flow to be added, got %v", added)
+	}
+
+	want := []string{"feature/unrelated", "feature/api", "feature/ui", "feature/flow"}
+	got := meta.Environments["dev"].Features
+	if len(got) != len(want) {
+		t.Fatalf("Expected dev features %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected dev features %v, got %v", want, got)
+		}
+	}
+	for _, branch := range stack {
+		if info := meta.Branches[branch]; len(info.PromotedTo) != 1 || info.PromotedTo[0] != "dev" {
+			t.Errorf("Expected %s promoted_to [dev], got %v", branch, info.PromotedTo)
+		}
+	}
+
+	if deps := meta.StackDependents("dev", "feature/api"); len(deps) != 2 || deps[0] != "feature/ui" || deps[1] != "feature/flow" {
+		t.Errorf("Expected feature/ui and feature/flow to depend on feature/api, got %v", deps)
+	}
+	if deps := meta.StackDependents("dev", "feature/flow"); len(deps) != 0 {
+		t.Errorf("Expected the top of the stack to have no dependents, got %v", deps)
+	}
+
+	var notFound *metadata.StackNotFoundError
+	if _, err := meta.PromoteStack("dev", "missing", "test@example.com"); !errors.As(err, &notFound) {
+		t.Errorf("Expected StackNotFoundError, got %v", err)
+	}
+}
+
+func TestExplainCleanup(t *testing.T) {
+	meta := metadata.NewMetadata([]string{"dev"}, "main", "test@example.com")
+
+	mergedAt := time.Now().Add(-10 * 24 * time.Hour)
+	eligibleAt := time.Now().Add(-3 * 24 * time.Hour)
+	notYet := time.Now().Add(3 * 24 * time.Hour)
+
+	meta.Branches["feature/unmerged"] = metadata.BranchInfo{PromotedTo: []string{}}
+	meta.Branches["feature/kept"] = metadata.BranchInfo{MergedToMainAt: &mergedAt}
+	meta.Branches["feature/recent"] = metadata.BranchInfo{MergedToMainAt: &mergedAt, EligibleForCleanupAt: &notYet}
+	meta.Branches["feature/deployed"] = metadata.BranchInfo{MergedToMainAt: &mergedAt, EligibleForCleanupAt: &eligibleAt}
+	meta.Branches["feature/done"] = metadata.BranchInfo{MergedToMainAt: &mergedAt, EligibleForCleanupAt: &eligibleAt}
+	if err := meta.AddBranchToEnvironment("dev", "feature/deployed", "test@example.com"); err != nil {
+		t.Fatalf("Failed to add branch: %v", err)
+	}
+
+	tests := []struct {
+		branch  string
+		blocker metadata.CleanupBlocker
+	}{
+		{"feature/untracked", metadata.CleanupNotTracked},
+		{"feature/unmerged", metadata.CleanupNotMerged},
+		{"feature/kept", metadata.CleanupKept},
+		{"feature/recent", metadata.CleanupRetention},
+		{"feature/deployed", metadata.CleanupInEnvironment},
+		{"feature/done", ""},
+	}
+
+	safe, _ := meta.StaleBranches()
+	for _, tt := range tests {
+		e := meta.ExplainCleanup(tt.branch)
+		if e.Blocker != tt.blocker {
+			t.Errorf("%s: expected blocker %q, got %q", tt.branch, tt.blocker, e.Blocker)
+		}
+
+		// The explanation must agree with what cleanup actually deletes
+		listed := false
+		for _, s := range safe {
+			listed = listed || s == tt.branch
+		}
+		if e.SafeToDelete() != listed {
+			t.Errorf("%s: explanation says safe=%v, cleanup says %v", tt.branch, e.SafeToDelete(), listed)
+		}
+	}
+
+	if e := meta.ExplainCleanup("feature/deployed"); len(e.Environments) != 1 || e.Environments[0] != "dev" {
+		t.Errorf("Expected feature/deployed to be reported in dev, got %v", e.Environments)
+	}
+}
+
+func TestMarshalIsStable(t *testing.T) {
+	meta := metadata.NewMetadata([]string{"qa", "dev", "staging"}, "main", "test@example.com")
+	for _, branch := range []string{"feature/zeta", "feature/alpha", "feature/mid"} {
+		if err := meta.AddBranchToEnvironment("dev", branch, "test@example.com"); err != nil {
+			t.Fatalf("Failed to add %s: %v", branch, err)
+		}
+	}
+
+	first, err := metadata.Marshal(meta)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if len(first) == 0 || first[len(first)-1] != '\n' {
+		t.Error("Expected hitch.json to end with a newline")
+	}
+
+	for i := 0; i < 10; i++ {
+		again, err := metadata.Marshal(meta)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		if !bytes.Equal(first, again) {
+			t.Fatalf("Expected identical bytes for the same metadata, got:\n%s\nand:\n%s", first, again)
+		}
+	}
+
+	// What is read back from hitch.json encodes to the same bytes
+	var decoded metadata.Metadata
+	if err := json.Unmarshal(first, &decoded); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	roundTrip, err := metadata.Marshal(&decoded)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if !bytes.Equal(first, roundTrip) {
+		t.Errorf("Expected a round trip to preserve the bytes, got:\n%s\nwant:\n%s", roundTrip, first)
+	}
+}
+
+func TestReadCachesUnchangedCommit(t *testing.T) {
+	tr := testutil.NewTestRepo(t)
+	meta := metadata.NewMetadata([]string{"dev", "qa"}, "main", "test@example.com")
+	if err := meta.AddBranchToEnvironment("dev", "feature/cached", "test@example.com"); err != nil {
+		t.Fatalf("Failed to add branch: %v", err)
+	}
+	if err := tr.InitMetadata(meta); err != nil {
+		t.Fatalf("Failed to initialize metadata: %v", err)
+	}
+
+	first, err := metadata.NewReader(tr.Repo.Repository).Read()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	// Remove the hitch.json blob; only a cache hit can still read it
+	blob := gitRevParse(t, tr, metadata.MetadataBranch+":"+metadata.MetadataFile)
+	if err := os.Remove(filepath.Join(tr.Path, ".git", "objects", blob[:2], blob[2:])); err != nil {
+		t.Fatalf("Failed to remove blob: %v", err)
+	}
+	reopened, err := git.PlainOpen(tr.Path)
+	if err != nil {
+		t.Fatalf("Failed to reopen repository: %v", err)
+	}
+
+	second, err := metadata.NewReader(reopened).Read()
+	if err != nil {
+		t.Fatalf("Expected the second Read to hit the cache, got %v", err)
+	}
+	if !slices.Equal(second.Environments["dev"].Features, []string{"feature/cached"}) {
+		t.Errorf("Expected the cached metadata, got dev features %v", second.Environments["dev"].Features)
+	}
+
+	// Each Read returns its own copy
+	if err := first.AddBranchToEnvironment("dev", "feature/other", "test@example.com"); err != nil {
+		t.Fatalf("Failed to add branch: %v", err)
+	}
+	third, err := metadata.NewReader(reopened).Read()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(third.Environments["dev"].Features) != 1 || len(third.Branches) != 1 {
+		t.Errorf("Expected changes to a Read result not to leak into the cache, got %v", third.Environments["dev"].Features)
+	}
+}
+
+func gitRevParse(t *testing.T, tr *testutil.TestRepo, rev string) string {
+	t.Helper()
+	out, err := exec.Command("git", "-C", tr.Path, "rev-parse", rev).Output()
+	if err != nil {
+		t.Fatalf("git rev-parse %s failed: %v", rev, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func BenchmarkRead(b *testing.B) {
+	repo, err := git.PlainInit(b.TempDir(), false)
+	if err != nil {
+		b.Fatalf("Failed to init repository: %v", err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		b.Fatalf("Failed to get worktree: %v", err)
+	}
+	signature := &object.Signature{Name: "Test User", Email: "test@example.com", When: time.Now()}
+	if _, err := worktree.Commit("Initial commit", &git.CommitOptions{Author: signature, AllowEmptyCommits: true}); err != nil {
+		b.Fatalf("Failed to create initial commit: %v", err)
+	}
+	if err := metadata.NewWriter(repo).WriteInitial(benchmarkMetadata(), "Test User", "test@example.com"); err != nil {
+		b.Fatalf("Failed to initialize metadata: %v", err)
+	}
+	reader := metadata.NewReader(repo)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := reader.Read(); err != nil {
+			b.Fatalf("Read failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkParse is what every Read cost before the cache
+func BenchmarkParse(b *testing.B) {
+	data, err := metadata.Marshal(benchmarkMetadata())
+	if err != nil {
+		b.Fatalf("Marshal failed: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := metadata.Parse(data); err != nil {
+			b.Fatalf("Parse failed: %v", err)
+		}
+	}
+}
+
+// benchmarkMetadata is a busy repository's metadata: a few hundred branches
+func benchmarkMetadata() *metadata.Metadata {
+	meta := metadata.NewMetadata([]string{"dev", "qa", "staging"}, "main", "test@example.com")
+	for i := 0; i < 300; i++ {
+		meta.AddBranchToEnvironment([]string{"dev", "qa", "staging"}[i%3], fmt.Sprintf("feature/branch-%d", i), "test@example.com")
+	}
+	return meta
+}
+
+func TestParseValidatesConfig(t *testing.T) {
+	valid := metadata.NewMetadata([]string{"dev"}, "main", "test@example.com")
+	valid.Branches["feature/kept"] = metadata.BranchInfo{PromotedTo: []string{}}
+
+	days := -3
+	tests := []struct {
+		name   string
+		modify func(m *metadata.Metadata)
+		reason string
+	}{
+		{"valid", func(m *metadata.Metadata) {}, ""},
+		{"manual strategy", func(m *metadata.Metadata) { m.Config.ConflictStrategy = "manual" }, ""},
+		{"default strategy", func(m *metadata.Metadata) { m.Config.ConflictStrategy = "" }, ""},
+		{"unknown strategy", func(m *metadata.Metadata) { m.Config.ConflictStrategy = "yolo" }, `config.conflict_strategy is "yolo"`},
+		{"archive inactive branches", func(m *metadata.Metadata) { m.Config.InactiveBranchAction = "archive" }, ""},
+		{"unknown inactive action", func(m *metadata.Metadata) { m.Config.InactiveBranchAction = "shred" }, `config.inactive_branch_action is "shred"`},
+		{"negative retention", func(m *metadata.Metadata) { m.Config.RetentionDaysAfterMerge = -1 }, "config.retention_days_after_merge is -1"},
+		{"negative stale days", func(m *metadata.Metadata) { m.Config.StaleDaysNoActivity = -30 }, "config.stale_days_no_activity is -30"},
+		{"negative lock timeout", func(m *metadata.Metadata) { m.Config.LockTimeoutMinutes = -5 }, "config.lock_timeout_minutes is -5"},
+		{"negative branch retention", func(m *metadata.Metadata) {
+			info := m.Branches["feature/kept"]
+			info.RetentionDays = &days
+			m.Branches["feature/kept"] = info
+		}, "branches.feature/kept.retention_days is -3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := valid.Clone()
+			tt.modify(m)
+			data, err := metadata.Marshal(m)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+
+			_, err = metadata.Parse(data)
+			if tt.reason == "" {
+				if err != nil {
+					t.Errorf("Expected valid metadata, got %v", err)
+				}
+				return
+			}
+
+			var invalid *metadata.InvalidMetadataError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("Expected InvalidMetadataError, got %v", err)
+			}
+			if !strings.Contains(invalid.Reason, tt.reason) {
+				t.Errorf("Expected reason to contain %q, got %q", tt.reason, invalid.Reason)
+			}
+		})
+	}
+}
+
+func TestCompactHistory(t *testing.T) {
+	m := metadata.NewMetadata([]string{"dev", "qa"}, "main", "test@example.com")
+	now := time.Now()
+	at := func(hoursAgo float64) time.Time { return now.Add(-time.Duration(hoursAgo * float64(time.Hour))) }
+	demotedAt := func(hoursAgo float64) *time.Time { t := at(hoursAgo); return &t }
+
+	for _, env := range []string{"dev", "qa"} {
+		e := m.Environments[env]
+		e.LastRebuild = at(1)
+		m.Environments[env] = e
+	}
+
+	// The oldest event is a promotion still in effect, and the last demotion
+	// happened after dev's last rebuild
+	history := []metadata.PromotionEvent{{Environment: "qa", PromotedAt: at(100)}}
+	for i := range 6 {
+		history = append(history, metadata.PromotionEvent{Environment: "dev", PromotedAt: at(float64(90 - 2*i)), DemotedAt: demotedAt(float64(89 - 2*i))})
+	}
+	history = append(history,
+		metadata.PromotionEvent{Environment: "dev", PromotedAt: at(3), DemotedAt: demotedAt(0.5)},
+		metadata.PromotionEvent{Environment: "dev", PromotedAt: at(0.25)},
+	)
+	m.Branches["feature/busy"] = metadata.BranchInfo{PromotedTo: []string{"dev", "qa"}, PromotedHistory: history}
+	m.Branches["feature/quiet"] = metadata.BranchInfo{PromotedHistory: history[1:2]}
+
+	pending := m.PendingRebuild("dev")
+
+	if removed := m.CompactHistory(2); removed != 6 {
+		t.Errorf("Expected 6 events removed, got %d", removed)
+	}
+	want := []metadata.PromotionEvent{history[0], history[7], history[8]}
+	if got := m.Branches["feature/busy"].PromotedHistory; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the active promotions and the 2 most recent events, got %+v", got)
+	}
+	if got := m.Branches["feature/quiet"].PromotedHistory; len(got) != 1 {
+		t.Errorf("Expected a history within the limit to be untouched, got %+v", got)
+	}
+	if m.PendingRebuild("dev") != pending {
+		t.Error("Expected compaction not to change whether dev needs a rebuild")
+	}
+
+	// Events still in effect survive even with nothing else kept
+	if removed := m.CompactHistory(0); removed != 1 {
+		t.Errorf("Expected only feature/quiet's old event removed, got %d", removed)
+	}
+	if got := m.Branches["feature/busy"].PromotedHistory; len(got) != 3 {
+		t.Errorf("Expected the 3 events in effect kept, got %+v", got)
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	tr := testutil.NewTestRepo(t)
+	meta := metadata.NewMetadata([]string{"dev", "qa"}, "main", "test@example.com")
+	if err := tr.InitMetadata(meta); err != nil {
+		t.Fatalf("Failed to initialize metadata: %v", err)
+	}
+	first := gitRevParse(t, tr, metadata.MetadataBranch)
+
+	if err := meta.AddBranchToEnvironment("dev", "feature/later", "test@example.com"); err != nil {
+		t.Fatalf("Failed to add branch: %v", err)
+	}
+	if err := metadata.NewWriter(tr.Repo.Repository).Write(meta, "Promote feature/later", "Test User", "test@example.com"); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+
+	reader := metadata.NewReader(tr.Repo.Repository)
+	for _, ref := range []string{metadata.MetadataBranch + "~1", first, first[:8]} {
+		past, err := reader.ReadAt(ref)
+		if err != nil {
+			t.Fatalf("ReadAt(%s) failed: %v", ref, err)
+		}
+		if len(past.Environments["dev"].Features) != 0 {
+			t.Errorf("Expected dev to be empty at %s, got %v", ref, past.Environments["dev"].Features)
+		}
+	}
+
+	// A date resolves to the last commit at or before it
+	tomorrow := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+	latest, err := reader.ReadAt(tomorrow)
+	if err != nil {
+		t.Fatalf("ReadAt(%s) failed: %v", tomorrow, err)
+	}
+	if !slices.Equal(latest.Environments["dev"].Features, []string{"feature/later"}) {
+		t.Errorf("Expected the latest metadata for %s, got dev features %v", tomorrow, latest.Environments["dev"].Features)
+	}
+
+	var readErr *metadata.MetadataReadError
+	if _, err := reader.ReadAt("2000-01-01"); !errors.As(err, &readErr) {
+		t.Errorf("Expected a MetadataReadError before hitch was initialized, got %v", err)
+	}
+	if _, err := reader.ReadAt("not-a-ref"); err == nil {
+		t.Error("Expected an error for an unknown ref")
+	}
+}
+
+func TestParseDefaultsAutoRebuildOnPromote(t *testing.T) {
+	m, err := metadata.Parse([]byte(`{"version": "1.0.0", "environments": {}, "branches": {}, "config": {"base_branch": "main"}}`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !m.Config.AutoRebuildOnPromote {
+		t.Error("Expected auto_rebuild_on_promote to default to true when missing")
+	}
+
+	m, err = metadata.Parse([]byte(`{"version": "1.0.0", "environments": {}, "branches": {}, "config": {"base_branch": "main", "auto_rebuild_on_promote": false}}`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if m.Config.AutoRebuildOnPromote {
+		t.Error("Expected an explicit false to be kept")
+	}
+}
+
+func TestBaseCycles(t *testing.T) {
+	m := metadata.NewMetadata([]string{"dev", "qa", "staging", "prod"}, "main", "test@example.com")
+
+	if cycles := m.BaseCycles(); len(cycles) != 0 {
+		t.Fatalf("Expected no cycles with every environment on main, got %v", cycles)
+	}
+
+	// Hand-edited hitch.json can still introduce them
+	setBase := func(env, base string) {
+		e := m.Environments[env]
+		e.Base = base
+		m.Environments[env] = e
+	}
+	setBase("prod", "prod")
+	setBase("dev", "qa")
+	setBase("qa", "dev")
+	setBase("staging", "qa")
+
+	if got := m.BaseCycle("prod"); !slices.Equal(got, []string{"prod"}) {
+		t.Errorf("Expected a self-based prod to be its own cycle, got %v", got)
+	}
+	if got := m.BaseCycle("qa"); !slices.Equal(got, []string{"qa", "dev"}) {
+		t.Errorf("Expected qa -> dev -> qa, got %v", got)
+	}
+	if got := m.BaseCycle("staging"); !slices.Equal(got, []string{"qa", "dev"}) {
+		t.Errorf("Expected staging to lead into the qa/dev cycle, got %v", got)
+	}
+
+	want := [][]string{{"dev", "qa"}, {"prod"}}
+	if got := m.BaseCycles(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected each cycle once, got %v, want %v", got, want)
+	}
+
+	// A chain through another environment that ends on a branch is fine
+	setBase("qa", "main")
+	if got := m.BaseCycle("staging"); got != nil {
+		t.Errorf("Expected staging -> qa -> main not to be a cycle, got %v", got)
+	}
+}
+
+func TestParseFeatureRef(t *testing.T) {
+	tests := []struct {
+		ref        string
+		wantBranch string
+		wantSHA    string
+		wantErr    bool
+	}{
+		{"feature/login", "feature/login", "", false},
+		{"team/feature/login", "team/feature/login", "", false},
+		{"feature/login@3f2a9c1", "feature/login", "3f2a9c1", false},
+		{"feature/login@3F2A9C1", "feature/login", "3f2a9c1", false},
+		{"feature/login@" + strings.Repeat("a", 40), "feature/login", strings.Repeat("a", 40), false},
+		{"feature/login@", "", "", true},
+		{"feature/login@abc", "", "", true},
+		{"feature/login@" + strings.Repeat("a", 41), "", "", true},
+		{"feature/login@HEAD~1", "", "", true},
+		{"feature/login@3f2a@9c1", "", "", true},
+		{"@3f2a9c1", "", "", true},
+		{"", "", "", true},
+		{"feature/..bad", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			branch, sha, err := metadata.ParseFeatureRef(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseFeatureRef(%q) error = %v, wantErr %v", tt.ref, err, tt.wantErr)
+			}
+			if branch != tt.wantBranch || sha != tt.wantSHA {
+				t.Errorf("ParseFeatureRef(%q) = %q, %q, want %q, %q", tt.ref, branch, sha, tt.wantBranch, tt.wantSHA)
+			}
+		})
+	}
+}
+
+func TestRepairConfigAndOrphanedBranches(t *testing.T) {
+	m := metadata.NewMetadata([]string{"dev"}, "main", "test@example.com")
+	m.Config.ConflictStrategy = "retry"
+	m.Config.InactiveBranchAction = "archive"
+
+	if got := m.InvalidConfigValues(); len(got) != 1 || !strings.Contains(got[0], "config.conflict_strategy") {
+		t.Errorf("Expected only conflict_strategy to be reported, got %v", got)
+	}
+	if err := m.ValidateConfig(); err == nil {
+		t.Error("Expected ValidateConfig to refuse the illegal value")
+	}
+	if got := m.RepairConfig(); len(got) != 1 {
+		t.Errorf("Expected one repair, got %v", got)
+	}
+	if m.Config.ConflictStrategy != "" || m.Config.InactiveBranchAction != "archive" {
+		t.Errorf("Expected only the illegal value to be reset, got %q and %q", m.Config.ConflictStrategy, m.Config.InactiveBranchAction)
+	}
+	if err := m.ValidateConfig(); err != nil {
+		t.Errorf("Expected a valid config after repair, got %v", err)
+	}
+
+	dev := m.Environments["dev"]
+	dev.Features = []string{"feature/gone-but-deployed"}
+	m.Environments["dev"] = dev
+	for _, name := range []string{"feature/gone-but-deployed", "feature/gone", "feature/here"} {
+		m.Branches[name] = metadata.BranchInfo{PromotedTo: []string{}}
+	}
+	exists := func(branch string) bool { return branch == "feature/here" }
+
+	// A missing branch still in an environment is for demote, not doctor
+	if got := m.OrphanedBranches(exists); !slices.Equal(got, []string{"feature/gone"}) {
+		t.Errorf("Expected only feature/gone to be orphaned, got %v", got)
+	}
+}
+
+func TestActiveFreeze(t *testing.T) {
+	utc := func(day, hour, minute int) time.Time {
+		// October 2026: the 17th is a Saturday
+		return time.Date(2026, time.October, day, hour, minute, 0, 0, time.UTC)
+	}
+	env := metadata.Environment{FreezeWindows: []metadata.FreezeWindow{
+		{Days: []string{"sat"}, Timezone: "UTC", Reason: "weekend"},
+		{Days: []string{"sun"}, Timezone: "UTC", Reason: "weekend"},
+		{Days: []string{"thu"}, Start: "22:00", End: "06:00", Timezone: "UTC", Reason: "nightly"},
+	}}
+
+	tests := []struct {
+		name      string
+		now       time.Time
+		wantUntil time.Time
+	}{
+		{"friday afternoon", utc(16, 15, 0), time.Time{}},
+		{"saturday runs into sunday", utc(17, 9, 30), utc(19, 0, 0)},
+		{"sunday", utc(18, 23, 59), utc(19, 0, 0)},
+		{"monday", utc(19, 0, 0), time.Time{}},
+		{"thursday before the window", utc(15, 21, 59), time.Time{}},
+		{"thursday night", utc(15, 22, 0), utc(16, 6, 0)},
+		{"past midnight into friday", utc(16, 5, 59), utc(16, 6, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window, until := env.ActiveFreeze(tt.now)
+			if tt.wantUntil.IsZero() {
+				if window != nil {
+					t.Errorf("Expected no freeze, got one until %s", until)
+				}
+				return
+			}
+			if window == nil {
+				t.Fatalf("Expected a freeze until %s, got none", tt.wantUntil)
+			}
+			if !until.Equal(tt.wantUntil) {
+				t.Errorf("Expected the freeze to end at %s, got %s", tt.wantUntil, until)
+			}
+		})
+	}
+
+	for _, w := range []metadata.FreezeWindow{
+		{Days: []string{"saturday"}},
+		{Start: "9:5"},
+		{Start: "25:00"},
+		{Start: "18:00", End: "18:00"},
+		{Timezone: "Mars/Olympus_Mons"},
+	} {
+		if err := w.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", w)
+		}
+	}
+}
+
+func TestRecordTipKeepsRecentBuilds(t *testing.T) {
+	m := metadata.NewMetadata([]string{"dev"}, "main", "test@example.com")
+	for i := range metadata.ReflogSize + 5 {
+		commit := fmt.Sprintf("%040x", i)
+		if err := m.RecordTip("dev", metadata.ReflogEntry{Commit: commit, Action: "rebuild"}); err != nil {
+			t.Fatalf("RecordTip failed: %v", err)
+		}
+	}
+
+	env := m.Environments["dev"]
+	if len(env.Reflog) != metadata.ReflogSize {
+		t.Fatalf("Expected %d entries, got %d", metadata.ReflogSize, len(env.Reflog))
+	}
+	if newest := env.Reflog[0].Commit; newest != fmt.Sprintf("%040x", metadata.ReflogSize+4) {
+		t.Errorf("Expected the newest entry first, got %s", newest)
+	}
+	if _, ok := env.FindReflogEntry(fmt.Sprintf("%040x", 0)); ok {
+		t.Error("Expected the oldest entries to be dropped")
+	}
+	if _, ok := env.FindReflogEntry("0000"); ok {
+		t.Error("Expected an ambiguous prefix not to match")
+	}
+	if _, ok := env.FindReflogEntry(fmt.Sprintf("%040x", 10)); !ok {
+		t.Error("Expected a kept entry to be found")
+	}
+	if err := m.RecordTip("prod", metadata.ReflogEntry{}); err == nil {
+		t.Error("Expected an unknown environment to be refused")
+	}
+}
+
+func TestContributors(t *testing.T) {
+	m := metadata.NewMetadata([]string{"dev", "qa"}, "main", "test@example.com")
+	demoted := time.Now()
+	m.Branches["feature/login"] = metadata.BranchInfo{
+		CreatedBy: "alice@example.com",
+		PromotedHistory: []metadata.PromotionEvent{
+			{Environment: "dev", PromotedBy: "Bob@Example.com"},
+			// Promoted to qa and demoted again: not in qa's contributors
+			{Environment: "qa", PromotedBy: "carol@example.com", DemotedAt: &demoted},
+		},
+	}
+	m.Branches["feature/search"] = metadata.BranchInfo{
+		PromotedHistory: []metadata.PromotionEvent{
+			{Environment: "dev", PromotedBy: "bob@example.com"},
+			{Environment: "qa", PromotedBy: "dave@example.com"},
+		},
+	}
+	m.Branches["feature/gone"] = metadata.BranchInfo{CreatedBy: "erin@example.com"}
+
+	dev := m.Environments["dev"]
+	dev.Features = []string{"feature/search", "feature/login"}
+	m.Environments["dev"] = dev
+	qa := m.Environments["qa"]
+	qa.Features = []string{"feature/search"}
+	m.Environments["qa"] = qa
+
+	if got, want := m.Contributors("dev"), []string{"alice@example.com", "bob@example.com"}; !slices.Equal(got, want) {
+		t.Errorf("Contributors(dev) = %v, want %v", got, want)
+	}
+	if got, want := m.Contributors("qa"), []string{"dave@example.com"}; !slices.Equal(got, want) {
+		t.Errorf("Contributors(qa) = %v, want %v", got, want)
+	}
+	if got := m.Contributors("prod"); got == nil || len(got) != 0 {
+		t.Errorf("Expected an empty list for an unknown environment, got %#v", got)
+	}
+}
+
+func TestCloneCopiesEnvironmentHistory(t *testing.T) {
+	m := metadata.NewMetadata([]string{"prod"}, "main", "test@example.com")
+	prod := m.Environments["prod"]
+	prod.FreezeWindows = []metadata.FreezeWindow{{Days: []string{"sat", "sun"}}}
+	prod.Reflog = []metadata.ReflogEntry{{Commit: "abc", Features: []string{"feature/a"}}}
+	prod.MergedCommits = map[string]string{"feature/a": "abc"}
+	m.Environments["prod"] = prod
+
+	c := m.Clone()
+	c.Environments["prod"].FreezeWindows[0].Days[0] = "mon"
+	c.Environments["prod"].FreezeWindows[0].Reason = "changed"
+	c.Environments["prod"].Reflog[0].Features[0] = "feature/b"
+	c.Environments["prod"].Reflog[0].Commit = "def"
+	c.Environments["prod"].MergedCommits["feature/a"] = "def"
+
+	if w := m.Environments["prod"].FreezeWindows[0]; w.Days[0] != "sat" || w.Reason != "" {
+		t.Errorf("Expected the original freeze window to be untouched, got %+v", w)
+	}
+	if entry := m.Environments["prod"].Reflog[0]; entry.Commit != "abc" || entry.Features[0] != "feature/a" {
+		t.Errorf("Expected the original reflog to be untouched, got %+v", entry)
+	}
+	if commit := m.Environments["prod"].MergedCommits["feature/a"]; commit != "abc" {
+		t.Errorf("Expected the original merged commits to be untouched, got %q", commit)
+	}
+}
+
+func TestCloneCopiesAdmins(t *testing.T) {
+	m := metadata.NewMetadata([]string{"dev"}, "main", "test@example.com")
+	m.Config.Admins = []string{"admin@example.com"}
+
+	c := m.Clone()
+	c.Config.Admins[0] = "intruder@example.com"
+
+	if !m.IsAdmin("admin@example.com") || m.IsAdmin("intruder@example.com") {
+		t.Errorf("Expected the original admins to be untouched, got %v", m.Config.Admins)
+	}
+}
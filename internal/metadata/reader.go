@@ -3,7 +3,14 @@ package metadata
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/DoomedRamen/hitch/internal/logging"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 )
@@ -23,8 +30,21 @@ func NewReader(repo *git.Repository) *Reader {
 	return &Reader{repo: repo}
 }
 
-// Read reads the metadata from the hitch-metadata branch
+// cache holds the last metadata read, keyed by the hitch-metadata commit it
+// came from. Commits are content-addressed, so an entry can never go stale:
+// a different tip is simply a miss.
+var cache struct {
+	sync.Mutex
+	commit plumbing.Hash
+	meta   *Metadata
+}
+
+// Read reads the metadata from the hitch-metadata branch. Reading the same
+// commit again returns a copy of the cached result without touching the
+// object store.
 func (r *Reader) Read() (*Metadata, error) {
+	defer logging.StartPhase("read metadata")()
+
 	// Get reference to hitch-metadata branch
 	ref, err := r.repo.Reference(plumbing.NewBranchReferenceName(MetadataBranch), true)
 	if err != nil {
@@ -34,8 +54,132 @@ func (r *Reader) Read() (*Metadata, error) {
 		}
 	}
 
-	// Get commit
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.meta != nil && cache.commit == ref.Hash() {
+		logging.Debugf("read %s from %s@%s (cached)", MetadataFile, MetadataBranch, ref.Hash().String()[:7])
+		return cache.meta.Clone(), nil
+	}
+
+	contents, err := r.readBlob(ref.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse and validate
+	metadata, err := Parse(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.Debugf("read %s from %s@%s", MetadataFile, MetadataBranch, ref.Hash().String()[:7])
+
+	cache.commit = ref.Hash()
+	cache.meta = metadata
+	return metadata.Clone(), nil
+}
+
+// ReadUnvalidated reads the metadata like Read, but doesn't check config
+// values, so that doctor can report and repair ones a hand edit broke.
+// Required fields are still checked. The result isn't cached.
+func (r *Reader) ReadUnvalidated() (*Metadata, error) {
+	ref, err := r.repo.Reference(plumbing.NewBranchReferenceName(MetadataBranch), true)
+	if err != nil {
+		return nil, &MetadataReadError{
+			Reason: "hitch-metadata branch not found (has 'hitch init' been run?)",
+			Err:    err,
+		}
+	}
+
+	contents, err := r.readBlob(ref.Hash())
+	if err != nil {
+		return nil, err
+	}
+	return parse(contents, false)
+}
+
+// dateLayouts are the date forms ReadAt accepts besides a revision
+var dateLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// ReadAt reads the metadata as it was at ref, which may be any revision
+// (a SHA, "hitch-metadata~3", a tag) or a date such as "2025-10-17" or
+// "2025-10-17 14:30", read as local time. A date picks the last
+// hitch-metadata commit made at or before it.
+func (r *Reader) ReadAt(ref string) (*Metadata, error) {
+	defer logging.StartPhase("read metadata at " + ref)()
+
+	hash, err := r.repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		when, ok := parseDate(ref)
+		if !ok {
+			return nil, &MetadataReadError{
+				Reason: fmt.Sprintf("%s is not a revision or a date", ref),
+				Err:    err,
+			}
+		}
+		if hash, err = r.commitAt(when); err != nil {
+			return nil, err
+		}
+	}
+
+	contents, err := r.readBlob(*hash)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.Debugf("read %s from %s", MetadataFile, hash.String()[:7])
+	return Parse(contents)
+}
+
+// parseDate parses s in one of dateLayouts, in local time
+func parseDate(s string) (time.Time, bool) {
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			if layout == "2006-01-02" {
+				// The whole day
+				t = t.Add(24*time.Hour - time.Nanosecond)
+			}
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// commitAt returns the last hitch-metadata commit made at or before when,
+// following first parents
+func (r *Reader) commitAt(when time.Time) (*plumbing.Hash, error) {
+	ref, err := r.repo.Reference(plumbing.NewBranchReferenceName(MetadataBranch), true)
+	if err != nil {
+		return nil, &MetadataReadError{
+			Reason: "hitch-metadata branch not found (has 'hitch init' been run?)",
+			Err:    err,
+		}
+	}
+
 	commit, err := r.repo.CommitObject(ref.Hash())
+	for err == nil {
+		if !commit.Committer.When.After(when) {
+			return &commit.Hash, nil
+		}
+		if commit.NumParents() == 0 {
+			break
+		}
+		commit, err = commit.Parent(0)
+	}
+	if err != nil {
+		return nil, &MetadataReadError{Reason: "failed to walk hitch-metadata history", Err: err}
+	}
+
+	return nil, &MetadataReadError{
+		Reason: fmt.Sprintf("no metadata existed at %s; hitch was initialized later", when.Format("2006-01-02 15:04")),
+	}
+}
+
+// readBlob reads hitch.json from commit by looking up its entry in the root
+// tree and loading just that blob, rather than walking the tree
+func (r *Reader) readBlob(commitHash plumbing.Hash) ([]byte, error) {
+	// Get commit
+	commit, err := r.repo.CommitObject(commitHash)
 	if err != nil {
 		return nil, &MetadataReadError{
 			Reason: "failed to get commit from hitch-metadata branch",
@@ -44,7 +188,7 @@ func (r *Reader) Read() (*Metadata, error) {
 	}
 
 	// Get tree
-	tree, err := commit.Tree()
+	tree, err := r.repo.TreeObject(commit.TreeHash)
 	if err != nil {
 		return nil, &MetadataReadError{
 			Reason: "failed to get tree from commit",
@@ -52,8 +196,8 @@ func (r *Reader) Read() (*Metadata, error) {
 		}
 	}
 
-	// Get hitch.json file
-	file, err := tree.File(MetadataFile)
+	// Get hitch.json entry
+	entry, err := tree.FindEntry(MetadataFile)
 	if err != nil {
 		return nil, &MetadataReadError{
 			Reason: fmt.Sprintf("%s not found in hitch-metadata branch", MetadataFile),
@@ -62,27 +206,56 @@ func (r *Reader) Read() (*Metadata, error) {
 	}
 
 	// Read file contents
-	contents, err := file.Contents()
+	blob, err := r.repo.BlobObject(entry.Hash)
 	if err != nil {
 		return nil, &MetadataReadError{
 			Reason: fmt.Sprintf("failed to read %s contents", MetadataFile),
 			Err:    err,
 		}
 	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, &MetadataReadError{
+			Reason: fmt.Sprintf("failed to read %s contents", MetadataFile),
+			Err:    err,
+		}
+	}
+	defer reader.Close()
 
-	// Parse JSON
-	var metadata Metadata
-	if err := json.Unmarshal([]byte(contents), &metadata); err != nil {
+	contents, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, &MetadataReadError{
+			Reason: fmt.Sprintf("failed to read %s contents", MetadataFile),
+			Err:    err,
+		}
+	}
+	return contents, nil
+}
+
+// Parse parses and validates the contents of a hitch.json file
+func Parse(data []byte) (*Metadata, error) {
+	return parse(data, true)
+}
+
+// parse parses data, checking config values only if checkConfig
+func parse(data []byte, checkConfig bool) (*Metadata, error) {
+	// Fields missing from hitch.json keep their documented defaults
+	metadata := Metadata{Config: Config{AutoRebuildOnPromote: true}}
+	if err := json.Unmarshal(data, &metadata); err != nil {
 		return nil, &InvalidMetadataError{
 			Reason: "failed to parse JSON",
 			Err:    err,
 		}
 	}
 
-	// Validate
-	if err := r.validate(&metadata); err != nil {
+	if err := validate(&metadata); err != nil {
 		return nil, err
 	}
+	if checkConfig {
+		if err := validateConfig(&metadata); err != nil {
+			return nil, err
+		}
+	}
 
 	return &metadata, nil
 }
@@ -93,8 +266,21 @@ func (r *Reader) Exists() bool {
 	return err == nil
 }
 
+// Commit returns the SHA of the hitch-metadata commit Read would read, so
+// callers can later tell whether the metadata has changed since
+func (r *Reader) Commit() (string, error) {
+	ref, err := r.repo.Reference(plumbing.NewBranchReferenceName(MetadataBranch), true)
+	if err != nil {
+		return "", &MetadataReadError{
+			Reason: "hitch-metadata branch not found (has 'hitch init' been run?)",
+			Err:    err,
+		}
+	}
+	return ref.Hash().String(), nil
+}
+
 // validate performs basic validation on metadata
-func (r *Reader) validate(m *Metadata) error {
+func validate(m *Metadata) error {
 	if m.Version == "" {
 		return &InvalidMetadataError{Reason: "version is required"}
 	}
@@ -107,5 +293,63 @@ func (r *Reader) validate(m *Metadata) error {
 		return &InvalidMetadataError{Reason: "config.base_branch is required"}
 	}
 
+	for _, name := range slices.Sorted(maps.Keys(m.Environments)) {
+		for i, w := range m.Environments[name].FreezeWindows {
+			if err := w.Validate(); err != nil {
+				return &InvalidMetadataError{Reason: fmt.Sprintf("environments.%s.freeze_windows[%d]: %v", name, i, err)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ConflictStrategies are the legal values of config.conflict_strategy
+var ConflictStrategies = []string{"abort", "manual"}
+
+// InactiveBranchActions are the legal values of config.inactive_branch_action:
+// "warn" only reports inactive branches, "archive" tags each one as
+// archive/<branch>-<date> before deleting it, and "delete" deletes it
+var InactiveBranchActions = []string{"warn", "archive", "delete"}
+
+// ValidateConfig checks m's config values as reading hitch.json does, for
+// metadata read with ReadUnvalidated
+func (m *Metadata) ValidateConfig() error {
+	return validateConfig(m)
+}
+
+// validateConfig checks enum-valued config fields against their legal values
+// and that counts and durations aren't negative, so a hand-edited hitch.json
+// fails when read instead of misbehaving later
+func validateConfig(m *Metadata) error {
+	c := m.Config
+
+	// Empty means the default
+	if c.ConflictStrategy != "" && !slices.Contains(ConflictStrategies, c.ConflictStrategy) {
+		return &InvalidMetadataError{Reason: fmt.Sprintf("config.conflict_strategy is %q, must be one of %s", c.ConflictStrategy, strings.Join(ConflictStrategies, ", "))}
+	}
+	if c.InactiveBranchAction != "" && !slices.Contains(InactiveBranchActions, c.InactiveBranchAction) {
+		return &InvalidMetadataError{Reason: fmt.Sprintf("config.inactive_branch_action is %q, must be one of %s", c.InactiveBranchAction, strings.Join(InactiveBranchActions, ", "))}
+	}
+
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"config.retention_days_after_merge", c.RetentionDaysAfterMerge},
+		{"config.stale_days_no_activity", c.StaleDaysNoActivity},
+		{"config.lock_timeout_minutes", c.LockTimeoutMinutes},
+	} {
+		if field.value < 0 {
+			return &InvalidMetadataError{Reason: fmt.Sprintf("%s is %d, must not be negative", field.name, field.value)}
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(m.Branches)) {
+		if days := m.Branches[name].RetentionDays; days != nil && *days < 0 {
+			return &InvalidMetadataError{Reason: fmt.Sprintf("branches.%s.retention_days is %d, must not be negative", name, *days)}
+		}
+	}
+
 	return nil
 }
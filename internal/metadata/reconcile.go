@@ -0,0 +1,157 @@
+package metadata
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Inconsistencies reports every place where Environment.Features and
+// BranchInfo.PromotedTo disagree, without changing anything
+func (m *Metadata) Inconsistencies() []string {
+	return m.reconcile(false)
+}
+
+// Reconcile repairs drift between Environment.Features and
+// BranchInfo.PromotedTo, e.g. after a partially failed write, and returns a
+// description of each repair made.
+//
+// Environment.Features is treated as the source of truth because it is what
+// rebuilds merge: a feature listed in an environment gets that environment
+// added to its PromotedTo, and an environment in PromotedTo that doesn't list
+// the branch is removed from it.
+func (m *Metadata) Reconcile() []string {
+	return m.reconcile(true)
+}
+
+func (m *Metadata) reconcile(apply bool) []string {
+	found := []string{}
+
+	// 1. Features missing from their branch's PromotedTo
+	for _, envName := range m.EnvironmentNames() {
+		for _, feature := range m.Environments[envName].Features {
+			info, exists := m.Branches[feature]
+			if exists && containsString(info.PromotedTo, envName) {
+				continue
+			}
+
+			if !apply {
+				found = append(found, fmt.Sprintf("%s is in %s's features but %s is missing from its promoted_to", feature, envName, envName))
+				continue
+			}
+
+			if !exists {
+				info = BranchInfo{
+					CreatedAt:       time.Now(),
+					PromotedTo:      []string{},
+					PromotedHistory: []PromotionEvent{},
+				}
+			}
+			info.PromotedTo = append(info.PromotedTo, envName)
+			m.Branches[feature] = info
+			found = append(found, fmt.Sprintf("Added %s to %s's promoted_to", envName, feature))
+		}
+	}
+
+	// 2. PromotedTo entries whose environment doesn't list the branch
+	branches := make([]string, 0, len(m.Branches))
+	for name := range m.Branches {
+		branches = append(branches, name)
+	}
+	sort.Strings(branches)
+
+	for _, branch := range branches {
+		info := m.Branches[branch]
+		kept := []string{}
+		for _, envName := range info.PromotedTo {
+			env, exists := m.Environments[envName]
+			if exists && containsString(env.Features, branch) {
+				kept = append(kept, envName)
+				continue
+			}
+
+			if apply {
+				found = append(found, fmt.Sprintf("Removed %s from %s's promoted_to", envName, branch))
+			} else if !exists {
+				found = append(found, fmt.Sprintf("%s's promoted_to lists %s, which is not an environment", branch, envName))
+			} else {
+				found = append(found, fmt.Sprintf("%s's promoted_to lists %s but %s's features don't include it", branch, envName, envName))
+			}
+		}
+
+		if apply && len(kept) != len(info.PromotedTo) {
+			info.PromotedTo = kept
+			m.Branches[branch] = info
+		}
+	}
+
+	return found
+}
+
+// InvalidConfigValues reports every enum-valued config field holding a
+// value that isn't one of its legal values, without changing anything
+func (m *Metadata) InvalidConfigValues() []string {
+	return m.repairConfig(false)
+}
+
+// RepairConfig resets enum-valued config fields holding illegal values to
+// their defaults and returns a description of each repair made
+func (m *Metadata) RepairConfig() []string {
+	return m.repairConfig(true)
+}
+
+func (m *Metadata) repairConfig(apply bool) []string {
+	found := []string{}
+	for _, field := range []struct {
+		name  string
+		value *string
+		legal []string
+	}{
+		{"config.conflict_strategy", &m.Config.ConflictStrategy, ConflictStrategies},
+		{"config.inactive_branch_action", &m.Config.InactiveBranchAction, InactiveBranchActions},
+	} {
+		// Empty means the default
+		if *field.value == "" || containsString(field.legal, *field.value) {
+			continue
+		}
+		if apply {
+			found = append(found, fmt.Sprintf("Reset %s from %q to the default", field.name, *field.value))
+			*field.value = ""
+		} else {
+			found = append(found, fmt.Sprintf("%s is %q, must be one of %s", field.name, *field.value, strings.Join(field.legal, ", ")))
+		}
+	}
+	return found
+}
+
+// OrphanedBranches returns the tracked branches, sorted, that are in no
+// environment and for which exists reports false: entries left behind by
+// branches deleted outside hitch
+func (m *Metadata) OrphanedBranches(exists func(branch string) bool) []string {
+	inEnvironment := make(map[string]bool)
+	for _, env := range m.Environments {
+		for _, feature := range env.Features {
+			inEnvironment[feature] = true
+		}
+	}
+
+	orphans := []string{}
+	for _, name := range slices.Sorted(maps.Keys(m.Branches)) {
+		if !inEnvironment[name] && !exists(name) {
+			orphans = append(orphans, name)
+		}
+	}
+	return orphans
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
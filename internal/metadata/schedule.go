@@ -0,0 +1,149 @@
+package metadata
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FreezeWindow is a recurring period, such as weekends, during which an
+// environment is in a scheduled change freeze
+type FreezeWindow struct {
+	// Days the window starts on, "mon" through "sun"; empty means every day
+	Days []string `json:"days,omitempty"`
+	// Start and End are "HH:MM". An empty Start is midnight and an empty
+	// End is the end of the day; an End before Start runs past midnight.
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	// Timezone is an IANA zone such as "Europe/London"; empty means local time
+	Timezone string `json:"timezone,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// weekdays are the legal FreezeWindow.Days values, indexed by time.Weekday
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Validate checks w's days, times, and timezone
+func (w FreezeWindow) Validate() error {
+	for _, day := range w.Days {
+		if !slices.Contains(weekdays, day) {
+			return fmt.Errorf("day %q must be one of %s", day, strings.Join(weekdays, ", "))
+		}
+	}
+	start, err := parseClock(w.Start, 0)
+	if err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	end, err := parseClock(w.End, 24*60)
+	if err != nil {
+		return fmt.Errorf("end: %w", err)
+	}
+	if start == end {
+		return fmt.Errorf("start and end must differ")
+	}
+	if _, err := w.location(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseClock parses "HH:MM" into minutes after midnight, allowing "24:00"
+// for the end of the day. An empty s is def.
+func parseClock(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	h, m, ok := strings.Cut(s, ":")
+	hours, herr := strconv.Atoi(h)
+	minutes, merr := strconv.Atoi(m)
+	if !ok || len(m) != 2 || herr != nil || merr != nil || hours < 0 || minutes < 0 || minutes > 59 {
+		return 0, fmt.Errorf("%q is not a time like 18:30", s)
+	}
+	clock := hours*60 + minutes
+	if clock > 24*60 {
+		return 0, fmt.Errorf("%q is past 24:00", s)
+	}
+	return clock, nil
+}
+
+func (w FreezeWindow) location() (*time.Location, error) {
+	if w.Timezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", w.Timezone)
+	}
+	return loc, nil
+}
+
+// coveringEnd returns when the occurrence of w that covers t ends, and false
+// if no occurrence covers t. An occurrence that runs past midnight belongs to
+// the day it started, so one started yesterday can still cover t.
+func (w FreezeWindow) coveringEnd(t time.Time) (time.Time, bool) {
+	loc, err := w.location()
+	if err != nil {
+		return time.Time{}, false
+	}
+	start, err := parseClock(w.Start, 0)
+	if err != nil {
+		return time.Time{}, false
+	}
+	end, err := parseClock(w.End, 24*60)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	t = t.In(loc)
+	year, month, day := t.Date()
+	for _, offset := range []int{0, -1} {
+		// time.Date normalizes the day and minutes, across DST changes too
+		from := time.Date(year, month, day+offset, 0, start, 0, 0, loc)
+		if len(w.Days) > 0 && !slices.Contains(w.Days, weekdays[from.Weekday()]) {
+			continue
+		}
+		endDay := day + offset
+		if end <= start {
+			endDay++
+		}
+		to := time.Date(year, month, endDay, 0, end, 0, 0, loc)
+		if !t.Before(from) && t.Before(to) {
+			return to, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ActiveFreeze returns the freeze window covering now and when the freeze
+// ends, or nil if e isn't in a scheduled freeze. Windows that meet or
+// overlap, such as Saturday and Sunday, count as one freeze.
+func (e Environment) ActiveFreeze(now time.Time) (*FreezeWindow, time.Time) {
+	var (
+		active *FreezeWindow
+		until  time.Time
+	)
+	for i := range e.FreezeWindows {
+		if end, ok := e.FreezeWindows[i].coveringEnd(now); ok && end.After(until) {
+			active, until = &e.FreezeWindows[i], end
+		}
+	}
+	if active == nil {
+		return nil, time.Time{}
+	}
+
+	// Bounded, since windows covering every day never end
+	for range 7 * len(e.FreezeWindows) {
+		extended := false
+		for _, w := range e.FreezeWindows {
+			if end, ok := w.coveringEnd(until); ok && end.After(until) {
+				until, extended = end, true
+			}
+		}
+		if !extended {
+			break
+		}
+	}
+	return active, until
+}
@@ -0,0 +1,128 @@
+package metadata
+
+import (
+	"fmt"
+
+	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+)
+
+// SetStack defines stack name as branches, in dependency order, replacing
+// any stack already using that name. A branch can belong to only one stack.
+func (m *Metadata) SetStack(name string, branches []string) error {
+	if name == "" {
+		return fmt.Errorf("stack name cannot be empty")
+	}
+	if len(branches) == 0 {
+		return fmt.Errorf("stack '%s' needs at least one branch", name)
+	}
+
+	seen := make(map[string]bool)
+	for _, branch := range branches {
+		if err := hitchgit.ValidBranchName(branch); err != nil {
+			return err
+		}
+		if seen[branch] {
+			return fmt.Errorf("%s is listed more than once in stack '%s'", branch, name)
+		}
+		seen[branch] = true
+
+		if other, ok := m.StackOf(branch); ok && other != name {
+			return fmt.Errorf("%s already belongs to stack '%s'", branch, other)
+		}
+	}
+
+	if m.Stacks == nil {
+		m.Stacks = make(map[string][]string)
+	}
+	m.Stacks[name] = append([]string{}, branches...)
+	return nil
+}
+
+// StackOf returns the name of the stack branch belongs to, if any
+func (m *Metadata) StackOf(branch string) (string, bool) {
+	for name, members := range m.Stacks {
+		for _, member := range members {
+			if member == branch {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// PromoteStack adds every branch of stack to env and orders them in env's
+// feature list as they are in the stack, after any other features, so each
+// branch is merged after the ones it depends on. It returns the branches that
+// weren't already in env.
+func (m *Metadata) PromoteStack(env string, stack string, user string) ([]string, error) {
+	members, ok := m.Stacks[stack]
+	if !ok {
+		return nil, &StackNotFoundError{Stack: stack}
+	}
+
+	e, exists := m.Environments[env]
+	if !exists {
+		return nil, &EnvironmentNotFoundError{Environment: env}
+	}
+
+	present := make(map[string]bool)
+	for _, f := range e.Features {
+		present[f] = true
+	}
+
+	added := []string{}
+	for _, branch := range members {
+		if present[branch] {
+			continue
+		}
+		if err := m.AddBranchToEnvironment(env, branch, user); err != nil {
+			return nil, err
+		}
+		added = append(added, branch)
+	}
+
+	inStack := make(map[string]bool)
+	for _, branch := range members {
+		inStack[branch] = true
+	}
+
+	e = m.Environments[env]
+	ordered := []string{}
+	for _, f := range e.Features {
+		if !inStack[f] {
+			ordered = append(ordered, f)
+		}
+	}
+	e.Features = append(ordered, members...)
+	m.Environments[env] = e
+
+	return added, nil
+}
+
+// StackDependents returns the branches in env that come after branch in its
+// stack, i.e. the ones that would lose something they build on if branch
+// were demoted from env
+func (m *Metadata) StackDependents(env string, branch string) []string {
+	stack, ok := m.StackOf(branch)
+	if !ok {
+		return nil
+	}
+
+	present := make(map[string]bool)
+	for _, f := range m.Environments[env].Features {
+		present[f] = true
+	}
+
+	dependents := []string{}
+	after := false
+	for _, member := range m.Stacks[stack] {
+		if member == branch {
+			after = true
+			continue
+		}
+		if after && present[member] {
+			dependents = append(dependents, member)
+		}
+	}
+	return dependents
+}
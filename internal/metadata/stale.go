@@ -0,0 +1,231 @@
+package metadata
+
+import (
+	"sort"
+	"time"
+)
+
+// StaleReason says why a branch was reported by stale-branch analysis
+type StaleReason string
+
+const (
+	// StaleMerged branches were merged to main and are past their cleanup date
+	StaleMerged StaleReason = "merged"
+	// StaleInactive branches are unmerged with no recent commits
+	StaleInactive StaleReason = "inactive"
+)
+
+// StaleBranch is a single result of stale-branch analysis
+type StaleBranch struct {
+	Branch          string
+	Reason          StaleReason
+	DaysSinceMerge  int
+	DaysSinceCommit int
+	InEnvironment   bool
+}
+
+// SafeToDelete reports whether cleanup may delete the branch
+func (s StaleBranch) SafeToDelete() bool {
+	return s.Reason == StaleMerged && !s.InEnvironment
+}
+
+// StaleBranchDetails analyzes every tracked branch and returns those that are
+// stale, sorted by name. This is the single source of truth for cleanup and
+// status --stale.
+//
+// A merged branch is stale once its EligibleForCleanupAt date has passed;
+// branches without an eligibility date (released with --no-delete) are never
+// stale. A merged branch still in an environment is reported with
+// InEnvironment set and is not safe to delete. An unmerged branch is stale
+// (inactive) if its last commit is older than Config.StaleDaysNoActivity.
+func (m *Metadata) StaleBranchDetails() []StaleBranch {
+	stale := []StaleBranch{}
+
+	for branchName, info := range m.Branches {
+		if s, ok := m.staleBranch(branchName, info); ok {
+			stale = append(stale, s)
+		}
+	}
+
+	sort.Slice(stale, func(i, j int) bool {
+		return stale[i].Branch < stale[j].Branch
+	})
+
+	return stale
+}
+
+// staleBranch applies the rules of StaleBranchDetails to a single branch
+func (m *Metadata) staleBranch(branchName string, info BranchInfo) (StaleBranch, bool) {
+	if info.MergedToMainAt != nil {
+		if !info.IsEligibleForCleanup() {
+			return StaleBranch{}, false
+		}
+		return StaleBranch{
+			Branch:         branchName,
+			Reason:         StaleMerged,
+			DaysSinceMerge: daysSince(*info.MergedToMainAt),
+			InEnvironment:  m.IsInAnyEnvironment(branchName),
+		}, true
+	}
+
+	if info.LastCommitAt.IsZero() {
+		return StaleBranch{}, false
+	}
+
+	if days := daysSince(info.LastCommitAt); days > m.Config.StaleDaysNoActivity {
+		return StaleBranch{
+			Branch:          branchName,
+			Reason:          StaleInactive,
+			DaysSinceCommit: days,
+			InEnvironment:   m.IsInAnyEnvironment(branchName),
+		}, true
+	}
+
+	return StaleBranch{}, false
+}
+
+// CleanupBlocker is the first condition, in the order cleanup checks them,
+// that keeps a branch from being deleted
+type CleanupBlocker string
+
+const (
+	CleanupNotTracked    CleanupBlocker = "not tracked by hitch"
+	CleanupNotMerged     CleanupBlocker = "not merged to main"
+	CleanupKept          CleanupBlocker = "released with --no-delete"
+	CleanupRetention     CleanupBlocker = "still within its retention period"
+	CleanupInEnvironment CleanupBlocker = "still in an environment"
+)
+
+// CleanupExplanation is every input to cleanup's decision about one branch
+type CleanupExplanation struct {
+	Branch        string
+	Tracked       bool
+	MergedAt      *time.Time
+	RetentionDays int
+	EligibleAt    *time.Time
+	PastRetention bool
+	Environments  []string
+	// Blocker is empty when cleanup would delete the branch
+	Blocker CleanupBlocker
+}
+
+// SafeToDelete reports whether cleanup would delete the branch
+func (e CleanupExplanation) SafeToDelete() bool {
+	return e.Blocker == ""
+}
+
+// ExplainCleanup walks through cleanup's decision for branch: is it tracked,
+// merged, past retention, and out of every environment. The verdict is the
+// one StaleBranchDetails reaches.
+func (m *Metadata) ExplainCleanup(branch string) CleanupExplanation {
+	e := CleanupExplanation{Branch: branch, Environments: m.EnvironmentsContaining(branch)}
+
+	info, tracked := m.Branches[branch]
+	if !tracked {
+		e.Blocker = CleanupNotTracked
+		return e
+	}
+	e.Tracked = true
+	e.MergedAt = info.MergedToMainAt
+	e.RetentionDays = m.RetentionDays(branch)
+	e.EligibleAt = info.EligibleForCleanupAt
+	e.PastRetention = info.IsEligibleForCleanup()
+
+	if s, ok := m.staleBranch(branch, info); ok && s.SafeToDelete() {
+		return e
+	}
+
+	switch {
+	case info.MergedToMainAt == nil:
+		e.Blocker = CleanupNotMerged
+	case info.EligibleForCleanupAt == nil:
+		e.Blocker = CleanupKept
+	case !e.PastRetention:
+		e.Blocker = CleanupRetention
+	default:
+		e.Blocker = CleanupInEnvironment
+	}
+	return e
+}
+
+// StaleBranches returns the names of branches that are safe to delete and of
+// inactive branches, both sorted by name. See StaleBranchDetails.
+func (m *Metadata) StaleBranches() (safe, inactive []string) {
+	safe = []string{}
+	inactive = []string{}
+
+	for _, s := range m.StaleBranchDetails() {
+		switch {
+		case s.SafeToDelete():
+			safe = append(safe, s.Branch)
+		case s.Reason == StaleInactive:
+			inactive = append(inactive, s.Branch)
+		}
+	}
+
+	return safe, inactive
+}
+
+// IsInAnyEnvironment checks if a branch is in any environment's feature list
+func (m *Metadata) IsInAnyEnvironment(branch string) bool {
+	for _, env := range m.Environments {
+		for _, f := range env.Features {
+			if f == branch {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EnvironmentsContaining returns the environments whose feature list has
+// branch, sorted by name
+func (m *Metadata) EnvironmentsContaining(branch string) []string {
+	envs := []string{}
+	for _, name := range m.EnvironmentNames() {
+		for _, f := range m.Environments[name].Features {
+			if f == branch {
+				envs = append(envs, name)
+				break
+			}
+		}
+	}
+	return envs
+}
+
+// MergedFeaturesInEnvironments returns, for each environment, the features
+// still in it whose branch is already merged to main. Release removes a
+// feature from every environment, so these were re-added by hand since.
+func (m *Metadata) MergedFeaturesInEnvironments() map[string][]string {
+	merged := map[string][]string{}
+	for _, name := range m.EnvironmentNames() {
+		for _, f := range m.Environments[name].Features {
+			if info, exists := m.Branches[f]; exists && info.MergedToMainAt != nil {
+				merged[name] = append(merged[name], f)
+			}
+		}
+	}
+	return merged
+}
+
+// IsFeatureBranch reports whether branch could be a feature: it isn't an
+// environment, a base branch, or the metadata branch
+func (m *Metadata) IsFeatureBranch(branch string) bool {
+	if branch == MetadataBranch || branch == m.Config.BaseBranch {
+		return false
+	}
+	if _, isEnv := m.Environments[branch]; isEnv {
+		return false
+	}
+	for _, env := range m.Environments {
+		if env.Base == branch {
+			return false
+		}
+	}
+	return true
+}
+
+// daysSince returns the number of whole days since t
+func daysSince(t time.Time) int {
+	return int(time.Since(t).Hours() / 24)
+}
@@ -1,6 +1,20 @@
 package metadata
 
-import "time"
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/version"
+)
+
+// SchemaVersion is the hitch.json format version written by this build
+const SchemaVersion = "1.0.0"
 
 // Metadata represents the complete hitch.json structure
 type Metadata struct {
@@ -9,31 +23,126 @@ type Metadata struct {
 	Branches     map[string]BranchInfo  `json:"branches"`
 	Config       Config                 `json:"config"`
 	Meta         MetaInfo               `json:"metadata"`
+	// Stacks maps a stack name to its branches in dependency order: each
+	// branch builds on the ones before it
+	Stacks map[string][]string `json:"stacks,omitempty"`
+	// Frozen puts the whole repository in maintenance mode: every command
+	// that changes metadata or hitched branches refuses to run
+	Frozen       bool       `json:"frozen,omitempty"`
+	FrozenBy     string     `json:"frozen_by,omitempty"`
+	FrozenAt     *time.Time `json:"frozen_at,omitempty"`
+	FrozenReason string     `json:"frozen_reason,omitempty"`
 }
 
 // Environment represents a deployment environment (dev, qa, etc.)
 type Environment struct {
-	Base              string    `json:"base"`
-	Features          []string  `json:"features"`
-	Locked            bool      `json:"locked"`
-	LockedBy          string    `json:"locked_by,omitempty"`
-	LockedAt          time.Time `json:"locked_at,omitempty"`
-	LockedReason      string    `json:"locked_reason,omitempty"`
+	Base         string    `json:"base"`
+	Features     []string  `json:"features"`
+	Locked       bool      `json:"locked"`
+	LockedBy     string    `json:"locked_by,omitempty"`
+	LockedAt     time.Time `json:"locked_at,omitempty"`
+	LockedReason string    `json:"locked_reason,omitempty"`
+	// LockedHost and LockedContext say where a lock was taken: the machine,
+	// and optionally something like a CI job URL
+	LockedHost        string    `json:"locked_host,omitempty"`
+	LockedContext     string    `json:"locked_context,omitempty"`
 	LastRebuild       time.Time `json:"last_rebuild,omitempty"`
 	LastRebuildCommit string    `json:"last_rebuild_commit,omitempty"`
+	// Pins maps a feature to the commit SHA rebuilds merge instead of its tip
+	Pins map[string]string `json:"pins,omitempty"`
+	// Skipped lists features the last rebuild left out after a conflict
+	Skipped []string `json:"skipped,omitempty"`
+	// MergedCommits maps each feature the last rebuild merged to the commit
+	// it merged. A feature whose changes were already there gets no merge
+	// commit, so it isn't an ancestor of the hitched branch; this records that
+	// it's included all the same.
+	MergedCommits map[string]string `json:"merged_commits,omitempty"`
+	// FreezeWindows are recurring periods when changes to the environment
+	// are refused unless forced
+	FreezeWindows []FreezeWindow `json:"freeze_windows,omitempty"`
+	// Reflog lists the commits the hitched branch was set to by recent
+	// rebuilds and rollbacks, newest first, since force pushes lose them
+	Reflog []ReflogEntry `json:"reflog,omitempty"`
+	// HadFeatures is set when a feature is first promoted to the environment
+	// and never cleared, unlike branch history, which cleanup and
+	// compact-history trim
+	HadFeatures bool `json:"had_features,omitempty"`
+}
+
+// EverHadFeatures reports whether a feature was ever promoted to e. Metadata
+// from before HadFeatures existed falls back to e's reflog.
+func (e Environment) EverHadFeatures() bool {
+	if e.HadFeatures {
+		return true
+	}
+	for _, entry := range e.Reflog {
+		if len(entry.Features) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ReflogSize is how many entries an environment's reflog keeps
+const ReflogSize = 20
+
+// ReflogEntry is one commit an environment's hitched branch was set to
+type ReflogEntry struct {
+	Commit string    `json:"commit"`
+	At     time.Time `json:"at"`
+	By     string    `json:"by,omitempty"`
+	// Action is "rebuild" or "rollback"
+	Action   string   `json:"action"`
+	Features []string `json:"features"`
+}
+
+// FindReflogEntry returns the entry of e's reflog whose commit starts with
+// sha, and false if there is none or sha matches more than one commit
+func (e Environment) FindReflogEntry(sha string) (ReflogEntry, bool) {
+	sha = strings.ToLower(sha)
+	var found *ReflogEntry
+	for i, entry := range e.Reflog {
+		if !strings.HasPrefix(entry.Commit, sha) {
+			continue
+		}
+		if found != nil && found.Commit != entry.Commit {
+			return ReflogEntry{}, false
+		}
+		if found == nil {
+			found = &e.Reflog[i]
+		}
+	}
+	if sha == "" || found == nil {
+		return ReflogEntry{}, false
+	}
+	return *found, true
+}
+
+// MergeRef returns what a rebuild merges for feature: its pinned commit if it
+// has one, otherwise the branch itself
+func (e Environment) MergeRef(feature string) string {
+	if sha, ok := e.Pins[feature]; ok {
+		return sha
+	}
+	return feature
 }
 
 // BranchInfo tracks the lifecycle of a feature branch
 type BranchInfo struct {
-	CreatedAt           time.Time          `json:"created_at"`
-	CreatedBy           string             `json:"created_by,omitempty"`
-	PromotedTo          []string           `json:"promoted_to"`
-	PromotedHistory     []PromotionEvent   `json:"promoted_history,omitempty"`
-	MergedToMainAt      *time.Time         `json:"merged_to_main_at,omitempty"`
-	MergedToMainBy      string             `json:"merged_to_main_by,omitempty"`
-	LastCommitAt        time.Time          `json:"last_commit_at,omitempty"`
-	LastCommitSHA       string             `json:"last_commit_sha,omitempty"`
-	EligibleForCleanupAt *time.Time        `json:"eligible_for_cleanup_at,omitempty"`
+	CreatedAt       time.Time        `json:"created_at"`
+	CreatedBy       string           `json:"created_by,omitempty"`
+	PromotedTo      []string         `json:"promoted_to"`
+	PromotedHistory []PromotionEvent `json:"promoted_history,omitempty"`
+	MergedToMainAt  *time.Time       `json:"merged_to_main_at,omitempty"`
+	MergedToMainBy  string           `json:"merged_to_main_by,omitempty"`
+	// MergedInto is the base branch the release merged into, which isn't
+	// Config.BaseBranch when environments have different bases
+	MergedInto           string     `json:"merged_into,omitempty"`
+	LastCommitAt         time.Time  `json:"last_commit_at,omitempty"`
+	LastCommitSHA        string     `json:"last_commit_sha,omitempty"`
+	EligibleForCleanupAt *time.Time `json:"eligible_for_cleanup_at,omitempty"`
+	// RetentionDays overrides Config.RetentionDaysAfterMerge for this branch
+	RetentionDays *int `json:"retention_days,omitempty"`
 }
 
 // PromotionEvent records a single promotion/demotion event
@@ -47,13 +156,46 @@ type PromotionEvent struct {
 
 // Config holds global configuration
 type Config struct {
-	RetentionDaysAfterMerge int      `json:"retention_days_after_merge"`
-	StaleDaysNoActivity     int      `json:"stale_days_no_activity"`
-	BaseBranch              string   `json:"base_branch"`
-	LockTimeoutMinutes      int      `json:"lock_timeout_minutes"`
-	AutoRebuildOnPromote    bool     `json:"auto_rebuild_on_promote"`
-	ConflictStrategy        string   `json:"conflict_strategy"`
+	RetentionDaysAfterMerge int       `json:"retention_days_after_merge"`
+	StaleDaysNoActivity     int       `json:"stale_days_no_activity"`
+	BaseBranch              string    `json:"base_branch"`
+	LockTimeoutMinutes      int       `json:"lock_timeout_minutes"`
+	AutoRebuildOnPromote    bool      `json:"auto_rebuild_on_promote"`
+	ConflictStrategy        string    `json:"conflict_strategy"`
 	NotificationWebhooks    []Webhook `json:"notification_webhooks,omitempty"`
+	// Aliases maps an alternate environment name to its canonical name,
+	// e.g. {"qa": "test"} after renaming qa to test
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// PostRebuildHook is a shell command run after every successful rebuild,
+	// e.g. to kick off a deploy
+	PostRebuildHook string `json:"post_rebuild_hook,omitempty"`
+	// GitLab, if set, has releases comment on and close the feature's open
+	// merge request
+	GitLab *GitLabConfig `json:"gitlab,omitempty"`
+	// RequireUpToDate makes promote refuse a feature that doesn't contain
+	// its environment's base, so stale features are rebased first
+	RequireUpToDate bool `json:"require_up_to_date,omitempty"`
+	// InactiveBranchAction is what cleanup does with inactive branches (see
+	// InactiveBranchActions); empty means "warn"
+	InactiveBranchAction string `json:"inactive_branch_action,omitempty"`
+	// Admins are the emails allowed to override other users: to force
+	// unlock, to unfreeze someone else's freeze, and to roll back an
+	// environment. Empty means everyone may.
+	Admins []string `json:"admins,omitempty"`
+}
+
+// GitLabConfig identifies the GitLab project whose merge requests releases
+// update. The API token is read from the environment, never from hitch.json,
+// since metadata is pushed with the repository.
+type GitLabConfig struct {
+	// ProjectID is the numeric project ID or its path, e.g. "group/app"
+	ProjectID string `json:"project_id"`
+	// BaseURL is the GitLab instance, for self-hosted GitLab (default
+	// https://gitlab.com)
+	BaseURL string `json:"base_url,omitempty"`
+	// TokenEnv names the environment variable holding the API token
+	// (default GITLAB_TOKEN)
+	TokenEnv string `json:"token_env,omitempty"`
 }
 
 // Webhook represents a notification webhook configuration
@@ -61,16 +203,28 @@ type Webhook struct {
 	URL     string            `json:"url"`
 	Events  []string          `json:"events"`
 	Headers map[string]string `json:"headers,omitempty"`
+	// Environments limits the webhook to events concerning these
+	// environments; empty means every environment
+	Environments []string `json:"environments,omitempty"`
+}
+
+// Wants reports whether the webhook fires for event concerning env. Events
+// that concern no environment (env is "") only go to unscoped webhooks.
+func (w Webhook) Wants(event string, env string) bool {
+	if !slices.Contains(w.Events, event) {
+		return false
+	}
+	return len(w.Environments) == 0 || slices.Contains(w.Environments, env)
 }
 
 // MetaInfo contains metadata about the metadata itself
 type MetaInfo struct {
-	InitializedAt   time.Time `json:"initialized_at"`
-	InitializedBy   string    `json:"initialized_by,omitempty"`
-	LastModifiedAt  time.Time `json:"last_modified_at"`
-	LastModifiedBy  string    `json:"last_modified_by,omitempty"`
-	LastCommand     string    `json:"last_command,omitempty"`
-	HitchVersion    string    `json:"hitch_version"`
+	InitializedAt  time.Time `json:"initialized_at"`
+	InitializedBy  string    `json:"initialized_by,omitempty"`
+	LastModifiedAt time.Time `json:"last_modified_at"`
+	LastModifiedBy string    `json:"last_modified_by,omitempty"`
+	LastCommand    string    `json:"last_command,omitempty"`
+	HitchVersion   string    `json:"hitch_version"`
 }
 
 // NewMetadata creates a new Metadata structure with defaults
@@ -87,7 +241,7 @@ func NewMetadata(environments []string, baseBranch string, user string) *Metadat
 	now := time.Now()
 
 	return &Metadata{
-		Version:      "1.0.0",
+		Version:      SchemaVersion,
 		Environments: envMap,
 		Branches:     make(map[string]BranchInfo),
 		Config: Config{
@@ -105,11 +259,121 @@ func NewMetadata(environments []string, baseBranch string, user string) *Metadat
 			LastModifiedAt: now,
 			LastModifiedBy: user,
 			LastCommand:    "hitch init",
-			HitchVersion:   "1.0.0", // TODO: Get from build
+			HitchVersion:   version.String(),
 		},
 	}
 }
 
+// ValidateEnvironmentName checks that an environment name can be used as the
+// name of its hitched branch. Environment names must be simple branch names:
+// no slashes, so they can't be confused with feature branches like feature/x
+func ValidateEnvironmentName(name string) error {
+	if err := hitchgit.ValidBranchName(name); err != nil {
+		return &InvalidEnvironmentNameError{Environment: name, Reason: err.Error()}
+	}
+
+	if strings.Contains(name, "/") {
+		return &InvalidEnvironmentNameError{Environment: name, Reason: "must not contain '/'"}
+	}
+
+	if name == MetadataBranch || strings.HasSuffix(name, "-hitch-temp") {
+		return &InvalidEnvironmentNameError{Environment: name, Reason: "name is reserved by hitch"}
+	}
+
+	return nil
+}
+
+// ParseFeatureRef splits a feature reference, <branch> or <branch>@<sha>,
+// into the branch and the commit it is pinned to ("" if unpinned). The
+// branch may contain '/' but not '@', and the pin must be a hexadecimal SHA
+// of at least 4 characters; whether it exists is left to the caller.
+func ParseFeatureRef(s string) (branch string, sha string, err error) {
+	branch, sha, pinned := strings.Cut(s, "@")
+	if err := hitchgit.ValidBranchName(branch); err != nil {
+		return "", "", fmt.Errorf("invalid feature %q: %w", s, err)
+	}
+	if !pinned {
+		return branch, "", nil
+	}
+
+	if sha == "" {
+		return "", "", fmt.Errorf("missing commit after '@' in %s", s)
+	}
+	if len(sha) < 4 || len(sha) > 40 || strings.Trim(strings.ToLower(sha), "0123456789abcdef") != "" {
+		return "", "", fmt.Errorf("invalid pin in %s: %q is not a commit SHA", s, sha)
+	}
+	return branch, strings.ToLower(sha), nil
+}
+
+// Clone returns a deep copy of m, so callers can change what Read returned
+// without touching the cached copy. Fields holding maps, slices, or pointers
+// must be copied here when they are added.
+func (m *Metadata) Clone() *Metadata {
+	c := *m
+	c.FrozenAt = clonePtr(m.FrozenAt)
+
+	if m.Environments != nil {
+		c.Environments = make(map[string]Environment, len(m.Environments))
+		for name, env := range m.Environments {
+			env.Features = slices.Clone(env.Features)
+			env.Pins = maps.Clone(env.Pins)
+			env.Skipped = slices.Clone(env.Skipped)
+			env.MergedCommits = maps.Clone(env.MergedCommits)
+			env.FreezeWindows = slices.Clone(env.FreezeWindows)
+			for i, w := range env.FreezeWindows {
+				env.FreezeWindows[i].Days = slices.Clone(w.Days)
+			}
+			env.Reflog = slices.Clone(env.Reflog)
+			for i, entry := range env.Reflog {
+				env.Reflog[i].Features = slices.Clone(entry.Features)
+			}
+			c.Environments[name] = env
+		}
+	}
+
+	if m.Branches != nil {
+		c.Branches = make(map[string]BranchInfo, len(m.Branches))
+		for name, info := range m.Branches {
+			info.PromotedTo = slices.Clone(info.PromotedTo)
+			info.PromotedHistory = slices.Clone(info.PromotedHistory)
+			for i, event := range info.PromotedHistory {
+				info.PromotedHistory[i].DemotedAt = clonePtr(event.DemotedAt)
+			}
+			info.MergedToMainAt = clonePtr(info.MergedToMainAt)
+			info.EligibleForCleanupAt = clonePtr(info.EligibleForCleanupAt)
+			info.RetentionDays = clonePtr(info.RetentionDays)
+			c.Branches[name] = info
+		}
+	}
+
+	if m.Stacks != nil {
+		c.Stacks = make(map[string][]string, len(m.Stacks))
+		for name, branches := range m.Stacks {
+			c.Stacks[name] = slices.Clone(branches)
+		}
+	}
+
+	c.Config.NotificationWebhooks = slices.Clone(m.Config.NotificationWebhooks)
+	for i, hook := range c.Config.NotificationWebhooks {
+		c.Config.NotificationWebhooks[i].Events = slices.Clone(hook.Events)
+		c.Config.NotificationWebhooks[i].Headers = maps.Clone(hook.Headers)
+		c.Config.NotificationWebhooks[i].Environments = slices.Clone(hook.Environments)
+	}
+	c.Config.Aliases = maps.Clone(m.Config.Aliases)
+	c.Config.Admins = slices.Clone(m.Config.Admins)
+	c.Config.GitLab = clonePtr(m.Config.GitLab)
+
+	return &c
+}
+
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
 // UpdateMeta updates the metadata modification tracking
 func (m *Metadata) UpdateMeta(user, command string) {
 	m.Meta.LastModifiedAt = time.Now()
@@ -142,9 +406,167 @@ func (m *Metadata) IsLockStale(env string) bool {
 		return false
 	}
 
-	lockAge := time.Since(e.LockedAt)
-	timeout := time.Duration(m.Config.LockTimeoutMinutes) * time.Minute
-	return lockAge > timeout
+	return time.Since(e.LockedAt) > m.LockTimeout()
+}
+
+// MergeOrder returns features in the order rebuilds merge them. The order is
+// the same for every environment: features in more environments come first,
+// then the earliest promoted, then by name. Environments sharing features
+// merge them first and in the same order, so they get the same merged tree
+// and the same conflicts for them.
+func (m *Metadata) MergeOrder(features []string) []string {
+	shares := map[string]int{}
+	for _, env := range m.Environments {
+		for _, f := range env.Features {
+			shares[f]++
+		}
+	}
+	firstPromoted := map[string]time.Time{}
+	for _, f := range features {
+		for _, event := range m.Branches[f].PromotedHistory {
+			if first, ok := firstPromoted[f]; !ok || event.PromotedAt.Before(first) {
+				firstPromoted[f] = event.PromotedAt
+			}
+		}
+	}
+
+	ordered := slices.Clone(features)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		if shares[a] != shares[b] {
+			return shares[a] > shares[b]
+		}
+		if !firstPromoted[a].Equal(firstPromoted[b]) {
+			// Features without a promotion record go last
+			if firstPromoted[a].IsZero() || firstPromoted[b].IsZero() {
+				return firstPromoted[b].IsZero()
+			}
+			return firstPromoted[a].Before(firstPromoted[b])
+		}
+		return a < b
+	})
+	return ordered
+}
+
+// Contributors returns who created or promoted the features now in env,
+// sorted and without duplicates: each feature's CreatedBy and the PromotedBy
+// of its promotion to env still in effect. Emails differing only in case
+// count once.
+func (m *Metadata) Contributors(env string) []string {
+	contributors := []string{}
+	add := func(who string) {
+		if who == "" || slices.ContainsFunc(contributors, func(c string) bool { return strings.EqualFold(c, who) }) {
+			return
+		}
+		contributors = append(contributors, who)
+	}
+
+	for _, feature := range m.Environments[env].Features {
+		info := m.Branches[feature]
+		add(info.CreatedBy)
+		for _, event := range info.PromotedHistory {
+			if event.Environment == env && event.DemotedAt == nil {
+				add(event.PromotedBy)
+			}
+		}
+	}
+
+	slices.SortFunc(contributors, func(a, b string) int {
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	})
+	return contributors
+}
+
+// PendingRebuild reports whether env's feature list has changed since it was
+// last rebuilt, e.g. after promoting or demoting with --no-rebuild
+func (m *Metadata) PendingRebuild(env string) bool {
+	e, exists := m.Environments[env]
+	if !exists {
+		return false
+	}
+	if e.LastRebuild.IsZero() {
+		return len(e.Features) > 0
+	}
+
+	for _, info := range m.Branches {
+		for _, event := range info.PromotedHistory {
+			if event.Environment != env {
+				continue
+			}
+			if event.PromotedAt.After(e.LastRebuild) || (event.DemotedAt != nil && event.DemotedAt.After(e.LastRebuild)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DemotedSinceRebuild reports whether a feature was demoted from env since
+// its last rebuild, so the hitched branch still has commits it shouldn't
+func (m *Metadata) DemotedSinceRebuild(env string) bool {
+	e, exists := m.Environments[env]
+	if !exists {
+		return false
+	}
+
+	for _, info := range m.Branches {
+		for _, event := range info.PromotedHistory {
+			if event.Environment == env && event.DemotedAt != nil && event.DemotedAt.After(e.LastRebuild) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LockTimeout returns how long a lock is held before it is considered stale
+func (m *Metadata) LockTimeout() time.Duration {
+	return time.Duration(m.Config.LockTimeoutMinutes) * time.Minute
+}
+
+// EnvironmentNames returns the names of all environments in a stable,
+// alphabetical order, for display and any other deterministic iteration
+func (m *Metadata) EnvironmentNames() []string {
+	names := make([]string, 0, len(m.Environments))
+	for name := range m.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResolveEnvironment returns the canonical environment name for name. Names
+// that aren't aliases, including unknown ones, are returned unchanged so
+// callers report the usual not-found error
+func (m *Metadata) ResolveEnvironment(name string) string {
+	if _, exists := m.Environments[name]; exists {
+		return name
+	}
+	if target, ok := m.Config.Aliases[name]; ok {
+		return target
+	}
+	return name
+}
+
+// SetAlias makes alias resolve to the environment env
+func (m *Metadata) SetAlias(alias string, env string) error {
+	if _, exists := m.Environments[env]; !exists {
+		return &EnvironmentNotFoundError{Environment: env}
+	}
+
+	if err := ValidateEnvironmentName(alias); err != nil {
+		return err
+	}
+
+	if _, exists := m.Environments[alias]; exists {
+		return &InvalidEnvironmentNameError{Environment: alias, Reason: "an environment with this name already exists"}
+	}
+
+	if m.Config.Aliases == nil {
+		m.Config.Aliases = make(map[string]string)
+	}
+	m.Config.Aliases[alias] = env
+	return nil
 }
 
 // LockEnvironment locks an environment
@@ -159,14 +581,35 @@ func (m *Metadata) LockEnvironment(env string, user string, reason string) error
 			Environment: env,
 			LockedBy:    e.LockedBy,
 			LockedAt:    e.LockedAt,
+			Host:        e.LockedHost,
+			Context:     e.LockedContext,
 		}
 	}
 
+	host, _ := os.Hostname()
+
 	e.Locked = true
 	e.LockedBy = user
 	e.LockedAt = time.Now()
 	e.LockedReason = reason
+	e.LockedHost = host
+	e.LockedContext = ""
+
+	m.Environments[env] = e
+	return nil
+}
+
+// SetLockContext records context, such as a CI job URL, on env's lock
+func (m *Metadata) SetLockContext(env string, context string) error {
+	e, exists := m.Environments[env]
+	if !exists {
+		return &EnvironmentNotFoundError{Environment: env}
+	}
+	if !e.Locked {
+		return fmt.Errorf("environment '%s' is not locked", env)
+	}
 
+	e.LockedContext = context
 	m.Environments[env] = e
 	return nil
 }
@@ -181,11 +624,36 @@ func (m *Metadata) UnlockEnvironment(env string) error {
 	e.Locked = false
 	e.LockedBy = ""
 	e.LockedReason = ""
+	e.LockedHost = ""
+	e.LockedContext = ""
 
 	m.Environments[env] = e
 	return nil
 }
 
+// Freeze puts the repository in maintenance mode. A repository frozen by
+// someone else can't be frozen again until it is unfrozen.
+func (m *Metadata) Freeze(user string, reason string) error {
+	if m.Frozen && m.FrozenBy != user {
+		return &FrozenError{FrozenBy: m.FrozenBy, Reason: m.FrozenReason}
+	}
+
+	now := time.Now()
+	m.Frozen = true
+	m.FrozenBy = user
+	m.FrozenAt = &now
+	m.FrozenReason = reason
+	return nil
+}
+
+// Unfreeze takes the repository out of maintenance mode
+func (m *Metadata) Unfreeze() {
+	m.Frozen = false
+	m.FrozenBy = ""
+	m.FrozenAt = nil
+	m.FrozenReason = ""
+}
+
 // AddBranchToEnvironment adds a branch to an environment's feature list
 func (m *Metadata) AddBranchToEnvironment(env string, branch string, user string) error {
 	e, exists := m.Environments[env]
@@ -201,6 +669,7 @@ func (m *Metadata) AddBranchToEnvironment(env string, branch string, user string
 	}
 
 	e.Features = append(e.Features, branch)
+	e.HadFeatures = true
 	m.Environments[env] = e
 
 	// Update branch info
@@ -237,6 +706,128 @@ func (m *Metadata) AddBranchToEnvironment(env string, branch string, user string
 	return nil
 }
 
+// PinFeature pins a feature in an environment to sha. An empty sha unpins it,
+// so rebuilds track the branch tip again
+func (m *Metadata) PinFeature(env string, branch string, sha string) error {
+	e, exists := m.Environments[env]
+	if !exists {
+		return &EnvironmentNotFoundError{Environment: env}
+	}
+
+	if sha == "" {
+		delete(e.Pins, branch)
+		if len(e.Pins) == 0 {
+			e.Pins = nil
+		}
+	} else {
+		if e.Pins == nil {
+			e.Pins = make(map[string]string)
+		}
+		e.Pins[branch] = sha
+	}
+
+	m.Environments[env] = e
+	return nil
+}
+
+// SetEnvironmentBase sets the branch env is rebuilt from, for repositories
+// where environments follow different release lines
+func (m *Metadata) SetEnvironmentBase(env string, base string) error {
+	e, exists := m.Environments[env]
+	if !exists {
+		return &EnvironmentNotFoundError{Environment: env}
+	}
+	if err := hitchgit.ValidBranchName(base); err != nil {
+		return err
+	}
+	if _, isEnv := m.Environments[base]; isEnv {
+		return fmt.Errorf("base of %s can't be the environment %s", env, base)
+	}
+
+	e.Base = base
+	m.Environments[env] = e
+	return nil
+}
+
+// BaseCycle follows env's base through any environments it names and
+// returns the environments that form a loop, such as [dev] for an
+// environment based on itself or [dev qa] for two based on each other. It
+// returns nil when the chain ends at a branch that isn't an environment. The
+// loop need not include env itself, if env is based on an environment in one.
+func (m *Metadata) BaseCycle(env string) []string {
+	var path []string
+	for name := env; ; name = m.Environments[name].Base {
+		if _, isEnv := m.Environments[name]; !isEnv {
+			return nil
+		}
+		if i := slices.Index(path, name); i >= 0 {
+			return path[i:]
+		}
+		path = append(path, name)
+	}
+}
+
+// BaseCycles returns every loop of environment bases once, each starting at
+// its alphabetically first environment
+func (m *Metadata) BaseCycles() [][]string {
+	var cycles [][]string
+	seen := make(map[string]bool)
+	for _, name := range m.EnvironmentNames() {
+		cycle := m.BaseCycle(name)
+		if cycle == nil {
+			continue
+		}
+		start := slices.Index(cycle, slices.Min(cycle))
+		cycle = append(slices.Clone(cycle[start:]), cycle[:start]...)
+		if key := strings.Join(cycle, " "); !seen[key] {
+			seen[key] = true
+			cycles = append(cycles, cycle)
+		}
+	}
+	return cycles
+}
+
+// ReleaseBase returns the base branch a release of branch merges into: the
+// base of the environments it was promoted to. It fails if those
+// environments have different bases, since the release target is then
+// ambiguous. A branch in no environment releases to Config.BaseBranch.
+func (m *Metadata) ReleaseBase(branch string) (string, error) {
+	bases := []string{}
+	seen := make(map[string]bool)
+	for _, env := range m.Branches[branch].PromotedTo {
+		e, exists := m.Environments[env]
+		if !exists || seen[e.Base] {
+			continue
+		}
+		seen[e.Base] = true
+		bases = append(bases, e.Base)
+	}
+
+	switch len(bases) {
+	case 0:
+		return m.Config.BaseBranch, nil
+	case 1:
+		return bases[0], nil
+	default:
+		sort.Strings(bases)
+		return "", fmt.Errorf("%s is in environments with different bases (%s)", branch, strings.Join(bases, ", "))
+	}
+}
+
+// RetentionDays returns how many days branch is kept after merging: its own
+// override if set, otherwise Config.RetentionDaysAfterMerge
+func (m *Metadata) RetentionDays(branch string) int {
+	if info, exists := m.Branches[branch]; exists && info.RetentionDays != nil {
+		return *info.RetentionDays
+	}
+	return m.Config.RetentionDaysAfterMerge
+}
+
+// CleanupDate returns when branch, merged at mergedAt, becomes eligible for cleanup
+func (m *Metadata) CleanupDate(branch string, mergedAt time.Time) time.Time {
+	return mergedAt.Add(time.Duration(m.RetentionDays(branch)) * 24 * time.Hour)
+}
+
 // IsEligibleForCleanup checks if a branch is eligible for cleanup
 func (b *BranchInfo) IsEligibleForCleanup() bool {
 	if b.EligibleForCleanupAt == nil {
@@ -260,6 +851,7 @@ func (m *Metadata) RemoveBranchFromEnvironment(env string, branch string, user s
 		}
 	}
 	e.Features = newFeatures
+	delete(e.Pins, branch)
 	m.Environments[env] = e
 
 	// Update branch info
@@ -289,3 +881,143 @@ func (m *Metadata) RemoveBranchFromEnvironment(env string, branch string, user s
 
 	return nil
 }
+
+// IsAdmin reports whether email is in config.admins, or true for everyone
+// when no admins are configured
+func (m *Metadata) IsAdmin(email string) bool {
+	if len(m.Config.Admins) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(m.Config.Admins, func(admin string) bool {
+		return strings.EqualFold(admin, email)
+	})
+}
+
+// RecordTip adds entry to the front of env's reflog, dropping the oldest
+// entries beyond ReflogSize
+func (m *Metadata) RecordTip(env string, entry ReflogEntry) error {
+	e, exists := m.Environments[env]
+	if !exists {
+		return &EnvironmentNotFoundError{Environment: env}
+	}
+
+	if entry.Features == nil {
+		entry.Features = []string{}
+	}
+	e.Reflog = append([]ReflogEntry{entry}, e.Reflog...)
+	if len(e.Reflog) > ReflogSize {
+		e.Reflog = e.Reflog[:ReflogSize]
+	}
+	m.Environments[env] = e
+	return nil
+}
+
+// ClearEnvironment demotes every feature from an environment, recording the
+// demotion in each branch's history. It returns the features that were removed.
+func (m *Metadata) ClearEnvironment(env string, user string) ([]string, error) {
+	e, exists := m.Environments[env]
+	if !exists {
+		return nil, &EnvironmentNotFoundError{Environment: env}
+	}
+
+	removed := append([]string{}, e.Features...)
+	for _, feature := range removed {
+		if err := m.RemoveBranchFromEnvironment(env, feature, user); err != nil {
+			return nil, err
+		}
+	}
+
+	return removed, nil
+}
+
+// CompactHistory trims each branch's promotion history to its keepPerBranch
+// most recent events. Promotions still in effect are always kept, and so are
+// demotions from an environment not rebuilt since, which PendingRebuild needs.
+// It returns how many events were removed.
+func (m *Metadata) CompactHistory(keepPerBranch int) int {
+	keepPerBranch = max(keepPerBranch, 0)
+
+	removed := 0
+	for name, info := range m.Branches {
+		history := info.PromotedHistory
+		if len(history) <= keepPerBranch {
+			continue
+		}
+
+		// Events are appended as they happen, so the most recent are last
+		kept := []PromotionEvent{}
+		for i, event := range history {
+			if i >= len(history)-keepPerBranch || m.historyEventInEffect(event) {
+				kept = append(kept, event)
+			}
+		}
+		if len(kept) == len(history) {
+			continue
+		}
+
+		removed += len(history) - len(kept)
+		info.PromotedHistory = kept
+		m.Branches[name] = info
+	}
+
+	return removed
+}
+
+// historyEventInEffect reports whether event still describes an environment:
+// the promotion hasn't been demoted, or the environment was rebuilt before
+// it was and not since. An environment never rebuilt is pending regardless.
+func (m *Metadata) historyEventInEffect(event PromotionEvent) bool {
+	if event.DemotedAt == nil {
+		return true
+	}
+	e, exists := m.Environments[event.Environment]
+	return exists && !e.LastRebuild.IsZero() && event.DemotedAt.After(e.LastRebuild)
+}
+
+// SetEnvironmentFeatures makes features, in order, the exact feature list of
+// env. Features not already in env are promoted and ones missing from the
+// list are demoted, so branch history stays consistent. It returns the
+// features added and removed.
+func (m *Metadata) SetEnvironmentFeatures(env string, features []string, user string) (added, removed []string, err error) {
+	e, exists := m.Environments[env]
+	if !exists {
+		return nil, nil, &EnvironmentNotFoundError{Environment: env}
+	}
+
+	wanted := make(map[string]bool)
+	for _, feature := range features {
+		if wanted[feature] {
+			return nil, nil, fmt.Errorf("%s is listed more than once", feature)
+		}
+		wanted[feature] = true
+	}
+
+	present := make(map[string]bool)
+	for _, feature := range e.Features {
+		present[feature] = true
+		if !wanted[feature] {
+			removed = append(removed, feature)
+		}
+	}
+
+	for _, feature := range removed {
+		if err := m.RemoveBranchFromEnvironment(env, feature, user); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, feature := range features {
+		if present[feature] {
+			continue
+		}
+		if err := m.AddBranchToEnvironment(env, feature, user); err != nil {
+			return nil, nil, err
+		}
+		added = append(added, feature)
+	}
+
+	e = m.Environments[env]
+	e.Features = append([]string{}, features...)
+	m.Environments[env] = e
+
+	return added, removed, nil
+}
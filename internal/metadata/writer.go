@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/DoomedRamen/hitch/internal/logging"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
@@ -20,92 +22,68 @@ func NewWriter(repo *git.Repository) *Writer {
 	return &Writer{repo: repo}
 }
 
-// Write writes metadata to the hitch-metadata branch
-// It uses optimistic concurrency control with force-with-lease
-func (w *Writer) Write(m *Metadata, commitMessage string, author string, authorEmail string) error {
-	// Marshal metadata to JSON (pretty-printed)
-	jsonBytes, err := json.MarshalIndent(m, "", "  ")
+// Marshal encodes m the way hitch.json is stored: indented with two spaces
+// and ending in a newline. The same metadata always encodes to the same
+// bytes, since encoding/json sorts map keys and keeps struct fields in
+// declaration order, so diffs of hitch.json show only what changed.
+func Marshal(m *Metadata) ([]byte, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
 	if err != nil {
-		return &MetadataWriteError{
-			Reason: "failed to marshal metadata to JSON",
-			Err:    err,
-		}
-	}
-
-	// Get worktree
-	worktree, err := w.repo.Worktree()
-	if err != nil {
-		return &MetadataWriteError{
-			Reason: "failed to get worktree",
-			Err:    err,
-		}
+		return nil, err
 	}
+	return append(data, '\n'), nil
+}
 
-	// Check out hitch-metadata branch
-	err = worktree.Checkout(&git.CheckoutOptions{
-		Branch: plumbing.NewBranchReferenceName(MetadataBranch),
-		Force:  false,
-	})
-	if err != nil {
-		return &MetadataWriteError{
-			Reason: "failed to checkout hitch-metadata branch",
-			Err:    err,
-		}
-	}
+// Write commits m to the hitch-metadata branch. It writes the objects
+// directly, so it never touches HEAD, the index, or the working tree: a
+// metadata write can't switch branches under uncommitted changes. The branch
+// is moved with a compare-and-swap against the tip the new commit builds on,
+// so a write that lands in between fails rather than being lost; changes
+// made since m was read aren't detected here.
+func (w *Writer) Write(m *Metadata, commitMessage string, author string, authorEmail string) error {
+	defer logging.StartPhase("write metadata")()
 
-	// Write hitch.json file
-	filename := worktree.Filesystem.Join(MetadataFile)
-	file, err := worktree.Filesystem.Create(filename)
+	// Marshal metadata to JSON (pretty-printed)
+	jsonBytes, err := Marshal(m)
 	if err != nil {
 		return &MetadataWriteError{
-			Reason: fmt.Sprintf("failed to create %s", MetadataFile),
+			Reason: "failed to marshal metadata to JSON",
 			Err:    err,
 		}
 	}
 
-	_, err = file.Write(jsonBytes)
+	name := plumbing.NewBranchReferenceName(MetadataBranch)
+	old, err := w.repo.Reference(name, true)
 	if err != nil {
-		file.Close()
 		return &MetadataWriteError{
-			Reason: fmt.Sprintf("failed to write to %s", MetadataFile),
+			Reason: "hitch-metadata branch not found",
 			Err:    err,
 		}
 	}
-	file.Close()
 
-	// Add to index
-	_, err = worktree.Add(MetadataFile)
+	commitHash, err := w.commitObjects(jsonBytes, []plumbing.Hash{old.Hash()}, commitMessage, author, authorEmail)
 	if err != nil {
-		return &MetadataWriteError{
-			Reason: "failed to add file to index",
-			Err:    err,
-		}
+		return err
 	}
 
-	// Commit
-	commitHash, err := worktree.Commit(commitMessage, &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  author,
-			Email: authorEmail,
-			When:  time.Now(),
-		},
-	})
-	if err != nil {
+	if err := w.repo.Storer.CheckAndSetReference(plumbing.NewHashReference(name, commitHash), old); err != nil {
 		return &MetadataWriteError{
-			Reason: "failed to create commit",
+			Reason: "failed to update hitch-metadata branch",
 			Err:    err,
 		}
 	}
 
-	_ = commitHash // TODO: Use for force-with-lease
+	logging.Debugf("wrote %s to %s@%s: %s", MetadataFile, MetadataBranch, commitHash.String()[:7], commitMessage)
 
 	return nil
 }
 
-// WriteInitial creates the hitch-metadata branch and writes initial metadata
+// WriteInitial creates the hitch-metadata branch as an orphan with a single
+// commit holding hitch.json. It writes the objects directly, so it never
+// touches HEAD, the index, or the working tree.
 func (w *Writer) WriteInitial(m *Metadata, author string, authorEmail string) error {
 	// Marshal metadata to JSON
-	jsonBytes, err := json.MarshalIndent(m, "", "  ")
+	jsonBytes, err := Marshal(m)
 	if err != nil {
 		return &MetadataWriteError{
 			Reason: "failed to marshal metadata to JSON",
@@ -113,111 +91,92 @@ func (w *Writer) WriteInitial(m *Metadata, author string, authorEmail string) er
 		}
 	}
 
-	// Get worktree
-	worktree, err := w.repo.Worktree()
+	// A commit without parents, so the branch shares no history
+	commitHash, err := w.commitObjects(jsonBytes, nil, "Initialize Hitch metadata", author, authorEmail)
 	if err != nil {
-		return &MetadataWriteError{
-			Reason: "failed to get worktree",
-			Err:    err,
-		}
-	}
-
-	// Create orphan branch by checking out to an empty tree
-	// This is a bit tricky with go-git, we'll use a workaround:
-	// 1. Get current HEAD
-	// 2. Checkout --orphan equivalent
-	headRef, err := w.repo.Head()
-	if err != nil {
-		return &MetadataWriteError{
-			Reason: "failed to get HEAD",
-			Err:    err,
-		}
+		return err
 	}
 
-	currentBranch := headRef.Name()
-
-	// Create a new branch reference (will be orphan after we remove all files)
-	branchRef := plumbing.NewHashReference(
-		plumbing.NewBranchReferenceName(MetadataBranch),
-		plumbing.ZeroHash, // Empty hash for orphan branch
-	)
-
-	// Note: Creating a true orphan branch with go-git is complex
-	// For now, we'll create the metadata file and commit it
-	// The actual orphan branch creation might need git command execution
-
-	// Checkout new branch
-	err = worktree.Checkout(&git.CheckoutOptions{
-		Branch: branchRef.Name(),
-		Create: true,
-		Force:  true,
-	})
-	if err != nil {
-		// If checkout fails, we might need to use git commands
+	ref := plumbing.NewHashReference(plumbing.NewBranchReferenceName(MetadataBranch), commitHash)
+	if err := w.repo.Storer.SetReference(ref); err != nil {
 		return &MetadataWriteError{
 			Reason: "failed to create hitch-metadata branch",
 			Err:    err,
 		}
 	}
 
-	// Remove all files to make it an orphan branch
-	// TODO: This is simplified, proper orphan branch creation needs work
+	logging.Debugf("wrote %s to %s@%s: Initialize Hitch metadata", MetadataFile, MetadataBranch, commitHash.String()[:7])
+
+	return nil
+}
 
-	// Write hitch.json
-	filename := worktree.Filesystem.Join(MetadataFile)
-	file, err := worktree.Filesystem.Create(filename)
+// commitObjects stores jsonBytes as hitch.json in a tree of its own and
+// returns a commit of that tree with the given parents
+func (w *Writer) commitObjects(jsonBytes []byte, parents []plumbing.Hash, message string, author string, authorEmail string) (plumbing.Hash, error) {
+	// Store hitch.json as a blob
+	blob := w.repo.Storer.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	writer, err := blob.Writer()
 	if err != nil {
-		return &MetadataWriteError{
+		return plumbing.ZeroHash, &MetadataWriteError{
 			Reason: fmt.Sprintf("failed to create %s", MetadataFile),
 			Err:    err,
 		}
 	}
-
-	_, err = file.Write(jsonBytes)
-	if err != nil {
-		file.Close()
-		return &MetadataWriteError{
+	if _, err := writer.Write(jsonBytes); err != nil {
+		writer.Close()
+		return plumbing.ZeroHash, &MetadataWriteError{
 			Reason: fmt.Sprintf("failed to write to %s", MetadataFile),
 			Err:    err,
 		}
 	}
-	file.Close()
-
-	// Add to index
-	_, err = worktree.Add(MetadataFile)
+	writer.Close()
+	blobHash, err := w.repo.Storer.SetEncodedObject(blob)
 	if err != nil {
-		return &MetadataWriteError{
-			Reason: "failed to add file to index",
+		return plumbing.ZeroHash, &MetadataWriteError{
+			Reason: fmt.Sprintf("failed to store %s", MetadataFile),
 			Err:    err,
 		}
 	}
 
-	// Commit
-	_, err = worktree.Commit("Initialize Hitch metadata", &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  author,
-			Email: authorEmail,
-			When:  time.Now(),
-		},
-	})
+	// A tree with just hitch.json
+	tree := &object.Tree{Entries: []object.TreeEntry{
+		{Name: MetadataFile, Mode: filemode.Regular, Hash: blobHash},
+	}}
+	treeHash, err := storeObject(w.repo, tree)
 	if err != nil {
-		return &MetadataWriteError{
-			Reason: "failed to create initial commit",
+		return plumbing.ZeroHash, &MetadataWriteError{
+			Reason: "failed to store tree",
 			Err:    err,
 		}
 	}
 
-	// Return to original branch
-	err = worktree.Checkout(&git.CheckoutOptions{
-		Branch: currentBranch,
-		Force:  false,
-	})
+	signature := object.Signature{Name: author, Email: authorEmail, When: time.Now()}
+	commit := &object.Commit{
+		Author:       signature,
+		Committer:    signature,
+		Message:      message + "\n",
+		TreeHash:     treeHash,
+		ParentHashes: parents,
+	}
+	commitHash, err := storeObject(w.repo, commit)
 	if err != nil {
-		return &MetadataWriteError{
-			Reason: "failed to return to original branch",
+		return plumbing.ZeroHash, &MetadataWriteError{
+			Reason: "failed to create commit",
 			Err:    err,
 		}
 	}
+	return commitHash, nil
+}
 
-	return nil
+// storeObject encodes obj (a tree or commit) into the repository's object
+// store and returns its hash
+func storeObject(repo *git.Repository, obj interface {
+	Encode(plumbing.EncodedObject) error
+}) (plumbing.Hash, error) {
+	encoded := repo.Storer.NewEncodedObject()
+	if err := obj.Encode(encoded); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repo.Storer.SetEncodedObject(encoded)
 }
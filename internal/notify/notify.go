@@ -0,0 +1,118 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/DoomedRamen/hitch/internal/logging"
+	"github.com/DoomedRamen/hitch/internal/metadata"
+)
+
+// Event names sent to webhooks, as listed in a webhook's events
+const (
+	EventPromote  = "promote"
+	EventDemote   = "demote"
+	EventRebuild  = "rebuild"
+	EventConflict = "conflict"
+	EventRelease  = "release"
+	EventLock     = "lock"
+	EventUnlock   = "unlock"
+)
+
+// Event is the JSON body posted to a webhook
+type Event struct {
+	Event       string    `json:"event"`
+	Environment string    `json:"environment,omitempty"`
+	Branch      string    `json:"branch,omitempty"`
+	Commit      string    `json:"commit,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Message     string    `json:"message"`
+	Time        time.Time `json:"time"`
+}
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Send posts event to every webhook that wants it and returns the errors of
+// the ones that failed; one webhook failing doesn't stop the others
+func Send(hooks []metadata.Webhook, event Event) []error {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return []error{fmt.Errorf("failed to encode %s event: %w", event.Event, err)}
+	}
+
+	var errs []error
+	for _, hook := range hooks {
+		if !hook.Wants(event.Event, event.Environment) {
+			continue
+		}
+		if err := post(hook, body); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// post sends body to hook.URL with the hook's headers
+func post(hook metadata.Webhook, body []byte) error {
+	defer logging.Timer("webhook " + hook.URL)()
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid webhook %s: %w", hook.URL, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range hook.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook %s failed: %w", hook.URL, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned %d", hook.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+// Ping checks that hook's URL answers, without sending an event, by making a
+// HEAD request with the hook's headers. Many webhook endpoints only accept
+// POST, so any answer counts except a server error, a refusal (401, 403), or
+// a URL that doesn't exist (404, 410).
+func Ping(hook metadata.Webhook) error {
+	defer logging.Timer("ping webhook " + hook.URL)()
+
+	req, err := http.NewRequest(http.MethodHead, hook.URL, nil)
+	if err != nil {
+		return fmt.Errorf("invalid webhook %s: %w", hook.URL, err)
+	}
+	for name, value := range hook.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook %s is unreachable: %w", hook.URL, err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("webhook %s refused the request (%d); check its headers", hook.URL, resp.StatusCode)
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return fmt.Errorf("webhook %s returned %d; the URL may be wrong or revoked", hook.URL, resp.StatusCode)
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("webhook %s returned %d", hook.URL, resp.StatusCode)
+	}
+	return nil
+}
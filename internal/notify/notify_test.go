@@ -0,0 +1,102 @@
+//go:build dockertest
+
+package notify_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/DoomedRamen/hitch/internal/metadata"
+	"github.com/DoomedRamen/hitch/internal/notify"
+)
+
+func TestSendFiltersByEnvironment(t *testing.T) {
+	var mu sync.Mutex
+	received := map[string][]notify.Event{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event notify.Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("Invalid event body: %v", err)
+		}
+		if r.URL.Path == "/prod" && r.Header.Get("X-Channel") != "prod-alerts" {
+			t.Errorf("Expected the configured header, got %q", r.Header.Get("X-Channel"))
+		}
+		mu.Lock()
+		received[r.URL.Path] = append(received[r.URL.Path], event)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	hooks := []metadata.Webhook{
+		{URL: server.URL + "/prod", Events: []string{"rebuild"}, Environments: []string{"prod"}, Headers: map[string]string{"X-Channel": "prod-alerts"}},
+		{URL: server.URL + "/dev", Events: []string{"rebuild", "promote"}, Environments: []string{"dev"}},
+		{URL: server.URL + "/all", Events: []string{"rebuild", "release"}},
+	}
+
+	if errs := notify.Send(hooks, notify.Event{Event: notify.EventRebuild, Environment: "dev", Message: "rebuilt dev"}); len(errs) != 0 {
+		t.Fatalf("Send failed: %v", errs)
+	}
+	notify.Send(hooks, notify.Event{Event: notify.EventRelease, Branch: "feature/x", Message: "released"})
+
+	if len(received["/prod"]) != 0 {
+		t.Errorf("Expected the prod webhook not to fire, got %v", received["/prod"])
+	}
+	if len(received["/dev"]) != 1 || received["/dev"][0].Environment != "dev" || received["/dev"][0].Time.IsZero() {
+		t.Errorf("Expected the dev webhook to get one dev rebuild, got %v", received["/dev"])
+	}
+	if len(received["/all"]) != 2 {
+		t.Errorf("Expected the unscoped webhook to get both events, got %v", received["/all"])
+	}
+
+	broken := httptest.NewServer(http.NotFoundHandler())
+	defer broken.Close()
+	failing := []metadata.Webhook{{URL: broken.URL, Events: []string{"rebuild"}}, hooks[1]}
+	if errs := notify.Send(failing, notify.Event{Event: notify.EventRebuild, Environment: "dev"}); len(errs) != 1 {
+		t.Errorf("Expected one error from a failing webhook, got %v", errs)
+	}
+}
+
+func TestPing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("Expected a HEAD request, got %s", r.Method)
+		}
+		switch r.URL.Path {
+		case "/post-only":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case "/private":
+			if r.Header.Get("Authorization") != "Bearer ok" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		hook    metadata.Webhook
+		wantErr bool
+	}{
+		{"POST-only endpoint", metadata.Webhook{URL: server.URL + "/post-only"}, false},
+		{"headers sent", metadata.Webhook{URL: server.URL + "/private", Headers: map[string]string{"Authorization": "Bearer ok"}}, false},
+		{"refused", metadata.Webhook{URL: server.URL + "/private"}, true},
+		{"not found", metadata.Webhook{URL: server.URL + "/gone"}, true},
+		{"unreachable", metadata.Webhook{URL: closed.URL}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := notify.Ping(tt.hook)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Ping() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
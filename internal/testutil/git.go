@@ -3,6 +3,7 @@
 package testutil
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -10,6 +11,7 @@ import (
 	"testing"
 
 	hitchgit "github.com/DoomedRamen/hitch/internal/git"
+	"github.com/DoomedRamen/hitch/internal/metadata"
 )
 
 // TestRepo represents an isolated Git repository for testing
@@ -17,6 +19,10 @@ type TestRepo struct {
 	Path string
 	Repo *hitchgit.Repo
 	T    *testing.T
+
+	// RemotePath is the bare repository wired up as origin by AddRemote,
+	// or "" if the repository has no remote
+	RemotePath string
 }
 
 // NewTestRepo creates a new isolated Git repository in a temporary directory
@@ -37,6 +43,11 @@ func NewTestRepo(t *testing.T) *TestRepo {
 		t.Fatalf("Failed to init git repo: %v", err)
 	}
 
+	// Keep the developer's own git config out of tests: an identity there
+	// would hide a missing one here
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
 	// Configure git user
 	configCmds := [][]string{
 		{"git", "config", "user.name", "Test User"},
@@ -159,6 +170,94 @@ func (tr *TestRepo) BranchExists(name string) bool {
 	return tr.Repo.BranchExists(name)
 }
 
+// InitMetadata creates the hitch-metadata branch containing m as hitch.json
+// It uses git plumbing so the worktree and current branch are untouched
+func (tr *TestRepo) InitMetadata(m *metadata.Metadata) error {
+	tr.T.Helper()
+
+	jsonBytes, err := metadata.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	blob, err := tr.gitStdin(string(jsonBytes), "hash-object", "-w", "--stdin")
+	if err != nil {
+		return err
+	}
+
+	tree, err := tr.gitStdin(fmt.Sprintf("100644 blob %s\t%s\n", blob, metadata.MetadataFile), "mktree")
+	if err != nil {
+		return err
+	}
+
+	commit, err := tr.gitStdin("", "commit-tree", tree, "-m", "Initialize Hitch metadata")
+	if err != nil {
+		return err
+	}
+
+	_, err = tr.gitStdin("", "update-ref", "refs/heads/"+metadata.MetadataBranch, commit)
+	return err
+}
+
+// AddRemote creates an empty bare repository and adds it as origin,
+// returning its path. The remote is removed along with the test.
+func (tr *TestRepo) AddRemote() (string, error) {
+	tr.T.Helper()
+
+	remote := tr.T.TempDir()
+	cmd := exec.Command("git", "init", "--bare", "--initial-branch=main")
+	cmd.Dir = remote
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to init bare remote: %w", err)
+	}
+
+	if _, err := tr.gitStdin("", "remote", "add", "origin", remote); err != nil {
+		return "", err
+	}
+
+	tr.RemotePath = remote
+	return remote, nil
+}
+
+// PushBranch pushes branch to origin, creating or fast-forwarding it there
+func (tr *TestRepo) PushBranch(branch string) error {
+	tr.T.Helper()
+
+	_, err := tr.gitStdin("", "push", "--quiet", "origin", "refs/heads/"+branch+":refs/heads/"+branch)
+	return err
+}
+
+// RemoteSHA returns the commit branch points to in the origin repository
+// created by AddRemote, read directly rather than through a fetch
+func (tr *TestRepo) RemoteSHA(branch string) (string, error) {
+	tr.T.Helper()
+
+	if tr.RemotePath == "" {
+		return "", fmt.Errorf("no remote; call AddRemote first")
+	}
+
+	cmd := exec.Command("git", "rev-parse", "--verify", "refs/heads/"+branch)
+	cmd.Dir = tr.RemotePath
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("branch %s not found on remote: %w", branch, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// gitStdin runs a git command in the repository with the given stdin and
+// returns its trimmed output
+func (tr *TestRepo) gitStdin(stdin string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = tr.Path
+	cmd.Stdin = strings.NewReader(stdin)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %w", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
 // createInitialCommit creates an initial commit in the repository
 func createInitialCommit(repoPath string) error {
 	// Create README
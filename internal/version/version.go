@@ -0,0 +1,72 @@
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at link time via ldflags (see .goreleaser.yml):
+//
+//	-X github.com/DoomedRamen/hitch/internal/version.Version=1.2.3
+//	-X github.com/DoomedRamen/hitch/internal/version.Commit=abc1234
+//	-X github.com/DoomedRamen/hitch/internal/version.Date=2025-01-01T00:00:00Z
+var (
+	Version = ""
+	Commit  = ""
+	Date    = ""
+)
+
+// devVersion is reported when no version was injected and the module
+// version is unknown (e.g. `go run` or `go build` from a checkout)
+const devVersion = "dev"
+
+// Info describes the running hitch binary
+type Info struct {
+	Version   string
+	Commit    string
+	Date      string
+	GoVersion string
+	Platform  string
+}
+
+// Get returns build information, preferring ldflags values and falling back
+// to the module and VCS data embedded by the Go toolchain
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = setting.Value
+				}
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = devVersion
+	}
+
+	return info
+}
+
+// String returns the version string used by --version
+func String() string {
+	return Get().Version
+}